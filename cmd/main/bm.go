@@ -1,12 +1,27 @@
 package main
 
 import (
+	"ccoms/pkg/catalog"
 	"ccoms/pkg/model"
+	"ccoms/pkg/rules"
 	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xnats"
 	"fmt"
 	"os"
 
 	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// the catalog of the benchmark, the banks and omes docker compose runs, see package catalog
+var (
+	bmCoins = []catalog.Coin{
+		{Coin: "BTC", Status: catalog.StatusTrading, Precision: 8},
+		{Coin: "USDT", Status: catalog.StatusTrading, Precision: 6},
+	}
+	bmSymbols = []catalog.Symbol{
+		{Base: "BTC", Quote: "USDT", Status: catalog.StatusTrading, PricePrecision: 2, QuantityPrecision: 6},
+	}
 )
 
 // PrepareForBenchmark prepare mysql, nats, etcd for benchmark with docker compose
@@ -36,21 +51,7 @@ func PrepareForBenchmark() (err error) {
 		db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%s`", t.TableName))
 	}
 
-	db.Scopes(model.OrderTable("btc_usdt")).AutoMigrate(model.Order{})
-	db.Scopes(model.TradeTable("btc_usdt")).AutoMigrate(model.Trade{})
-	db.Scopes(model.TicketTable("btc_usdt", "ask")).AutoMigrate(model.Ticket{})
-	db.Scopes(model.TicketTable("btc_usdt", "bid")).AutoMigrate(model.Ticket{})
-	db.Scopes(model.OrderTable("eth_usdt")).AutoMigrate(model.Order{})
-	db.Scopes(model.TradeTable("eth_usdt")).AutoMigrate(model.Trade{})
-	db.Scopes(model.TicketTable("eth_usdt", "ask")).AutoMigrate(model.Ticket{})
-	db.Scopes(model.TicketTable("eth_usdt", "bid")).AutoMigrate(model.Ticket{})
-	db.Scopes(model.OrderTable("eth_btc")).AutoMigrate(model.Order{})
-	db.Scopes(model.TradeTable("eth_btc")).AutoMigrate(model.Trade{})
-	db.Scopes(model.TicketTable("eth_btc", "ask")).AutoMigrate(model.Ticket{})
-	db.Scopes(model.TicketTable("eth_btc", "bid")).AutoMigrate(model.Ticket{})
-	db.Scopes(model.BalanceSnapTable("btc")).AutoMigrate(model.BalanceSnap{})
-	db.Scopes(model.BalanceSnapTable("usdt")).AutoMigrate(model.BalanceSnap{})
-	db.Scopes(model.BalanceSnapTable("eth")).AutoMigrate(model.BalanceSnap{})
+	// the tables of each coin and symbol are created by its bank and ome, see model.MigrateCoin and model.MigrateSymbol
 	db.AutoMigrate(model.Lastkv{})
 	db.AutoMigrate(model.Balance{})
 	db.AutoMigrate(model.User{})
@@ -87,9 +88,19 @@ func PrepareForBenchmark() (err error) {
 			logger.Debugf("bm prepare failed with err:%s", err)
 			return
 		}
+
+		// order events of the orders whose funds are held by this bank
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     xnats.OrderEventStream,
+			Subjects: []string{xnats.OrderEventStream + ".*"},
+		})
+		if err != nil {
+			logger.Debugf("bm prepare failed with err:%s", err)
+			return
+		}
 	}
 
-	// 3. Prepare etcd
+	// 3. Prepare etcd, the banks and omes register their own addresses, see xetcd.Register
 
 	err = xetcd.Put(xetcd.KeyNatsService("usdt"), "nats_usdt:4222")
 	if err != nil {
@@ -106,17 +117,29 @@ func PrepareForBenchmark() (err error) {
 		logger.Debugf("bm prepare failed with err:%s", err)
 		return
 	}
-	err = xetcd.Put(xetcd.KeyBankService("usdt"), "bank_usdt:12341")
-	if err != nil {
-		logger.Debugf("bm prepare failed with err:%s", err)
-		return
+
+	for _, c := range bmCoins {
+		err = catalog.PutCoin(c)
+		if err != nil {
+			logger.Debugf("bm prepare failed with err:%s", err)
+			return
+		}
 	}
-	err = xetcd.Put(xetcd.KeyBankService("btc"), "bank_btc:12342")
-	if err != nil {
-		logger.Debugf("bm prepare failed with err:%s", err)
-		return
+	for _, sym := range bmSymbols {
+		err = catalog.PutSymbol(sym)
+		if err != nil {
+			logger.Debugf("bm prepare failed with err:%s", err)
+			return
+		}
 	}
-	err = xetcd.Put(xetcd.KeyBankService("eth"), "bank_eth:12343")
+
+	err = rules.PutRules(rules.Rules{
+		Symbol:      "BTC_USDT",
+		TickSize:    decimal.New(1, -2),
+		StepSize:    decimal.New(1, -6),
+		MinQty:      decimal.New(1, -6),
+		MinNotional: decimal.New(1, 0),
+	})
 	if err != nil {
 		logger.Debugf("bm prepare failed with err:%s", err)
 		return
@@ -2,6 +2,7 @@ package main
 
 import (
 	"ccoms/pkg/bank"
+	"ccoms/pkg/catalog"
 	"ccoms/pkg/config"
 	"ccoms/pkg/filedb"
 	"ccoms/pkg/ingress"
@@ -10,7 +11,6 @@ import (
 	"ccoms/pkg/xetcd"
 	"ccoms/pkg/xlog"
 	"ccoms/pkg/xnats"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -19,6 +19,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"syscall"
@@ -36,10 +37,17 @@ var (
 	fSymbol  string
 	fLogDir  string
 	fLogFile string
+	fCodec   string
+	fStandby bool
+	fElect   bool
+	fAddr    string
 )
 
+// promote the standby bank or ome of this process, see handleSignals
+var promote = func() {}
+
 var (
-	apps = map[string]bool{"ingress": true, "bank": true, "ome": true, "bm": true, "fm": true}
+	apps = map[string]bool{"ingress": true, "bank": true, "ome": true, "bm": true, "fm": true, "fv": true, "fc": true}
 )
 
 func init() {
@@ -48,6 +56,10 @@ func init() {
 	flag.StringVar(&fSymbol, "symbol", "", "")
 	flag.StringVar(&fLogDir, "logdir", "", "")
 	flag.StringVar(&fLogFile, "logfile", "", "")
+	flag.StringVar(&fCodec, "codec", filedb.CodecBinary, "")
+	flag.BoolVar(&fStandby, "standby", false, "")
+	flag.BoolVar(&fElect, "elect", false, "")
+	flag.StringVar(&fAddr, "addr", "", "")
 }
 
 func main() {
@@ -77,6 +89,20 @@ func main() {
 	logger.Info(fApp + " started")
 	logger.Infof("xlog in %s", logPath)
 
+	// The filedb verifier and converter need neither etcd nor mysql
+	if fApp == "fv" || fApp == "fc" {
+		if fApp == "fv" {
+			err = verifyFiledb()
+		} else {
+			err = convertFiledb()
+		}
+		if err != nil {
+			logger.Error(err)
+			panic(err)
+		}
+		return
+	}
+
 	// Handle signals
 	go handleSignals()
 
@@ -111,6 +137,7 @@ func main() {
 
 	if err != nil {
 		logger.Error(err)
+		xetcd.DeregisterAll()
 		panic(err)
 	}
 }
@@ -119,9 +146,12 @@ func main() {
 //
 //	Function 1: Change log level via SIGUSR1 signal
 //		docker exec <container_id> sh -c 'export XLOG_LVL=TRACE && kill -SIGUSR1 1'
+//	Function 2: Promote a bank or ome started with -standby via SIGUSR2 signal
+//		docker exec <container_id> sh -c 'kill -SIGUSR2 1'
+//	Function 3: Deregister the services of the process via SIGINT or SIGTERM signal, then exit
 func handleSignals() {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGUSR1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
 	logLevelChan := make(chan string)
 
 	for {
@@ -134,6 +164,15 @@ func handleSignals() {
 					logLevelChan <- level
 				}
 			}
+			if sig == syscall.SIGUSR2 {
+				logger.Infof("promoting via signal")
+				promote()
+			}
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				logger.Infof("exiting via signal %s", sig)
+				xetcd.DeregisterAll()
+				os.Exit(0)
+			}
 		case level := <-logLevelChan:
 			logger := xlog.GetLogger()
 			logger.SetLevel(level)
@@ -170,29 +209,27 @@ func startIngress() (err error) {
 		Nats: make(map[string]nats.JetStreamContext),
 	}
 
-	for i := 0; i < 100; i++ {
-		_, err = ing.GetNats("BTC")
-		if err != nil {
-			logger.Errorf("ing.GetNats BTC failed with err:%s", err)
-		} else {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
+	// connect to the bank of every coin trading
+	coins, err := catalog.Shared.Coins()
 	if err != nil {
 		return
 	}
-	for i := 0; i < 100; i++ {
-		_, err = ing.GetNats("USDT")
+	for _, c := range coins {
+		if c.Status != catalog.StatusTrading {
+			continue
+		}
+		for i := 0; i < 100; i++ {
+			_, err = ing.GetNats(c.Coin)
+			if err != nil {
+				logger.Errorf("ing.GetNats %s failed with err:%s", c.Coin, err)
+			} else {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
 		if err != nil {
-			logger.Errorf("ing.GetNats USDT failed with err:%s", err)
-		} else {
-			break
+			return
 		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	if err != nil {
-		return
 	}
 
 	// create orders(ask and bid) with random price and quantity
@@ -227,7 +264,7 @@ func startIngress() (err error) {
 					ch2 <- 1
 					return
 				}
-				err := ing.SendOrderReq(dispatchBank(od.Symbol, od.Side), od)
+				_, err := ing.SendOrderReq(dispatchBank(od.Symbol, od.Side), od)
 				if err != nil {
 					logger.Errorf("SendOrderReq failed with err:%s", err)
 				}
@@ -282,7 +319,21 @@ func startBank() (err error) {
 		return
 	}
 
-	err = bankw.Run()
+	// registers its grpc address, see xetcd.Register
+	bankw.Addr = fAddr
+
+	if fElect {
+		// a standby until it leads, see xetcd.Campaign
+		if fAddr == "" {
+			return errors.New("empty addr")
+		}
+		err = bankw.RunElected(fAddr)
+	} else if fStandby {
+		promote = bankw.Promote
+		err = bankw.RunStandby()
+	} else {
+		err = bankw.Run()
+	}
 	if err != nil {
 		return
 	}
@@ -299,7 +350,21 @@ func startOme() (err error) {
 		return
 	}
 
-	err = omew.Run()
+	// registers its grpc address, see xetcd.Register
+	omew.Addr = fAddr
+
+	if fElect {
+		// a standby until it leads, see xetcd.Campaign
+		if fAddr == "" {
+			return errors.New("empty addr")
+		}
+		err = omew.RunElected(fAddr)
+	} else if fStandby {
+		promote = omew.Promote
+		err = omew.RunStandby()
+	} else {
+		err = omew.Run()
+	}
 	if err != nil {
 		return
 	}
@@ -320,74 +385,184 @@ func startFiledbMonitor() (err error) {
 	}
 }
 
+// monitorLog the first fields of both the bank and the ome logs, in the same order for the binary codec
+type monitorLog struct {
+	LogID int64 `json:"logID"`
+	Ts    int64 `json:"ts"`
+}
+
+func (l monitorLog) GetLogID() int64 {
+	return l.LogID
+}
+
+// segmentName a rolled segment of a filedb log, e.g. ome_btc_usdt.10001.log, read through the manifest of its first one
+var segmentName = regexp.MustCompile(`\.\d+\.log$`)
+
 // runFiledbMonitorOne runs the filedb monitor one time
 //
-//	Function 1: Traverse all files ending with .log,
-//		read the first and last line of each file,
-//		each line should be a json object,
+//	Function 1: Traverse the filedb logs in data_dir/filedb, the rolled segments and the subdirectories are left out,
+//		open each one read-only, the services may be writing it,
+//		read its first and last log, in either codec,
 //		parse out {ts: nanosec, logID: int64} values,
 //		calculate the time difference and logID difference, and output
 func runFiledbMonitorOne() (err error) {
 	filedbLogDir := path.Join(config.Shared.DataDir, "filedb")
 
-	err = filepath.Walk(filedbLogDir, func(path string, info os.FileInfo, err error) error {
+	entries, err := os.ReadDir(filedbLogDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") || segmentName.MatchString(entry.Name()) {
+			continue
+		}
+		err = monitorFiledb(path.Join(filedbLogDir, entry.Name()))
 		if err != nil {
-			return err
+			return
 		}
+	}
+	return
+}
 
-		if !info.IsDir() && strings.HasSuffix(info.Name(), ".log") {
-			fdb, err := filedb.New(path)
-			if err != nil {
-				return err
-			}
-			err = fdb.Open()
-			if err != nil {
-				return err
-			}
-			defer fdb.Close()
+// monitorFiledb prints the logs saved to the filedb at p, see runFiledbMonitorOne
+func monitorFiledb(p string) (err error) {
+	fdb, err := filedb.OpenReadOnly(p)
+	if err != nil {
+		return
+	}
+	defer fdb.Close()
 
-			firstLine, err := fdb.ReadFirstLine()
-			if err != nil {
-				return err
-			}
-			lastLine, err := fdb.ReadLastLine()
-			if err != nil {
-				return err
-			}
+	first, ok, err := filedb.First[monitorLog](fdb, 0)
+	if err != nil || !ok {
+		return
+	}
+	last, _, err := filedb.Last[monitorLog](fdb)
+	if err != nil {
+		return
+	}
+	firstLog, lastLog := first.Log, last.Log
 
-			var firstLog, lastLog struct {
-				Ts    int64 `json:"ts"`
-				LogID int64 `json:"logID"`
-			}
+	timeDiff := (lastLog.Ts - firstLog.Ts)
+	logIDDiff := lastLog.LogID - firstLog.LogID
 
-			if err := json.Unmarshal([]byte(firstLine), &firstLog); err != nil {
-				return err
-			}
-			if err := json.Unmarshal([]byte(lastLine), &lastLog); err != nil {
-				return err
-			}
+	// timeDiff to duration
+	duration := time.Duration(timeDiff) * time.Nanosecond
+	lastLogTime := time.Unix(0, lastLog.Ts)
+
+	rate := int64(0)
+	if int64(duration.Seconds()) > 0 {
+		rate = logIDDiff / int64(duration.Seconds())
+	}
+	fmt.Printf(
+		"Benchmark: %s saved %d logs to filedb in %s at %s with rate %d/sec\n",
+		p, logIDDiff, duration, lastLogTime.Format(time.RFC3339), rate,
+	)
+	return
+}
 
-			timeDiff := (lastLog.Ts - firstLog.Ts)
-			logIDDiff := lastLog.LogID - firstLog.LogID
+// verifyFiledb checks the records of every filedb log file and reports the damaged ones with their byte offsets
+//
+//	run it while the services are stopped, a log being written may end with a record in the middle of its write
+func verifyFiledb() (err error) {
+	filedbLogDir := path.Join(config.Shared.DataDir, "filedb")
 
-			// timeDiff to duration
-			duration := time.Duration(timeDiff) * time.Nanosecond
-			lastLogTime := time.Unix(0, lastLog.Ts)
+	var damaged int
+	err = filepath.Walk(filedbLogDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".log") {
+			return nil
+		}
 
-			rate := int64(0)
-			if int64(duration.Seconds()) > 0 {
-				rate = logIDDiff / int64(duration.Seconds())
-			}
-			fmt.Printf(
-				"Benchmark: %s saved %d logs to filedb in %s at %s with rate %d/sec\n",
-				path, logIDDiff, duration, lastLogTime.Format(time.RFC3339), rate,
-			)
+		records, corruptions, err := filedb.VerifyFile(path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Verify: %s has %d records and %d damaged spans\n", path, records, len(corruptions))
+		for _, c := range corruptions {
+			fmt.Printf("Verify: %s at offset %d, %d bytes: %s\n", c.File, c.Offset, c.Size, c.Reason)
 		}
+		damaged += len(corruptions)
 		return nil
 	})
 	if err != nil {
 		return
 	}
 
+	if damaged > 0 {
+		err = fmt.Errorf("found %d damaged spans", damaged)
+	}
+	return
+}
+
+// convertFiledb rewrites the filedb logs of the bank of fCoin or the ome of fSymbol with the codec fCodec,
+// into <data_dir>/filedb/<codec>, the segments, the manifest and the indexes are written anew
+//
+//	run it while the app is stopped, then move the files over the old ones
+func convertFiledb() (err error) {
+	var name string
+	var convert func(src, dst *filedb.Filedb) (logs int64, err error)
+	switch {
+	case fCoin != "":
+		name = "Bank_" + fCoin
+		convert = convertLogs[bank.BankLog]
+	case fSymbol != "":
+		name = "OME_" + fSymbol
+		convert = convertLogs[ome.OmeLog]
+	default:
+		return errors.New("empty coin and symbol")
+	}
+	if fCodec != filedb.CodecJSON && fCodec != filedb.CodecBinary {
+		return fmt.Errorf("invalid codec %s, only (%s, %s) avaliable", fCodec, filedb.CodecJSON, filedb.CodecBinary)
+	}
+
+	name = strings.ToLower(name) + ".log"
+	src, err := filedb.New(path.Join(config.Shared.DataDir, "filedb", name))
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	dst, err := filedb.New(path.Join(config.Shared.DataDir, "filedb", fCodec, name))
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+	dst.SegmentSize = config.Shared.Filedb.SegmentSize
+	dst.SegmentLogs = config.Shared.Filedb.SegmentLogs
+	dst.Codec = fCodec
+	// Close syncs it
+	dst.SyncPolicy = filedb.SyncPolicyInterval
+
+	last, err := dst.ReadLastLine()
+	if err != nil {
+		return
+	}
+	if last != "" {
+		return fmt.Errorf("%s already has logs", dst.FilePath)
+	}
+
+	logs, err := convert(src, dst)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Convert: %s has %d logs in %s\n", dst.FilePath, logs, fCodec)
+	return
+}
+
+// convertLogs appends the logs of src to dst in the codec of dst
+func convertLogs[T any, PT interface {
+	*T
+	filedb.Log
+}](src, dst *filedb.Filedb) (logs int64, err error) {
+	err = filedb.Iterate[T, PT](src, filedb.IterOptions{}, func(r filedb.Record[T]) (err error) {
+		b, err := dst.Marshal(r.Log)
+		if err != nil {
+			return
+		}
+		logs++
+		return dst.Append(r.LogID, string(b)+"\n")
+	})
 	return
 }
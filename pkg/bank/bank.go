@@ -1,9 +1,12 @@
 package bank
 
 import (
+	"ccoms/pkg/catalog"
 	"ccoms/pkg/config"
 	"ccoms/pkg/filedb"
 	"ccoms/pkg/model"
+	"ccoms/pkg/replica"
+	"ccoms/pkg/rules"
 	"ccoms/pkg/xgrpc"
 	"ccoms/pkg/xlog"
 	"ccoms/pkg/xnats"
@@ -11,6 +14,8 @@ import (
 	"errors"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -22,7 +27,7 @@ import (
 type Worker struct {
 	Name    string   // e.g. Bank_USDT
 	Coin    string   // e.g. USDT
-	Symbols []string // e.g. BTC_USDT
+	Symbols []string // e.g. BTC_USDT, the symbols listed with Coin as base or quote, see LoadSymbols
 	State   string
 
 	LogID int64 // ID of the latest log
@@ -34,11 +39,23 @@ type Worker struct {
 	Assets map[int64]*UserAsset // userid -> coin balance
 
 	ch           chan BankMsg     // Other worker threads send requests (OrderReq, BalanceChange) to the main thread for processing via this chan
-	OmeReasonIDs map[string]int64 // symbol -> reasonID, the latest BalanceChanges received from each ome, the ID of the latest one
+	OmeReasonIDs map[string]int64 // ome reason table -> reasonID, the latest BalanceChanges received from each ome, the ID of the latest one
 	LatestMsgSeq uint64           // ID of the latest NATS message received
 	SavedLogID   int64            // ID of the log already processed (written to MySQL)
 
+	SnapshotLogID int64       // ID of the log of the latest snapshot, see MaybeSnapshot
+	snapshotting  atomic.Bool // a snapshot is being written
+
+	ClientOrderIDs *ClientOrderIDs // client order ids accepted recently, see config.Bank.ClientOrderIDWindow
+	TicketMarks    *TicketMarks    // the logs of the tickets, where a Tickets stream starts
+
+	ReplicaLag  *replica.Lag  // how far a standby is behind the primary, see RunStandby
+	promoted    chan struct{} // closed by Promote
+	promoteOnce sync.Once
+	Addr        string // grpc address of this bank when it is elected, see RunElected, xetcd.KeyBankService if empty
+
 	fdb *filedb.Filedb
+	js  nats.JetStreamContext // publishes order events, see Nats
 }
 
 var logger = xlog.GetLogger()
@@ -49,7 +66,7 @@ func New(coin string) (w *Worker, err error) {
 	w = &Worker{
 		Name:    "Bank_" + coin,
 		Coin:    coin,
-		Symbols: []string{"BTC_USDT"}, // TODO
+		Symbols: nil, // from the catalog, see LoadSymbols
 
 		// LogID: load from filedb
 
@@ -61,6 +78,12 @@ func New(coin string) (w *Worker, err error) {
 		OmeReasonIDs: map[string]int64{},
 		// LatestMsgSeq: load from filedb
 
+		ClientOrderIDs: NewClientOrderIDs(time.Duration(config.Shared.Bank.ClientOrderIDWindow) * time.Second),
+		TicketMarks:    NewTicketMarks(),
+
+		ReplicaLag: &replica.Lag{},
+		promoted:   make(chan struct{}),
+
 		// fdb: -
 
 		State: "Init",
@@ -73,21 +96,14 @@ func New(coin string) (w *Worker, err error) {
 	}
 
 	// Read the last logID from filedb
-	txt, err := w.fdb.ReadLastLine()
+	// a torn last record is truncated when filedb opens, see filedb.Open
+	last, ok, err := filedb.Last[BankLog](w.fdb)
 	if err != nil {
 		return nil, err
 	}
-	if txt != "" {
-		bl := BankLog{}
-		err = json.Unmarshal([]byte(txt), &bl)
-		if err != nil {
-			// TODO
-			// One possible error is that the log was not written completely
-			// Are there any other errors?
-			return nil, err
-		}
-		w.LogID = bl.LogID
-		w.LatestMsgSeq = bl.MsgSeq
+	if ok {
+		w.LogID = last.LogID
+		w.LatestMsgSeq = last.Log.MsgSeq
 	}
 
 	logger.Info("bank worker created")
@@ -97,9 +113,11 @@ func New(coin string) (w *Worker, err error) {
 // Run starts the service
 //
 //	a. Main thread: Use `chan BankMsg` to receive requests from ingress and ome, process requests sequentially in a single thread (create ticket, update balance in memory, write to filedb)
+//	a0. Derive the symbols from the catalog and create their tables, see LoadSymbols
 //	a1. Writer handles all filedb logs before the main thread
 //	a2. Cache existing OmeReasonIDs, LatestMsgSeq, TicketID, LogID (this is read from MySQL or filedb?)
 //	a3. Cache existing Assets (read from MySQL)
+//	With snapshots enabled, a1-a3 are replaced by loading the latest snapshot and replaying the filedb logs after it
 //	a4. Preparation complete, start other worker threads
 //
 //	b. natscli thread: Connect to NATS service, subscribe to messages from ingress, and forward them to the main thread via chan for processing
@@ -114,24 +132,47 @@ func New(coin string) (w *Worker, err error) {
 //	d1. This thread is started immediately after the main thread task preparation, monitor filedb updates in real-time, and write to MySQL
 //	Can run as a separate process because the main thread task completion judgment is based on the lastLogID in filedb and the lastLogID in MySQL, so it can run independently
 func (w *Worker) Run() (err error) {
+	w.State = "LoadingSymbols"
+	err = w.LoadSymbols()
+	if err != nil {
+		return
+	}
 
 	go w.StartWriter()
 
-	// wait for mysql.lastLogID == w.LogID(last logID in filedb)
-	w.State = "WaitForFiledb"
+	if config.Shared.Snapshot.Enabled {
+		w.State = "LoadingSnapshot"
+		// load the latest snapshot, then replay the filedb logs after it, mysql is written asynchronously
+		err = w.LoadSnapshot()
+		if err != nil {
+			return
+		}
+		err = w.ReplayLogs()
+		if err != nil {
+			return
+		}
+	} else {
+		// wait for mysql.lastLogID == w.LogID(last logID in filedb)
+		w.State = "WaitForFiledb"
 
-	err = w.WaitForFiledb()
-	if err != nil {
-		return
-	}
+		err = w.WaitForFiledb()
+		if err != nil {
+			return
+		}
 
-	w.State = "LoadingAssets"
-	// load Assets, ticketID, LatestMsgSeq (nats), OmeReasonIDs (grpc) from mysql
-	err = w.LoadAllAssets()
-	if err != nil {
-		return
+		w.State = "LoadingAssets"
+		// load Assets, ticketID, LatestMsgSeq (nats), OmeReasonIDs (grpc) from mysql
+		err = w.LoadAllAssets()
+		if err != nil {
+			return
+		}
 	}
 
+	return w.work()
+}
+
+// work consumes the requests once the state is loaded, see Run and RunStandby
+func (w *Worker) work() (err error) {
 	// set status=ready
 	w.State = "Working"
 
@@ -200,19 +241,11 @@ func (w *Worker) WaitForFiledb() (err error) {
 		}
 	}()
 
-	s, err := w.fdb.ReadLastLine()
-	if err != nil {
-		return
-	}
-	if s == "" {
-		return nil
-	}
-
-	var bl BankLog
-	err = json.Unmarshal([]byte(s), &bl)
-	if err != nil {
+	last, ok, err := filedb.Last[BankLog](w.fdb)
+	if err != nil || !ok {
 		return
 	}
+	bl := last.Log
 
 	w.LogID = bl.LogID
 
@@ -229,6 +262,47 @@ func (w *Worker) WaitForFiledb() (err error) {
 	}
 }
 
+// LoadSymbols derives the symbols of the bank from the catalog and creates the tables they are missing,
+// the symbols listed later get their tables once the writer meets their tickets
+func (w *Worker) LoadSymbols() (err error) {
+	defer func() {
+		if err != nil {
+			logger.Errorf("LoadSymbols failed with err:%s", err)
+		} else {
+			logger.Infof("LoadSymbols done with symbols:%v", w.Symbols)
+		}
+	}()
+
+	symbols, err := catalog.Shared.SymbolsOf(w.Coin)
+	if err != nil {
+		return
+	}
+
+	db := model.GetMySQL()
+	err = model.MigrateCoin(db, w.Coin)
+	if err != nil {
+		return
+	}
+	w.Symbols = w.Symbols[:0]
+	for _, s := range symbols {
+		err = model.MigrateSymbol(db, s.Symbol)
+		if err != nil {
+			return
+		}
+		// CreateOrder only reads what is cached
+		_, err = catalog.Shared.Trading(s.Symbol)
+		if err != nil {
+			return
+		}
+		err = rules.Shared.Load(s.Symbol)
+		if err != nil {
+			return
+		}
+		w.Symbols = append(w.Symbols, s.Symbol)
+	}
+	return
+}
+
 // LoadSavedLogID reads logID from MySQL
 func (w *Worker) LoadSavedLogID() (id int64, err error) {
 	defer func() {
@@ -249,6 +323,36 @@ func (w *Worker) LoadSavedLogID() (id int64, err error) {
 	}
 	id = lastBs.LogID
 
+	// logs without balance changes (e.g. cancel tickets) only move the lastkv
+	var lastkv model.Lastkv
+	err = db.Model(model.Lastkv{}).
+		Where("`app`=? and `key`=?", strings.ToLower(w.Name), model.LASTKV_K_SAVED_LOG_ID).
+		Limit(1).Find(&lastkv).Error
+	if err != nil {
+		return
+	}
+	id = max(id, lastkv.Val)
+
+	return
+}
+
+// LoadOmeTicketID read from mysql the latest ticket of this bank the ome of the symbol has saved, 0 if none
+func (w *Worker) LoadOmeTicketID(symbol string) (id int64, err error) {
+	db := model.GetMySQL()
+
+	key := model.LASTKV_K_LATEST_BID_TICKET_ID
+	if w.GetSide(symbol) == "ask" {
+		key = model.LASTKV_K_LATEST_ASK_TICKET_ID
+	}
+	var lastkv model.Lastkv
+	err = db.Model(model.Lastkv{}).
+		Where("`app`=? and `key`=?", "ome_"+strings.ToLower(symbol), key).
+		Limit(1).Find(&lastkv).Error
+	if err != nil {
+		return
+	}
+
+	id = int64(lastkv.Val)
 	return
 }
 
@@ -299,13 +403,32 @@ func (w *Worker) LoadAllAssets() (err error) {
 		return
 	}
 
+	// client order ids accepted within the window, the tickets are in mysql already
+	now := time.Now()
+	since := now.Add(-time.Duration(w.ClientOrderIDs.window))
+	for _, symbol := range w.Symbols {
+		side := w.GetSide(symbol)
+		var tickets []model.Ticket
+		err = db.Scopes(model.TicketTable(symbol, side)).
+			Select("`id`, `owner`, `client_order_id`, `created_at`").
+			Where("`created_at`>=? and `action`=? and `client_order_id`<>''", since, model.TicketActionCreate).
+			Order("id asc").Find(&tickets).Error
+		if err != nil {
+			return
+		}
+		for _, t := range tickets {
+			w.ClientOrderIDs.Add(t.Owner, t.ClientOrderID, t.CreatedAt.UnixNano())
+		}
+	}
+	w.ClientOrderIDs.Expire(now.UnixNano())
+
 	for _, item := range lastkvs {
 		if item.Key == model.LASTKV_K_NATS_SEQ {
 			w.LatestMsgSeq = uint64(item.Val)
 		}
 		if strings.HasPrefix(item.Key, model.LASTKV_K_OME_REASONID) {
-			symbol := strings.ToUpper(strings.Replace(item.Key, model.LASTKV_K_OME_REASONID, "", 1))
-			w.OmeReasonIDs[symbol] = item.Val
+			symbol := strings.Replace(item.Key, model.LASTKV_K_OME_REASONID, "", 1)
+			w.OmeReasonIDs[omeReasonTable(symbol)] = item.Val
 		}
 	}
 
@@ -313,8 +436,9 @@ func (w *Worker) LoadAllAssets() (err error) {
 }
 
 type ackPayload struct {
-	msg *nats.Msg
-	seq uint64
+	msg    *nats.Msg
+	seq    uint64
+	fdbSeq uint64 // the filedb records to be durable before the ack, see filedb.WaitDurable
 }
 
 // HandleBankMsgs handles tasks from other worker threads (single-threaded sequentially)
@@ -323,6 +447,8 @@ func (w *Worker) HandleBankMsgs() (err error) {
 	// and ack msgs in batch here.
 	chAck := make(chan ackPayload, 1024)
 	// chAck2 := make(chan ackPayload)
+	// a failed sync stays failed, nothing is acked after it, the worker stops and starts again from the disk
+	chFail := make(chan error, 1)
 
 	go func() {
 		var latest ackPayload
@@ -341,8 +467,14 @@ func (w *Worker) HandleBankMsgs() (err error) {
 					}
 				}
 			}
-			err = latest.msg.Ack()
-			if err != nil {
+			// the logs of the requests reach the disk under config.Filedb.Sync first,
+			// the requests acked meanwhile wait for the next round, so one sync covers many acks
+			if err := w.fdb.WaitDurable(latest.fdbSeq); err != nil {
+				logger.Errorf("msg(%v) ack skipped as its logs are not durable, err:%s", latest.seq, err)
+				chFail <- err
+				return
+			}
+			if err := latest.msg.Ack(); err != nil {
 				logger.Errorf("msg(%v) ack failed with err:%s", mp.seq, err)
 				continue
 			}
@@ -383,10 +515,22 @@ func (w *Worker) HandleBankMsgs() (err error) {
 
 	// start handling bank msgs
 	for {
-		bs, ok := <-w.ch
+		var bs BankMsg
+		var ok bool
+		select {
+		case err = <-chFail:
+			return
+		case bs, ok = <-w.ch:
+		}
 		if !ok {
 			return
 		}
+		// both may have been ready, bs is not handled, it is delivered again after the restart
+		select {
+		case err = <-chFail:
+			return
+		default:
+		}
 
 		// nast msg
 		if bs.N != nil {
@@ -397,6 +541,16 @@ func (w *Worker) HandleBankMsgs() (err error) {
 				if err != nil {
 					return
 				}
+			case "BANK." + w.Coin + ".CancelReq":
+				err = w.HandleCancelReq(msg, chAck)
+				if err != nil {
+					return
+				}
+			case "BANK." + w.Coin + ".AmendReq":
+				err = w.HandleAmendReq(msg, chAck)
+				if err != nil {
+					return
+				}
 			}
 		}
 
@@ -407,6 +561,8 @@ func (w *Worker) HandleBankMsgs() (err error) {
 				return
 			}
 		}
+
+		w.MaybeSnapshot()
 	}
 }
 
@@ -438,26 +594,98 @@ func (w *Worker) HandleOrderReq(msg *nats.Msg, chAck chan ackPayload) (err error
 	if md.Sequence.Stream <= w.LatestMsgSeq {
 		// TODO
 		logger.Warningf("md.Sequence.Stream(%d) <= w.LatestMsgSeq(%d)", md.Sequence.Stream, w.LatestMsgSeq)
-		chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream}
+		chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
 		return
 	}
 
 	err = w.CreateOrder(md.Sequence.Stream, orderReq)
 	if err != nil {
 		if errors.Is(err, ErrCreateOrderSafeSkip) {
-			chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream}
+			chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
+		}
+		return
+	}
+
+	// ack
+	chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
+
+	return
+}
+
+func (w *Worker) HandleCancelReq(msg *nats.Msg, chAck chan ackPayload) (err error) {
+	var cancelReq xnats.CancelReq
+	err = json.Unmarshal(msg.Data, &cancelReq)
+	if err != nil {
+		// TODO
+		return
+	}
+
+	md, err := msg.Metadata()
+	if err != nil {
+		// TODO
+		return
+	}
+
+	logger.Tracef("HandleCancelReq msg:%s, seq:%d", msg.Subject, md.Sequence.Stream)
+
+	if md.Sequence.Stream <= w.LatestMsgSeq {
+		logger.Warningf("md.Sequence.Stream(%d) <= w.LatestMsgSeq(%d)", md.Sequence.Stream, w.LatestMsgSeq)
+		chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
+		return
+	}
+
+	err = w.CancelOrder(md.Sequence.Stream, cancelReq)
+	if err != nil {
+		if errors.Is(err, ErrCreateOrderSafeSkip) {
+			chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
+		}
+		return
+	}
+
+	// ack
+	chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
+
+	return
+}
+
+func (w *Worker) HandleAmendReq(msg *nats.Msg, chAck chan ackPayload) (err error) {
+	var amendReq xnats.AmendReq
+	err = json.Unmarshal(msg.Data, &amendReq)
+	if err != nil {
+		// TODO
+		return
+	}
+
+	md, err := msg.Metadata()
+	if err != nil {
+		// TODO
+		return
+	}
+
+	logger.Tracef("HandleAmendReq msg:%s, seq:%d", msg.Subject, md.Sequence.Stream)
+
+	if md.Sequence.Stream <= w.LatestMsgSeq {
+		logger.Warningf("md.Sequence.Stream(%d) <= w.LatestMsgSeq(%d)", md.Sequence.Stream, w.LatestMsgSeq)
+		chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
+		return
+	}
+
+	err = w.AmendOrder(md.Sequence.Stream, amendReq)
+	if err != nil {
+		if errors.Is(err, ErrCreateOrderSafeSkip) {
+			chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
 		}
 		return
 	}
 
 	// ack
-	chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream}
+	chAck <- ackPayload{msg: msg, seq: md.Sequence.Stream, fdbSeq: w.fdb.Seq()}
 
 	return
 }
 
 // Filedb returns the current working filedb instance
-// TODO: According to the current file splitting method, a new instance should be returned when the time is up
+// the instance splits the logs into segments itself, see config.Filedb
 func (w *Worker) Filedb() (fdb *filedb.Filedb, err error) {
 	if w.fdb != nil {
 		return w.fdb, nil
@@ -468,7 +696,11 @@ func (w *Worker) Filedb() (fdb *filedb.Filedb, err error) {
 		return nil, err
 	}
 
-	fdb.ToMySQLHandler = w.ParseAndWriteLogs
+	fdb.SegmentSize = config.Shared.Filedb.SegmentSize
+	fdb.SegmentLogs = config.Shared.Filedb.SegmentLogs
+	fdb.SyncPolicy = config.Shared.Filedb.Sync
+	fdb.SyncInterval = time.Duration(config.Shared.Filedb.SyncInterval) * time.Millisecond
+	fdb.Codec = config.Shared.Filedb.Codec
 
 	w.fdb = fdb
 	return w.fdb, nil
@@ -518,8 +750,9 @@ func (w *Worker) CreateOrder(msgSeq uint64, o xnats.OrderReq) (err error) {
 		return ErrCreateOrderSafeSkip
 	}
 
-	// Calculate fee and final fee
-	feeRate := o.FeeLevel
+	// Calculate fee and final fee, reserve enough for the highest rate ome may charge,
+	// whatever is not charged is returned when the order completes
+	feeRate := max(o.FeeLevel, config.Shared.Fee.MakerRate, config.Shared.Fee.TakerRate)
 	fee := value.Mul(decimal.NewFromFloat(feeRate))
 	total := value.Add(fee)
 
@@ -530,6 +763,64 @@ func (w *Worker) CreateOrder(msgSeq uint64, o xnats.OrderReq) (err error) {
 	// get user's coin asset
 	uaa := w.CheckoutAsset(o.Owner)
 
+	now := time.Now().UnixNano()
+	if len(o.ClientOrderID) > model.ClientOrderIDMaxLen {
+		o.ClientOrderID = o.ClientOrderID[:model.ClientOrderIDMaxLen] // to fit the column of the reject
+		return w.RejectOrder(msgSeq, o, RejectLog{
+			Reason: model.OrderRejectReasonInvalidClientOrderID,
+			Coin:   coin,
+		})
+	}
+	// the ome cancels it once its clock passes the expiry, an expiry already passed would just lock the funds for a while
+	if o.ExpireAt < 0 || (o.ExpireAt > 0 && o.ExpireAt <= now/int64(time.Second)) {
+		return w.RejectOrder(msgSeq, o, RejectLog{
+			Reason: model.OrderRejectReasonInvalidExpireAt,
+			Coin:   coin,
+		})
+	}
+	// a symbol or coin not listed or halted takes no new orders, ingress has checked the rules already, they may have changed since,
+	// both are read from the cache, which is refreshed in the background, the bank never waits for etcd
+	trading, err := catalog.Shared.Cached().Trading(o.Symbol)
+	if err != nil {
+		logger.Warningf("CreateOrder cannot check the catalog of %s, err:%s", o.Symbol, err)
+		return w.RejectOrder(msgSeq, o, RejectLog{
+			Reason: model.OrderRejectReasonRulesUnavailable,
+			Coin:   coin,
+		})
+	}
+	if !trading {
+		return w.RejectOrder(msgSeq, o, RejectLog{
+			Reason: model.OrderRejectReasonSymbolNotTrading,
+			Coin:   coin,
+		})
+	}
+	reason, err := rules.Shared.Cached().Check(o)
+	if err != nil {
+		logger.Warningf("CreateOrder cannot check the rules of %s, err:%s", o.Symbol, err)
+		reason = model.OrderRejectReasonRulesUnavailable
+	}
+	if reason != "" {
+		return w.RejectOrder(msgSeq, o, RejectLog{
+			Reason: reason,
+			Coin:   coin,
+		})
+	}
+	if o.ClientOrderID != "" && w.ClientOrderIDs.Has(o.Owner, o.ClientOrderID, now) {
+		return w.RejectOrder(msgSeq, o, RejectLog{
+			Reason: model.OrderRejectReasonDuplicateClientOrderID,
+			Coin:   coin,
+		})
+	}
+
+	if total.GreaterThan(uaa.Free) {
+		return w.RejectOrder(msgSeq, o, RejectLog{
+			Reason:   model.OrderRejectReasonInsufficientBalance,
+			Coin:     coin,
+			Required: total.String(),
+			Free:     uaa.Free.String(),
+		})
+	}
+
 	// update data in memory
 	uaa.Free = uaa.Free.Sub(total)
 	uaa.Freeze = uaa.Freeze.Add(total)
@@ -550,17 +841,31 @@ func (w *Worker) CreateOrder(msgSeq uint64, o xnats.OrderReq) (err error) {
 
 	logIndex++
 	tl := TicketLog{
-		LogIndex: logIndex,
-		Reason:   "CreateOrder",
-		ID:       w.TicketIDs[o.Symbol],
-		Owner:    o.Owner,
-		Symbol:   o.Symbol,
-		Type:     o.Type,
-		Side:     o.Side,
-		Price:    o.Price.String(),
-		Quantity: o.Quantity.String(),
-		Amount:   o.Amount.String(),
+		LogIndex:    logIndex,
+		Reason:      "CreateOrder",
+		ID:          w.TicketIDs[o.Symbol],
+		Owner:       o.Owner,
+		Symbol:      o.Symbol,
+		Type:        o.Type,
+		TimeInForce: o.TimeInForce,
+		Side:        o.Side,
+		Price:       o.Price.String(),
+		Quantity:    o.Quantity.String(),
+		Amount:      o.Amount.String(),
+		Frozen:      total.String(),
+
+		ClientOrderID: o.ClientOrderID,
+		Time:          o.Time,
+
+		SelfTradePrevention: o.SelfTradePrevention,
 	}
+	if o.Type == model.OrderTypeStopLimit || o.Type == model.OrderTypeStopMarket {
+		tl.StopPrice = o.StopPrice.String()
+	}
+	if o.DisplayQty.IsPositive() {
+		tl.DisplayQty = o.DisplayQty.String()
+	}
+	tl.ExpireAt = o.ExpireAt
 
 	logIndex++
 	bl := BalanceLog{
@@ -578,24 +883,74 @@ func (w *Worker) CreateOrder(msgSeq uint64, o xnats.OrderReq) (err error) {
 
 	bankLog := BankLog{
 		LogID:  w.LogID,
-		Ts:     time.Now().UnixNano(),
+		Ts:     now,
 		MsgSeq: msgSeq,
 
 		TicketLogs:  []TicketLog{tl},
 		BalanceLogs: []BalanceLog{bl},
 	}
 
-	blb, err := json.Marshal(bankLog)
+	// write to filedb
+	_, err = w.Filedb()
+	if err != nil {
+		return
+	}
+	blb, err := w.fdb.Marshal(bankLog)
+	if err != nil {
+		return
+	}
+	err = w.fdb.Append(bankLog.LogID, string(blb)+"\n")
 	if err != nil {
 		return
 	}
 
+	w.LatestMsgSeq = msgSeq
+	w.TicketMarks.Add(tl.Symbol, tl.ID, bankLog.LogID)
+	if o.ClientOrderID != "" {
+		w.ClientOrderIDs.Add(o.Owner, o.ClientOrderID, now)
+	}
+
+	return
+}
+
+// RejectOrder records an order request that is turned down, the request is still acked
+//
+//	ingress looks the rejection up by msgSeq, see model.OrderReject
+func (w *Worker) RejectOrder(msgSeq uint64, o xnats.OrderReq, rl RejectLog) (err error) {
+	logger.Infof("RejectOrder seq:%d, owner:%d, reason:%s", msgSeq, o.Owner, rl.Reason)
+
+	w.LogID++
+	defer func() {
+		if err != nil {
+			w.LogID--
+		}
+	}()
+
+	rl.LogIndex = 1
+	rl.Owner = o.Owner
+	rl.Symbol = o.Symbol
+	rl.Side = o.Side
+	rl.Time = o.Time
+	rl.ClientOrderID = o.ClientOrderID
+
+	bankLog := BankLog{
+		LogID:  w.LogID,
+		Ts:     time.Now().UnixNano(),
+		MsgSeq: msgSeq,
+
+		RejectLogs: []RejectLog{rl},
+	}
+
 	// write to filedb
 	_, err = w.Filedb()
 	if err != nil {
 		return
 	}
-	err = w.fdb.WriteLine(string(blb) + "\n")
+	blb, err := w.fdb.Marshal(bankLog)
+	if err != nil {
+		return
+	}
+	err = w.fdb.Append(bankLog.LogID, string(blb)+"\n")
 	if err != nil {
 		return
 	}
@@ -605,9 +960,219 @@ func (w *Worker) CreateOrder(msgSeq uint64, o xnats.OrderReq) (err error) {
 	return
 }
 
+// - Create a cancel ticket for ome, the balance is not changed here
 // - Cancel buy order, increase available money, and decrease frozen money
 // - Cancel sell order, increase available coins, and decrease frozen coins
-func (w *Worker) CancelOrder(symbol string, o model.Order) (err error) { return }
+// The last two are done in BalanceChanged, after ome has removed the order and pushed the refund back
+func (w *Worker) CancelOrder(msgSeq uint64, o xnats.CancelReq) (err error) {
+	// prepare data
+	ss := strings.Split(o.Symbol, "_")
+	if len(ss) != 2 {
+		return errors.New("invalid symbol")
+	}
+	base, quote := ss[0], ss[1]
+
+	var coin string
+	if o.Side == model.OrderSideBid {
+		coin = quote
+	} else if o.Side == model.OrderSideAsk {
+		coin = base
+	} else {
+		return errors.New("invalid order side")
+	}
+	if coin != w.Coin {
+		logger.Errorf("only for %s", w.Coin)
+		return ErrCreateOrderSafeSkip
+	}
+
+	// update data in memory
+	w.LogID++
+	w.TicketIDs[o.Symbol]++
+
+	defer func() {
+		if err != nil {
+			w.LogID--
+			w.TicketIDs[o.Symbol]--
+		}
+	}()
+
+	// create logs
+	tl := TicketLog{
+		LogIndex: 1,
+		Reason:   "CancelOrder",
+		ID:       w.TicketIDs[o.Symbol],
+		Owner:    o.Owner,
+		Symbol:   o.Symbol,
+		Side:     o.Side,
+		Action:   model.TicketActionCancel,
+		OrderID:  o.OrderID,
+
+		ClientOrderID: o.ClientOrderID,
+		Time:          o.Time,
+	}
+
+	bankLog := BankLog{
+		LogID:  w.LogID,
+		Ts:     time.Now().UnixNano(),
+		MsgSeq: msgSeq,
+
+		TicketLogs: []TicketLog{tl},
+	}
+
+	// write to filedb
+	_, err = w.Filedb()
+	if err != nil {
+		return
+	}
+	blb, err := w.fdb.Marshal(bankLog)
+	if err != nil {
+		return
+	}
+	err = w.fdb.Append(bankLog.LogID, string(blb)+"\n")
+	if err != nil {
+		return
+	}
+
+	w.LatestMsgSeq = msgSeq
+	w.TicketMarks.Add(tl.Symbol, tl.ID, bankLog.LogID)
+
+	return
+}
+
+// - Create an amend ticket for ome, freezing the funds for the new price and quantity, fee included
+// - Nothing is frozen for a reduce-only amend, which keeps the price
+// ome returns the funds of the order before the amend, or the ones frozen here if the amend is invalid, see BalanceChanged
+func (w *Worker) AmendOrder(msgSeq uint64, o xnats.AmendReq) (err error) {
+	// prepare data
+	ss := strings.Split(o.Symbol, "_")
+	if len(ss) != 2 {
+		return errors.New("invalid symbol")
+	}
+	base, quote := ss[0], ss[1]
+
+	var coin string
+	var value decimal.Decimal
+	var side string
+	if o.Side == model.OrderSideBid {
+		side = "bid"
+		coin = quote
+		value = o.Price.Mul(o.Quantity)
+	} else if o.Side == model.OrderSideAsk {
+		side = "ask"
+		coin = base
+		value = o.Quantity
+	} else {
+		return errors.New("invalid order side")
+	}
+	if coin != w.Coin {
+		logger.Errorf("only for %s", w.Coin)
+		return ErrCreateOrderSafeSkip
+	}
+
+	req := xnats.OrderReq{Symbol: o.Symbol, Owner: o.Owner, Side: o.Side, Time: o.Time, ClientOrderID: o.ClientOrderID}
+	if !o.Quantity.IsPositive() || o.Price.IsNegative() {
+		return w.RejectOrder(msgSeq, req, RejectLog{
+			Reason: model.OrderRejectReasonInvalidQuantity,
+			Coin:   coin,
+		})
+	}
+
+	// the new price and quantity need total, only what the order does not hold yet is frozen,
+	// ome returns the rest once it knows what the order really holds, a reduce-only amend needs nothing
+	total := decimal.Zero
+	if o.Price.IsPositive() {
+		feeRate := max(config.Shared.Fee.MakerRate, config.Shared.Fee.TakerRate)
+		total = value.Add(value.Mul(decimal.NewFromFloat(feeRate)))
+	}
+	reserve := decimal.Max(total.Sub(decimal.Max(o.Frozen, decimal.Zero)), decimal.Zero)
+
+	uaa := w.CheckoutAsset(o.Owner)
+	if reserve.GreaterThan(uaa.Free) {
+		return w.RejectOrder(msgSeq, req, RejectLog{
+			Reason:   model.OrderRejectReasonInsufficientBalance,
+			Coin:     coin,
+			Required: reserve.String(),
+			Free:     uaa.Free.String(),
+		})
+	}
+
+	// update data in memory
+	uaa.Free = uaa.Free.Sub(reserve)
+	uaa.Freeze = uaa.Freeze.Add(reserve)
+	w.LogID++
+	w.TicketIDs[o.Symbol]++
+
+	defer func() {
+		if err != nil {
+			uaa.Free = uaa.Free.Add(reserve)
+			uaa.Freeze = uaa.Freeze.Sub(reserve)
+			w.LogID--
+			w.TicketIDs[o.Symbol]--
+		}
+	}()
+
+	// create logs
+	tl := TicketLog{
+		LogIndex: 1,
+		Reason:   "AmendOrder",
+		ID:       w.TicketIDs[o.Symbol],
+		Owner:    o.Owner,
+		Symbol:   o.Symbol,
+		Type:     model.OrderTypeLimit,
+		Side:     o.Side,
+		Price:    o.Price.String(),
+		Quantity: o.Quantity.String(),
+		Frozen:   total.String(),
+		Action:   model.TicketActionAmend,
+		OrderID:  o.OrderID,
+
+		ClientOrderID: o.ClientOrderID,
+		Time:          o.Time,
+
+		Reserve: reserve.String(),
+	}
+
+	bankLog := BankLog{
+		LogID:  w.LogID,
+		Ts:     time.Now().UnixNano(),
+		MsgSeq: msgSeq,
+
+		TicketLogs: []TicketLog{tl},
+	}
+	if reserve.IsPositive() {
+		bankLog.BalanceLogs = []BalanceLog{{
+			LogIndex:     2,
+			Reason:       "AmendOrder",
+			ReasonTable:  strings.ToLower(o.Symbol) + "_" + side + "_tickets",
+			ReasonID:     tl.ID,
+			Owner:        o.Owner,
+			Coin:         coin,
+			FreeChange:   "-" + reserve.String(),
+			FreezeChange: reserve.String(),
+			FreeNew:      uaa.Free.String(),
+			FreezeNew:    uaa.Freeze.String(),
+		}}
+	}
+
+	// write to filedb
+	_, err = w.Filedb()
+	if err != nil {
+		return
+	}
+	blb, err := w.fdb.Marshal(bankLog)
+	if err != nil {
+		return
+	}
+	err = w.fdb.Append(bankLog.LogID, string(blb)+"\n")
+	if err != nil {
+		return
+	}
+
+	w.LatestMsgSeq = msgSeq
+	w.TicketMarks.Add(tl.Symbol, tl.ID, bankLog.LogID)
+
+	return
+}
 
 // - Match successful, buyer: increase available coins, decrease corresponding frozen money; seller: increase available money, decrease corresponding frozen coins
 func (w *Worker) OrderMatched(
@@ -670,17 +1235,16 @@ func (w *Worker) OrderMatched(
 		BalanceLogs: []BalanceLog{bl},
 	}
 
-	blb, err := json.Marshal(bankLog)
+	// write to filedb
+	_, err = w.Filedb()
 	if err != nil {
 		return
 	}
-
-	// write to filedb
-	_, err = w.Filedb()
+	blb, err := w.fdb.Marshal(bankLog)
 	if err != nil {
 		return
 	}
-	err = w.fdb.WriteLine(string(blb) + "\n")
+	err = w.fdb.Append(bankLog.LogID, string(blb)+"\n")
 	if err != nil {
 		return
 	}
@@ -696,10 +1260,13 @@ func (w *Worker) BalanceChanged(bc *xgrpc.BalanceChange) (err error) {
 
 	// get user's coin asset
 	uaa1 := w.CheckoutAsset(bc.Owner)
-	var uaa2 *UserAsset
+	var uaa2, uaa3 *UserAsset
 	if bc.Owner2 > 0 {
 		uaa2 = w.CheckoutAsset(bc.Owner2)
 	}
+	if bc.Owner3 > 0 {
+		uaa3 = w.CheckoutAsset(bc.Owner3)
+	}
 
 	// update data in memory
 	freeChange, _ := decimal.NewFromString(bc.FreeChange)     // TODO handle error
@@ -714,6 +1281,14 @@ func (w *Worker) BalanceChanged(bc *xgrpc.BalanceChange) (err error) {
 		uaa2.Free = uaa2.Free.Add(freeChange2)
 		uaa2.Freeze = uaa2.Freeze.Add(freezeChange2)
 	}
+
+	var freeChange3, freezeChange3 decimal.Decimal
+	if bc.Owner3 > 0 {
+		freeChange3, _ = decimal.NewFromString(bc.FreeChange3)     // TODO handle error
+		freezeChange3, _ = decimal.NewFromString(bc.FreezeChange3) // TODO handle error
+		uaa3.Free = uaa3.Free.Add(freeChange3)
+		uaa3.Freeze = uaa3.Freeze.Add(freezeChange3)
+	}
 	w.LogID++
 
 	defer func() {
@@ -724,6 +1299,10 @@ func (w *Worker) BalanceChanged(bc *xgrpc.BalanceChange) (err error) {
 				uaa2.Free = uaa2.Free.Sub(freeChange2)
 				uaa2.Freeze = uaa2.Freeze.Sub(freezeChange2)
 			}
+			if bc.Owner3 > 0 {
+				uaa3.Free = uaa3.Free.Sub(freeChange3)
+				uaa3.Freeze = uaa3.Freeze.Sub(freezeChange3)
+			}
 			w.LogID--
 		}
 	}()
@@ -733,21 +1312,32 @@ func (w *Worker) BalanceChanged(bc *xgrpc.BalanceChange) (err error) {
 
 	logIndex++
 	bl := BalanceLog{
-		LogIndex:      logIndex,
-		Reason:        bc.Reason,
-		ReasonTable:   bc.ReasonTable,
-		ReasonID:      bc.ReasonID,
-		Owner:         bc.Owner,
-		Coin:          w.Coin,
-		FreeChange:    bc.FreeChange,
-		FreezeChange:  bc.FreezeChange,
-		FreeNew:       uaa1.Free.String(),
-		FreezeNew:     uaa1.Freeze.String(),
-		Owner2:        bc.Owner2,
-		FreeChange2:   bc.FreeChange2,
-		FreezeChange2: bc.FreezeChange2,
-		FreeNew2:      uaa2.Free.String(),
-		FreezeNew2:    uaa2.Freeze.String(),
+		LogIndex:     logIndex,
+		Reason:       bc.Reason,
+		ReasonTable:  bc.ReasonTable,
+		ReasonID:     bc.ReasonID,
+		Owner:        bc.Owner,
+		Coin:         w.Coin,
+		FreeChange:   bc.FreeChange,
+		FreezeChange: bc.FreezeChange,
+		FreeNew:      uaa1.Free.String(),
+		FreezeNew:    uaa1.Freeze.String(),
+	}
+	// e.g. a refund of a canceled order only has one owner
+	if bc.Owner2 > 0 {
+		bl.Owner2 = bc.Owner2
+		bl.FreeChange2 = bc.FreeChange2
+		bl.FreezeChange2 = bc.FreezeChange2
+		bl.FreeNew2 = uaa2.Free.String()
+		bl.FreezeNew2 = uaa2.Freeze.String()
+	}
+	// e.g. the fee collector of a trade
+	if bc.Owner3 > 0 {
+		bl.Owner3 = bc.Owner3
+		bl.FreeChange3 = bc.FreeChange3
+		bl.FreezeChange3 = bc.FreezeChange3
+		bl.FreeNew3 = uaa3.Free.String()
+		bl.FreezeNew3 = uaa3.Freeze.String()
 	}
 
 	bankLog := BankLog{
@@ -757,17 +1347,16 @@ func (w *Worker) BalanceChanged(bc *xgrpc.BalanceChange) (err error) {
 		BalanceLogs: []BalanceLog{bl},
 	}
 
-	blb, err := json.Marshal(bankLog)
+	// write to filedb
+	_, err = w.Filedb()
 	if err != nil {
 		return
 	}
-
-	// write to filedb
-	_, err = w.Filedb()
+	blb, err := w.fdb.Marshal(bankLog)
 	if err != nil {
 		return
 	}
-	err = w.fdb.WriteLine(string(blb) + "\n")
+	err = w.fdb.Append(bankLog.LogID, string(blb)+"\n")
 	if err != nil {
 		return
 	}
@@ -826,17 +1415,16 @@ func (w *Worker) DirectChange(
 		BalanceLogs: []BalanceLog{bl},
 	}
 
-	blb, err := json.Marshal(bankLog)
+	// write to filedb
+	_, err = w.Filedb()
 	if err != nil {
 		return
 	}
-
-	// write to filedb
-	_, err = w.Filedb()
+	blb, err := w.fdb.Marshal(bankLog)
 	if err != nil {
 		return
 	}
-	err = w.fdb.WriteLine(string(blb) + "\n")
+	err = w.fdb.Append(bankLog.LogID, string(blb)+"\n")
 	// lastFiledbedTime = time.Now()
 	// filedbedLines += 1
 	if err != nil {
@@ -0,0 +1,152 @@
+package bank_test
+
+import (
+	"ccoms/pkg/bank"
+	"ccoms/pkg/catalog"
+	"ccoms/pkg/config"
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/model"
+	"ccoms/pkg/rules"
+	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xgrpc"
+	"ccoms/pkg/xnats"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+// listBTCUSDT lists BTC_USDT without trading rules, in place of etcd
+func listBTCUSDT() {
+	kvs := map[string]string{
+		xetcd.KeyCatalogSymbol("BTC_USDT"): `{"symbol":"BTC_USDT","base":"BTC","quote":"USDT","status":"trading"}`,
+		xetcd.KeyCatalogCoin("BTC"):        `{"coin":"BTC","status":"trading"}`,
+		xetcd.KeyCatalogCoin("USDT"):       `{"coin":"USDT","status":"trading"}`,
+	}
+	get := func(k string) (string, error) {
+		v, ok := kvs[k]
+		if !ok {
+			return "", xetcd.ErrNotFound
+		}
+		return v, nil
+	}
+	rules.Shared = rules.NewRegistry(time.Minute, get)
+	catalog.Shared = catalog.NewRegistry(time.Minute, get, nil)
+	// as LoadSymbols does
+	catalog.Shared.Trading("BTC_USDT")
+	rules.Shared.Load("BTC_USDT")
+}
+
+func lastLog(t *testing.T, w *bank.Worker) *bank.BankLog {
+	fdb, err := w.Filedb()
+	require.Nil(t, err)
+	last, ok, err := filedb.Last[bank.BankLog](fdb)
+	require.Nil(t, err)
+	require.True(t, ok)
+	return last.Log
+}
+
+func TestCreateOrderCache(t *testing.T) {
+	config.Shared = &config.Config{DataDir: t.TempDir()}
+	kvs := map[string]string{
+		xetcd.KeyCatalogSymbol("BTC_USDT"): `{"symbol":"BTC_USDT","base":"BTC","quote":"USDT","status":"trading"}`,
+		xetcd.KeyCatalogCoin("BTC"):        `{"coin":"BTC","status":"trading"}`,
+		xetcd.KeyCatalogCoin("USDT"):       `{"coin":"USDT","status":"trading"}`,
+	}
+	var down atomic.Bool
+	get := func(k string) (string, error) {
+		if down.Load() {
+			return "", errors.New("etcd is down")
+		}
+		v, ok := kvs[k]
+		if !ok {
+			return "", xetcd.ErrNotFound
+		}
+		return v, nil
+	}
+	rules.Shared = rules.NewRegistry(time.Nanosecond, get)
+	catalog.Shared = catalog.NewRegistry(time.Nanosecond, get, nil)
+
+	w, err := bank.New("USDT")
+	require.Nil(t, err)
+	require.Nil(t, w.HandleBalanceChange(&xgrpc.BalanceChange{
+		Reason: "match", ReasonTable: "ome_btc_usdt_logs", ReasonID: 1,
+		Owner: 1, FreeChange: "100", FreezeChange: "0",
+	}))
+	order := xnats.OrderReq{
+		Symbol: "BTC_USDT", Owner: 1, Side: model.OrderSideBid, Type: model.OrderTypeLimit,
+		Price: decimal.NewFromInt(10), Quantity: decimal.NewFromInt(1), Amount: decimal.NewFromInt(10),
+	}
+	seq := uint64(0)
+
+	// nothing cached, the order is not taken unchecked
+	down.Store(true)
+	seq++
+	require.Nil(t, w.CreateOrder(seq, order))
+	require.Equal(t, model.OrderRejectReasonRulesUnavailable, lastLog(t, w).RejectLogs[0].Reason)
+
+	// read in the background meanwhile
+	down.Store(false)
+	require.Eventually(t, func() bool {
+		seq++
+		return w.CreateOrder(seq, order) == nil && len(lastLog(t, w).TicketLogs) == 1
+	}, time.Second, time.Millisecond)
+
+	// stale, served from the cache while etcd is down
+	down.Store(true)
+	seq++
+	require.Nil(t, w.CreateOrder(seq, order))
+	require.Len(t, lastLog(t, w).TicketLogs, 1)
+}
+
+func TestAmendOrder(t *testing.T) {
+	config.Shared = &config.Config{DataDir: t.TempDir()}
+	listBTCUSDT()
+
+	w, err := bank.New("USDT")
+	require.Nil(t, err)
+	require.Nil(t, w.HandleBalanceChange(&xgrpc.BalanceChange{
+		Reason: "match", ReasonTable: "ome_btc_usdt_logs", ReasonID: 1,
+		Owner: 1, FreeChange: "20", FreezeChange: "0",
+	}))
+	require.Nil(t, w.CreateOrder(1, xnats.OrderReq{
+		Symbol: "BTC_USDT", Owner: 1, Side: model.OrderSideBid, Type: model.OrderTypeLimit,
+		Price: decimal.NewFromInt(10), Quantity: decimal.NewFromInt(2), Amount: decimal.NewFromInt(20),
+	}))
+	require.True(t, w.Assets[1].Free.IsZero())
+
+	lastTicket := func() bank.TicketLog {
+		l := lastLog(t, w)
+		require.Len(t, l.TicketLogs, 1)
+		return l.TicketLogs[0]
+	}
+	amend := xnats.AmendReq{
+		Symbol: "BTC_USDT", Owner: 1, Side: model.OrderSideBid, OrderID: 1,
+		Price: decimal.NewFromInt(9), Quantity: decimal.NewFromInt(2), Frozen: decimal.NewFromInt(20),
+	}
+
+	// a lower price is covered by the funds of the order, nothing more is frozen
+	require.Nil(t, w.AmendOrder(2, amend))
+	tl := lastTicket()
+	require.Equal(t, model.TicketActionAmend, tl.Action)
+	require.Equal(t, "18", tl.Frozen)
+	require.Equal(t, "0", tl.Reserve)
+	require.True(t, w.Assets[1].Free.IsZero())
+	require.Equal(t, "20", w.Assets[1].Freeze.String())
+
+	// only the difference is frozen for a higher price
+	require.Nil(t, w.HandleBalanceChange(&xgrpc.BalanceChange{
+		Reason: "match", ReasonTable: "ome_btc_usdt_logs", ReasonID: 2,
+		Owner: 1, FreeChange: "5", FreezeChange: "0",
+	}))
+	amend.Price, amend.Frozen = decimal.NewFromInt(11), decimal.NewFromInt(18)
+	require.Nil(t, w.AmendOrder(3, amend))
+	tl = lastTicket()
+	require.Equal(t, "22", tl.Frozen)
+	require.Equal(t, "4", tl.Reserve)
+	require.Equal(t, "1", w.Assets[1].Free.String())
+	require.Equal(t, "24", w.Assets[1].Freeze.String())
+}
@@ -0,0 +1,74 @@
+package bank
+
+import (
+	"time"
+)
+
+// ClientOrderIDs remembers the client order ids accepted within the retention window, to reject repeated order requests
+//
+//	NATS only drops duplicates published within the duplicate window of the stream, this covers the rest
+type ClientOrderIDs struct {
+	window int64 // nanoseconds
+	seen   map[clientOrderKey]int64
+	queue  []clientOrderEntry // in the order of acceptance, for expiring
+}
+
+type clientOrderKey struct {
+	Owner int64
+	ID    string
+}
+
+type clientOrderEntry struct {
+	key clientOrderKey
+	at  int64
+}
+
+// DefaultClientOrderIDWindow used if config.Bank.ClientOrderIDWindow is not set
+const DefaultClientOrderIDWindow = 24 * time.Hour
+
+func NewClientOrderIDs(window time.Duration) *ClientOrderIDs {
+	if window <= 0 {
+		window = DefaultClientOrderIDWindow
+	}
+	return &ClientOrderIDs{
+		window: int64(window),
+		seen:   map[clientOrderKey]int64{},
+	}
+}
+
+// Has whether the id was accepted for the owner within the window before now (nanoseconds)
+func (c *ClientOrderIDs) Has(owner int64, id string, now int64) bool {
+	c.Expire(now)
+	_, ok := c.seen[clientOrderKey{Owner: owner, ID: id}]
+	return ok
+}
+
+// Add remembers the id accepted for the owner at the given time (nanoseconds), ids are expected in the order of acceptance
+func (c *ClientOrderIDs) Add(owner int64, id string, at int64) {
+	key := clientOrderKey{Owner: owner, ID: id}
+	c.seen[key] = at
+	c.queue = append(c.queue, clientOrderEntry{key: key, at: at})
+}
+
+// Expire forgets the ids accepted before now-window
+func (c *ClientOrderIDs) Expire(now int64) {
+	i := 0
+	for ; i < len(c.queue); i++ {
+		e := c.queue[i]
+		if e.at > now-c.window {
+			break
+		}
+		// the id may have been added again later
+		if c.seen[e.key] == e.at {
+			delete(c.seen, e.key)
+		}
+	}
+	if i > 0 {
+		c.queue = append(c.queue[:0], c.queue[i:]...)
+	}
+}
+
+// Len number of ids remembered
+func (c *ClientOrderIDs) Len() int {
+	return len(c.seen)
+}
@@ -0,0 +1,33 @@
+package bank_test
+
+import (
+	"ccoms/pkg/bank"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientOrderIDs(t *testing.T) {
+	c := bank.NewClientOrderIDs(time.Minute)
+	now := time.Now().UnixNano()
+	min := int64(time.Minute)
+
+	c.Add(1, "a", now)
+	c.Add(2, "a", now+1)
+	require.True(t, c.Has(1, "a", now+10))
+	require.True(t, c.Has(2, "a", now+10))
+	require.False(t, c.Has(1, "b", now+10))
+	require.False(t, c.Has(3, "a", now+10))
+
+	// reused after the window, the later one is kept when the first expires
+	require.False(t, c.Has(1, "a", now+min))
+	require.True(t, c.Has(2, "a", now+min))
+	c.Add(1, "a", now+min)
+	require.False(t, c.Has(2, "a", now+min+1))
+	require.True(t, c.Has(1, "a", now+min+1))
+	require.Equal(t, 1, c.Len())
+
+	c.Expire(now + 2*min)
+	require.Equal(t, 0, c.Len())
+}
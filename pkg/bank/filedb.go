@@ -1,18 +1,25 @@
 package bank
 
 import (
-	"encoding/json"
 	"strings"
 
+	"ccoms/pkg/config"
+	"ccoms/pkg/filedb"
 	"ccoms/pkg/model"
 
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // FiledbToMySQL retrieves the content of filedb in real-time and writes it to MySQL
 func (w *Worker) FiledbToMySQL() (err error) {
-	ch := make(chan string, 1000)
+	ch := make(chan filedb.Record[BankLog], 1000)
+
+	err = model.MigrateCoin(model.GetMySQL(), w.Coin)
+	if err != nil {
+		return
+	}
 
 	w.SavedLogID, err = w.LoadSavedLogID()
 	if err != nil {
@@ -24,15 +31,22 @@ func (w *Worker) FiledbToMySQL() (err error) {
 	if err != nil {
 		return
 	}
+	_, err = w.CheckoutLastKv("", model.LASTKV_K_SAVED_LOG_ID)
+	if err != nil {
+		return
+	}
 
 	go func() {
-		err = w.fdb.Tailf(ch)
+		err = filedb.Iterate(w.fdb, filedb.IterOptions{From: w.SavedLogID + 1, Follow: true}, func(r filedb.Record[BankLog]) error {
+			ch <- r
+			return nil
+		})
 		if err != nil {
 			close(ch)
 		}
 	}()
 
-	err2 := w.fdb.ToMySQL(ch)
+	err2 := filedb.ToMySQL(w.fdb, ch, w.ParseAndWriteLogs)
 	if err == nil {
 		err = err2
 	}
@@ -41,36 +55,25 @@ func (w *Worker) FiledbToMySQL() (err error) {
 }
 
 // ParseAndWriteLogs parses and writes logs to MySQL
-func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
+func (w *Worker) ParseAndWriteLogs(rs []filedb.Record[BankLog]) (err error) {
 	latestLogID := 0
 	latestMsgSeq := int64(0)
 
 	newTicketsMap := make(map[string][]model.Ticket, 0)
 	newBalanceSnaps := make([]model.BalanceSnap, 0)
 	updateBalances := make(map[int64]*model.Balance)
+	newRejects := make([]model.OrderReject, 0)
+	omeReasonIDs := make(map[string]int64) // symbol -> the latest balance change pushed by its ome
 
-	// ----- Parse the last log, if the latest log ID is less than or equal to the saved log ID, skip it
-	ol := new(BankLog)
-	err = json.Unmarshal([]byte(ss[len(ss)-1]), ol)
-	if err != nil {
-		logger.Errorf("ParseAndWriteLogs failed with data:%s, err:%s", ss[len(ss)-1], err)
-		return
-	}
-	if ol.LogID <= w.SavedLogID {
-		// The latest log ID is less than or equal to the saved log ID, skip it
-		logger.Debugf("ParseAndWriteLogs skip latestLogID:%d <= saveLogID:%d", ol.LogID, w.SavedLogID)
+	// ----- If the latest log ID is less than or equal to the saved log ID, skip them all
+	if last := rs[len(rs)-1].LogID; last <= w.SavedLogID {
+		logger.Debugf("ParseAndWriteLogs skip latestLogID:%d <= saveLogID:%d", last, w.SavedLogID)
 		return
 	}
 
-	// ----- Parse all logs and cache them as variables for further processing
-	for _, s := range ss {
-		ol := new(BankLog)
-		err = json.Unmarshal([]byte(s), ol)
-		if err != nil {
-			// TODO When concurrency is high, incomplete logs may sometimes appear here
-			logger.Errorf("Unmarshal BankLog failed with data:%s, err:%s", s, err)
-			return
-		}
+	// ----- Go through all logs and cache them as variables for further processing
+	for _, r := range rs {
+		ol := r.Log
 
 		// if ol.LogID != int64(ol.MsgSeq) {
 		// 	fmt.Println("=====", s)
@@ -83,6 +86,15 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			continue
 		}
 
+		// ----- Let the owners know, before the log is saved so that nothing is lost on failures
+		if config.Shared.OrderEvents.Enabled {
+			err = w.PublishOrderEvents(ol)
+			if err != nil {
+				logger.Errorf("PublishOrderEvents failed with logID:%d, err:%s", ol.LogID, err)
+				return
+			}
+		}
+
 		// ----- Update the latest message sequence number
 		if int64(ol.MsgSeq) > latestMsgSeq {
 			latestMsgSeq = int64(ol.MsgSeq)
@@ -96,17 +108,31 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			price, _ := decimal.NewFromString(ml.Price)
 			quantity, _ := decimal.NewFromString(ml.Quantity)
 			amount, _ := decimal.NewFromString(ml.Amount)
+			stopPrice, _ := decimal.NewFromString(ml.StopPrice)
+			displayQty, _ := decimal.NewFromString(ml.DisplayQty)
 
 			// create ticket
 			logIndex++
 			ticket := model.Ticket{
-				LogType:  1,
-				LogID:    ol.LogID,
-				LogIndex: logIndex,
-				Price:    price,
-				Quantity: quantity,
-				Amount:   amount,
-				// Time:     ml.Time, // TODO
+				ID:          ml.ID,
+				LogType:     1,
+				LogID:       ol.LogID,
+				LogIndex:    logIndex,
+				Owner:       ml.Owner,
+				Type:        ml.Type,
+				TimeInForce: ml.TimeInForce,
+				Action:      ml.Action,
+				OrderID:     ml.OrderID,
+				Price:       price,
+				Quantity:    quantity,
+				Amount:      amount,
+				Time:        ml.Time,
+
+				ClientOrderID:       ml.ClientOrderID,
+				SelfTradePrevention: ml.SelfTradePrevention,
+				StopPrice:           stopPrice,
+				DisplayQty:          displayQty,
+				ExpireAt:            ml.ExpireAt,
 			}
 
 			if _, ok := newTicketsMap[ml.Symbol]; !ok {
@@ -140,6 +166,9 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 				Free:   balSnap.FreeNew,
 				Freeze: balSnap.FreezeNew,
 			}
+			if symbol := omeReasonSymbol(ml.ReasonTable); symbol != "" {
+				omeReasonIDs[symbol] = ml.ReasonID
+			}
 
 			if ml.Owner2 > 0 {
 				freeChange, _ := decimal.NewFromString(ml.FreeChange2)
@@ -165,13 +194,61 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 					Freeze: balSnap.FreezeNew,
 				}
 			}
+
+			if ml.Owner3 > 0 {
+				freeChange, _ := decimal.NewFromString(ml.FreeChange3)
+				freezeChange, _ := decimal.NewFromString(ml.FreezeChange3)
+				freeNew, _ := decimal.NewFromString(ml.FreeNew3)
+				freezeNew, _ := decimal.NewFromString(ml.FreezeNew3)
+
+				// create balSnap
+				logIndex++
+				balSnap := model.BalanceSnap{
+					LogType:      1,
+					LogID:        ol.LogID,
+					LogIndex:     logIndex,
+					Owner:        ml.Owner3,
+					FreeChange:   freeChange,
+					FreezeChange: freezeChange,
+					FreeNew:      freeNew,
+					FreezeNew:    freezeNew,
+				}
+				newBalanceSnaps = append(newBalanceSnaps, balSnap)
+				updateBalances[balSnap.Owner] = &model.Balance{
+					Free:   balSnap.FreeNew,
+					Freeze: balSnap.FreezeNew,
+				}
+			}
+		}
+
+		// reject log
+		for _, rl := range ol.RejectLogs {
+			required, _ := decimal.NewFromString(rl.Required)
+			free, _ := decimal.NewFromString(rl.Free)
+
+			logIndex++
+			newRejects = append(newRejects, model.OrderReject{
+				LogType:  1,
+				LogID:    ol.LogID,
+				LogIndex: logIndex,
+				MsgSeq:   ol.MsgSeq,
+				Owner:    rl.Owner,
+				Symbol:   rl.Symbol,
+				Side:     rl.Side,
+				Reason:   rl.Reason,
+				Time:     rl.Time,
+				Required: required,
+				Free:     free,
+
+				ClientOrderID: rl.ClientOrderID,
+			})
 		}
 
 		latestLogID = int(ol.LogID)
 	}
 
-	// ----- If there are no new balance snapshots, skip it
-	if len(newBalanceSnaps) == 0 {
+	// ----- If there are no new balance snapshots, tickets (cancel tickets have no balance logs) and rejects, skip it
+	if len(newBalanceSnaps) == 0 && len(newTicketsMap) == 0 && len(newRejects) == 0 {
 		logger.Debugf("ParseAndWriteLogs skip because no newBalanceSnaps with latestLogID:%d, saveLogID:%d", latestLogID, w.SavedLogID)
 		return
 	}
@@ -209,6 +286,15 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 		"WHERE `owner` IN (" + sql4 + ") and `coin`=?;"
 
 	db := model.GetMySQLSlience()
+
+	// a symbol listed since the bank started
+	for symbol := range newTicketsMap {
+		err = model.MigrateSymbol(db, symbol)
+		if err != nil {
+			return
+		}
+	}
+
 	err = db.Transaction(func(tx *gorm.DB) (err error) {
 		// upsert lastkv
 		if latestMsgSeq > 0 {
@@ -225,6 +311,31 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			}
 		}
 
+		// where each ome resumes pushing balance changes after a restart, see BalanceChanges
+		for symbol, reasonID := range omeReasonIDs {
+			err = tx.Model(model.Lastkv{}).
+				Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "app"}, {Name: "key"}},
+					DoUpdates: clause.AssignmentColumns([]string{"val"}),
+				}).
+				Create(&model.Lastkv{
+					App: strings.ToLower(w.Name),
+					Key: model.LASTKV_K_OME_REASONID + strings.ToLower(symbol),
+					Val: reasonID,
+				}).Error
+			if err != nil {
+				return
+			}
+		}
+
+		// the last log may have no balance snaps, so savedLogID is also kept in lastkv
+		err = tx.Model(model.Lastkv{}).
+			Where("`app`=? and `key`=? and `val`<?", strings.ToLower(w.Name), model.LASTKV_K_SAVED_LOG_ID, latestLogID).
+			Limit(1).Update("`val`", latestLogID).Error
+		if err != nil {
+			return
+		}
+
 		// create balanceSnaps
 		if len(newBalanceSnaps) > 0 {
 			err = tx.Scopes(model.BalanceSnapTable(w.Coin)).CreateInBatches(newBalanceSnaps, len(newBalanceSnaps)).Error
@@ -233,6 +344,14 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			}
 		}
 
+		// create rejects
+		if len(newRejects) > 0 {
+			err = tx.Scopes(model.OrderRejectTable(w.Coin)).CreateInBatches(newRejects, len(newRejects)).Error
+			if err != nil {
+				return
+			}
+		}
+
 		// create tickets
 		for symbol, newTickets := range newTicketsMap {
 			if len(newTickets) > 0 {
@@ -1,10 +1,10 @@
 package bank
 
 import (
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/replica"
 	"ccoms/pkg/xetcd"
 	"ccoms/pkg/xgrpc"
-	"context"
-	"encoding/json"
 	"io"
 	"net"
 	"strings"
@@ -48,15 +48,8 @@ func (s *BankServiceServer) BalanceChanges(stream xgrpc.BankService_BalanceChang
 
 // Tickets pushes new tickets to ome
 func (s *BankServiceServer) Tickets(id *xgrpc.ID, stream xgrpc.BankService_TicketsServer) (err error) {
-	ch := make(chan string, 1024)
-	ctx := context.Background()
-
-	var push = func(s string) (err error) {
-		var bl BankLog
-		err = json.Unmarshal([]byte(s), &bl)
-		if err != nil {
-			return
-		}
+	var push = func(r filedb.Record[BankLog]) (err error) {
+		bl := r.Log
 		if len(bl.TicketLogs) == 0 {
 			return
 		}
@@ -65,13 +58,25 @@ func (s *BankServiceServer) Tickets(id *xgrpc.ID, stream xgrpc.BankService_Ticke
 				continue
 			}
 			err = stream.Send(&xgrpc.Ticket{
-				Id:       tl.ID,
-				Time:     0,
-				Owner:    tl.Owner,
-				Side:     int64(tl.Side),
-				Type:     int64(tl.Type),
-				Price:    tl.Price,
-				Quantity: tl.Quantity,
+				Id:          tl.ID,
+				Time:        0,
+				Owner:       tl.Owner,
+				Side:        int64(tl.Side),
+				Type:        int64(tl.Type),
+				Price:       tl.Price,
+				Quantity:    tl.Quantity,
+				Amount:      tl.Amount,
+				TimeInForce: int64(tl.TimeInForce),
+				Frozen:      tl.Frozen,
+				Action:      int64(tl.Action),
+				OrderID:     tl.OrderID,
+
+				ClientOrderID:       tl.ClientOrderID,
+				SelfTradePrevention: int64(tl.SelfTradePrevention),
+				StopPrice:           tl.StopPrice,
+				DisplayQty:          tl.DisplayQty,
+				ExpireAt:            tl.ExpireAt,
+				Reserve:             tl.Reserve,
 			})
 			if err != nil {
 				return
@@ -80,43 +85,22 @@ func (s *BankServiceServer) Tickets(id *xgrpc.ID, stream xgrpc.BankService_Ticke
 		return
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case s := <-ch:
-				l := len(s)
-				if l > 50 {
-					l = 50
-				}
-				logger.Tracef("pushing ticket '%s'", s[0:l])
-				err = push(s)
-				if err != nil {
-					return
-				}
-			}
-		}
-	}()
-
 	logger.Infof("tailing filedb")
 
-	// TODO starting from the latest id would be more efficient
-	err = s.w.fdb.Tailf(ch)
-	if err != nil {
-		close(ch)
-		return
-	}
-
-	return
+	// the request has no symbol, start from the earliest log of the tickets after id of any symbol,
+	// a failed send ends the stream
+	return filedb.Iterate(s.w.fdb, filedb.IterOptions{From: s.w.TicketMarks.MinLogID(id.Id), Follow: true}, push)
 }
 
 // StartServe starts the grpc service
 func (w *Worker) ServeGrpc() (err error) {
-	// TODO should retry if etcd get failed
-	grpcUrl, err := xetcd.Get(xetcd.KeyBankService(w.Coin))
-	if err != nil {
-		return
+	grpcUrl := w.Addr
+	if grpcUrl == "" {
+		// TODO should retry if etcd get failed
+		grpcUrl, err = xetcd.Get(xetcd.KeyBankService(w.Coin))
+		if err != nil {
+			return
+		}
 	}
 
 	ss := strings.Split(grpcUrl, ":")
@@ -125,12 +109,24 @@ func (w *Worker) ServeGrpc() (err error) {
 	grpcServer := grpc.NewServer()
 	srv := &BankServiceServer{w: w}
 	xgrpc.RegisterBankServiceServer(grpcServer, srv)
+	xgrpc.RegisterReplicaServiceServer(grpcServer, replica.NewServer[BankLog](w.fdb))
 
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return
 	}
 
+	// the ome finds this bank here, and reconnects once it is gone, see xetcd.Changed
+	if w.Addr != "" {
+		var r *xetcd.Registration
+		r, err = xetcd.Register(xetcd.KeyBankService(w.Coin), w.Addr)
+		if err != nil {
+			lis.Close()
+			return
+		}
+		defer r.Deregister()
+	}
+
 	logger.Infof("grpc server listening %s", addr)
 
 	err = grpcServer.Serve(lis)
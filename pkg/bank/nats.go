@@ -1,9 +1,14 @@
 package bank
 
 import (
+	"ccoms/pkg/model"
 	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xnats"
+	"fmt"
+	"strings"
 
 	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
 )
 
 // SubNats subscribes to messages from ingress via NATS
@@ -44,3 +49,93 @@ func (w *Worker) SubNats() (err error) {
 		w.ch <- BankMsg{N: m}
 	}
 }
+
+// GetNats returns the JetStream context of the NATS server of this bank, used to publish order events
+func (w *Worker) GetNats() (js nats.JetStreamContext, err error) {
+	if w.js != nil {
+		return w.js, nil
+	}
+
+	natsUrl, err := xetcd.Get(xetcd.KeyNatsService(w.Coin))
+	if err != nil {
+		return
+	}
+
+	// Connect to NATS
+	nc, err := nats.Connect(natsUrl)
+	if err != nil {
+		return
+	}
+
+	// Create JetStream Context
+	js, err = nc.JetStream(nats.PublishAsyncMaxPending(256))
+	if err != nil {
+		return
+	}
+	w.js = js
+
+	return
+}
+
+// OrderEventsOf returns the order events of the log: accepted for new tickets, rejected for rejections
+//
+//	cancel tickets have no event here, ome reports the outcome
+func (w *Worker) OrderEventsOf(bl *BankLog) (events []xnats.OrderEvent) {
+	for _, tl := range bl.TicketLogs {
+		if tl.Action != model.TicketActionCreate {
+			continue
+		}
+		price, _ := decimal.NewFromString(tl.Price)
+		quantity, _ := decimal.NewFromString(tl.Quantity)
+		events = append(events, xnats.OrderEvent{
+			Type:          xnats.OrderEventAccepted,
+			ClientOrderID: tl.ClientOrderID,
+			Owner:         tl.Owner,
+			Symbol:        tl.Symbol,
+			Side:          tl.Side,
+			MsgSeq:        bl.MsgSeq,
+			TicketID:      tl.ID,
+			Price:         price,
+			Remaining:     quantity,
+			Time:          bl.Ts,
+		})
+	}
+
+	for _, rl := range bl.RejectLogs {
+		events = append(events, xnats.OrderEvent{
+			Type:          xnats.OrderEventRejected,
+			ClientOrderID: rl.ClientOrderID,
+			Owner:         rl.Owner,
+			Symbol:        rl.Symbol,
+			Side:          rl.Side,
+			MsgSeq:        bl.MsgSeq,
+			Reason:        rl.Reason,
+			Time:          bl.Ts,
+		})
+	}
+
+	return
+}
+
+// PublishOrderEvents publishes the order events of the log, called by the writer before the log is saved,
+// so events may be published more than once across restarts, the msg id lets NATS drop the duplicates
+func (w *Worker) PublishOrderEvents(bl *BankLog) (err error) {
+	events := w.OrderEventsOf(bl)
+	if len(events) == 0 {
+		return
+	}
+
+	js, err := w.GetNats()
+	if err != nil {
+		return
+	}
+
+	for i, ev := range events {
+		err = xnats.PublishOrderEvent(js, fmt.Sprintf("%s:%d:%d", strings.ToLower(w.Name), bl.LogID, i), ev)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
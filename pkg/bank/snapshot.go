@@ -0,0 +1,395 @@
+package bank
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccoms/pkg/config"
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/model"
+	"ccoms/pkg/replica"
+
+	"github.com/shopspring/decimal"
+)
+
+// Snapshot the state of the bank right after the log LogID, encoded with gob
+//
+//	a restart loads the latest one and replays the filedb logs after it, see LoadSnapshot and ReplayLogs
+type Snapshot struct {
+	LogID        int64
+	LatestMsgSeq uint64
+
+	TicketIDs    map[string]int64 // symbol -> ticket id
+	OmeReasonIDs map[string]int64 // ome reason table -> reason id
+	Assets       map[int64]UserAsset
+
+	ClientOrderIDs []ClientOrderID // in the order of acceptance
+	TicketMarks    map[string][]TicketMark
+}
+
+// ClientOrderID a client order id accepted at At (nanoseconds), see ClientOrderIDs
+type ClientOrderID struct {
+	Owner int64
+	ID    string
+	At    int64
+}
+
+// Snapshot copies the state of the bank
+func (w *Worker) Snapshot() Snapshot {
+	s := Snapshot{
+		LogID:        w.LogID,
+		LatestMsgSeq: w.LatestMsgSeq,
+
+		TicketIDs:    make(map[string]int64, len(w.TicketIDs)),
+		OmeReasonIDs: make(map[string]int64, len(w.OmeReasonIDs)),
+		Assets:       make(map[int64]UserAsset, len(w.Assets)),
+	}
+	for k, v := range w.TicketIDs {
+		s.TicketIDs[k] = v
+	}
+	for k, v := range w.OmeReasonIDs {
+		s.OmeReasonIDs[k] = v
+	}
+	for k, v := range w.Assets {
+		s.Assets[k] = *v
+	}
+	for _, e := range w.ClientOrderIDs.queue {
+		// replaced by a later one
+		if w.ClientOrderIDs.seen[e.key] == e.at {
+			s.ClientOrderIDs = append(s.ClientOrderIDs, ClientOrderID{Owner: e.key.Owner, ID: e.key.ID, At: e.at})
+		}
+	}
+	s.TicketMarks = w.TicketMarks.All()
+
+	return s
+}
+
+// MaybeSnapshot write a snapshot in the background once config.Snapshot.Interval logs are written since the last one,
+// it is skipped while the previous one is still being written
+func (w *Worker) MaybeSnapshot() {
+	cfg := config.Shared.Snapshot
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 10000
+	}
+	if !cfg.Enabled || w.LogID-w.SnapshotLogID < interval {
+		return
+	}
+	if !w.snapshotting.CompareAndSwap(false, true) {
+		return
+	}
+
+	s := w.Snapshot()
+	w.SnapshotLogID = s.LogID
+	go func() {
+		defer w.snapshotting.Store(false)
+		err := w.WriteSnapshot(s)
+		if err != nil {
+			logger.Errorf("WriteSnapshot failed with logID:%d, err:%s", s.LogID, err)
+			return
+		}
+		w.RetainLogs(s.LogID)
+	}()
+}
+
+// RetainLogs remove or archive the filedb segments saved to mysql, covered by the snapshot of snapshotLogID
+// holding no ticket the omes have not saved and replicated by the standby, as config.Filedb.Retention says
+func (w *Worker) RetainLogs(snapshotLogID int64) (err error) {
+	archiveDir := ""
+	switch config.Shared.Filedb.Retention {
+	case config.RetentionDelete:
+	case config.RetentionArchive:
+		archiveDir = path.Join(config.Shared.DataDir, "archive")
+	default:
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			logger.Errorf("RetainLogs failed with snapshotLogID:%d, err:%s", snapshotLogID, err)
+		}
+	}()
+
+	savedLogID, err := w.LoadSavedLogID()
+	if err != nil {
+		return
+	}
+	logID := min(savedLogID, snapshotLogID)
+	for _, symbol := range w.TicketMarks.Symbols() {
+		var ticketID int64
+		ticketID, err = w.LoadOmeTicketID(symbol)
+		if err != nil {
+			return
+		}
+		logID = min(logID, w.TicketMarks.LogID(symbol, ticketID))
+	}
+	// the standby replicates from the segments too
+	standbyLogID, ok, err := replica.StandbyLogID(w.Name)
+	if err != nil {
+		return
+	}
+	if ok {
+		logID = min(logID, standbyLogID)
+	}
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	segments, err := f.Retain(logID, archiveDir)
+	if err != nil {
+		return
+	}
+	for _, seg := range segments {
+		logger.Infof("RetainLogs %s the segment %s with logs:%d-%d", config.Shared.Filedb.Retention, seg.File, seg.FirstLogID, seg.LastLogID)
+	}
+
+	return
+}
+
+// SnapshotPath returns the file of the snapshot taken after the log logID
+func (w *Worker) SnapshotPath(logID int64) string {
+	return path.Join(config.Shared.DataDir, "snapshot", fmt.Sprintf("%s-%d.snap", strings.ToLower(w.Name), logID))
+}
+
+// SnapshotLogIDs returns the logIDs of the snapshots on disk, the latest first
+func (w *Worker) SnapshotLogIDs() (ids []int64, err error) {
+	entries, err := os.ReadDir(path.Join(config.Shared.DataDir, "snapshot"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	prefix := strings.ToLower(w.Name) + "-"
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".snap") {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".snap"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	return
+}
+
+// WriteSnapshot write the snapshot to a temporary file and move it into place, then remove the old ones beyond config.Snapshot.Keep
+func (w *Worker) WriteSnapshot(s Snapshot) (err error) {
+	p := w.SnapshotPath(s.LogID)
+	err = os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(path.Dir(p), path.Base(p)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	err = gob.NewEncoder(bw).Encode(s)
+	if err != nil {
+		return
+	}
+	err = bw.Flush()
+	if err != nil {
+		return
+	}
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		return
+	}
+	logger.Infof("WriteSnapshot done with logID:%d, assets:%d", s.LogID, len(s.Assets))
+
+	keep := config.Shared.Snapshot.Keep
+	if keep <= 0 {
+		keep = 3
+	}
+	ids, err := w.SnapshotLogIDs()
+	if err != nil {
+		return
+	}
+	for i := keep; i < len(ids); i++ {
+		err = os.Remove(w.SnapshotPath(ids[i]))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// LoadSnapshot restore the state from the latest snapshot, or start from scratch if there is none,
+// the logs after it are applied by ReplayLogs
+func (w *Worker) LoadSnapshot() (err error) {
+	defer func() {
+		if err != nil {
+			logger.Errorf("LoadSnapshot failed with err:%s", err)
+		} else {
+			logger.Infof("LoadSnapshot done with logID:%d, latestMsgSeq:%d, assets:%d", w.LogID, w.LatestMsgSeq, len(w.Assets))
+		}
+	}()
+
+	var s Snapshot
+	ids, err := w.SnapshotLogIDs()
+	if err != nil {
+		return
+	}
+	if len(ids) > 0 {
+		var f *os.File
+		f, err = os.Open(w.SnapshotPath(ids[0]))
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		err = gob.NewDecoder(bufio.NewReader(f)).Decode(&s)
+		if err != nil {
+			return
+		}
+	}
+
+	// New has read them from the last log
+	w.LogID = s.LogID
+	w.SnapshotLogID = s.LogID
+	w.LatestMsgSeq = s.LatestMsgSeq
+
+	for k, v := range s.TicketIDs {
+		w.TicketIDs[k] = v
+	}
+	for k, v := range s.OmeReasonIDs {
+		w.OmeReasonIDs[k] = v
+	}
+	for k, v := range s.Assets {
+		ua := v
+		w.Assets[k] = &ua
+	}
+	for _, c := range s.ClientOrderIDs {
+		w.ClientOrderIDs.Add(c.Owner, c.ID, c.At)
+	}
+	for symbol, marks := range s.TicketMarks {
+		for _, m := range marks {
+			w.TicketMarks.Add(symbol, m.TicketID, m.LogID)
+		}
+	}
+
+	return
+}
+
+// ReplayLogs apply the filedb logs after w.LogID to the state, the logs must follow each other without a gap
+func (w *Worker) ReplayLogs() (err error) {
+	from := w.LogID
+	defer func() {
+		if err != nil {
+			logger.Errorf("ReplayLogs failed with logID:%d, err:%s", w.LogID, err)
+		} else {
+			logger.Infof("ReplayLogs done with logs:%d, logID:%d, ticketIDs:%v, omeReasonIDs:%+v",
+				w.LogID-from, w.LogID, w.TicketIDs, w.OmeReasonIDs)
+		}
+	}()
+
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+
+	err = filedb.Iterate(f, filedb.IterOptions{From: w.LogID + 1}, func(r filedb.Record[BankLog]) (err error) {
+		if r.LogID != w.LogID+1 {
+			return fmt.Errorf("log id is not continuous, expected:%d, got:%d", w.LogID+1, r.LogID)
+		}
+
+		return w.ApplyLog(r.Log)
+	})
+	if err != nil {
+		return
+	}
+
+	w.ClientOrderIDs.Expire(time.Now().UnixNano())
+	return
+}
+
+// ApplyLog change the state as the bank did when it wrote the log, the balance logs carry the new balances
+func (w *Worker) ApplyLog(bl *BankLog) (err error) {
+	w.LogID = bl.LogID
+	w.LatestMsgSeq = max(w.LatestMsgSeq, bl.MsgSeq)
+
+	for _, tl := range bl.TicketLogs {
+		w.TicketIDs[tl.Symbol] = max(w.TicketIDs[tl.Symbol], tl.ID)
+		w.TicketMarks.Add(tl.Symbol, tl.ID, bl.LogID)
+		if tl.Action == model.TicketActionCreate && tl.ClientOrderID != "" {
+			w.ClientOrderIDs.Add(tl.Owner, tl.ClientOrderID, bl.Ts)
+		}
+	}
+
+	set := func(owner int64, free, freeze string) (err error) {
+		ua := w.CheckoutAsset(owner)
+		ua.Free, err = decimal.NewFromString(free)
+		if err != nil {
+			return
+		}
+		ua.Freeze, err = decimal.NewFromString(freeze)
+		return
+	}
+	for _, l := range bl.BalanceLogs {
+		err = set(l.Owner, l.FreeNew, l.FreezeNew)
+		if err != nil {
+			return
+		}
+		if l.Owner2 > 0 {
+			err = set(l.Owner2, l.FreeNew2, l.FreezeNew2)
+			if err != nil {
+				return
+			}
+		}
+		if l.Owner3 > 0 {
+			err = set(l.Owner3, l.FreeNew3, l.FreezeNew3)
+			if err != nil {
+				return
+			}
+		}
+		if omeReasonSymbol(l.ReasonTable) != "" {
+			w.OmeReasonIDs[l.ReasonTable] = l.ReasonID
+		}
+	}
+
+	return
+}
+
+// omeReasonTable the reason table of the balance changes pushed by the ome of the symbol, see HandleBalanceChange
+func omeReasonTable(symbol string) string {
+	return "ome_" + strings.ToLower(symbol) + "_logs"
+}
+
+// omeReasonSymbol the symbol of an ome reason table, "" for other reason tables
+func omeReasonSymbol(table string) string {
+	if !strings.HasPrefix(table, "ome_") || !strings.HasSuffix(table, "_logs") {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSuffix(strings.TrimPrefix(table, "ome_"), "_logs"))
+}
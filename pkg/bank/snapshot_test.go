@@ -0,0 +1,63 @@
+package bank_test
+
+import (
+	"ccoms/pkg/bank"
+	"ccoms/pkg/config"
+	"ccoms/pkg/model"
+	"ccoms/pkg/xgrpc"
+	"ccoms/pkg/xnats"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	config.Shared = &config.Config{DataDir: t.TempDir(), Snapshot: config.Snapshot{Enabled: true}}
+	listBTCUSDT()
+
+	w, err := bank.New("USDT")
+	require.Nil(t, err)
+
+	deposit := &xgrpc.BalanceChange{
+		Reason: "match", ReasonTable: "ome_btc_usdt_logs", ReasonID: 3,
+		Owner: 1, FreeChange: "100", FreezeChange: "0",
+		Owner2: 2, FreeChange2: "50", FreezeChange2: "0",
+	}
+	require.Nil(t, w.HandleBalanceChange(deposit))
+	order := xnats.OrderReq{
+		Symbol: "BTC_USDT", Owner: 1, Side: model.OrderSideBid, Type: model.OrderTypeLimit,
+		Price: decimal.NewFromInt(10), Quantity: decimal.NewFromInt(2), Amount: decimal.NewFromInt(20),
+		ClientOrderID: "a",
+	}
+	require.Nil(t, w.CreateOrder(1, order))
+
+	require.Nil(t, w.WriteSnapshot(w.Snapshot()))
+	snapLogID := w.LogID
+
+	order.Owner, order.ClientOrderID = 2, "b"
+	require.Nil(t, w.CreateOrder(2, order))
+	require.Nil(t, w.CancelOrder(3, xnats.CancelReq{Symbol: "BTC_USDT", Owner: 1, Side: model.OrderSideBid, OrderID: 1}))
+	require.Nil(t, w.HandleBalanceChange(&xgrpc.BalanceChange{
+		Reason: "cancel", ReasonTable: "ome_btc_usdt_logs", ReasonID: 7,
+		Owner: 1, FreeChange: "20", FreezeChange: "-20",
+	}))
+	// turned down, the balance is not enough
+	order.Amount = decimal.NewFromInt(1000)
+	require.Nil(t, w.CreateOrder(4, order))
+
+	w2, err := bank.New("USDT")
+	require.Nil(t, err)
+	require.Nil(t, w2.LoadSnapshot())
+	require.Equal(t, snapLogID, w2.LogID)
+	require.Equal(t, uint64(1), w2.LatestMsgSeq)
+	require.Nil(t, w2.ReplayLogs())
+	require.Equal(t, fmt.Sprint(w.Snapshot()), fmt.Sprint(w2.Snapshot()))
+	require.Equal(t, uint64(4), w2.LatestMsgSeq)
+	require.Equal(t, int64(7), w2.OmeReasonIDs["ome_btc_usdt_logs"])
+	require.Equal(t, "100", w2.Assets[1].Free.String())
+	require.Equal(t, "30", w2.Assets[2].Free.String())
+	require.True(t, w2.ClientOrderIDs.Has(2, "b", time.Now().UnixNano()))
+}
@@ -0,0 +1,145 @@
+package bank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"ccoms/pkg/config"
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/replica"
+	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xgrpc"
+)
+
+// RunStandby keeps a replica of the bank in step with the primary at xetcd.KeyBankService until Promote,
+// then takes over from the last replicated log as Run does
+//
+//	the state comes from the local snapshot and filedb first, a new standby replicates from the first log of the primary,
+//	it consumes nothing and writes nothing to mysql before it is promoted
+func (w *Worker) RunStandby() (err error) {
+	w.State = "LoadingSnapshot"
+	err = w.LoadSnapshot()
+	if err != nil {
+		return
+	}
+	err = w.ReplayLogs()
+	if err != nil {
+		return
+	}
+
+	w.State = "Replicating"
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-w.promoted
+		cancel()
+	}()
+	go w.ReplicaLag.Report(ctx, w.Name)
+
+	round := 0
+	for ctx.Err() == nil {
+		round++
+		logger.Infof("Replicate round:%d started", round)
+		err = w.Replicate(ctx)
+		if errors.Is(err, replica.ErrRetained) {
+			logger.Errorf("Replicate round:%d cannot go on, start the standby from a newer snapshot of the primary, err:%s", round, err)
+			return
+		}
+		if err != nil {
+			logger.Errorf("Replicate round:%d failed with err:%s", round, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+	logger.Infof("RunStandby promoted with logID:%d, latestMsgSeq:%d", w.LogID, w.LatestMsgSeq)
+
+	go w.StartWriter()
+	return w.work()
+}
+
+// RunElected runs as a standby of the leading bank of its coin until it is elected, then leads at the grpc address addr,
+// which ServeGrpc registers at xetcd.KeyBankService
+//
+//	the logs the old leader wrote after the last one replicated are not in the new leader,
+//	RunElected returns xetcd.ErrNotLeader once the lease may have expired, and the filedb takes no more writes from then on
+func (w *Worker) RunElected(addr string) (err error) {
+	w.Addr = addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- w.RunStandby()
+		cancel()
+	}()
+
+	var l *xetcd.Leadership
+	for {
+		l, err = xetcd.Campaign(ctx, xetcd.KeyBankLeader(w.Coin), addr, config.Shared.Election.TTL)
+		if err == nil {
+			break
+		}
+		select {
+		case err = <-done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	defer l.Resign()
+
+	w.fdb.SetFence(l.Fence)
+	w.Promote()
+
+	select {
+	case err = <-done:
+	case <-l.Done():
+		err = xetcd.ErrNotLeader
+	}
+	return
+}
+
+// Promote ends the replication of RunStandby, which then takes over as the primary
+func (w *Worker) Promote() {
+	w.promoteOnce.Do(func() {
+		close(w.promoted)
+	})
+}
+
+// Replicate appends the logs of the primary after w.LogID to the local filedb and applies them, until ctx is done
+func (w *Worker) Replicate(ctx context.Context) (err error) {
+	addr, err := xetcd.Get(xetcd.KeyBankService(w.Coin))
+	if err != nil {
+		return
+	}
+
+	return replica.Follow(ctx, addr, w.LogID, w.ReplicaLag, func(r *xgrpc.Record) (err error) {
+		bl := new(BankLog)
+		err = filedb.Unmarshal(r.Data, bl)
+		if err != nil {
+			return
+		}
+		if bl.LogID != w.LogID+1 {
+			return fmt.Errorf("log id is not continuous, expected:%d, got:%d", w.LogID+1, bl.LogID)
+		}
+
+		// in the codec of the local filedb
+		blb, err := w.fdb.Marshal(bl)
+		if err != nil {
+			return
+		}
+		err = w.fdb.Append(bl.LogID, string(blb)+"\n")
+		if err != nil {
+			return
+		}
+		err = w.ApplyLog(bl)
+		if err != nil {
+			return
+		}
+
+		w.MaybeSnapshot()
+		return
+	})
+}
@@ -27,6 +27,12 @@ type BankLog struct {
 
 	BalanceLogs []BalanceLog `json:"balances,omitempty"`
 	TicketLogs  []TicketLog  `json:"tickets,omitempty"`
+	RejectLogs  []RejectLog  `json:"rejects,omitempty"`
+}
+
+// GetLogID makes it a filedb.Log
+func (bl BankLog) GetLogID() int64 {
+	return bl.LogID
 }
 
 // BalanceLog  Balance log
@@ -50,6 +56,12 @@ type BalanceLog struct {
 	FreezeChange2 string `json:"freezeChange2,omitempty"`
 	FreeNew2      string `json:"freeNew2,omitempty"`
 	FreezeNew2    string `json:"freezeNew2,omitempty"`
+
+	Owner3        int64  `json:"owner3,omitempty"` // e.g. the fee collector of a trade
+	FreeChange3   string `json:"freeChange3,omitempty"`
+	FreezeChange3 string `json:"freezeChange3,omitempty"`
+	FreeNew3      string `json:"freeNew3,omitempty"`
+	FreezeNew3    string `json:"freezeNew3,omitempty"`
 }
 
 // TicketLog  Ticket log
@@ -68,6 +80,38 @@ type TicketLog struct {
 	Price    string `json:"price"`
 	Quantity string `json:"quantity"`
 	Amount   string `json:"amount"`
+	Frozen   string `json:"frozen,omitempty"` // funds frozen for this order, fee included
+
+	TimeInForce int8  `json:"timeInForce,omitempty"` // model.OrderTIFXxx
+	Action      int8  `json:"action,omitempty"`      // model.TicketActionXxx
+	OrderID     int64 `json:"orderID,omitempty"`     // target order of a cancel or amend ticket
+
+	ClientOrderID string `json:"clientOrderID,omitempty"`
+	Time          int64  `json:"time,omitempty"` // request time, in nanoseconds
+
+	SelfTradePrevention int8   `json:"selfTradePrevention,omitempty"` // model.OrderSTPXxx
+	StopPrice           string `json:"stopPrice,omitempty"`           // stop orders only
+	DisplayQty          string `json:"displayQty,omitempty"`          // iceberg orders only
+	ExpireAt            int64  `json:"expireAt,omitempty"`            // good-till-time orders only, unix seconds
+
+	Reserve string `json:"reserve,omitempty"` // amend tickets only, funds frozen on top of those the order holds
+}
+
+// RejectLog  An order request turned down, nothing else is changed
+type RejectLog struct {
+	LogIndex int64 `json:"logIndex"`
+
+	Reason string `json:"reason"` // model.OrderRejectReasonXxx
+
+	Owner    int64  `json:"owner"`
+	Symbol   string `json:"symbol"`
+	Side     int8   `json:"side"`
+	Coin     string `json:"coin"`
+	Required string `json:"required"` // funds the order needed to freeze, fee included
+	Free     string `json:"free"`     // available funds at the time
+	Time     int64  `json:"time"`     // order request time, in nanoseconds
+
+	ClientOrderID string `json:"clientOrderID,omitempty"`
 }
 
 var Exp = decimal.New(1, 12)
@@ -0,0 +1,92 @@
+package bank
+
+import (
+	"sort"
+	"sync"
+)
+
+// TicketMarkInterval tickets of a symbol between two marks, see TicketMarks
+const TicketMarkInterval = 1000
+
+// TicketMarks the logs of the tickets of each symbol, one every TicketMarkInterval tickets,
+// a Tickets stream starts from them instead of the first log, see Tickets and RetainLogs
+//
+//	they are kept in the snapshots and the logs after it add the rest, see ApplyLog
+type TicketMarks struct {
+	mu    sync.Mutex
+	marks map[string][]TicketMark // symbol -> in ticket order
+}
+
+// TicketMark the ticket TicketID of a symbol is in the log LogID
+type TicketMark struct {
+	TicketID int64
+	LogID    int64
+}
+
+func NewTicketMarks() *TicketMarks {
+	return &TicketMarks{
+		marks: map[string][]TicketMark{},
+	}
+}
+
+// Add marks the ticket if it is the first one of the symbol or TicketMarkInterval tickets after the latest mark
+func (m *TicketMarks) Add(symbol string, ticketID, logID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	marks := m.marks[symbol]
+	if len(marks) > 0 && ticketID-marks[len(marks)-1].TicketID < TicketMarkInterval {
+		return
+	}
+	m.marks[symbol] = append(marks, TicketMark{TicketID: ticketID, LogID: logID})
+}
+
+// LogID returns the log of the latest mark of the symbol at or before the ticket, 0 if there is none,
+// the tickets after ticketID are all in the logs after it
+func (m *TicketMarks) LogID(symbol string, ticketID int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	marks := m.marks[symbol]
+	i := sort.Search(len(marks), func(i int) bool { return marks[i].TicketID > ticketID })
+	if i == 0 {
+		return 0
+	}
+	return marks[i-1].LogID
+}
+
+// MinLogID returns the earliest LogID of the symbols, for a reader that does not say which symbol it follows
+func (m *TicketMarks) MinLogID(ticketID int64) (logID int64) {
+	for i, symbol := range m.Symbols() {
+		id := m.LogID(symbol, ticketID)
+		if i == 0 || id < logID {
+			logID = id
+		}
+	}
+	return
+}
+
+// Symbols returns the symbols having tickets
+func (m *TicketMarks) Symbols() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	symbols := make([]string, 0, len(m.marks))
+	for symbol := range m.marks {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// All returns a copy of the marks
+func (m *TicketMarks) All() map[string][]TicketMark {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	all := make(map[string][]TicketMark, len(m.marks))
+	for symbol, marks := range m.marks {
+		all[symbol] = append([]TicketMark(nil), marks...)
+	}
+	return all
+}
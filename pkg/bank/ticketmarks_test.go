@@ -0,0 +1,26 @@
+package bank_test
+
+import (
+	"ccoms/pkg/bank"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTicketMarks(t *testing.T) {
+	m := bank.NewTicketMarks()
+	for id := int64(1); id <= 2500; id++ {
+		m.Add("BTC_USDT", id, id*2) // a log of another symbol between two tickets
+		m.Add("ETH_USDT", id, id*2+1)
+	}
+
+	require.Equal(t, []bank.TicketMark{{1, 2}, {1001, 2002}, {2001, 4002}}, m.All()["BTC_USDT"])
+	require.Equal(t, int64(0), m.LogID("BTC_USDT", 0))
+	require.Equal(t, int64(2), m.LogID("BTC_USDT", 1000))
+	require.Equal(t, int64(2002), m.LogID("BTC_USDT", 1001))
+	require.Equal(t, int64(4002), m.LogID("BTC_USDT", 9999))
+	require.Equal(t, int64(0), m.LogID("XRP_USDT", 9999))
+
+	require.Equal(t, []string{"BTC_USDT", "ETH_USDT"}, m.Symbols())
+	require.Equal(t, int64(2002), m.MinLogID(1500))
+}
@@ -0,0 +1,190 @@
+// Package catalog keeps the coins and symbols listed in etcd, listing a new pair is putting its entries, no redeploy is needed.
+package catalog
+
+import (
+	"ccoms/pkg/xetcd"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The status of a coin or symbol
+const (
+	StatusTrading = "trading" // orders are taken
+	StatusHalted  = "halted"  // listed, but new orders are rejected, the cancels still go through
+)
+
+// Coin a coin listed, it has a bank
+type Coin struct {
+	Coin      string `json:"coin"`
+	Status    string `json:"status"`    // StatusXxx
+	Precision int32  `json:"precision"` // decimal places of its amounts
+}
+
+// Symbol a trading pair listed, it has an ome
+type Symbol struct {
+	Symbol            string `json:"symbol"` // Base_Quote, e.g. BTC_USDT
+	Base              string `json:"base"`
+	Quote             string `json:"quote"`
+	Status            string `json:"status"`            // StatusXxx
+	PricePrecision    int32  `json:"pricePrecision"`    // decimal places of the prices, in Quote
+	QuantityPrecision int32  `json:"quantityPrecision"` // decimal places of the quantities, in Base
+}
+
+// Trading returns whether the orders of the symbol are taken, as far as the symbol itself goes, see Registry.Trading
+func (s Symbol) Trading() bool {
+	return s.Status == StatusTrading
+}
+
+// Trading returns whether the orders of the symbols of the coin are taken, as far as the coin goes
+func (c Coin) Trading() bool {
+	return c.Status == StatusTrading
+}
+
+// Registry caches the entries read from etcd, see xetcd.Cache, the lists are always read from etcd
+type Registry struct {
+	cache *xetcd.Cache
+	list  func(prefix string) (map[string]string, error)
+	peek  bool // see Cached
+}
+
+// Shared the registry backed by xetcd
+var Shared = NewRegistry(5*time.Second, xetcd.Get, xetcd.GetPrefix)
+
+// NewRegistry returns a registry reading the entries with get, which returns xetcd.ErrNotFound for missing keys,
+// and the lists of them with list
+func NewRegistry(ttl time.Duration, get func(k string) (string, error), list func(prefix string) (map[string]string, error)) *Registry {
+	return &Registry{
+		cache: xetcd.NewCache("catalog", ttl, get),
+		list:  list,
+	}
+}
+
+// Cached returns the registry reading the entries only from the cache, it never waits for etcd for them, see xetcd.Cache.Peek,
+// they fail with xetcd.ErrNotCached until they are read the first time, e.g. by Registry.Trading
+func (r *Registry) Cached() *Registry {
+	return &Registry{cache: r.cache, list: r.list, peek: true}
+}
+
+func (r *Registry) value(k string) (v string, found bool, err error) {
+	if r.peek {
+		return r.cache.Peek(k)
+	}
+	return r.cache.Get(k)
+}
+
+// Symbol returns the listing of the symbol, found is false if it is not listed
+func (r *Registry) Symbol(symbol string) (s Symbol, found bool, err error) {
+	v, found, err := r.value(xetcd.KeyCatalogSymbol(symbol))
+	if err != nil || !found {
+		return
+	}
+	err = json.Unmarshal([]byte(v), &s)
+	return
+}
+
+// Coin returns the listing of the coin, found is false if it is not listed
+func (r *Registry) Coin(coin string) (c Coin, found bool, err error) {
+	v, found, err := r.value(xetcd.KeyCatalogCoin(coin))
+	if err != nil || !found {
+		return
+	}
+	err = json.Unmarshal([]byte(v), &c)
+	return
+}
+
+// Trading returns whether the orders of the symbol are taken, the symbol and both of its coins are listed and trading
+func (r *Registry) Trading(symbol string) (trading bool, err error) {
+	s, found, err := r.Symbol(symbol)
+	if err != nil || !found || !s.Trading() {
+		return
+	}
+	for _, coin := range []string{s.Base, s.Quote} {
+		var c Coin
+		c, found, err = r.Coin(coin)
+		if err != nil || !found || !c.Trading() {
+			return
+		}
+	}
+	return true, nil
+}
+
+// Symbols returns the symbols listed, by name
+func (r *Registry) Symbols() (symbols []Symbol, err error) {
+	kvs, err := r.list(xetcd.KeyCatalogSymbol(""))
+	if err != nil {
+		return
+	}
+	for k, v := range kvs {
+		var s Symbol
+		err = json.Unmarshal([]byte(v), &s)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", k, err)
+		}
+		symbols = append(symbols, s)
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].Symbol < symbols[j].Symbol })
+	return
+}
+
+// Coins returns the coins listed, by name
+func (r *Registry) Coins() (coins []Coin, err error) {
+	kvs, err := r.list(xetcd.KeyCatalogCoin(""))
+	if err != nil {
+		return
+	}
+	for k, v := range kvs {
+		var c Coin
+		err = json.Unmarshal([]byte(v), &c)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", k, err)
+		}
+		coins = append(coins, c)
+	}
+	sort.Slice(coins, func(i, j int) bool { return coins[i].Coin < coins[j].Coin })
+	return
+}
+
+// SymbolsOf returns the symbols listed whose base or quote is the coin, i.e. whose orders the bank of the coin holds funds for
+func (r *Registry) SymbolsOf(coin string) (symbols []Symbol, err error) {
+	all, err := r.Symbols()
+	if err != nil {
+		return
+	}
+	coin = strings.ToUpper(coin)
+	for _, s := range all {
+		if s.Base == coin || s.Quote == coin {
+			symbols = append(symbols, s)
+		}
+	}
+	return
+}
+
+// PutCoin lists the coin in etcd, or changes its listing
+func PutCoin(c Coin) (err error) {
+	c.Coin = strings.ToUpper(c.Coin)
+	if c.Coin == "" || strings.Contains(c.Coin, "_") {
+		return fmt.Errorf("invalid coin %q", c.Coin)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	return xetcd.Put(xetcd.KeyCatalogCoin(c.Coin), string(b))
+}
+
+// PutSymbol lists the symbol in etcd, or changes its listing, Symbol is derived from Base and Quote
+func PutSymbol(s Symbol) (err error) {
+	s.Base, s.Quote = strings.ToUpper(s.Base), strings.ToUpper(s.Quote)
+	if s.Base == "" || s.Quote == "" || s.Base == s.Quote {
+		return fmt.Errorf("invalid symbol %s_%s", s.Base, s.Quote)
+	}
+	s.Symbol = s.Base + "_" + s.Quote
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	return xetcd.Put(xetcd.KeyCatalogSymbol(s.Symbol), string(b))
+}
@@ -0,0 +1,98 @@
+package catalog_test
+
+import (
+	"ccoms/pkg/catalog"
+	"ccoms/pkg/xetcd"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	kvs := map[string]string{}
+	put := func(k string, v any) {
+		b, err := json.Marshal(v)
+		require.Nil(t, err)
+		kvs[k] = string(b)
+	}
+	put(xetcd.KeyCatalogCoin("BTC"), catalog.Coin{Coin: "BTC", Status: catalog.StatusTrading, Precision: 8})
+	put(xetcd.KeyCatalogCoin("USDT"), catalog.Coin{Coin: "USDT", Status: catalog.StatusTrading, Precision: 6})
+	put(xetcd.KeyCatalogSymbol("BTC_USDT"), catalog.Symbol{Symbol: "BTC_USDT", Base: "BTC", Quote: "USDT", Status: catalog.StatusTrading})
+	put(xetcd.KeyCatalogSymbol("ETH_BTC"), catalog.Symbol{Symbol: "ETH_BTC", Base: "ETH", Quote: "BTC", Status: catalog.StatusHalted})
+
+	down := false
+	get := func(k string) (string, error) {
+		if down {
+			return "", errors.New("etcd is down")
+		}
+		v, ok := kvs[k]
+		if !ok {
+			return "", xetcd.ErrNotFound
+		}
+		return v, nil
+	}
+	list := func(prefix string) (map[string]string, error) {
+		m := map[string]string{}
+		for k, v := range kvs {
+			if strings.HasPrefix(k, prefix) {
+				m[k] = v
+			}
+		}
+		return m, nil
+	}
+	r := catalog.NewRegistry(time.Nanosecond, get, list)
+
+	s, found, err := r.Symbol("btc_usdt")
+	require.Nil(t, err)
+	require.True(t, found)
+	require.True(t, s.Trading())
+	s, found, err = r.Symbol("ETH_BTC")
+	require.Nil(t, err)
+	require.True(t, found)
+	require.False(t, s.Trading())
+	_, found, err = r.Symbol("ETH_USDT")
+	require.Nil(t, err)
+	require.False(t, found)
+
+	// the bank of BTC holds the funds of both
+	symbols, err := r.SymbolsOf("btc")
+	require.Nil(t, err)
+	require.Len(t, symbols, 2)
+	require.Equal(t, "BTC_USDT", symbols[0].Symbol)
+	require.Equal(t, "ETH_BTC", symbols[1].Symbol)
+	symbols, err = r.SymbolsOf("USDT")
+	require.Nil(t, err)
+	require.Len(t, symbols, 1)
+
+	coins, err := r.Coins()
+	require.Nil(t, err)
+	require.Len(t, coins, 2)
+	require.Equal(t, "BTC", coins[0].Coin)
+	require.Equal(t, int32(8), coins[0].Precision)
+
+	trading, err := r.Trading("BTC_USDT")
+	require.Nil(t, err)
+	require.True(t, trading)
+	// a halted coin halts its symbols
+	put(xetcd.KeyCatalogCoin("BTC"), catalog.Coin{Coin: "BTC", Status: catalog.StatusHalted, Precision: 8})
+	trading, err = r.Trading("BTC_USDT")
+	require.Nil(t, err)
+	require.False(t, trading)
+
+	c, found, err := r.Coin("USDT")
+	require.Nil(t, err)
+	require.True(t, found)
+
+	// the cached entry is used while etcd is down
+	down = true
+	c, found, err = r.Coin("USDT")
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, int32(6), c.Precision)
+	_, _, err = r.Coin("ETH")
+	require.NotNil(t, err)
+}
@@ -21,6 +21,20 @@ type Config struct {
 	Redis Redis `yaml:"redis"`
 	Etcd  Etcd  `yaml:"etcd"`
 
+	Fee Fee `yaml:"fee"`
+
+	SelfTradePrevention map[string]int8 `yaml:"self_trade_prevention"` // symbol (e.g. BTC_USDT) -> model.OrderSTPXxx, trading with itself is allowed if missing
+
+	OrderEvents OrderEvents `yaml:"order_events"`
+
+	Bank Bank `yaml:"bank"`
+
+	Snapshot Snapshot `yaml:"snapshot"`
+
+	Filedb Filedb `yaml:"filedb"`
+
+	Election Election `yaml:"election"`
+
 	Env Env `yaml:"env"`
 
 	Sentry Sentry `yaml:"sentry"`
@@ -61,6 +75,51 @@ type EtcdServer struct {
 	Url    string `yaml:"url"`
 }
 
+// Fee trading fee rates, fees are charged in the coin each side pays and credited to the collector
+type Fee struct {
+	Collector int64   `yaml:"collector"`  // owner id of the fee collector account, no fees are charged if 0
+	MakerRate float64 `yaml:"maker_rate"` // e.g. 0.001
+	TakerRate float64 `yaml:"taker_rate"` // e.g. 0.002
+}
+
+// OrderEvents order lifecycle events published to NATS for ingress, see xnats.OrderEvent
+type OrderEvents struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type Bank struct {
+	ClientOrderIDWindow int64 `yaml:"client_order_id_window"` // seconds a client order id can not be used again by the same owner, 24h if 0
+}
+
+// Snapshot periodic binary snapshots of the in-memory state, a restart loads the latest one and replays the filedb logs after it
+type Snapshot struct {
+	Enabled  bool  `yaml:"enabled"`
+	Interval int64 `yaml:"interval"` // logs written between two snapshots, 10000 if 0
+	Keep     int   `yaml:"keep"`     // snapshots kept on disk, the older ones are removed, 3 if 0
+}
+
+// Election the leader election of the banks and omes started with -elect, see xetcd.Campaign
+type Election struct {
+	TTL int64 `yaml:"ttl"` // seconds the leader lease lasts without a keepalive, a standby takes over after it, 5 if 0
+}
+
+const (
+	RetentionDelete  = "delete"
+	RetentionArchive = "archive"
+)
+
+// Filedb how the filedb logs are split into segments, and what happens to the segments both saved to mysql and covered by a snapshot
+type Filedb struct {
+	SegmentSize int64  `yaml:"segment_size"` // bytes of a segment before a new one is started, no limit if 0
+	SegmentLogs int64  `yaml:"segment_logs"` // logs of a segment before a new one is started, no limit if 0
+	Retention   string `yaml:"retention"`    // RetentionDelete, RetentionArchive (moved to <data_dir>/archive), or kept if ""
+
+	Sync         string `yaml:"sync"`          // filedb.SyncPolicyNone (default), filedb.SyncPolicyInterval or filedb.SyncPolicyAlways
+	SyncInterval int64  `yaml:"sync_interval"` // milliseconds between two syncs of filedb.SyncPolicyInterval, 100 if 0
+
+	Codec string `yaml:"codec"` // filedb.CodecJSON (default) or filedb.CodecBinary for the new logs, both are read
+}
+
 type Env struct {
 	XlogMode  string `yaml:"xlog_mode"`
 	XlogColor bool   `yaml:"xlog_color"`
@@ -0,0 +1,319 @@
+package filedb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+)
+
+// The codecs of the records, see Marshal and Unmarshal
+//
+// a binary record is binaryVersion then the fields of the struct in the order they are declared, each one is a varint
+// of its number (index + 1) and wire type, then its value, like protobuf without a schema:
+//
+//	bool, intN, uintN   a varint, zigzag for the signed ones
+//	string, []byte      the length in a varint, then the bytes
+//	*big.Int            the length, a sign byte (1 for negative) and the big-endian magnitude, nil is left out but 0 is not
+//	struct, *struct     the length, then the fields of it
+//	[]T                 the field once per element
+//
+// zero fields are left out and unknown ones are skipped, so fields are only ever added at the end of a struct
+const (
+	CodecJSON   = "json"
+	CodecBinary = "binary"
+
+	// binaryVersion the first byte of a binary record, a JSON record starts with '{'
+	binaryVersion = 1
+
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errTruncated = errors.New("binary codec: truncated record")
+
+var bigIntType = reflect.TypeOf(big.Int{})
+
+// Marshal encodes the log with f.Codec, the active segment of the older format takes JSON only
+func (f *Filedb) Marshal(v any) (b []byte, err error) {
+	f.mu.Lock()
+	framed := f.framed
+	f.mu.Unlock()
+
+	if f.Codec == CodecBinary && framed {
+		return MarshalBinary(v)
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes a record of either codec into v, a pointer to a struct
+func Unmarshal(b []byte, v any) error {
+	if len(b) > 0 && b[0] == binaryVersion {
+		return UnmarshalBinary(b, v)
+	}
+	return json.Unmarshal(b, v)
+}
+
+// MarshalBinary encodes the struct v, or the struct it points to, in the binary codec
+func MarshalBinary(v any) (b []byte, err error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("binary codec: %T is not a struct", v)
+	}
+
+	b = make([]byte, 1, 256)
+	b[0] = binaryVersion
+	return appendStruct(b, rv)
+}
+
+// UnmarshalBinary decodes a binary record into v, a pointer to a struct
+func UnmarshalBinary(b []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("binary codec: %T is not a pointer to a struct", v)
+	}
+	if len(b) == 0 || b[0] != binaryVersion {
+		return errors.New("binary codec: unknown version")
+	}
+	return decodeStruct(b[1:], rv.Elem())
+}
+
+func appendStruct(b []byte, v reflect.Value) ([]byte, error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		var err error
+		b, err = appendField(b, uint64(i+1), v.Field(i), false)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), t.Field(i).Name, err)
+		}
+	}
+	return b, nil
+}
+
+// appendField appends the field num, an element of a slice (repeated) is written even if it is zero
+func appendField(b []byte, num uint64, v reflect.Value, repeated bool) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if !v.Bool() && !repeated {
+			return b, nil
+		}
+		x := uint64(0)
+		if v.Bool() {
+			x = 1
+		}
+		b = binary.AppendUvarint(b, num<<3|wireVarint)
+		return binary.AppendUvarint(b, x), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() == 0 && !repeated {
+			return b, nil
+		}
+		b = binary.AppendUvarint(b, num<<3|wireVarint)
+		return binary.AppendVarint(b, v.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() == 0 && !repeated {
+			return b, nil
+		}
+		b = binary.AppendUvarint(b, num<<3|wireVarint)
+		return binary.AppendUvarint(b, v.Uint()), nil
+
+	case reflect.String:
+		if v.Len() == 0 && !repeated {
+			return b, nil
+		}
+		b = binary.AppendUvarint(b, num<<3|wireBytes)
+		b = binary.AppendUvarint(b, uint64(v.Len()))
+		return append(b, v.String()...), nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() == 0 && !repeated {
+				return b, nil
+			}
+			b = binary.AppendUvarint(b, num<<3|wireBytes)
+			b = binary.AppendUvarint(b, uint64(v.Len()))
+			return append(b, v.Bytes()...), nil
+		}
+		if repeated {
+			return nil, errors.New("slices of slices are not supported")
+		}
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			b, err = appendField(b, num, v.Index(i), true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+
+	case reflect.Pointer:
+		if v.IsNil() {
+			if repeated {
+				return nil, errors.New("nil elements are not supported")
+			}
+			return b, nil
+		}
+		if v.Type().Elem() == bigIntType {
+			return appendBigInt(b, num, v.Interface().(*big.Int)), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return appendMessage(b, num, v.Elem(), true)
+		}
+
+	case reflect.Struct:
+		if v.Type() != bigIntType {
+			return appendMessage(b, num, v, repeated)
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not supported", v.Type())
+}
+
+func appendBigInt(b []byte, num uint64, x *big.Int) []byte {
+	n := (x.BitLen() + 7) / 8
+	sign := byte(0)
+	if x.Sign() < 0 {
+		sign = 1
+	}
+	b = binary.AppendUvarint(b, num<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(1+n))
+	b = append(b, sign)
+	b = append(b, make([]byte, n)...)
+	x.FillBytes(b[len(b)-n:])
+	return b
+}
+
+// appendMessage appends the struct v as a length-delimited field, an empty one is left out unless always
+func appendMessage(b []byte, num uint64, v reflect.Value, always bool) ([]byte, error) {
+	sub, err := appendStruct(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	if len(sub) == 0 && !always {
+		return b, nil
+	}
+	b = binary.AppendUvarint(b, num<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(sub)))
+	return append(b, sub...), nil
+}
+
+func decodeStruct(b []byte, v reflect.Value) error {
+	t := v.Type()
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+
+		var x uint64
+		var data []byte
+		wire := key & 7
+		switch wire {
+		case wireVarint:
+			x, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errTruncated
+			}
+			data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return fmt.Errorf("binary codec: unknown wire type %d in %s", wire, t.Name())
+		}
+
+		// a field of a later version of the struct
+		num := key >> 3
+		if num == 0 || num > uint64(t.NumField()) || !t.Field(int(num-1)).IsExported() {
+			continue
+		}
+		err := decodeField(v.Field(int(num-1)), wire, x, data)
+		if err != nil {
+			return fmt.Errorf("binary codec: %s.%s: %w", t.Name(), t.Field(int(num-1)).Name, err)
+		}
+	}
+	return nil
+}
+
+// decodeField sets v to the value x of a varint or data of a length-delimited field, a slice gets one more element
+func decodeField(v reflect.Value, wire, x uint64, data []byte) error {
+	want := uint64(wireBytes)
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		want = wireVarint
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			e := reflect.New(v.Type().Elem()).Elem()
+			err := decodeField(e, wire, x, data)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, e))
+			return nil
+		}
+	}
+	if wire != want {
+		return fmt.Errorf("wire type %d, expected %d", wire, want)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(x != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := int64(x>>1) ^ -int64(x&1)
+		if v.OverflowInt(i) {
+			return fmt.Errorf("%d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.OverflowUint(x) {
+			return fmt.Errorf("%d overflows %s", x, v.Type())
+		}
+		v.SetUint(x)
+	case reflect.String:
+		v.SetString(string(data))
+	case reflect.Slice:
+		v.SetBytes(append([]byte(nil), data...))
+	case reflect.Pointer:
+		if v.Type().Elem() == bigIntType {
+			if len(data) == 0 {
+				return errTruncated
+			}
+			i := new(big.Int).SetBytes(data[1:])
+			if data[0] == 1 {
+				i.Neg(i)
+			}
+			v.Set(reflect.ValueOf(i))
+			return nil
+		}
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return fmt.Errorf("%s is not supported", v.Type())
+		}
+		p := reflect.New(v.Type().Elem())
+		err := decodeStruct(data, p.Elem())
+		if err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Struct:
+		return decodeStruct(data, v)
+	default:
+		return fmt.Errorf("%s is not supported", v.Type())
+	}
+	return nil
+}
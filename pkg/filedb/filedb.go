@@ -1,24 +1,50 @@
 // Package filedb is a simple database based on files.
+//
+// The lines are split into segment files, see Segment, Append and Retain
 package filedb
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/nxadm/tail"
 )
 
 type Filedb struct {
-	File     *os.File
-	FilePath string
-
-	ToMySQLHandler func([]string) error
+	File     *os.File // the active segment
+	FilePath string   // the first segment, the others are named after it
+
+	SegmentSize int64 // Append starts a new segment once the active one has this many bytes, 0 for no limit
+	SegmentLogs int64 // Append starts a new segment once the active one has this many logs, 0 for no limit
+
+	IndexInterval int64 // Append indexes the offset of a log every this many logs, 1000 if 0, see TailFrom
+
+	SyncPolicy   string        // SyncPolicyXxx, when the records reach the disk, see WaitDurable
+	SyncInterval time.Duration // between two syncs of SyncPolicyInterval, 100ms if 0
+
+	Codec string // CodecJSON (default) or CodecBinary, how Marshal encodes the logs, Unmarshal reads both
+
+	mu       sync.Mutex
+	segments []Segment
+	size     int64                // bytes of the active segment
+	framed   bool                 // the active segment is in the framed format, see recordMagic
+	idx      *os.File             // the index of the active segment
+	indexed  int64                // logID of the latest entry of idx, 0 if it has none
+	changed  chan struct{}        // closed and replaced on every write and sync, wakes up the readers
+	readers  map[*reader]struct{} // the running Tailf and ReadLines, see Retain
+	fence    func() error         // see SetFence
+
+	seq       uint64        // records written
+	lastLogID int64         // of the latest Append
+	syncedSeq uint64        // records on the disk
+	durable   int64         // bytes of the active segment on the disk, the readers stop there
+	syncErr   error         // a failed sync, nothing written after it is durable
+	syncWake  chan struct{} // a write for the syncer, see syncLoop
 }
 
 func New(filePath string) (fdb *Filedb, err error) {
@@ -36,146 +62,225 @@ func (f *Filedb) Open() (err error) {
 		return
 	}
 
-	f.File, err = os.OpenFile(f.FilePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err = f.loadManifest()
 	if err != nil {
 		return
 	}
-	return
-}
 
-func (f *Filedb) Close() (err error) {
-	if f.File == nil {
+	f.File, err = os.OpenFile(f.segmentPath(f.segments[len(f.segments)-1]), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
 		return
 	}
-
-	err = f.File.Close()
+	stat, err := f.File.Stat()
+	if err != nil {
+		return
+	}
+	f.size = stat.Size()
+	if f.size == 0 {
+		err = f.writeMagic()
+		if err != nil {
+			return
+		}
+	}
+	f.framed, err = isFramed(f.File)
+	if err != nil {
+		return
+	}
+	err = f.recoverTail(f.segments[len(f.segments)-1])
 	if err != nil {
 		return
 	}
 
-	f.File = nil
-
+	err = f.openIndex(f.segments[len(f.segments)-1])
+	if err != nil {
+		return
+	}
+	if f.changed == nil {
+		f.changed = make(chan struct{})
+	}
+	if f.readers == nil {
+		f.readers = make(map[*reader]struct{})
+	}
+	// what is there when it opens is taken as it is
+	f.durable = f.size
+	f.syncedSeq = f.seq
 	return
 }
 
-// const lineSeparator = "\x1E" // Define special separator
+// ErrReadOnly returned by the writes of a filedb opened with OpenReadOnly
+var ErrReadOnly = errors.New("filedb is read-only")
 
-func (f *Filedb) WriteLine(s string) (err error) {
-	_, err = f.File.WriteString(s)
+// OpenReadOnly opens the filedb at filePath to read it while its owner may be writing it, e.g. to monitor it,
+// it creates nothing and never changes the files, a torn record at the end is not truncated but left unread
+func OpenReadOnly(filePath string) (fdb *Filedb, err error) {
+	fdb = &Filedb{
+		FilePath: filePath,
+		fence:    func() error { return ErrReadOnly },
+		changed:  make(chan struct{}),
+		readers:  make(map[*reader]struct{}),
+	}
+	err = fdb.loadManifest()
 	if err != nil {
-		log.Println("WriteLine err:", err)
 		return
 	}
 
-	return
-}
-
-// ReadLastLine reads the last non-empty line of the file
-func (f *Filedb) ReadLastLine() (s string, err error) {
-	stat, err := f.File.Stat()
+	fdb.File, err = os.Open(fdb.segmentPath(fdb.segments[len(fdb.segments)-1]))
 	if err != nil {
 		return
 	}
-
-	// Since we don't know how many bytes the last line has, try to read the last 1024 bytes, and extract the last line based on \n
-	var b []byte
-	var off int64
-	size := stat.Size()
-	if size < 1024 {
-		b = make([]byte, size)
-	} else {
-		b = make([]byte, 1024)
-		off = size - 1024
+	stat, err := fdb.File.Stat()
+	if err != nil {
+		fdb.File.Close()
+		return
 	}
-
-	_, err = f.File.ReadAt(b, off)
+	fdb.size = stat.Size()
+	fdb.framed, err = isFramed(fdb.File)
 	if err != nil {
+		fdb.File.Close()
 		return
 	}
+	// the readers stop at the size it had when it was opened
+	fdb.durable = fdb.size
+	return
+}
 
-	txt := strings.Trim(string(b), " \n")
-	txts := strings.Split(txt, "\n")
+func (f *Filedb) Close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	if len(txts) == 0 {
+	if f.File == nil {
 		return
 	}
 
-	s = txts[len(txts)-1]
+	if f.SyncPolicy == SyncPolicyInterval || f.SyncPolicy == SyncPolicyAlways {
+		err = f.File.Sync()
+		if err != nil {
+			return
+		}
+	}
+	err = f.File.Close()
+	if err != nil {
+		return
+	}
+	if f.idx != nil {
+		f.idx.Close()
+		f.idx = nil
+	}
+
+	f.File = nil
+	// the syncer sees it is closed
+	if f.syncWake != nil {
+		f.syncWake <- struct{}{}
+		f.syncWake = nil
+	}
 
 	return
 }
 
-// ReadFirstLine reads the first non-empty line of the file
-func (f *Filedb) ReadFirstLine() (s string, err error) {
-	_, err = f.File.Seek(0, 0)
-	if err != nil {
-		return
-	}
+// const lineSeparator = "\x1E" // Define special separator
 
-	reader := bufio.NewReader(f.File)
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return "", err
-		}
+// WriteLine appends the record s to the active segment, the trailing \n is dropped in the framed format,
+// use Append for the logs so that the segments roll over
+func (f *Filedb) WriteLine(s string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-		line = strings.TrimSpace(line)
-		if line != "" {
-			s = line
-			return s, nil
+	if f.fence != nil {
+		err = f.fence()
+		if err != nil {
+			return
 		}
 	}
+	return f.write(s)
+}
 
-	return "", io.EOF
+// SetFence makes Append and WriteLine fail with the error of fence once it returns one,
+// e.g. a leader that may have lost its lease, see xetcd.Leadership.Fence
+func (f *Filedb) SetFence(fence func() error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fence = fence
 }
 
-// Tailf continuously monitors new data writes and passes them to the handler via chan
-func (f *Filedb) Tailf(ch chan<- string) (err error) {
-	var loc *tail.SeekInfo
-	// TODO locate based on SavedLogID or other parameters to avoid starting from the beginning
-	// loc = &tail.SeekInfo{Offset: 0, Whence: 0}
-	ta, err := tail.TailFile(f.FilePath, tail.Config{
-		Follow:        true,
-		ReOpen:        true,
-		Location:      loc,
-		CompleteLines: true,
-	})
+func (f *Filedb) write(s string) (err error) {
+	b := []byte(s)
+	if f.framed {
+		s = strings.TrimSuffix(s, "\n")
+		if len(s) > MaxRecordSize {
+			return fmt.Errorf("record of %d bytes is larger than %d", len(s), MaxRecordSize)
+		}
+		b = encodeRecord(s)
+	}
+
+	// a record goes in one write, a crash leaves at most a torn one at the end, see recoverTail
+	n, err := f.File.Write(b)
+	f.size += int64(n)
+	f.seq++
+	f.scheduleSync()
+	f.notify()
 	if err != nil {
+		log.Println("WriteLine err:", err)
 		return
 	}
 
-	// var buffer string
-	// for line := range ta.Lines {
-	// 	if line.Err != nil {
-	// 		err = line.Err
-	// 		return
-	// 	}
-
-	// 	buffer += line.Text
-	// 	if strings.HasSuffix(buffer, lineSeparator) {
-	// 		ch <- strings.TrimSuffix(buffer, lineSeparator)
-	// 		buffer = ""
-	// 	} else {
-	// 		log.Println("===== buffer:", buffer)
-	// 	}
-	// }
-
-	for line := range ta.Lines {
-		if line.Err != nil {
-			// If an error occurs in a line of data, exit and return the error. Do not skip this line directly, as this may cause data disorder.
-			err = line.Err
+	return
+}
+
+// ReadLastLine reads the last non-empty record of the segments
+func (f *Filedb) ReadLastLine() (s string, err error) {
+	segments := f.Segments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		s, err = f.lastRecord(segments[i])
+		if err != nil || s != "" {
 			return
 		}
-
-		ch <- line.Text
 	}
 
 	return
 }
 
+// ReadFirstLine reads the first non-empty record of the segments
+func (f *Filedb) ReadFirstLine() (s string, err error) {
+	for _, seg := range f.Segments() {
+		s, err = firstRecord(f.segmentPath(seg))
+		if err != nil || s != "" {
+			return
+		}
+	}
+
+	return "", io.EOF
+}
+
+// ReadLines calls fn with every non-empty line from the start of the first segment in order, until fn returns an error
+func (f *Filedb) ReadLines(fn func(s string) error) (err error) {
+	return f.scan(0, false, fn)
+}
+
+// ReadLinesFrom is ReadLines starting from the line of logID, see TailFrom
+func (f *Filedb) ReadLinesFrom(logID int64, fn func(s string) error) (err error) {
+	return f.scan(logID, false, fn)
+}
+
+// Tailf continuously monitors new data writes and passes them to the handler via chan,
+// it starts from the first segment and follows Append into the next ones
+func (f *Filedb) Tailf(ch chan<- string) (err error) {
+	return f.TailFrom(0, ch)
+}
+
+// TailFrom is Tailf starting from the line of logID, found by the manifest and the index of its segment,
+// it may start up to IndexInterval lines earlier, or from the first segment if they don't know the logID,
+// so the consumers still skip the logs they have
+func (f *Filedb) TailFrom(logID int64, ch chan<- string) (err error) {
+	return f.scan(logID, true, func(s string) error {
+		ch <- s
+		return nil
+	})
+}
+
 type PerformanceData struct {
 	Name      string
 	FirstTime time.Time
@@ -213,8 +318,9 @@ func showPerformance(data *PerformanceData, ch chan struct{}) {
 	}()
 }
 
-// ToMySQL parses the logs and writes them to mysql. This is just the control logic, the actual writing is done in f.ToMySQLHandler
-func (f *Filedb) ToMySQL(ch <-chan string) (err error) {
+// ToMySQL hands the logs from ch to handler in batches, which writes them to mysql. This is just the control logic,
+// the logs usually come from Iterate in follow mode
+func ToMySQL[T any](f *Filedb, ch <-chan T, handler func([]T) error) (err error) {
 	fmt.Printf("===== ToMySQL start with %s\n", f.FilePath)
 	defer func() {
 		if err != nil {
@@ -235,7 +341,7 @@ func (f *Filedb) ToMySQL(ch <-chan string) (err error) {
 
 	// ----- Read data from ch and write to mysql
 
-	ss := make([]string, 100)
+	ss := make([]T, 100)
 
 	for {
 		size := 1
@@ -259,7 +365,7 @@ func (f *Filedb) ToMySQL(ch <-chan string) (err error) {
 			perfData.FirstTime = time.Now()
 		}
 
-		err = f.ToMySQLHandler(ss[:size])
+		err = handler(ss[:size])
 		if err != nil {
 			return
 		}
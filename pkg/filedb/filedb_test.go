@@ -3,8 +3,14 @@ package filedb_test
 import (
 	"ccoms/pkg/config"
 	"ccoms/pkg/filedb"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -79,6 +85,416 @@ func TestReadFirstLine(t *testing.T) {
 	fmt.Println(line)
 }
 
+func TestSegments(t *testing.T) {
+	dir := t.TempDir()
+	fdb, err := filedb.New(path.Join(dir, "test.log"))
+	require.Nil(t, err)
+	fdb.SegmentLogs = 10
+
+	ch := make(chan string, 64)
+	go fdb.Tailf(ch)
+
+	for i := int64(1); i <= 35; i++ {
+		err = fdb.Append(i, fmt.Sprintf("%d\n", i))
+		require.Nil(t, err)
+	}
+
+	require.Equal(t, []filedb.Segment{
+		{File: "test.log", FirstLogID: 1, LastLogID: 10},
+		{File: "test.11.log", FirstLogID: 11, LastLogID: 20},
+		{File: "test.21.log", FirstLogID: 21, LastLogID: 30},
+		{File: "test.31.log", FirstLogID: 31},
+	}, fdb.Segments())
+
+	// the manifest brings them back
+	fdb2, err := filedb.New(path.Join(dir, "test.log"))
+	require.Nil(t, err)
+	require.Equal(t, fdb.Segments(), fdb2.Segments())
+	fdb2.Close()
+
+	first, err := fdb.ReadFirstLine()
+	require.Nil(t, err)
+	require.Equal(t, "1", first)
+	last, err := fdb.ReadLastLine()
+	require.Nil(t, err)
+	require.Equal(t, "35", last)
+
+	var lines []string
+	err = fdb.ReadLines(func(s string) error {
+		lines = append(lines, s)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Len(t, lines, 35)
+
+	// Tailf follows into the next segments
+	for i := 1; i <= 35; i++ {
+		select {
+		case s := <-ch:
+			require.Equal(t, strconv.Itoa(i), s)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Tailf stopped before %d", i)
+		}
+	}
+
+	// the segment of log 25 is kept
+	removed, err := fdb.Retain(25, "")
+	require.Nil(t, err)
+	require.Len(t, removed, 2)
+	_, err = os.Stat(path.Join(dir, "test.11.log"))
+	require.True(t, os.IsNotExist(err))
+
+	// the active segment is kept
+	removed, err = fdb.Retain(100, path.Join(dir, "archive"))
+	require.Nil(t, err)
+	require.Equal(t, []filedb.Segment{{File: "test.21.log", FirstLogID: 21, LastLogID: 30}}, removed)
+	_, err = os.Stat(path.Join(dir, "archive", "test.21.log"))
+	require.Nil(t, err)
+
+	first, err = fdb.ReadFirstLine()
+	require.Nil(t, err)
+	require.Equal(t, "31", first)
+
+	// by size
+	fdb3, err := filedb.New(path.Join(dir, "size.log"))
+	require.Nil(t, err)
+	fdb3.SegmentSize = 30 // the header and two records of 11 bytes
+	for i := int64(1); i <= 5; i++ {
+		err = fdb3.Append(i, "abc\n")
+		require.Nil(t, err)
+	}
+	require.Len(t, fdb3.Segments(), 3)
+}
+
+func TestTailFrom(t *testing.T) {
+	dir := t.TempDir()
+	fdb, err := filedb.New(path.Join(dir, "test.log"))
+	require.Nil(t, err)
+	fdb.SegmentLogs = 10
+	fdb.IndexInterval = 4
+
+	for i := int64(1); i <= 35; i++ {
+		err = fdb.Append(i, fmt.Sprintf("%d\n", i))
+		require.Nil(t, err)
+	}
+
+	// the segment of 21 is indexed at 21, 25 and 29
+	for logID, first := range map[int64]string{0: "1", 7: "5", 23: "21", 30: "29", 31: "31", 100: "35"} {
+		ch := make(chan string, 64)
+		go fdb.TailFrom(logID, ch)
+		select {
+		case s := <-ch:
+			require.Equal(t, first, s, "TailFrom %d", logID)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("TailFrom %d got nothing", logID)
+		}
+	}
+
+	var lines []string
+	err = fdb.ReadLinesFrom(12, func(s string) error {
+		lines = append(lines, s)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, "11", lines[0])
+	require.Len(t, lines, 25)
+
+	// the following logs come after the last one
+	ch := make(chan string, 64)
+	go fdb.TailFrom(35, ch)
+	require.Equal(t, "35", <-ch)
+	err = fdb.Append(36, "36\n")
+	require.Nil(t, err)
+	require.Equal(t, "36", <-ch)
+
+	// the index goes with its segment
+	_, err = fdb.Retain(20, "")
+	require.Nil(t, err)
+	_, err = os.Stat(path.Join(dir, "test.11.idx"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestIterate(t *testing.T) {
+	fdb, err := filedb.New(path.Join(t.TempDir(), "test.log"))
+	require.Nil(t, err)
+	fdb.SegmentLogs = 10
+	fdb.IndexInterval = 4
+	fdb.Codec = filedb.CodecBinary
+
+	for i := int64(1); i <= 35; i++ {
+		b, err := fdb.Marshal(codecLog{LogID: i})
+		require.Nil(t, err)
+		require.Nil(t, fdb.Append(i, string(b)+"\n"))
+	}
+
+	ids := func(opts filedb.IterOptions) (ids []int64) {
+		err := filedb.Iterate(fdb, opts, func(r filedb.Record[codecLog]) error {
+			require.Equal(t, r.LogID, r.Log.LogID)
+			ids = append(ids, r.LogID)
+			return nil
+		})
+		require.Nil(t, err)
+		return
+	}
+	span := func(from, to int64) (ids []int64) {
+		for i := from; i != to; {
+			ids = append(ids, i)
+			if from < to {
+				i++
+			} else {
+				i--
+			}
+		}
+		return append(ids, to)
+	}
+	require.Equal(t, span(1, 35), ids(filedb.IterOptions{}))
+	require.Equal(t, span(12, 27), ids(filedb.IterOptions{From: 12, To: 27}))
+	require.Equal(t, span(35, 1), ids(filedb.IterOptions{Reverse: true}))
+	require.Equal(t, span(27, 12), ids(filedb.IterOptions{From: 12, To: 27, Reverse: true}))
+	require.Equal(t, span(9, 1), ids(filedb.IterOptions{To: 9, Reverse: true}))
+
+	// the first log of a segment is right after the magic
+	first, ok, err := filedb.First[codecLog](fdb, 11)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(11), first.LogID)
+	require.Equal(t, "test.11.log", first.Segment)
+	require.Equal(t, int64(4), first.Offset)
+	last, ok, err := filedb.Last[codecLog](fdb)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(35), last.LogID)
+	require.Equal(t, "test.31.log", last.Segment)
+
+	// follow until To
+	done := make(chan []int64)
+	go func() {
+		done <- ids(filedb.IterOptions{From: 34, To: 37, Follow: true})
+	}()
+	for i := int64(36); i <= 38; i++ {
+		b, err := fdb.Marshal(codecLog{LogID: i})
+		require.Nil(t, err)
+		require.Nil(t, fdb.Append(i, string(b)+"\n"))
+	}
+	select {
+	case got := <-done:
+		require.Equal(t, span(34, 37), got)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Iterate did not stop at To")
+	}
+
+	err = filedb.Iterate(fdb, filedb.IterOptions{Reverse: true, Follow: true}, func(r filedb.Record[codecLog]) error { return nil })
+	require.NotNil(t, err)
+	require.Nil(t, fdb.Close())
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	p := path.Join(dir, "test.log")
+	fdb, err := filedb.New(p)
+	require.Nil(t, err)
+	for i := int64(1); i <= 5; i++ {
+		err = fdb.Append(i, fmt.Sprintf("{\"logID\":%d}\n", i))
+		require.Nil(t, err)
+	}
+	fdb.Close()
+
+	// a crash in the middle of a write
+	stat, err := os.Stat(p)
+	require.Nil(t, err)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{12, 0, 0, 0, 0xAA, 0xBB, 0xCC, 0xDD, '{', '"'})
+	require.Nil(t, err)
+	f.Close()
+
+	_, corruptions, err := filedb.VerifyFile(p)
+	require.Nil(t, err)
+	require.Equal(t, []filedb.Corruption{{File: p, Offset: stat.Size(), Size: 10, Reason: "torn record at the end"}}, corruptions)
+
+	fdb, err = filedb.New(p)
+	require.Nil(t, err)
+	last, err := fdb.ReadLastLine()
+	require.Nil(t, err)
+	require.Equal(t, `{"logID":5}`, last)
+	err = fdb.Append(6, "{\"logID\":6}\n")
+	require.Nil(t, err)
+	records, corruptions, err := fdb.Verify()
+	require.Nil(t, err)
+	require.Equal(t, int64(6), records)
+	require.Empty(t, corruptions)
+	fdb.Close()
+
+	// a damaged record with whole ones after it is not truncated
+	b, err := os.ReadFile(p)
+	require.Nil(t, err)
+	i := strings.Index(string(b), `{"logID":3}`)
+	b[i+9] = '7'
+	err = os.WriteFile(p, b, 0644)
+	require.Nil(t, err)
+
+	records, corruptions, err = filedb.VerifyFile(p)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), records)
+	require.Equal(t, []filedb.Corruption{{File: p, Offset: int64(i - 8), Size: 19, Reason: "corrupt record, checksum mismatch"}}, corruptions)
+
+	_, err = filedb.New(p)
+	require.ErrorIs(t, err, filedb.ErrCorrupt)
+
+	// a log written before the framed format keeps its lines
+	p = path.Join(dir, "lines.log")
+	err = os.WriteFile(p, []byte("{\"logID\":1}\n{\"logID\":2}\n{\"log"), 0644)
+	require.Nil(t, err)
+	fdb, err = filedb.New(p)
+	require.Nil(t, err)
+	err = fdb.Append(3, "{\"logID\":3}\n")
+	require.Nil(t, err)
+	b, err = os.ReadFile(p)
+	require.Nil(t, err)
+	require.Equal(t, "{\"logID\":1}\n{\"logID\":2}\n{\"logID\":3}\n", string(b))
+}
+
+func TestSync(t *testing.T) {
+	dir := t.TempDir()
+	fdb, err := filedb.New(path.Join(dir, "interval.log"))
+	require.Nil(t, err)
+	fdb.SyncPolicy = filedb.SyncPolicyInterval
+	fdb.SyncInterval = 200 * time.Millisecond
+
+	ch := make(chan string, 64)
+	go fdb.Tailf(ch)
+
+	err = fdb.Append(1, "1\n")
+	require.Nil(t, err)
+	seq := fdb.Seq()
+
+	// the readers see a record once it is synced
+	select {
+	case s := <-ch:
+		t.Fatalf("got %s before the sync", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Nil(t, fdb.WaitDurable(seq))
+	select {
+	case s := <-ch:
+		require.Equal(t, "1", s)
+	case <-time.After(3 * time.Second):
+		t.Fatal("got nothing after the sync")
+	}
+	require.Nil(t, fdb.Close())
+
+	// concurrent writers share the syncs
+	fdb, err = filedb.New(path.Join(dir, "always.log"))
+	require.Nil(t, err)
+	fdb.SyncPolicy = filedb.SyncPolicyAlways
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := fdb.WriteLine(fmt.Sprintf("%d\n", i))
+			if err == nil {
+				err = fdb.WaitDurable(fdb.Seq())
+			}
+			require.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	records, corruptions, err := fdb.Verify()
+	require.Nil(t, err)
+	require.Empty(t, corruptions)
+	require.Equal(t, int64(20), records)
+	require.Nil(t, fdb.Close())
+}
+
+type codecItem struct {
+	ID       int64
+	Side     int8
+	Price    *big.Int
+	Quantity *big.Int
+	Note     string
+	Done     bool
+}
+
+type codecLog struct {
+	LogID int64
+	Ts    int64
+	Seq   uint64
+	Items []codecItem
+	Extra *big.Int
+}
+
+func (l codecLog) GetLogID() int64 {
+	return l.LogID
+}
+
+// codecLogV0 an earlier version of codecLog, without the fields added at the end
+type codecLogV0 struct {
+	LogID int64
+	Ts    int64
+}
+
+func TestCodec(t *testing.T) {
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	l := codecLog{
+		LogID: 7,
+		Ts:    -1,
+		Seq:   1 << 40,
+		Items: []codecItem{
+			{ID: 1, Side: -1, Price: big.NewInt(0), Quantity: huge, Note: "a\nb", Done: true},
+			{},
+		},
+	}
+
+	b, err := filedb.MarshalBinary(l)
+	require.Nil(t, err)
+	var got codecLog
+	require.Nil(t, filedb.Unmarshal(b, &got))
+	require.Equal(t, l, got)
+	// nil stays nil, 0 stays 0
+	require.Nil(t, got.Extra)
+	require.Equal(t, 0, got.Items[0].Price.Sign())
+
+	// the unknown fields are skipped
+	var v0 codecLogV0
+	require.Nil(t, filedb.Unmarshal(b, &v0))
+	require.Equal(t, codecLogV0{LogID: 7, Ts: -1}, v0)
+
+	// JSON is still read
+	jb, err := json.Marshal(l)
+	require.Nil(t, err)
+	got = codecLog{}
+	require.Nil(t, filedb.Unmarshal(jb, &got))
+	require.Equal(t, l, got)
+
+	_, err = filedb.MarshalBinary(map[string]int{})
+	require.NotNil(t, err)
+	require.NotNil(t, filedb.Unmarshal(b[:len(b)-1], &got))
+
+	// the binary logs go through the segments as they are
+	fdb, err := filedb.New(path.Join(t.TempDir(), "codec.log"))
+	require.Nil(t, err)
+	fdb.Codec = filedb.CodecBinary
+	for i := int64(1); i <= 3; i++ {
+		l.LogID = i
+		b, err := fdb.Marshal(l)
+		require.Nil(t, err)
+		require.Nil(t, fdb.Append(i, string(b)+"\n"))
+	}
+	var ids []int64
+	err = fdb.ReadLines(func(s string) error {
+		var l codecLog
+		err := filedb.Unmarshal([]byte(s), &l)
+		ids = append(ids, l.LogID)
+		return err
+	})
+	require.Nil(t, err)
+	require.Equal(t, []int64{1, 2, 3}, ids)
+	require.Nil(t, fdb.Close())
+}
+
 func BenchmarkWrite(b *testing.B) {
 	fdb, err := filedb.New(path.Join(config.DEVDATA, "filedb/test.log"))
 	require.Nil(b, err)
@@ -88,3 +504,95 @@ func BenchmarkWrite(b *testing.B) {
 		fdb.WriteLine("vFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTMvFFDUPCTQVYuzFEhgjxPmHnwLxswVNPjOSNbMk6zDA3qPltQVuuTPcJXHpv31eTM\n")
 	}
 }
+
+func BenchmarkCodec(b *testing.B) {
+	l := codecLog{LogID: 1, Ts: time.Now().UnixNano(), Items: []codecItem{
+		{ID: 1, Price: big.NewInt(30000_000000000000), Quantity: big.NewInt(1_500000000000)},
+		{ID: 2, Price: big.NewInt(30001_000000000000), Quantity: big.NewInt(2_000000000000)},
+	}}
+
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, _ := json.Marshal(l)
+			var got codecLog
+			filedb.Unmarshal(s, &got)
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, _ := filedb.MarshalBinary(l)
+			var got codecLog
+			filedb.Unmarshal(s, &got)
+		}
+	})
+}
+
+func TestFence(t *testing.T) {
+	fdb, err := filedb.New(path.Join(t.TempDir(), "test.log"))
+	require.Nil(t, err)
+
+	var fenced error
+	fdb.SetFence(func() error { return fenced })
+	require.Nil(t, fdb.Append(1, "{\"LogID\":1}\n"))
+
+	// a stale leader writes nothing more
+	fenced = errors.New("not the leader")
+	require.Equal(t, fenced, fdb.Append(2, "{\"LogID\":2}\n"))
+	require.Equal(t, fenced, fdb.WriteLine("{\"LogID\":2}\n"))
+	require.Equal(t, int64(1), fdb.LastLogID())
+	s, err := fdb.ReadLastLine()
+	require.Nil(t, err)
+	require.Equal(t, "{\"LogID\":1}", s)
+	require.Nil(t, fdb.Close())
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	p := path.Join(dir, "test.log")
+	fdb, err := filedb.New(p)
+	require.Nil(t, err)
+	fdb.SegmentLogs = 2
+	for i := int64(1); i <= 5; i++ {
+		require.Nil(t, fdb.Append(i, fmt.Sprintf("{\"logID\":%d}\n", i)))
+	}
+	require.Nil(t, fdb.Close())
+
+	// a record in the middle of its write
+	active := path.Join(dir, "test.5.log")
+	f, err := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{12, 0, 0, 0, 0xAA, 0xBB, 0xCC, 0xDD, '{', '"'})
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	before, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	stat, err := os.Stat(active)
+	require.Nil(t, err)
+
+	fdb, err = filedb.OpenReadOnly(p)
+	require.Nil(t, err)
+	require.Len(t, fdb.Segments(), 3)
+	first, ok, err := filedb.First[codecLog](fdb, 0)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(1), first.LogID)
+	last, ok, err := filedb.Last[codecLog](fdb)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(5), last.LogID)
+	require.Equal(t, filedb.ErrReadOnly, fdb.Append(6, "{\"logID\":6}\n"))
+	require.Nil(t, fdb.Close())
+
+	// nothing is created or truncated
+	after, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Equal(t, len(before), len(after))
+	stat2, err := os.Stat(active)
+	require.Nil(t, err)
+	require.Equal(t, stat.Size(), stat2.Size())
+
+	_, err = filedb.OpenReadOnly(path.Join(dir, "missing.log"))
+	require.NotNil(t, err)
+	_, err = os.Stat(path.Join(dir, "missing.log"))
+	require.True(t, os.IsNotExist(err))
+}
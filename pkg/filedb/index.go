@@ -0,0 +1,128 @@
+package filedb
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// indexEntrySize an index entry is the logID and the offset of its line, both little-endian int64
+const indexEntrySize = 16
+
+// DefaultIndexInterval used if IndexInterval is not set
+const DefaultIndexInterval = 1000
+
+func (f *Filedb) indexPath(seg Segment) string {
+	return strings.TrimSuffix(f.segmentPath(seg), ".log") + ".idx"
+}
+
+// openIndex opens the index of the active segment for Append, a torn entry at the end is dropped,
+// so are the entries of the records recoverTail truncated
+func (f *Filedb) openIndex(seg Segment) (err error) {
+	if f.idx != nil {
+		f.idx.Close()
+		f.idx = nil
+	}
+
+	idx, err := os.OpenFile(f.indexPath(seg), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	b, err := io.ReadAll(idx)
+	if err != nil {
+		idx.Close()
+		return
+	}
+
+	f.indexed = 0
+	size := 0
+	for ; size+indexEntrySize <= len(b); size += indexEntrySize {
+		if int64(binary.LittleEndian.Uint64(b[size+8:])) >= f.size {
+			break
+		}
+		f.indexed = int64(binary.LittleEndian.Uint64(b[size:]))
+	}
+	if size != len(b) {
+		err = idx.Truncate(int64(size))
+		if err != nil {
+			idx.Close()
+			return
+		}
+	}
+	f.idx = idx
+	return
+}
+
+// index records the offset of the line of logID once IndexInterval logs are written since the latest entry,
+// and for the first line of a segment, the caller holds f.mu
+//
+//	the index only saves reading, a failed entry is logged and the log is written anyway
+func (f *Filedb) index(logID, offset int64) {
+	interval := f.IndexInterval
+	if interval <= 0 {
+		interval = DefaultIndexInterval
+	}
+	if f.idx == nil || offset > f.dataStart() && f.indexed > 0 && logID-f.indexed < interval {
+		return
+	}
+
+	b := make([]byte, indexEntrySize)
+	binary.LittleEndian.PutUint64(b, uint64(logID))
+	binary.LittleEndian.PutUint64(b[8:], uint64(offset))
+	_, err := f.idx.Write(b)
+	if err != nil {
+		log.Println("index err:", err)
+		return
+	}
+	f.indexed = logID
+}
+
+// indexEntry the logID and the offset of its line in a segment
+type indexEntry struct {
+	logID  int64
+	offset int64
+}
+
+// indexEntries returns the entries of the index of the segment in order, without the ones past the end of it
+func (f *Filedb) indexEntries(seg Segment) (entries []indexEntry, err error) {
+	b, err := os.ReadFile(f.indexPath(seg))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	stat, err := os.Stat(f.segmentPath(seg))
+	if err != nil {
+		return
+	}
+
+	for i := 0; i+indexEntrySize <= len(b); i += indexEntrySize {
+		e := indexEntry{
+			logID:  int64(binary.LittleEndian.Uint64(b[i:])),
+			offset: int64(binary.LittleEndian.Uint64(b[i+8:])),
+		}
+		// an entry may outlive its line if the index reached the disk first
+		if e.offset <= stat.Size() {
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// seek returns the offset in the segment of the latest indexed line at or before logID, 0 if there is none
+func (f *Filedb) seek(seg Segment, logID int64) (offset int64, err error) {
+	entries, err := f.indexEntries(seg)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.logID > logID {
+			break
+		}
+		offset = e.offset
+	}
+	return
+}
@@ -0,0 +1,224 @@
+package filedb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Log the records the iterators decode, e.g. bank.BankLog and ome.OmeLog
+type Log interface {
+	GetLogID() int64
+}
+
+// Record a log decoded by Iterate, with where it is
+type Record[T any] struct {
+	LogID   int64
+	Segment string // the segment file
+	Offset  int64  // of the record in the segment
+	Data    string // the record as it is, see Unmarshal
+	Log     *T
+}
+
+// IterOptions the logs Iterate reads
+type IterOptions struct {
+	From    int64 // the first logID, from the first log if 0
+	To      int64 // the last logID, to the last log if 0
+	Reverse bool  // from To down to From
+	Follow  bool  // wait for the logs appended after the last one, until To or fn stops it, not with Reverse
+
+	Done <-chan struct{} // ends a follow waiting for logs once closed
+}
+
+// ErrStop returned by fn ends Iterate early, Iterate returns nil then
+var ErrStop = errors.New("stop iterating")
+
+// Iterate calls fn with the logs of the range in order, decoded with Unmarshal, until fn returns an error,
+// it starts from the index of the segment of From like TailFrom, and skips the logs out of the range
+func Iterate[T any, PT interface {
+	*T
+	Log
+}](f *Filedb, opts IterOptions, fn func(r Record[T]) error) (err error) {
+	if opts.Reverse && opts.Follow {
+		return errors.New("filedb: cannot follow in reverse")
+	}
+
+	visit := func(file string, offset int64, s string) error {
+		l := PT(new(T))
+		err := Unmarshal([]byte(s), l)
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", file, offset, err)
+		}
+
+		id := l.GetLogID()
+		switch {
+		case id < opts.From && opts.Reverse, opts.To > 0 && id > opts.To && !opts.Reverse:
+			return ErrStop
+		case id < opts.From, opts.To > 0 && id > opts.To:
+			return nil
+		}
+		return fn(Record[T]{LogID: id, Segment: file, Offset: offset, Data: s, Log: (*T)(l)})
+	}
+
+	if opts.Reverse {
+		err = f.scanReverse(opts.From, opts.To, visit)
+	} else {
+		err = f.scanAt(opts.From, opts.Follow, opts.Done, visit)
+	}
+	if errors.Is(err, ErrStop) {
+		err = nil
+	}
+	return
+}
+
+// First returns the first log at or after logID, ok is false if there is none
+func First[T any, PT interface {
+	*T
+	Log
+}](f *Filedb, logID int64) (r Record[T], ok bool, err error) {
+	err = Iterate[T, PT](f, IterOptions{From: logID}, func(rec Record[T]) error {
+		r, ok = rec, true
+		return ErrStop
+	})
+	return
+}
+
+// Last returns the latest log, ok is false if there is none
+func Last[T any, PT interface {
+	*T
+	Log
+}](f *Filedb) (r Record[T], ok bool, err error) {
+	err = Iterate[T, PT](f, IterOptions{Reverse: true}, func(rec Record[T]) error {
+		r, ok = rec, true
+		return ErrStop
+	})
+	return
+}
+
+// prev returns the segment before file, false if file is the first one
+func (f *Filedb) prev(r *reader, file string) (seg Segment, ok bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, s := range f.segments {
+		if s.File != file {
+			continue
+		}
+		if i == 0 {
+			return
+		}
+		r.file = f.segments[i-1].File
+		return f.segments[i-1], true, nil
+	}
+	return seg, false, fmt.Errorf("segment %s is gone", file)
+}
+
+// scanReverse calls fn with every non-empty line of the segments from the last one back to the first, until fn returns an error,
+// the segments after the one of to and before the one of from are skipped if they are not 0
+func (f *Filedb) scanReverse(from, to int64, fn func(file string, offset int64, s string) error) (err error) {
+	r := new(reader)
+	f.mu.Lock()
+	i := len(f.segments) - 1
+	for i > 0 && to > 0 && f.segments[i].FirstLogID > to {
+		i--
+	}
+	seg := f.segments[i]
+	r.file = seg.File
+	f.readers[r] = struct{}{}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.readers, r)
+		f.mu.Unlock()
+	}()
+
+	for {
+		err = f.scanSegmentReverse(seg, to, fn)
+		if err != nil {
+			return
+		}
+		if seg.FirstLogID > 0 && seg.FirstLogID <= from {
+			return
+		}
+
+		var ok bool
+		seg, ok, err = f.prev(r, seg.File)
+		if err != nil || !ok {
+			return
+		}
+	}
+}
+
+// scanSegmentReverse reads the lines between two index entries forward and passes them to fn in reverse,
+// from the last entry back to the start of the segment, so it holds at most IndexInterval lines
+func (f *Filedb) scanSegmentReverse(seg Segment, to int64, fn func(file string, offset int64, s string) error) (err error) {
+	entries, err := f.indexEntries(seg)
+	if err != nil {
+		return
+	}
+
+	// the lines after the durable ones are not read, nor the ones after the entry past to
+	_, _, limit := f.state(seg.File)
+	end := limit
+	for _, e := range entries {
+		if to > 0 && e.logID > to && (end < 0 || e.offset < end) {
+			end = e.offset
+			break
+		}
+	}
+	starts := []int64{0}
+	for _, e := range entries {
+		if (end < 0 || e.offset < end) && e.offset > starts[len(starts)-1] {
+			starts = append(starts, e.offset)
+		}
+	}
+
+	type line struct {
+		offset int64
+		s      string
+	}
+	tail := true
+	for i := len(starts) - 1; i >= 0; i-- {
+		var lines []line
+		err = func() (err error) {
+			r, err := openRecords(f.segmentPath(seg), starts[i])
+			if err != nil {
+				return
+			}
+			defer r.Close()
+
+			r.limit = limit
+			for end < 0 || r.pos < end {
+				at := r.pos
+				s, ok, err := r.next()
+				if err != nil {
+					return err
+				}
+				if !ok {
+					// the last line of the older format may have no \n
+					if s := strings.TrimSpace(string(r.rest())); tail && !r.framed && s != "" {
+						lines = append(lines, line{offset: r.pos, s: s})
+					}
+					break
+				}
+				if s != "" {
+					lines = append(lines, line{offset: at, s: s})
+				}
+			}
+			return
+		}()
+		if err != nil {
+			return
+		}
+
+		for j := len(lines) - 1; j >= 0; j-- {
+			err = fn(seg.File, lines[j].offset, lines[j].s)
+			if err != nil {
+				return
+			}
+		}
+		end = starts[i]
+		tail = false
+	}
+	return
+}
@@ -0,0 +1,239 @@
+package filedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// The records of a segment written since the format came in are framed, the file starts with recordMagic
+// and each record is its length and its CRC32 (IEEE), both little-endian uint32, then the bytes of it
+//
+//	a file without recordMagic is the older format, a record per line, it is still read as such
+const (
+	recordMagic      = "FDB1"
+	recordHeaderSize = 8
+
+	// MaxRecordSize the largest record Append takes, a longer length in a header is a damaged one
+	MaxRecordSize = 16 * 1024 * 1024
+)
+
+// ErrCorrupt a record does not match its checksum, or its length is out of range
+var ErrCorrupt = errors.New("corrupt record")
+
+// encodeRecord frames the record
+func encodeRecord(s string) []byte {
+	b := make([]byte, recordHeaderSize+len(s))
+	binary.LittleEndian.PutUint32(b, uint32(len(s)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE([]byte(s)))
+	copy(b[recordHeaderSize:], s)
+	return b
+}
+
+// parseRecord returns the first record of b and its size with the header, n is 0 if b does not hold all of it yet
+func parseRecord(b []byte) (s string, n int, err error) {
+	if len(b) < recordHeaderSize {
+		return
+	}
+	size := binary.LittleEndian.Uint32(b)
+	if size > MaxRecordSize {
+		return "", 0, fmt.Errorf("%w, length %d out of range", ErrCorrupt, size)
+	}
+	if len(b) < recordHeaderSize+int(size) {
+		return
+	}
+	payload := b[recordHeaderSize : recordHeaderSize+int(size)]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(b[4:]) {
+		return "", 0, fmt.Errorf("%w, checksum mismatch", ErrCorrupt)
+	}
+	return string(payload), recordHeaderSize + int(size), nil
+}
+
+// isFramed whether the file is in the framed format, see recordMagic
+func isFramed(file *os.File) (framed bool, err error) {
+	b := make([]byte, len(recordMagic))
+	n, err := file.ReadAt(b, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return n == len(recordMagic) && string(b) == recordMagic, err
+}
+
+// recordReader reads the records of a segment file in order, in either format
+type recordReader struct {
+	file    *os.File
+	framed  bool
+	pos     int64  // offset of pending in the file
+	limit   int64  // the records ending after it are not read yet, -1 for none
+	pending []byte // read but not returned yet
+	buf     []byte
+	chunk   []byte
+}
+
+// openRecords opens the segment file to read the records from offset, the start of a record
+func openRecords(p string, offset int64) (r *recordReader, err error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return
+	}
+	framed, err := isFramed(file)
+	if err != nil {
+		file.Close()
+		return
+	}
+	if framed {
+		offset = max(offset, int64(len(recordMagic)))
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return
+	}
+
+	return &recordReader{
+		file:   file,
+		framed: framed,
+		pos:    offset,
+		limit:  -1,
+		buf:    make([]byte, 0, 64*1024),
+		chunk:  make([]byte, 64*1024),
+	}, nil
+}
+
+func (r *recordReader) Close() error {
+	return r.file.Close()
+}
+
+// next returns the next record, ok is false if the rest of the file is not a whole record (yet),
+// the lines of the older format are trimmed and may be empty
+func (r *recordReader) next() (s string, ok bool, err error) {
+	for {
+		var n int
+		if r.framed {
+			s, n, err = parseRecord(r.pending)
+			if err != nil {
+				return "", false, fmt.Errorf("%s at offset %d: %w", r.file.Name(), r.pos, err)
+			}
+		} else if i := bytes.IndexByte(r.pending, '\n'); i >= 0 {
+			s, n = strings.TrimSpace(string(r.pending[:i])), i+1
+		}
+		if n > 0 && r.limit >= 0 && r.pos+int64(n) > r.limit {
+			return "", false, nil
+		}
+		if n > 0 {
+			r.pending = r.pending[n:]
+			r.pos += int64(n)
+			return s, true, nil
+		}
+
+		if len(r.pending) == 0 {
+			r.pending = r.buf[:0]
+		}
+		m, err := r.file.Read(r.chunk)
+		r.pending = append(r.pending, r.chunk[:m]...)
+		if err == io.EOF && m == 0 {
+			return "", false, nil
+		}
+		if err != nil && err != io.EOF {
+			return "", false, err
+		}
+	}
+}
+
+// rest returns what is left after the last whole record
+func (r *recordReader) rest() []byte {
+	return r.pending
+}
+
+// resync returns the offset of the first whole record at or after from in a framed file, found is false if there is none
+func resync(p string, from int64) (offset int64, found bool, err error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return
+	}
+	for i := from; i+recordHeaderSize <= int64(len(b)); i++ {
+		_, n, err := parseRecord(b[i:])
+		if err == nil && n > 0 {
+			return i, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Corruption a damaged span of a segment file, see Verify
+type Corruption struct {
+	File   string
+	Offset int64 // where the damage starts
+	Size   int64 // bytes up to the next whole record or the end of the file
+	Reason string
+}
+
+// VerifyFile reads all the records of a segment file and reports the damaged spans,
+// a file ending with a part of a record has a torn tail, which Open truncates in the active segment
+func VerifyFile(p string) (records int64, corruptions []Corruption, err error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+
+	offset := int64(0)
+	for {
+		var r *recordReader
+		r, err = openRecords(p, offset)
+		if err != nil {
+			return
+		}
+		for {
+			var ok bool
+			_, ok, err = r.next()
+			if err != nil || !ok {
+				break
+			}
+			records++
+		}
+		r.Close()
+
+		switch {
+		case errors.Is(err, ErrCorrupt):
+			// go on from the next whole record
+			next, found, err2 := resync(p, r.pos+1)
+			if err2 != nil {
+				return records, corruptions, err2
+			}
+			if !found {
+				next = stat.Size()
+			}
+			corruptions = append(corruptions, Corruption{File: p, Offset: r.pos, Size: next - r.pos, Reason: errors.Unwrap(err).Error()})
+			if !found {
+				return records, corruptions, nil
+			}
+			offset = next
+			continue
+		case err != nil:
+			return
+		}
+
+		if rest := len(r.rest()); rest > 0 && (r.framed || strings.TrimSpace(string(r.rest())) != "") {
+			corruptions = append(corruptions, Corruption{File: p, Offset: r.pos, Size: int64(rest), Reason: "torn record at the end"})
+		}
+		return
+	}
+}
+
+// Verify runs VerifyFile on every segment
+func (f *Filedb) Verify() (records int64, corruptions []Corruption, err error) {
+	for _, seg := range f.Segments() {
+		n, cs, err := VerifyFile(f.segmentPath(seg))
+		if err != nil {
+			return records, corruptions, err
+		}
+		records += n
+		corruptions = append(corruptions, cs...)
+	}
+	return
+}
@@ -0,0 +1,538 @@
+package filedb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Segment a file holding the logs FirstLogID to LastLogID,
+// the first one is FilePath and the next ones are named after the first log they hold, e.g. ome_btc_usdt.10001.log
+//
+//	the manifest (e.g. ome_btc_usdt.manifest) lists them in order, it is written when a segment starts or is removed
+//	each segment has a sparse index of its logs next to it, e.g. ome_btc_usdt.10001.idx, see TailFrom
+type Segment struct {
+	File       string `json:"file"`       // file name in the directory of FilePath
+	FirstLogID int64  `json:"firstLogID"` // 0 if unknown, a file written before the segments
+	LastLogID  int64  `json:"lastLogID"`  // 0 while it is the active segment
+}
+
+type manifest struct {
+	Segments []Segment `json:"segments"`
+}
+
+// reader a running scan, see Retain
+type reader struct {
+	file string // the segment it is on
+}
+
+// Segments returns a copy of the segments in order, the last one is the active segment
+func (f *Filedb) Segments() []Segment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Segment(nil), f.segments...)
+}
+
+// ManifestPath returns the manifest file of the segments
+func (f *Filedb) ManifestPath() string {
+	return strings.TrimSuffix(f.FilePath, ".log") + ".manifest"
+}
+
+func (f *Filedb) segmentPath(seg Segment) string {
+	return filepath.Join(filepath.Dir(f.FilePath), seg.File)
+}
+
+// loadManifest reads the segments, a log without a manifest is a single segment
+func (f *Filedb) loadManifest() (err error) {
+	b, err := os.ReadFile(f.ManifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		f.segments = []Segment{{File: filepath.Base(f.FilePath)}}
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	var m manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return
+	}
+	if len(m.Segments) == 0 {
+		return fmt.Errorf("manifest %s has no segment", f.ManifestPath())
+	}
+	f.segments = m.Segments
+	return
+}
+
+// saveManifest write the segments to a temporary file and move it into place
+func (f *Filedb) saveManifest(segments []Segment) (err error) {
+	b, err := json.Marshal(manifest{Segments: segments})
+	if err != nil {
+		return
+	}
+
+	p := f.ManifestPath()
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(b)
+	if err != nil {
+		return
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return
+	}
+	return syncDir(filepath.Dir(p))
+}
+
+// Append writes the line s of the log logID, the logIDs must follow each other,
+// the active segment is sealed and a new one started first once it reaches SegmentSize or SegmentLogs
+func (f *Filedb) Append(logID int64, s string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fence != nil {
+		err = f.fence()
+		if err != nil {
+			return
+		}
+	}
+
+	active := f.segments[len(f.segments)-1]
+	switch {
+	case f.size == f.dataStart() && active.FirstLogID == 0:
+		// the first log of a new log
+		segments := append([]Segment(nil), f.segments...)
+		segments[len(segments)-1].FirstLogID = logID
+		err = f.saveManifest(segments)
+		if err != nil {
+			return
+		}
+		f.segments = segments
+		f.indexed = 0
+	case f.size > f.dataStart() && (f.SegmentSize > 0 && f.size+f.recordSize(s) > f.SegmentSize ||
+		f.SegmentLogs > 0 && active.FirstLogID > 0 && logID-active.FirstLogID >= f.SegmentLogs):
+		err = f.roll(logID)
+		if err != nil {
+			return
+		}
+	}
+
+	offset := f.size
+	err = f.write(s)
+	if err != nil {
+		return
+	}
+	f.index(logID, offset)
+	f.lastLogID = logID
+	return
+}
+
+// LastLogID returns the log of the latest Append since Open, 0 if there is none
+func (f *Filedb) LastLogID() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.lastLogID
+}
+
+// roll seals the active segment and starts a new one with the log logID
+func (f *Filedb) roll(logID int64) (err error) {
+	next := Segment{
+		File:       fmt.Sprintf("%s.%d.log", strings.TrimSuffix(filepath.Base(f.FilePath), ".log"), logID),
+		FirstLogID: logID,
+	}
+	file, err := os.OpenFile(f.segmentPath(next), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	_, err = file.WriteString(recordMagic)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return
+	}
+	idx, err := os.OpenFile(f.indexPath(next), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return
+	}
+
+	segments := append([]Segment(nil), f.segments...)
+	segments[len(segments)-1].LastLogID = logID - 1
+	segments = append(segments, next)
+	err = f.saveManifest(segments)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		idx.Close()
+		os.Remove(idx.Name())
+		return
+	}
+
+	if f.SyncPolicy == SyncPolicyInterval || f.SyncPolicy == SyncPolicyAlways {
+		err = f.File.Sync()
+		if err != nil {
+			file.Close()
+			idx.Close()
+			f.syncErr = err
+			return
+		}
+		f.syncedSeq = f.seq
+	}
+	f.File.Close()
+	f.File = file
+	f.size = int64(len(recordMagic))
+	f.framed = true
+	f.durable = f.size
+	if f.idx != nil {
+		f.idx.Close()
+	}
+	f.idx = idx
+	f.indexed = 0
+	f.segments = segments
+	f.notify()
+	return
+}
+
+// notify wakes up the readers waiting for more lines, the caller holds f.mu
+func (f *Filedb) notify() {
+	if f.changed == nil {
+		return
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Retain removes the sealed segments whose logs are all at or before logID, or moves them into archiveDir if it is not "",
+// the active segment and the ones a running Tailf or ReadLines has not finished are kept
+func (f *Filedb) Retain(logID int64, archiveDir string) (removed []Segment, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for n < len(f.segments)-1 && f.segments[n].LastLogID > 0 && f.segments[n].LastLogID <= logID {
+		n++
+	}
+	for r := range f.readers {
+		for i := 0; i < n; i++ {
+			if f.segments[i].File == r.file {
+				n = i
+				break
+			}
+		}
+	}
+	if n == 0 {
+		return
+	}
+
+	// the manifest goes first, a crash leaves a stray file rather than a missing segment
+	err = f.saveManifest(f.segments[n:])
+	if err != nil {
+		return
+	}
+	removed = append([]Segment(nil), f.segments[:n]...)
+	f.segments = append([]Segment(nil), f.segments[n:]...)
+
+	if archiveDir != "" {
+		err = os.MkdirAll(archiveDir, 0755)
+		if err != nil {
+			return
+		}
+	}
+	for _, seg := range removed {
+		for _, p := range []string{f.segmentPath(seg), f.indexPath(seg)} {
+			if archiveDir != "" {
+				err = os.Rename(p, filepath.Join(archiveDir, filepath.Base(p)))
+			} else {
+				err = os.Remove(p)
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return
+			}
+			err = nil
+		}
+	}
+
+	return
+}
+
+// state returns the channel closed on the next write, whether the segment file is sealed,
+// and the bytes of it the readers may read, all of it (-1) once it is sealed, see WaitDurable
+func (f *Filedb) state(file string) (changed <-chan struct{}, sealed bool, limit int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sealed = f.segments[len(f.segments)-1].File != file
+	if sealed {
+		return f.changed, true, -1
+	}
+	return f.changed, false, f.durable
+}
+
+// next returns the segment after file, false if file is the active segment
+func (f *Filedb) next(r *reader, file string) (seg Segment, ok bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, s := range f.segments {
+		if s.File != file {
+			continue
+		}
+		if i == len(f.segments)-1 {
+			return
+		}
+		r.file = f.segments[i+1].File
+		return f.segments[i+1], true, nil
+	}
+	return seg, false, fmt.Errorf("segment %s is gone", file)
+}
+
+// scan calls fn with every non-empty line of the segments in order from the line of logID (see TailFrom), until fn returns an error,
+// at the end of the active segment it returns, or waits for more lines if follow
+func (f *Filedb) scan(logID int64, follow bool, fn func(s string) error) (err error) {
+	return f.scanAt(logID, follow, nil, func(file string, offset int64, s string) error {
+		return fn(s)
+	})
+}
+
+// scanAt is scan passing the segment file and the offset of each line too, a follow ends with ErrStop once done is closed
+func (f *Filedb) scanAt(logID int64, follow bool, done <-chan struct{}, fn func(file string, offset int64, s string) error) (err error) {
+	r := new(reader)
+	f.mu.Lock()
+	seg := f.segments[0]
+	for _, s := range f.segments {
+		if s.FirstLogID > 0 && s.FirstLogID <= logID {
+			seg = s
+		}
+	}
+	r.file = seg.File
+	f.readers[r] = struct{}{}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.readers, r)
+		f.mu.Unlock()
+	}()
+
+	offset, err := f.seek(seg, logID)
+	if err != nil {
+		return
+	}
+	for {
+		err = f.scanSegment(seg, offset, follow, done, func(offset int64, s string) error {
+			return fn(seg.File, offset, s)
+		})
+		if err != nil {
+			return
+		}
+		offset = 0
+
+		var ok bool
+		seg, ok, err = f.next(r, seg.File)
+		if err != nil || !ok {
+			return
+		}
+	}
+}
+
+// scanSegment reads the segment from offset until it is sealed and read to the end, or to the end of it if not follow
+func (f *Filedb) scanSegment(seg Segment, offset int64, follow bool, done <-chan struct{}, fn func(offset int64, s string) error) (err error) {
+	r, err := openRecords(f.segmentPath(seg), offset)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for {
+		// sealed before the read, so the read reaches the real end of it
+		changed, sealed, limit := f.state(seg.File)
+
+		r.limit = limit
+		at := r.pos
+		s, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			if s != "" {
+				err = fn(at, s)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if sealed || !follow {
+			// the last line of the older format may have no \n
+			if s := strings.TrimSpace(string(r.rest())); !r.framed && s != "" {
+				return fn(r.pos, s)
+			}
+			return nil
+		}
+		// the rest of a partial record comes with a later write
+		select {
+		case <-changed:
+		case <-done:
+			return ErrStop
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// lastRecord reads the last non-empty record of the segment, from its last index entry, "" if there is none
+func (f *Filedb) lastRecord(seg Segment) (s string, err error) {
+	offset, err := f.seek(seg, math.MaxInt64)
+	if err != nil {
+		return
+	}
+	r, err := openRecords(f.segmentPath(seg), offset)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for {
+		record, ok, err := r.next()
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			break
+		}
+		if record != "" {
+			s = record
+		}
+	}
+	if rest := strings.TrimSpace(string(r.rest())); !r.framed && rest != "" {
+		s = rest
+	}
+	return
+}
+
+// firstRecord reads the first non-empty record of the file, "" if there is none
+func firstRecord(p string) (s string, err error) {
+	r, err := openRecords(p, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for {
+		s, ok, err := r.next()
+		if err != nil || !ok {
+			if !r.framed && err == nil {
+				s = strings.TrimSpace(string(r.rest()))
+			}
+			return s, err
+		}
+		if s != "" {
+			return s, nil
+		}
+	}
+}
+
+// writeMagic starts the empty active segment in the framed format, the caller holds f.mu
+func (f *Filedb) writeMagic() (err error) {
+	n, err := f.File.WriteString(recordMagic)
+	f.size += int64(n)
+	f.framed = err == nil
+	return
+}
+
+// recordSize the bytes the record s takes in the active segment
+func (f *Filedb) recordSize(s string) int64 {
+	if f.framed {
+		return int64(recordHeaderSize + len(strings.TrimSuffix(s, "\n")))
+	}
+	return int64(len(s))
+}
+
+// dataStart the offset of the first record of the active segment
+func (f *Filedb) dataStart() int64 {
+	if f.framed {
+		return int64(len(recordMagic))
+	}
+	return 0
+}
+
+// recoverTail truncates the torn record at the end of the active segment, left by a crash in the middle of a write,
+// a damaged record followed by whole ones is not a torn write and fails instead, see Verify
+func (f *Filedb) recoverTail(seg Segment) (err error) {
+	p := f.segmentPath(seg)
+	offset, err := f.seek(seg, math.MaxInt64)
+	if err != nil {
+		return
+	}
+	r, err := openRecords(p, offset)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for {
+		var ok bool
+		_, ok, err = r.next()
+		if errors.Is(err, ErrCorrupt) {
+			_, found, err2 := resync(p, r.pos+1)
+			if err2 != nil {
+				return err2
+			}
+			if found {
+				return
+			}
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		if !ok {
+			break
+		}
+	}
+	if r.pos >= f.size {
+		return
+	}
+
+	log.Printf("filedb: truncate the torn record of %d bytes at offset %d of %s", f.size-r.pos, r.pos, p)
+	err = f.File.Truncate(r.pos)
+	if err != nil {
+		return
+	}
+	f.size = r.pos
+	return
+}
@@ -0,0 +1,120 @@
+package filedb
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// The durability of the records, a record is durable once it is on the disk, see WaitDurable
+const (
+	SyncPolicyNone     = "none"     // left to the os, a record counts as durable once written, the default
+	SyncPolicyInterval = "interval" // synced every SyncInterval
+	SyncPolicyAlways   = "always"   // synced at once, the records written during a sync go together in the next one
+)
+
+// DefaultSyncInterval used if SyncInterval is not set
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// Seq returns the number of records written so far
+func (f *Filedb) Seq() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.seq
+}
+
+// WaitDurable blocks until the first seq records are durable under SyncPolicy, see Seq,
+// it fails once a sync has failed, as the records after it may never reach the disk
+func (f *Filedb) WaitDurable(seq uint64) error {
+	for {
+		f.mu.Lock()
+		if f.syncErr != nil {
+			f.mu.Unlock()
+			return f.syncErr
+		}
+		if f.syncedSeq >= seq {
+			f.mu.Unlock()
+			return nil
+		}
+		changed := f.changed
+		f.mu.Unlock()
+
+		<-changed
+	}
+}
+
+// scheduleSync marks the written records durable under SyncPolicyNone, or wakes up the syncer, the caller holds f.mu
+func (f *Filedb) scheduleSync() {
+	if f.SyncPolicy != SyncPolicyInterval && f.SyncPolicy != SyncPolicyAlways {
+		f.syncedSeq = f.seq
+		f.durable = f.size
+		return
+	}
+
+	if f.syncWake == nil {
+		f.syncWake = make(chan struct{}, 1)
+		go f.syncLoop(f.syncWake)
+	}
+	select {
+	case f.syncWake <- struct{}{}:
+	default:
+	}
+}
+
+// syncLoop syncs the active segment after the writes, at once or every SyncInterval,
+// the writes made during a sync wait for the next one, so a sync covers all of them
+func (f *Filedb) syncLoop(wake <-chan struct{}) {
+	interval := f.SyncInterval
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+
+	for {
+		<-wake
+		if f.SyncPolicy == SyncPolicyInterval {
+			time.Sleep(interval)
+		}
+
+		f.mu.Lock()
+		file, seq, size := f.File, f.seq, f.size
+		f.mu.Unlock()
+		if file == nil {
+			return
+		}
+
+		err := file.Sync()
+		// roll synced the segment before closing it
+		if errors.Is(err, os.ErrClosed) {
+			err = nil
+		}
+
+		f.mu.Lock()
+		if err != nil {
+			log.Println("Sync err:", err)
+			if f.syncErr == nil {
+				f.syncErr = err
+			}
+		}
+		if f.syncErr == nil {
+			f.syncedSeq = max(f.syncedSeq, seq)
+			if file == f.File {
+				f.durable = max(f.durable, size)
+			}
+		}
+		f.notify()
+		f.mu.Unlock()
+	}
+}
+
+// syncDir syncs the directory, so that the files created or renamed in it stay
+func syncDir(dir string) (err error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -1,7 +1,15 @@
 package ingress
 
-import "github.com/nats-io/nats.go"
+import (
+	"ccoms/pkg/xlog"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
 
 type Worker struct {
-	Nats map[string]nats.JetStreamContext
+	Nats   map[string]nats.JetStreamContext // coin -> NATS server of its bank, see GetNats
+	natsMu sync.Mutex
 }
+
+var logger = xlog.GetLogger()
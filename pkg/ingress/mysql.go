@@ -0,0 +1,38 @@
+package ingress
+
+import (
+	"ccoms/pkg/model"
+	"strings"
+)
+
+// GetOrderReject looks up the result of an order request sent by SendOrderReq
+//
+//	processed is false until the bank has handled the request and saved it to mysql,
+//	reject is nil if the request was accepted
+func (w *Worker) GetOrderReject(bankCoin string, seq uint64) (reject *model.OrderReject, processed bool, err error) {
+	db := model.GetMySQL()
+
+	// read the progress first, rejects are saved in the same transaction as it
+	var lastkv model.Lastkv
+	err = db.Model(model.Lastkv{}).
+		Where("`app`=? and `key`=?", "bank_"+strings.ToLower(bankCoin), model.LASTKV_K_NATS_SEQ).
+		Limit(1).Find(&lastkv).Error
+	if err != nil {
+		return
+	}
+	if uint64(lastkv.Val) < seq {
+		return
+	}
+	processed = true
+
+	var rejects []model.OrderReject
+	err = db.Scopes(model.OrderRejectTable(bankCoin)).Where("`msg_seq`=?", seq).Limit(1).Find(&rejects).Error
+	if err != nil {
+		return
+	}
+	if len(rejects) > 0 {
+		reject = &rejects[0]
+	}
+
+	return
+}
@@ -1,8 +1,11 @@
 package ingress
 
 import (
+	"ccoms/pkg/model"
+	"ccoms/pkg/rules"
 	"ccoms/pkg/xetcd"
 	"ccoms/pkg/xnats"
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -10,12 +13,19 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
+// GetNats returns the JetStream context of the NATS server of the bank of the coin,
+// the connection is closed and made again to the new address once xetcd.KeyNatsService changes,
+// the subscriptions of SubOrderEvents end with it
 func (w *Worker) GetNats(coin string) (js nats.JetStreamContext, err error) {
+	w.natsMu.Lock()
+	defer w.natsMu.Unlock()
+
 	if w.Nats[coin] != nil {
 		return w.Nats[coin], nil
 	}
 
-	natsUrl, err := xetcd.Get(xetcd.KeyNatsService(coin))
+	key := xetcd.KeyNatsService(coin)
+	natsUrl, err := xetcd.Get(key)
 	if err != nil {
 		return
 	}
@@ -33,10 +43,44 @@ func (w *Worker) GetNats(coin string) (js nats.JetStreamContext, err error) {
 	}
 	w.Nats[coin] = js
 
+	// connect to the new address once it changes
+	ctx, cancel := xetcd.Changed(context.Background(), key, natsUrl)
+	go func() {
+		<-ctx.Done()
+		cancel()
+
+		w.natsMu.Lock()
+		if w.Nats[coin] == js {
+			delete(w.Nats, coin)
+		}
+		w.natsMu.Unlock()
+		nc.Close()
+
+		if _, err := w.GetNats(coin); err != nil {
+			logger.Errorf("GetNats coin(%s) failed to reconnect with err:%s", coin, err)
+		}
+	}()
+
 	return
 }
 
-func (w *Worker) SendOrderReq(bankCoin string, msg xnats.OrderReq) (err error) {
+// SendOrderReq publishes the order request to the bank, seq is the NATS stream sequence of the request,
+// use it with GetOrderReject to find out whether the bank rejected it
+//
+//	with a ClientOrderID the request is safe to retry, NATS drops the copies published within its duplicate window
+//	and returns the seq of the first one, the bank rejects the ones arriving later
+//
+//	requests breaking the trading rules of the symbol are not sent, err is a *rules.Error then
+func (w *Worker) SendOrderReq(bankCoin string, msg xnats.OrderReq) (seq uint64, err error) {
+	reason, err := rules.Shared.Check(msg)
+	if err != nil {
+		return
+	}
+	if reason != "" {
+		err = &rules.Error{Reason: reason}
+		return
+	}
+
 	js, err := w.GetNats(bankCoin)
 	if err != nil {
 		return
@@ -46,7 +90,88 @@ func (w *Worker) SendOrderReq(bankCoin string, msg xnats.OrderReq) (err error) {
 	if err != nil {
 		return
 	}
-	_, err = js.Publish(fmt.Sprintf("BANK.%s.OrderReq", strings.ToUpper(bankCoin)), data)
+	var opts []nats.PubOpt
+	if msg.ClientOrderID != "" {
+		opts = append(opts, nats.MsgId(fmt.Sprintf("%d:%s", msg.Owner, msg.ClientOrderID)))
+	}
+	ack, err := js.Publish(fmt.Sprintf("BANK.%s.OrderReq", strings.ToUpper(bankCoin)), data, opts...)
+	if err != nil {
+		return
+	}
+	seq = ack.Sequence
+
+	return
+}
+
+func (w *Worker) SendCancelReq(bankCoin string, msg xnats.CancelReq) (err error) {
+	js, err := w.GetNats(bankCoin)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	_, err = js.Publish(fmt.Sprintf("BANK.%s.CancelReq", strings.ToUpper(bankCoin)), data)
+
+	return
+}
+
+// SendAmendReq publishes the amend request to the bank holding the frozen funds of the order
+//
+//	a new price and quantity must follow the trading rules of the symbol as for a new limit order, err is a *rules.Error otherwise
+func (w *Worker) SendAmendReq(bankCoin string, msg xnats.AmendReq) (err error) {
+	if msg.Price.IsPositive() {
+		var reason string
+		reason, err = rules.Shared.Check(xnats.OrderReq{
+			Symbol:   msg.Symbol,
+			Side:     msg.Side,
+			Type:     model.OrderTypeLimit,
+			Price:    msg.Price,
+			Quantity: msg.Quantity,
+			Amount:   msg.Price.Mul(msg.Quantity),
+		})
+		if err != nil {
+			return
+		}
+		if reason != "" {
+			return &rules.Error{Reason: reason}
+		}
+	}
+
+	js, err := w.GetNats(bankCoin)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	_, err = js.Publish(fmt.Sprintf("BANK.%s.AmendReq", strings.ToUpper(bankCoin)), data)
+
+	return
+}
+
+// SubOrderEvents subscribes to the events of the orders of the owner whose funds are held by the bank of bankCoin,
+// i.e. the base coin for asks and the quote coin for bids, only events published from now on are delivered
+//
+//	use ClientOrderID, or MsgSeq as returned by SendOrderReq, to correlate the events with the requests
+func (w *Worker) SubOrderEvents(bankCoin string, owner int64, handler func(xnats.OrderEvent)) (sub *nats.Subscription, err error) {
+	js, err := w.GetNats(bankCoin)
+	if err != nil {
+		return
+	}
+
+	sub, err = js.Subscribe(xnats.OrderEventSubject(owner), func(msg *nats.Msg) {
+		var ev xnats.OrderEvent
+		if err := json.Unmarshal(msg.Data, &ev); err != nil {
+			logger.Errorf("SubOrderEvents unmarshal failed with data:%s, err:%s", msg.Data, err)
+			return
+		}
+		handler(ev)
+	}, nats.DeliverNew())
 
 	return
 }
@@ -15,17 +15,30 @@ type Order struct {
 
 	TicketID int64 `json:"ticketID" gorm:"omitempty; not null; default:0; index;"`
 
-	Owner    int64   `json:"owner" gorm:"omitempty; not null; default:0; index;"`
-	Side     int8    `json:"side" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // 1 sell ask, 2 buy bid
-	Type     int8    `json:"type" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // 1 limit, 2 market
-	Trades   int64   `json:"trades" gorm:"omitempty; not null; default:0;"`                // Current number of trades
-	Time     int64   `json:"time" gorm:"omitempty; not null; default:0;"`                  // Order creation time
-	FeeLevel float64 `json:"feeLevel" gorm:"omitempty; not null; default:0;"`              // Creator's fee rate level
+	Owner       int64   `json:"owner" gorm:"omitempty; not null; default:0; index;"`
+	Side        int8    `json:"side" gorm:"omitempty; not null; default:0; type:tinyint(1);"`        // 1 sell ask, 2 buy bid
+	Type        int8    `json:"type" gorm:"omitempty; not null; default:0; type:tinyint(1);"`        // 1 limit, 2 market
+	TimeInForce int8    `json:"timeInForce" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // 0 GTC, 1 IOC, 2 FOK, 3 post-only
+	Trades      int64   `json:"trades" gorm:"omitempty; not null; default:0;"`                       // Current number of trades
+	Time        int64   `json:"time" gorm:"omitempty; not null; default:0;"`                         // Order creation time
+	FeeLevel    float64 `json:"feeLevel" gorm:"omitempty; not null; default:0;"`                     // Creator's fee rate level
 
 	Price    decimal.Decimal `json:"price" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`    // Price
 	Quantity decimal.Decimal `json:"quantity" gorm:"omitempty; not null; default:0; type:decimal(36,18);"` // Remaining quantity
 	OrigQty  decimal.Decimal `json:"origQty" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`  // Quantity at the time of order creation
 	Amount   decimal.Decimal `json:"amount" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`   // Current total transaction amount
+	Frozen   decimal.Decimal `json:"frozen" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`   // Funds still frozen in the bank for this order
+
+	ClientOrderID       string `json:"clientOrderID" gorm:"omitempty; not null; default:''; size:64;"`              // Chosen by the client, carried by order events
+	SelfTradePrevention int8   `json:"selfTradePrevention" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // OrderSTPXxx
+
+	StopPrice decimal.Decimal `json:"stopPrice" gorm:"omitempty; not null; default:0; type:decimal(36,18);"` // Stop orders only
+	StopAbove bool            `json:"stopAbove" gorm:"omitempty; not null; default:false;"`                  // Triggered by a rising price, otherwise by a falling one
+	Seq       int64           `json:"seq" gorm:"omitempty; not null; default:0;"`                            // Log ID that put the order into the book, for time priority
+
+	DisplayQty decimal.Decimal `json:"displayQty" gorm:"omitempty; not null; default:0; type:decimal(36,18);"` // Iceberg orders only, size of a slice, the rest of Quantity is hidden
+	Visible    decimal.Decimal `json:"visible" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`    // Iceberg orders only, what is left of the current slice
+	ExpireAt   int64           `json:"expireAt" gorm:"omitempty; not null; default:0;"`                        // Good-till-time orders only, unix seconds, canceled by the ome once passed
 
 	Model
 }
@@ -36,6 +49,7 @@ const (
 	OrderStatusDraft      int8 = 0  // Draft, not shown to users
 	OrderStatusFrozen     int8 = 10 // Freezing funds stage
 	OrderStatusFreezeFail int8 = 11
+	OrderStatusPending    int8 = 15 // Stop order waiting for its stop price
 	OrderStatusMatching   int8 = 20 // Matching stage
 	OrderStatusMatched    int8 = 21
 	OrderStatusDone       int8 = 40 // Finishing stage
@@ -43,12 +57,29 @@ const (
 	OrderStatusBanned     int8 = 42 // Banned by the system
 	OrderStatusAppealing  int8 = 43 // Under appeal
 	OrderStatusAppealed   int8 = 44 // Appeal ended
+	OrderStatusRejected   int8 = 45 // Rejected by its time in force (FOK, post-only)
+	OrderStatusExpired    int8 = 46 // Canceled by the ome once its expiry passed
 
 	OrderSideAsk int8 = 1
 	OrderSideBid int8 = 2
 
-	OrderTypeLimit  int8 = 1
-	OrderTypeMarket int8 = 2
+	OrderTypeLimit      int8 = 1
+	OrderTypeMarket     int8 = 2
+	OrderTypeStopLimit  int8 = 3 // Becomes a limit order once the last trade price reaches the stop price
+	OrderTypeStopMarket int8 = 4 // Becomes a market order once the last trade price reaches the stop price
+
+	OrderTIFGTC      int8 = 0 // Good till canceled, the remainder rests in the book
+	OrderTIFIOC      int8 = 1 // Immediate or cancel, the remainder is canceled
+	OrderTIFFOK      int8 = 2 // Fill or kill, rejected unless it can be filled completely
+	OrderTIFPostOnly int8 = 3 // Rejected if it would take liquidity
+
+	// Self-trade prevention, applied when the new order would match an order of the same owner, the mode of the new order decides
+	OrderSTPDefault            int8 = 0 // Use the mode of the symbol, see config.SelfTradePrevention
+	OrderSTPNone               int8 = 1 // Trade with itself
+	OrderSTPCancelNewest       int8 = 2 // Cancel the new order
+	OrderSTPCancelOldest       int8 = 3 // Cancel the resting order
+	OrderSTPCancelBoth         int8 = 4 // Cancel both orders
+	OrderSTPDecrementAndCancel int8 = 5 // Take the smaller quantity off both orders, the one left with nothing is canceled
 )
 
 // Price limits for market orders
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// OrderReject model, an order request turned down by the bank, partitioned by the coin of the bank
+//
+// The NATS msg sequence of the request is the key ingress uses to look it up
+type OrderReject struct {
+	ID int64 `json:"id" gorm:"omitempty; primaryKey;"`
+
+	LogType   int64 `json:"logType" gorm:"omitempty; not null; default:0; uniqueindex:idx_or_log_type_id_index"`
+	LogID     int64 `json:"logID" gorm:"omitempty; not null; default:0; uniqueindex:idx_or_log_type_id_index"`
+	LogIndex  int64 `json:"logIndex" gorm:"omitempty; not null; default:0; uniqueindex:idx_or_log_type_id_index"`
+	LogOffset int64 `json:"logOffset" gorm:"omitempty; not null; default:0;"` // Position in the file
+
+	MsgSeq uint64 `json:"msgSeq" gorm:"omitempty; not null; default:0; uniqueindex:idx_or_msg_seq;"` // NATS msg stream sequence of the request
+
+	Owner  int64  `json:"owner" gorm:"omitempty; not null; default:0; index;"`
+	Symbol string `json:"symbol" gorm:"omitempty; not null; default:''; type:varchar(32);"`
+	Side   int8   `json:"side" gorm:"omitempty; not null; default:0; type:tinyint(1);"`     // 1 sell ask, 2 buy bid
+	Reason string `json:"reason" gorm:"omitempty; not null; default:''; type:varchar(64);"` // OrderRejectReasonXxx
+	Time   int64  `json:"time" gorm:"omitempty; not null; default:0;"`                      // Order request time, nanoseconds
+
+	ClientOrderID string `json:"clientOrderID" gorm:"omitempty; not null; default:''; size:64;"`
+
+	Required decimal.Decimal `json:"required" gorm:"omitempty; not null; default:0; type:decimal(36,18);"` // Funds the order needed to freeze, fee included
+	Free     decimal.Decimal `json:"free" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`     // Available funds at the time
+
+	Model
+}
+
+const (
+	OrderRejectReasonInsufficientBalance    = "InsufficientBalance"
+	OrderRejectReasonDuplicateClientOrderID = "DuplicateClientOrderID" // the owner used the client order id within the retention window
+	OrderRejectReasonInvalidClientOrderID   = "InvalidClientOrderID"   // longer than ClientOrderIDMaxLen
+	OrderRejectReasonSymbolNotTrading       = "SymbolNotTrading"       // the symbol or one of its coins is not listed or halted, see package catalog
+	OrderRejectReasonRulesUnavailable       = "RulesUnavailable"       // the catalog or the rules of the symbol are not read from etcd yet, try again
+
+	// Trading rules of the symbol, see package rules
+	OrderRejectReasonInvalidPrice       = "InvalidPrice"       // not positive or not a multiple of the tick size
+	OrderRejectReasonInvalidQuantity    = "InvalidQuantity"    // not positive or not a multiple of the step size
+	OrderRejectReasonQuantityOutOfRange = "QuantityOutOfRange" // below the min or above the max quantity
+	OrderRejectReasonMinNotional        = "MinNotional"        // price * quantity below the min notional
+	OrderRejectReasonPriceOutOfBand     = "PriceOutOfBand"     // too far from the last trade price
+	OrderRejectReasonInvalidStopPrice   = "InvalidStopPrice"   // stop order without a positive stop price on the tick size
+	OrderRejectReasonInvalidDisplayQty  = "InvalidDisplayQty"  // iceberg slice not on the step size, below the min quantity, or not a limit order
+	OrderRejectReasonInvalidExpireAt    = "InvalidExpireAt"    // expiry already passed
+
+	ClientOrderIDMaxLen = 64
+)
@@ -2,6 +2,7 @@ package model
 
 import (
 	"strings"
+	"sync"
 
 	"gorm.io/gorm"
 )
@@ -27,9 +28,61 @@ func TradeTable(symbol string) func(tx *gorm.DB) *gorm.DB {
 	}
 }
 
+// OrderRejectTable generates different table names based on the coin of the bank
+func OrderRejectTable(coin string) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Table(strings.ToLower(coin + "_order_rejects"))
+	}
+}
+
 // BalanceSnapTable generates different table names based on the trading pair
 func BalanceSnapTable(coin string) func(tx *gorm.DB) *gorm.DB {
 	return func(tx *gorm.DB) *gorm.DB {
 		return tx.Table(strings.ToLower(coin + "_balance_snaps"))
 	}
 }
+
+// migrated the symbols and coins whose tables exist, see MigrateSymbol and MigrateCoin
+var migrated sync.Map
+
+type tableModel struct {
+	scope func(tx *gorm.DB) *gorm.DB
+	model any
+}
+
+func migrate(db *gorm.DB, key string, tables []tableModel) (err error) {
+	if _, ok := migrated.Load(key); ok {
+		return
+	}
+	for _, t := range tables {
+		err = db.Scopes(t.scope).AutoMigrate(t.model)
+		if err != nil {
+			logger.Errorf("migrate tables of %s failed with err:%s", key, err)
+			return
+		}
+	}
+	migrated.Store(key, struct{}{})
+	logger.Infof("migrate tables of %s done", key)
+	return
+}
+
+// MigrateSymbol creates the missing tables of the symbol, the orders, the trades and the tickets of both sides,
+// outside of a transaction as MySQL commits it on DDL
+func MigrateSymbol(db *gorm.DB, symbol string) error {
+	symbol = strings.ToLower(symbol)
+	return migrate(db, "symbol "+symbol, []tableModel{
+		{OrderTable(symbol), Order{}},
+		{TradeTable(symbol), Trade{}},
+		{TicketTable(symbol, "ask"), Ticket{}},
+		{TicketTable(symbol, "bid"), Ticket{}},
+	})
+}
+
+// MigrateCoin creates the missing tables of the bank of the coin, the balance snaps and the order rejects
+func MigrateCoin(db *gorm.DB, coin string) error {
+	coin = strings.ToLower(coin)
+	return migrate(db, "coin "+coin, []tableModel{
+		{BalanceSnapTable(coin), BalanceSnap{}},
+		{OrderRejectTable(coin), OrderReject{}},
+	})
+}
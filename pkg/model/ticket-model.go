@@ -13,14 +13,30 @@ type Ticket struct {
 	LogIndex  int64 `json:"logIndex" gorm:"omitempty; not null; default:0; uniqueindex:idx_t_log_type_id_index"`
 	LogOffset int64 `json:"logOffset" gorm:"omitempty; not null; default:0;"` // Position in the file
 
-	Owner    int64   `json:"owner" gorm:"omitempty; not null; default:0; index;"`
-	Type     int8    `json:"type" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // 0 limit, 1 market
-	Time     int64   `json:"time" gorm:"omitempty; not null; default:0;"`                  // Ticket creation time, nanoseconds
-	FeeLevel float64 `json:"feeLevel" gorm:"omitempty; not null; default:0;"`              // Creator's fee rate level
+	Owner       int64   `json:"owner" gorm:"omitempty; not null; default:0; index;"`
+	Type        int8    `json:"type" gorm:"omitempty; not null; default:0; type:tinyint(1);"`        // 0 limit, 1 market
+	Action      int8    `json:"action" gorm:"omitempty; not null; default:0; type:tinyint(1);"`      // 0 create, 1 cancel
+	TimeInForce int8    `json:"timeInForce" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // 0 GTC, 1 IOC, 2 FOK, 3 post-only
+	OrderID     int64   `json:"orderID" gorm:"omitempty; not null; default:0;"`                      // Target order of a cancel or amend ticket
+	Time        int64   `json:"time" gorm:"omitempty; not null; default:0;"`                         // Ticket creation time, nanoseconds
+	FeeLevel    float64 `json:"feeLevel" gorm:"omitempty; not null; default:0;"`                     // Creator's fee rate level
 
 	Price    decimal.Decimal `json:"price" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`    // Price
 	Quantity decimal.Decimal `json:"quantity" gorm:"omitempty; not null; default:0; type:decimal(36,18);"` // Quantity
 	Amount   decimal.Decimal `json:"amount" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`   // Total amount
 
+	ClientOrderID       string `json:"clientOrderID" gorm:"omitempty; not null; default:''; size:64;"`              // Chosen by the client, carried by order events
+	SelfTradePrevention int8   `json:"selfTradePrevention" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // OrderSTPXxx
+
+	StopPrice  decimal.Decimal `json:"stopPrice" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`  // Stop orders only
+	DisplayQty decimal.Decimal `json:"displayQty" gorm:"omitempty; not null; default:0; type:decimal(36,18);"` // Iceberg orders only, size of the shown slice
+	ExpireAt   int64           `json:"expireAt" gorm:"omitempty; not null; default:0;"`                        // Good-till-time orders only, unix seconds
+
 	Model
 }
+
+const (
+	TicketActionCreate int8 = 0 // Create a new order
+	TicketActionCancel int8 = 1 // Cancel an existing order
+	TicketActionAmend  int8 = 2 // Change the price or quantity of an existing order
+)
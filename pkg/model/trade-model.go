@@ -25,5 +25,7 @@ type Trade struct {
 	AskFee   decimal.Decimal `json:"askFee" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`
 	BidFee   decimal.Decimal `json:"bidFee" gorm:"omitempty; not null; default:0; type:decimal(36,18);"`
 
+	TakerSide int8 `json:"takerSide" gorm:"omitempty; not null; default:0; type:tinyint(1);"` // Side of the order that took the liquidity, 1 ask, 2 bid
+
 	Model
 }
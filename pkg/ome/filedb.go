@@ -1,10 +1,13 @@
 package ome
 
 import (
-	"encoding/json"
+	"math/big"
 	"strings"
 
+	"ccoms/pkg/config"
+	"ccoms/pkg/filedb"
 	"ccoms/pkg/model"
+	"ccoms/pkg/rules"
 
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
@@ -12,7 +15,12 @@ import (
 
 // FiledbToMySQL retrieves the content of filedb in real-time and writes it to MySQL
 func (w *Worker) FiledbToMySQL() (err error) {
-	ch := make(chan string, 1000)
+	ch := make(chan filedb.Record[OmeLog], 1000)
+
+	err = model.MigrateSymbol(model.GetMySQL(), w.Symbol)
+	if err != nil {
+		return
+	}
 
 	w.SavedLogID, err = w.LoadSavedLogID()
 	if err != nil {
@@ -38,13 +46,16 @@ func (w *Worker) FiledbToMySQL() (err error) {
 	}
 
 	go func() {
-		err = w.fdb.Tailf(ch)
+		err = filedb.Iterate(w.fdb, filedb.IterOptions{From: w.SavedLogID + 1, Follow: true}, func(r filedb.Record[OmeLog]) error {
+			ch <- r
+			return nil
+		})
 		if err != nil {
 			close(ch)
 		}
 	}()
 
-	err2 := w.fdb.ToMySQL(ch)
+	err2 := filedb.ToMySQL(w.fdb, ch, w.ParseAndWriteLogs)
 	if err == nil {
 		err = err2
 	}
@@ -52,7 +63,7 @@ func (w *Worker) FiledbToMySQL() (err error) {
 	return
 }
 
-func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
+func (w *Worker) ParseAndWriteLogs(rs []filedb.Record[OmeLog]) (err error) {
 	latestLogID := 0
 	latestOrderID := int64(0)
 	latestAskTicketID := int64(0)
@@ -61,19 +72,32 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 	newTrades := make([]model.Trade, 0)
 	newOrders := make([]model.Order, 0)
 	updateOrders := make(map[int64]*model.Order)
-
-	for _, s := range ss {
-		ol := new(OmeLog)
-		err = json.Unmarshal([]byte(s), ol)
-		if err != nil {
-			return
-		}
+	cancelOrders := make([]int64, 0)
+	decrementOrders := make(map[int64]*model.Order) // partially canceled, not touched by the trades in this batch
+	rejectOrders := make([]int64, 0)
+	expireOrders := make([]int64, 0)
+	stopOrders := make([]int64, 0)                  // new orders waiting in the trigger book
+	triggerOrders := make(map[int64]int64)          // stop orders moved into the list, the value is the new seq
+	replenishOrders := make(map[int64]*model.Order) // iceberg orders showing a new slice, queued again from a new seq
+	amendOrders := make(map[int64]*model.Order)     // orders changed in place, queued again from a new seq unless it is 0
+
+	for _, r := range rs {
+		ol := r.Log
 
 		if ol.LogID <= w.SavedLogID {
 			latestLogID = int(ol.LogID)
 			continue
 		}
 
+		// let the owners know, before the log is saved so that nothing is lost on failures
+		if config.Shared.OrderEvents.Enabled {
+			err = w.PublishOrderEvents(ol)
+			if err != nil {
+				logger.Errorf("PublishOrderEvents failed with logID:%d, err:%s", ol.LogID, err)
+				return
+			}
+		}
+
 		var logIndex int64
 
 		if ol.MatchLogs != nil && len(ol.MatchLogs) > 0 {
@@ -100,6 +124,8 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 				Bider:    ml.Bider,
 				AskFee:   askFee,
 				BidFee:   bidFee,
+
+				TakerSide: ml.TakerSide,
 			}
 			newTrades = append(newTrades, trade)
 
@@ -110,7 +136,9 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 				Owner:    ml.Asker,
 				Quantity: IntToDecimal(ml.AskQuantity),
 				Amount:   IntToDecimal(ml.Amount),
+				Frozen:   intToDecimalOrZero(ml.AskFrozen),
 				Trades:   1,
+				Visible:  intToDecimalOrZero(ml.AskVisible),
 			}
 			logIndex++
 			o2 := model.Order{
@@ -118,14 +146,20 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 				Owner:    ml.Bider,
 				Quantity: IntToDecimal(ml.BidQuantity),
 				Amount:   IntToDecimal(ml.Amount),
+				Frozen:   intToDecimalOrZero(ml.BidFrozen),
 				Trades:   1,
+				Visible:  intToDecimalOrZero(ml.BidVisible),
 			}
+			delete(decrementOrders, ml.AskID)
+			delete(decrementOrders, ml.BidID)
 			_, ok := updateOrders[ml.AskID]
 			if !ok {
 				updateOrders[ml.AskID] = &o1
 			} else {
 				updateOrders[ml.AskID].Quantity = o1.Quantity
 				updateOrders[ml.AskID].Amount = o1.Amount
+				updateOrders[ml.AskID].Frozen = o1.Frozen
+				updateOrders[ml.AskID].Visible = o1.Visible
 				updateOrders[ml.AskID].Trades = updateOrders[ml.AskID].Trades + 1
 			}
 			_, ok = updateOrders[ml.BidID]
@@ -134,8 +168,52 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			} else {
 				updateOrders[ml.BidID].Quantity = o2.Quantity
 				updateOrders[ml.BidID].Amount = o2.Amount
+				updateOrders[ml.BidID].Frozen = o2.Frozen
+				updateOrders[ml.BidID].Visible = o2.Visible
 				updateOrders[ml.BidID].Trades = updateOrders[ml.BidID].Trades + 1
 			}
+			// a slice replenished earlier in this batch is updated by both, they must agree
+			if o, ok := replenishOrders[ml.AskID]; ok {
+				o.Visible = o1.Visible
+			}
+			if o, ok := replenishOrders[ml.BidID]; ok {
+				o.Visible = o2.Visible
+			}
+			if o, ok := amendOrders[ml.AskID]; ok {
+				o.Quantity, o.Frozen, o.Visible = o1.Quantity, o1.Frozen, o1.Visible
+			}
+			if o, ok := amendOrders[ml.BidID]; ok {
+				o.Quantity, o.Frozen, o.Visible = o2.Quantity, o2.Frozen, o2.Visible
+			}
+		}
+
+		for _, cl := range ol.CancelLogs {
+			if cl.Partial() {
+				if o, ok := amendOrders[cl.ID]; ok {
+					o.Quantity = IntToDecimal(cl.Remaining)
+					o.Frozen = intToDecimalOrZero(cl.Frozen)
+				}
+				if o, ok := updateOrders[cl.ID]; ok {
+					o.Quantity = IntToDecimal(cl.Remaining)
+					o.Frozen = intToDecimalOrZero(cl.Frozen)
+				} else {
+					decrementOrders[cl.ID] = &model.Order{
+						Quantity: IntToDecimal(cl.Remaining),
+						Frozen:   intToDecimalOrZero(cl.Frozen),
+					}
+				}
+			} else if cl.Rejected() {
+				rejectOrders = append(rejectOrders, cl.ID)
+			} else if cl.Reason == CancelReasonExpired {
+				expireOrders = append(expireOrders, cl.ID)
+			} else if cl.Reason != CancelReasonInvalid {
+				cancelOrders = append(cancelOrders, cl.ID)
+			}
+			if cl.Side == model.OrderSideAsk {
+				latestAskTicketID = cl.TicketID
+			} else {
+				latestBidTicketID = cl.TicketID
+			}
 		}
 
 		if ol.OrderLogs != nil && len(ol.OrderLogs) > 0 {
@@ -160,6 +238,29 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 				Side:     ml.Side,
 				Type:     ml.Type,
 				FeeLevel: float64(ml.FeeRate),
+				Frozen:   intToDecimalOrZero(ml.Frozen),
+
+				TimeInForce:   ml.TimeInForce,
+				ClientOrderID: ml.ClientOrderID,
+
+				SelfTradePrevention: ml.SelfTradePrevention,
+
+				StopPrice: intToDecimalOrZero(ml.StopPrice),
+				StopAbove: ml.StopAbove,
+				Seq:       ol.LogID,
+
+				DisplayQty: intToDecimalOrZero(ml.DisplayQty),
+				ExpireAt:   ml.ExpireAt,
+			}
+			if ml.DisplayQty != nil {
+				order.Visible = IntToDecimal(Min(ml.DisplayQty, ml.Quantity))
+			}
+			if ml.Type == model.OrderTypeStopLimit || ml.Type == model.OrderTypeStopMarket {
+				stopOrders = append(stopOrders, order.ID)
+				// the quote budget of a stop-market bid is needed again once it is triggered
+				if ml.Amount != nil {
+					order.Amount = IntToDecimal(ml.Amount)
+				}
 			}
 			newOrders = append(newOrders, order)
 			latestOrderID = order.ID
@@ -170,10 +271,60 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			}
 		}
 
+		for _, tl := range ol.TriggerLogs {
+			triggerOrders[tl.ID] = ol.LogID
+		}
+
+		for _, al := range ol.AmendLogs {
+			if al.Side == model.OrderSideAsk {
+				latestAskTicketID = al.TicketID
+			} else {
+				latestBidTicketID = al.TicketID
+			}
+			if !al.Applied() {
+				continue
+			}
+
+			a := &model.Order{
+				Price:    IntToDecimal(al.Price),
+				Quantity: IntToDecimal(al.Quantity),
+				Frozen:   IntToDecimal(al.Frozen),
+				Visible:  intToDecimalOrZero(al.Visible),
+			}
+			if !al.KeepPriority {
+				a.Seq = ol.LogID
+			}
+			if o, ok := amendOrders[al.ID]; ok && a.Seq == 0 {
+				a.Seq = o.Seq
+			}
+			amendOrders[al.ID] = a
+			if o, ok := updateOrders[al.ID]; ok {
+				o.Quantity, o.Frozen, o.Visible = a.Quantity, a.Frozen, a.Visible
+			}
+			if o, ok := replenishOrders[al.ID]; ok {
+				o.Visible = a.Visible
+				if a.Seq > 0 {
+					o.Seq = a.Seq
+				}
+			}
+			delete(decrementOrders, al.ID)
+		}
+
+		for _, rl := range ol.ReplenishLogs {
+			visible := IntToDecimal(rl.Visible)
+			replenishOrders[rl.ID] = &model.Order{Seq: ol.LogID, Visible: visible}
+			if o, ok := updateOrders[rl.ID]; ok {
+				o.Visible = visible
+			}
+			if o, ok := amendOrders[rl.ID]; ok {
+				o.Seq, o.Visible = ol.LogID, visible
+			}
+		}
+
 		latestLogID = int(ol.LogID)
 	}
 
-	if len(newTrades) == 0 && len(newOrders) == 0 && len(updateOrders) == 0 {
+	if len(newTrades) == 0 && len(newOrders) == 0 && len(updateOrders) == 0 && len(decrementOrders) == 0 && len(triggerOrders) == 0 && len(replenishOrders) == 0 && len(amendOrders) == 0 && latestLogID <= int(w.SavedLogID) {
 		logger.Tracef("ParseAndWriteLogs skip because no newTrades/newOrders with latestLogID:%d, saveLogID:%d", latestLogID, w.SavedLogID)
 		return
 	}
@@ -183,11 +334,15 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 	updateOrderValues := make([]interface{}, 0)
 	updateOrderValues2 := make([]interface{}, 0)
 	updateOrderValues3 := make([]interface{}, 0)
+	updateOrderValues4 := make([]interface{}, 0)
+	updateOrderValues5 := make([]interface{}, 0)
 	ids := make([]interface{}, 0)
 
 	_sql1 := "WHEN ? THEN ?\n"
 	_sql2 := "WHEN ? THEN ?\n"
 	_sql3 := "WHEN ? THEN `trades` + ?\n"
+	_sql5 := "WHEN ? THEN ?\n"
+	_sql6 := "WHEN ? THEN ?\n"
 	_sql4 := "(?,?)"
 	_sqlCount := 0
 
@@ -200,6 +355,8 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 		updateOrderValues = append(updateOrderValues, oid, o.Quantity)
 		updateOrderValues2 = append(updateOrderValues2, oid, o.Amount)
 		updateOrderValues3 = append(updateOrderValues3, oid, o.Trades)
+		updateOrderValues4 = append(updateOrderValues4, oid, o.Frozen)
+		updateOrderValues5 = append(updateOrderValues5, oid, o.Visible)
 		if o.Quantity.Equal(decimal.Zero) {
 			delOrders = append(delOrders, oid)
 		}
@@ -218,6 +375,8 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 
 	updateOrderValues = append(updateOrderValues, updateOrderValues2...)
 	updateOrderValues = append(updateOrderValues, updateOrderValues3...)
+	updateOrderValues = append(updateOrderValues, updateOrderValues4...)
+	updateOrderValues = append(updateOrderValues, updateOrderValues5...)
 	updateOrderValues = append(updateOrderValues, ids...)
 
 	_sql4 = strings.Repeat("?,", len(ids))
@@ -238,6 +397,14 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 		"`trades` = CASE id\n" +
 		strings.Repeat(_sql3, _sqlCount) +
 		"ELSE `trades`\n" +
+		"END,\n" +
+		"`frozen` = CASE id\n" +
+		strings.Repeat(_sql5, _sqlCount) +
+		"ELSE `frozen`\n" +
+		"END,\n" +
+		"`visible` = CASE id\n" +
+		strings.Repeat(_sql6, _sqlCount) +
+		"ELSE `visible`\n" +
 		"END\n" +
 		"WHERE `id` IN (" + _sql4 + ");"
 
@@ -251,6 +418,44 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			}
 		}
 
+		// stop orders are pending until triggered, then they are ordinary orders queued from the trigger
+		if len(stopOrders) > 0 {
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id` in (?)", stopOrders).Limit(len(stopOrders)).
+				Update("status", model.OrderStatusPending).Error
+			if err != nil {
+				return
+			}
+		}
+		for oid, seq := range triggerOrders {
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id`=?", oid).Limit(1).
+				Updates(map[string]any{"status": model.OrderStatusMatching, "seq": seq}).Error
+			if err != nil {
+				return
+			}
+		}
+		for oid, o := range amendOrders {
+			values := map[string]any{"price": o.Price, "quantity": o.Quantity, "frozen": o.Frozen, "visible": o.Visible}
+			if o.Seq > 0 {
+				values["seq"] = o.Seq
+			}
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id`=?", oid).Limit(1).
+				Updates(values).Error
+			if err != nil {
+				return
+			}
+		}
+		for oid, o := range replenishOrders {
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id`=?", oid).Limit(1).
+				Updates(map[string]any{"seq": o.Seq, "visible": o.Visible}).Error
+			if err != nil {
+				return
+			}
+		}
+
 		if len(newTrades) > 0 {
 			err = tx.Scopes(model.TradeTable(w.Symbol)).CreateInBatches(newTrades, len(newTrades)).Error
 			if err != nil {
@@ -275,6 +480,40 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 			}
 		}
 
+		// the remaining quantity is kept, the frozen funds have been refunded
+		if len(cancelOrders) > 0 {
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id` in (?)", cancelOrders).Limit(len(cancelOrders)).
+				Updates(map[string]any{"status": model.OrderStatusCancel, "frozen": decimal.Zero}).Error
+			if err != nil {
+				return
+			}
+		}
+		for oid, o := range decrementOrders {
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id`=?", oid).Limit(1).
+				Updates(map[string]any{"quantity": o.Quantity, "frozen": o.Frozen}).Error
+			if err != nil {
+				return
+			}
+		}
+		if len(rejectOrders) > 0 {
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id` in (?)", rejectOrders).Limit(len(rejectOrders)).
+				Updates(map[string]any{"status": model.OrderStatusRejected, "frozen": decimal.Zero}).Error
+			if err != nil {
+				return
+			}
+		}
+		if len(expireOrders) > 0 {
+			err = tx.Scopes(model.OrderTable(w.Symbol)).
+				Where("`id` in (?)", expireOrders).Limit(len(expireOrders)).
+				Updates(map[string]any{"status": model.OrderStatusExpired, "frozen": decimal.Zero}).Error
+			if err != nil {
+				return
+			}
+		}
+
 		err = tx.Model(model.Lastkv{}).
 			Where("`app`=? and `key`=? and `val`<?", strings.ToLower(w.Name), model.LASTKV_K_SAVED_LOG_ID, latestLogID).
 			Limit(1).Update("`val`", latestLogID).Error
@@ -315,5 +554,20 @@ func (w *Worker) ParseAndWriteLogs(ss []string) (err error) {
 
 	w.SavedLogID = int64(latestLogID)
 
+	// the last trade price bounds the prices of new orders, see rules.Rules.MaxDeviation
+	if len(newTrades) > 0 {
+		err2 := rules.PutLastPrice(w.Symbol, newTrades[len(newTrades)-1].Price)
+		if err2 != nil {
+			logger.Warningf("PutLastPrice failed with err:%s", err2)
+		}
+	}
+
 	return
 }
+
+func intToDecimalOrZero(i *big.Int) decimal.Decimal {
+	if i == nil {
+		return decimal.Zero
+	}
+	return IntToDecimal(i)
+}
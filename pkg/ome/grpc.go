@@ -1,13 +1,17 @@
 package ome
 
 import (
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/model"
+	"ccoms/pkg/replica"
 	"ccoms/pkg/xetcd"
 	"ccoms/pkg/xgrpc"
 	"context"
-	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
 	"strings"
 
-	"github.com/shopspring/decimal"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
@@ -24,11 +28,16 @@ func (s *BankServiceClient) BalanceChanges(ctx context.Context, opts ...grpc.Cal
 	return nil, nil
 }
 
+// PushBalanceChanges pushes the balance changes to the bank of the coin, until the stream fails or the bank moves,
+// xetcd.ErrChanged then
 func (w *Worker) PushBalanceChanges(coin string) (err error) {
-	grpcUrl, err := xetcd.Get(xetcd.KeyBankService(coin))
+	key := xetcd.KeyBankService(coin)
+	grpcUrl, err := xetcd.GetWait(context.Background(), key)
 	if err != nil {
 		return
 	}
+	ctx, cancel := xetcd.Changed(context.Background(), key, grpcUrl)
+	defer cancel()
 
 	grcpClient, err := grpc.Dial(grpcUrl, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -38,10 +47,15 @@ func (w *Worker) PushBalanceChanges(coin string) (err error) {
 
 	client := xgrpc.NewBankServiceClient(grcpClient)
 
-	chClient, err := client.BalanceChanges(context.Background())
+	chClient, err := client.BalanceChanges(ctx)
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = xetcd.ErrChanged
+		}
+	}()
 
 	var firstID int64
 	err = chClient.Send(&xgrpc.BalanceChange{
@@ -69,98 +83,143 @@ func (w *Worker) PushBalanceChanges(coin string) (err error) {
 }
 
 func (w *Worker) PushBalanceLogs(coin string, chClient xgrpc.BankService_BalanceChangesClient, firstID int64) (err error) {
-	ch := make(chan string, 1000)
-	ctx := context.Background()
-
-	var push = func(s string) (err error) {
-		var bl OmeLog
-		err = json.Unmarshal([]byte(s), &bl)
-		if err != nil {
-			return
-		}
-		if len(bl.MatchLogs) == 0 {
+	var push = func(r filedb.Record[OmeLog]) (err error) {
+		bc, err := w.BalanceChangeOf(coin, r.Log)
+		if err != nil || bc == nil {
 			return
 		}
-		ml := bl.MatchLogs[0]
+		bc.ReasonIDFirst = firstID
+		return chClient.Send(bc)
+	}
 
-		if bl.LogID <= firstID {
-			return
-		}
+	// a failed send or the end of the stream ends the push, StartBanker connects again
+	return filedb.Iterate(w.fdb, filedb.IterOptions{From: firstID + 1, Follow: true, Done: chClient.Context().Done()}, push)
+}
 
-		quantity := IntToDecimal(ml.Quantity)
-		amount := IntToDecimal(ml.Amount)
+// balanceLeg the change of one owner's balance in a BalanceChange
+type balanceLeg struct {
+	owner  int64
+	free   *big.Int
+	freeze *big.Int
+}
 
-		// BTC TODO distinguish between USDT and BTC
-		if coin == w.QuoteAsset {
-			// USDT
-			err = chClient.Send(&xgrpc.BalanceChange{
-				Reason:        "match",
-				ReasonTable:   "ome_" + strings.ToLower(w.Symbol) + "_logs",
-				ReasonID:      bl.LogID,
-				Owner:         ml.Asker,
-				FreeChange:    amount.String(),
-				FreezeChange:  decimal.Zero.String(),
-				Owner2:        ml.Bider,
-				FreeChange2:   decimal.Zero.String(),
-				FreezeChange2: amount.Neg().String(),
-				ReasonIDFirst: firstID,
-			})
-			if err != nil {
+// BalanceChangeOf returns the balance change of the given coin caused by the log, nil if it has none
+//
+//	all changes of a log are merged by owner into one BalanceChange, a trade touches at most
+//	the asker, the bider and the fee collector of each coin
+func (w *Worker) BalanceChangeOf(coin string, bl *OmeLog) (bc *xgrpc.BalanceChange, err error) {
+	legs := make([]*balanceLeg, 0, 3)
+	add := func(owner int64, free, freeze *big.Int) {
+		if owner == 0 || (IsZero(free) && IsZero(freeze)) {
+			return
+		}
+		for _, leg := range legs {
+			if leg.owner == owner {
+				leg.free.Add(leg.free, free)
+				leg.freeze.Add(leg.freeze, freeze)
 				return
 			}
 		}
+		legs = append(legs, &balanceLeg{
+			owner:  owner,
+			free:   big.NewInt(0).Set(free),
+			freeze: big.NewInt(0).Set(freeze),
+		})
+	}
+	neg := func(i ...*big.Int) *big.Int {
+		sum := big.NewInt(0)
+		for _, v := range i {
+			sum.Sub(sum, OrZero(v))
+		}
+		return sum
+	}
+
+	reason := "match"
+	for _, ml := range bl.MatchLogs {
+		zero := big.NewInt(0)
+		if coin == w.QuoteAsset {
+			// USDT: the asker gets the amount, the bider pays it plus the fee from frozen funds
+			add(ml.Asker, ml.Amount, zero)
+			add(ml.Bider, OrZero(ml.BidRefund), neg(ml.Amount, ml.BidFee, ml.BidRefund))
+			add(w.FeeCollector, OrZero(ml.BidFee), zero)
+		}
 		if coin == w.BaseAsset {
-			// BTC
-			err = chClient.Send(&xgrpc.BalanceChange{
-				Reason:        "match",
-				ReasonTable:   "ome_" + strings.ToLower(w.Symbol) + "_logs",
-				ReasonID:      bl.LogID,
-				Owner:         ml.Asker,
-				FreeChange:    decimal.Zero.String(),
-				FreezeChange:  quantity.Neg().String(),
-				Owner2:        ml.Bider,
-				FreeChange2:   quantity.String(),
-				FreezeChange2: decimal.Zero.String(),
-				ReasonIDFirst: firstID,
-			})
-			if err != nil {
-				return
-			}
+			// BTC: the bider gets the quantity, the asker pays it plus the fee from frozen funds
+			add(ml.Asker, OrZero(ml.AskRefund), neg(ml.Quantity, ml.AskFee, ml.AskRefund))
+			add(ml.Bider, ml.Quantity, zero)
+			add(w.FeeCollector, OrZero(ml.AskFee), zero)
 		}
+	}
 
-		return
+	// refund the frozen funds of canceled orders, asks are frozen in BTC, bids in USDT
+	for _, cl := range bl.CancelLogs {
+		refundCoin := w.QuoteAsset
+		if cl.Side == model.OrderSideAsk {
+			refundCoin = w.BaseAsset
+		}
+		if coin != refundCoin {
+			continue
+		}
+		if len(bl.MatchLogs) == 0 {
+			reason = "cancel"
+		}
+		add(cl.Owner, OrZero(cl.Refund), neg(cl.Refund))
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case s := <-ch:
-				err = push(s)
-				if err != nil {
-					return
-				}
-			}
+	// an amend returns what is no longer needed, the order keeps the rest frozen
+	for _, al := range bl.AmendLogs {
+		refundCoin := w.QuoteAsset
+		if al.Side == model.OrderSideAsk {
+			refundCoin = w.BaseAsset
 		}
-	}()
+		if coin != refundCoin {
+			continue
+		}
+		reason = "amend"
+		add(al.Owner, OrZero(al.Refund), neg(al.Refund))
+	}
 
-	// TODO starting from the latest id will be more efficient
-	err = w.fdb.Tailf(ch)
-	if err != nil {
-		close(ch)
+	if len(legs) == 0 {
+		return
+	}
+	if len(legs) > 3 {
+		err = errors.New("too many owners in one balance change")
+		logger.Errorf("BalanceChangeOf failed with logID:%d, coin:%s, err:%s", bl.LogID, coin, err)
 		return
 	}
 
+	bc = &xgrpc.BalanceChange{
+		Reason:       reason,
+		ReasonTable:  "ome_" + strings.ToLower(w.Symbol) + "_logs",
+		ReasonID:     bl.LogID,
+		Owner:        legs[0].owner,
+		FreeChange:   IntToDecimal(legs[0].free).String(),
+		FreezeChange: IntToDecimal(legs[0].freeze).String(),
+	}
+	if len(legs) > 1 {
+		bc.Owner2 = legs[1].owner
+		bc.FreeChange2 = IntToDecimal(legs[1].free).String()
+		bc.FreezeChange2 = IntToDecimal(legs[1].freeze).String()
+	}
+	if len(legs) > 2 {
+		bc.Owner3 = legs[2].owner
+		bc.FreeChange3 = IntToDecimal(legs[2].free).String()
+		bc.FreezeChange3 = IntToDecimal(legs[2].freeze).String()
+	}
+
 	return
 }
 
-// PullTickets connect to grpc service and continuously receive tickets
+// PullTickets connect to grpc service and continuously receive tickets, until the stream fails or the bank moves,
+// xetcd.ErrChanged then
 func (w *Worker) PullTickets(coin string, ch chan<- *xgrpc.Ticket) (err error) {
-	grpcUrl, err := xetcd.Get(xetcd.KeyBankService(coin))
+	key := xetcd.KeyBankService(coin)
+	grpcUrl, err := xetcd.GetWait(context.Background(), key)
 	if err != nil {
 		return
 	}
+	ctx, cancel := xetcd.Changed(context.Background(), key, grpcUrl)
+	defer cancel()
 
 	logger.Infof("PullTickets connecting %s", grpcUrl)
 
@@ -182,7 +241,7 @@ func (w *Worker) PullTickets(coin string, ch chan<- *xgrpc.Ticket) (err error) {
 		lastID = w.LatestBidTicketID
 	}
 
-	chClient, err := client.Tickets(context.Background(), &xgrpc.ID{Id: lastID})
+	chClient, err := client.Tickets(ctx, &xgrpc.ID{Id: lastID})
 	if err != nil {
 		return
 	}
@@ -191,9 +250,49 @@ func (w *Worker) PullTickets(coin string, ch chan<- *xgrpc.Ticket) (err error) {
 	for {
 		msg, err = chClient.Recv()
 		if err != nil {
+			if ctx.Err() != nil {
+				err = xetcd.ErrChanged
+			}
 			return
 		}
 		logger.Tracef("recv new msg(%d) from grpc", msg.Id)
 		ch <- msg
 	}
 }
+
+// ServeGrpc serves the ReplicaService of the ome at w.Addr or xetcd.KeyOmeService
+func (w *Worker) ServeGrpc() (err error) {
+	grpcUrl := w.Addr
+	if grpcUrl == "" {
+		grpcUrl, err = xetcd.Get(xetcd.KeyOmeService(w.Symbol))
+		if err != nil {
+			return
+		}
+	}
+
+	ss := strings.Split(grpcUrl, ":")
+	addr := ":" + ss[len(ss)-1]
+
+	grpcServer := grpc.NewServer()
+	xgrpc.RegisterReplicaServiceServer(grpcServer, replica.NewServer[OmeLog](w.fdb))
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	// the standbys find this ome here
+	if w.Addr != "" {
+		var r *xetcd.Registration
+		r, err = xetcd.Register(xetcd.KeyOmeService(w.Symbol), w.Addr)
+		if err != nil {
+			lis.Close()
+			return
+		}
+		defer r.Deregister()
+	}
+
+	logger.Infof("grpc server listening %s", addr)
+
+	return grpcServer.Serve(lis)
+}
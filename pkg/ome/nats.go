@@ -1,25 +1,219 @@
 package ome
 
-// func (w *Worker) GetNats() (js nats.JetStreamContext, err error) {
-// 	if w.Nats != nil {
-// 		return w.Nats, nil
-// 	}
+import (
+	"ccoms/pkg/model"
+	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xnats"
+	"context"
+	"fmt"
+	"strings"
 
-// 	// Connect to NATS
-// 	nc, err := nats.Connect(nats.DefaultURL)
-// 	if err != nil {
-// 		return
-// 	}
+	"github.com/nats-io/nats.go"
+)
 
-// 	// Create JetStream Context
-// 	js, err = nc.JetStream(nats.PublishAsyncMaxPending(256))
-// 	if err != nil {
-// 		return
-// 	}
-// 	w.Nats = js
+// GetNats returns the JetStream context of the NATS server of the bank of the coin,
+// the connection is closed and made again to the new address once xetcd.KeyNatsService changes
+func (w *Worker) GetNats(coin string) (js nats.JetStreamContext, err error) {
+	w.natsMu.Lock()
+	defer w.natsMu.Unlock()
 
-// 	return
-// }
+	if w.natsConns[coin] != nil {
+		return w.natsConns[coin], nil
+	}
+
+	key := xetcd.KeyNatsService(coin)
+	natsUrl, err := xetcd.Get(key)
+	if err != nil {
+		return
+	}
+
+	// Connect to NATS
+	nc, err := nats.Connect(natsUrl)
+	if err != nil {
+		return
+	}
+
+	// Create JetStream Context
+	js, err = nc.JetStream(nats.PublishAsyncMaxPending(256))
+	if err != nil {
+		return
+	}
+	w.natsConns[coin] = js
+
+	// connect to the new address once it changes
+	ctx, cancel := xetcd.Changed(context.Background(), key, natsUrl)
+	go func() {
+		<-ctx.Done()
+		cancel()
+
+		w.natsMu.Lock()
+		if w.natsConns[coin] == js {
+			delete(w.natsConns, coin)
+		}
+		w.natsMu.Unlock()
+		nc.Close()
+
+		if _, err := w.GetNats(coin); err != nil {
+			logger.Errorf("GetNats coin(%s) failed to reconnect with err:%s", coin, err)
+		}
+	}()
+
+	return
+}
+
+// OrderEventsOf returns the order events of the log
+//
+//	triggers: triggered
+//	rests: resting
+//	matchs: partiallyFilled or filled, for both orders
+//	amends: amended, or rejected if the amend was invalid
+//	cancels: cancelled, expired, decremented if only part of the order was canceled,
+//	or rejected if the order was turned down as a whole or the cancel request was invalid
+func (w *Worker) OrderEventsOf(ol *OmeLog) (events []xnats.OrderEvent) {
+	for _, tl := range ol.TriggerLogs {
+		events = append(events, xnats.OrderEvent{
+			Type:          xnats.OrderEventTriggered,
+			ClientOrderID: tl.ClientOrderID,
+			Owner:         tl.Owner,
+			Symbol:        w.Symbol,
+			Side:          tl.Side,
+			TicketID:      tl.TicketID,
+			OrderID:       tl.ID,
+			Price:         IntToDecimal(tl.Price),
+			Remaining:     IntToDecimal(tl.Quantity),
+			Time:          ol.Ts,
+		})
+	}
+
+	for _, rl := range ol.RestLogs {
+		events = append(events, xnats.OrderEvent{
+			Type:          xnats.OrderEventResting,
+			ClientOrderID: rl.ClientOrderID,
+			Owner:         rl.Owner,
+			Symbol:        w.Symbol,
+			Side:          rl.Side,
+			TicketID:      rl.TicketID,
+			OrderID:       rl.ID,
+			Price:         IntToDecimal(rl.Price),
+			Remaining:     IntToDecimal(rl.Quantity),
+			Time:          ol.Ts,
+		})
+	}
+
+	for _, ml := range ol.MatchLogs {
+		ask := xnats.OrderEvent{
+			Type:          xnats.OrderEventPartiallyFilled,
+			ClientOrderID: ml.AskClientOrderID,
+			Owner:         ml.Asker,
+			Symbol:        w.Symbol,
+			Side:          model.OrderSideAsk,
+			OrderID:       ml.AskID,
+			Price:         IntToDecimal(ml.Price),
+			Quantity:      IntToDecimal(ml.Quantity),
+			Remaining:     IntToDecimal(ml.AskQuantity),
+			Fee:           intToDecimalOrZero(ml.AskFee),
+			Time:          ol.Ts,
+		}
+		if IsZero(ml.AskQuantity) {
+			ask.Type = xnats.OrderEventFilled
+		}
+
+		// a market bid is sized by its budget, what is left of it is reported instead
+		bidRemaining := ml.BidQuantity
+		if ml.BidAmount != nil {
+			bidRemaining = ml.BidAmount
+		}
+		bid := xnats.OrderEvent{
+			Type:          xnats.OrderEventPartiallyFilled,
+			ClientOrderID: ml.BidClientOrderID,
+			Owner:         ml.Bider,
+			Symbol:        w.Symbol,
+			Side:          model.OrderSideBid,
+			OrderID:       ml.BidID,
+			Price:         IntToDecimal(ml.Price),
+			Quantity:      IntToDecimal(ml.Quantity),
+			Remaining:     IntToDecimal(bidRemaining),
+			Fee:           intToDecimalOrZero(ml.BidFee),
+			Time:          ol.Ts,
+		}
+		if IsZero(bidRemaining) {
+			bid.Type = xnats.OrderEventFilled
+		}
+
+		events = append(events, ask, bid)
+	}
+
+	for _, al := range ol.AmendLogs {
+		ev := xnats.OrderEvent{
+			Type:          xnats.OrderEventAmended,
+			ClientOrderID: al.ClientOrderID,
+			Owner:         al.Owner,
+			Symbol:        w.Symbol,
+			Side:          al.Side,
+			TicketID:      al.TicketID,
+			OrderID:       al.ID,
+			Price:         IntToDecimal(al.Price),
+			Remaining:     IntToDecimal(al.Quantity),
+			Time:          ol.Ts,
+		}
+		if !al.Applied() {
+			ev.Type = xnats.OrderEventRejected
+			ev.Reason = al.Reason
+		}
+		events = append(events, ev)
+	}
+
+	for _, cl := range ol.CancelLogs {
+		ev := xnats.OrderEvent{
+			Type:          xnats.OrderEventCancelled,
+			ClientOrderID: cl.ClientOrderID,
+			Owner:         cl.Owner,
+			Symbol:        w.Symbol,
+			Side:          cl.Side,
+			TicketID:      cl.TicketID,
+			OrderID:       cl.ID,
+			Reason:        cl.Reason,
+			Remaining:     intToDecimalOrZero(cl.Quantity),
+			Time:          ol.Ts,
+		}
+		if cl.Rejected() || cl.Reason == CancelReasonInvalid {
+			ev.Type = xnats.OrderEventRejected
+		} else if cl.Reason == CancelReasonExpired {
+			ev.Type = xnats.OrderEventExpired
+		} else if cl.Partial() {
+			ev.Type = xnats.OrderEventDecremented
+			ev.Quantity = IntToDecimal(cl.Quantity)
+			ev.Remaining = IntToDecimal(cl.Remaining)
+		}
+		events = append(events, ev)
+	}
+
+	return
+}
+
+// PublishOrderEvents publishes the order events of the log to the NATS server of the bank holding the funds of each order,
+// called by the writer before the log is saved, the msg id lets NATS drop what is published again after a restart
+func (w *Worker) PublishOrderEvents(ol *OmeLog) (err error) {
+	for i, ev := range w.OrderEventsOf(ol) {
+		coin := w.QuoteAsset
+		if ev.Side == model.OrderSideAsk {
+			coin = w.BaseAsset
+		}
+
+		var js nats.JetStreamContext
+		js, err = w.GetNats(coin)
+		if err != nil {
+			return
+		}
+
+		err = xnats.PublishOrderEvent(js, fmt.Sprintf("%s:%d:%d", strings.ToLower(w.Name), ol.LogID, i), ev)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
 
 // func (w *Worker) SendBalancesReq(msg xnats.BalancesReq) (err error) {
 // 	_, err = w.GetNats()
@@ -4,18 +4,23 @@
 package ome
 
 import (
+	"ccoms/pkg/catalog"
 	"ccoms/pkg/config"
 	"ccoms/pkg/xlog"
 	"path"
 
-	"encoding/json"
 	"errors"
+	"fmt"
 	"math/big"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"ccoms/pkg/filedb"
 	"ccoms/pkg/model"
+	"ccoms/pkg/replica"
+	"ccoms/pkg/xetcd"
 	"ccoms/pkg/xgrpc"
 
 	"github.com/google/btree"
@@ -26,12 +31,24 @@ import (
 
 // Worker matching engine worker class
 type Worker struct {
-	Nats nats.JetStreamContext
+	Nats      nats.JetStreamContext
+	natsConns map[string]nats.JetStreamContext // coin -> NATS server of its bank, see GetNats
+	natsMu    sync.Mutex
 
 	Asks *btree.BTree
 	Bids *btree.BTree
 	fdb  *filedb.Filedb
 
+	keys map[int64]orderKey // order id -> sort key, to locate an order in Asks/Bids
+
+	StopsAbove *btree.BTree        // trigger book, stop orders waiting for the price to rise
+	StopsBelow *btree.BTree        // trigger book, stop orders waiting for the price to fall
+	stops      map[int64]StopOrder // order id -> stop order in the trigger book
+	LastPrice  *big.Int            // price of the last trade, nil if there is none yet
+
+	Expiries *btree.BTree // good-till-time orders, see ExpiryItem
+	Now      int64        // clock of the ome, unix seconds of the last TimerLog, see Expire and Expired
+
 	Name        string
 	Symbol      string
 	BaseAsset   string
@@ -42,12 +59,27 @@ type Worker struct {
 	LatestAskTicketID int64
 	LatestBidTicketID int64
 
+	FeeCollector int64    // owner of the fees, see config.Fee
+	MakerFeeRate *big.Int // scaled by Exp
+	TakerFeeRate *big.Int // scaled by Exp
+
+	SelfTradePrevention int8 // default mode of the symbol, model.OrderSTPXxx
+
 	LogID       int64 // auto-increment log ID
 	OrderID     int64 // the order ID maintained by ome itself for this trading pair
 	SavedLogID  int64 // processed (written to mysql) logID
 	ToBankLogID int64 // processed (sent to bank) logID
 
-	ch chan *xgrpc.Ticket
+	SnapshotLogID int64       // logID of the latest snapshot, see MaybeSnapshot
+	snapshotting  atomic.Bool // a snapshot is being written
+
+	ReplicaLag  *replica.Lag  // how far a standby is behind the primary, see RunStandby
+	promoted    chan struct{} // closed by Promote
+	promoteOnce sync.Once
+	Addr        string // grpc address of this ome when it is elected, see RunElected, xetcd.KeyOmeService if empty
+
+	ch   chan *xgrpc.Ticket
+	tick chan int64 // unix seconds, see StartTimer
 }
 
 var logger = xlog.GetLogger()
@@ -68,6 +100,15 @@ func New(symbol string) (w *Worker, err error) {
 		Asks: asks,
 		Bids: bids,
 
+		keys:      map[int64]orderKey{},
+		natsConns: map[string]nats.JetStreamContext{},
+
+		StopsAbove: btree.New(2),
+		StopsBelow: btree.New(2),
+		stops:      map[int64]StopOrder{},
+
+		Expiries: btree.New(2),
+
 		Name:        "OME_" + symbol,
 		Symbol:      symbol,
 		BaseAsset:   ss[0],
@@ -76,9 +117,27 @@ func New(symbol string) (w *Worker, err error) {
 
 		State: "Init",
 
-		ch: make(chan *xgrpc.Ticket, 1024),
+		MakerFeeRate: big.NewInt(0),
+		TakerFeeRate: big.NewInt(0),
+
+		ReplicaLag: &replica.Lag{},
+		promoted:   make(chan struct{}),
+
+		ch:   make(chan *xgrpc.Ticket, 1024),
+		tick: make(chan int64, 1),
 	}
 
+	fee := config.Shared.Fee
+	if fee.Collector > 0 {
+		w.FeeCollector = fee.Collector
+		w.MakerFeeRate = DecimalToInt(decimal.NewFromFloat(fee.MakerRate))
+		w.TakerFeeRate = DecimalToInt(decimal.NewFromFloat(fee.TakerRate))
+	} else if fee.MakerRate > 0 || fee.TakerRate > 0 {
+		logger.Warningf("fee rates are ignored without a fee collector")
+	}
+
+	w.SelfTradePrevention = config.Shared.SelfTradePrevention[symbol]
+
 	// open filedb
 	_, err = w.Filedb()
 	if err != nil {
@@ -93,8 +152,10 @@ func New(symbol string) (w *Worker, err error) {
 // Run starts the ome process
 //
 //	a. Main thread: use `chan OmeMsg` to receive requests from the bank, complete requests (order, trade) sequentially in a single thread
+//	a0. check the symbol is listed in the catalog and create its tables, see LoadListing
 //	a1. writer processes all previous filedb logs
 //	a2. cache existing Orders (read through mysql)
+//	with snapshots enabled, a1 and a2 are replaced by loading the latest snapshot and replaying the filedb logs after it
 //	a3. cache LatestAskTicketID, LatestBidTicketID, to filter out duplicate tickets
 //	a4. preparation is complete, start other worker threads
 //
@@ -106,23 +167,45 @@ func New(symbol string) (w *Worker, err error) {
 //	c. writer thread: read filedb logs and batch write to mysql
 //	c1. This thread is started during the preparation phase of the main thread task, and it monitors filedb updates in real-time and writes to mysql
 //	It can be a separate process because the a1 task is judged to be completed based on filedb lastLogID and mysql lastLogID, so it can be independent
+//
+//	d. grpc server thread: streams the filedb logs to the standbys, see RunStandby
 func (w *Worker) Run() (err error) {
+	w.State = "LoadingListing"
+	err = w.LoadListing()
+	if err != nil {
+		return
+	}
+
 	go w.StartWriter()
 	go w.StartBanker(w.BaseAsset)
 	go w.StartBanker(w.QuoteAsset)
+	go w.StartServeGrpc()
 
-	w.State = "WaitForFiledb"
-	// wait for mysql.lastLogID == w.LogID(last logID in filedb)
-	err = w.WaitForFiledb()
-	if err != nil {
-		return
-	}
+	if config.Shared.Snapshot.Enabled {
+		w.State = "LoadingSnapshot"
+		// load the latest snapshot, then replay the filedb logs after it, mysql may be far behind
+		err = w.LoadSnapshot()
+		if err != nil {
+			return
+		}
+		err = w.ReplayLogs()
+		if err != nil {
+			return
+		}
+	} else {
+		w.State = "WaitForFiledb"
+		// wait for mysql.lastLogID == w.LogID(last logID in filedb)
+		err = w.WaitForFiledb()
+		if err != nil {
+			return
+		}
 
-	w.State = "LoadingOrders"
-	// load Orders, LatestAskTicketID, LatestBidTicketID from mysql
-	err = w.LoadAllOrders()
-	if err != nil {
-		return
+		w.State = "LoadingOrders"
+		// load Orders, LatestAskTicketID, LatestBidTicketID from mysql
+		err = w.LoadAllOrders()
+		if err != nil {
+			return
+		}
 	}
 
 	w.State = "Matching"
@@ -142,6 +225,12 @@ func (w *Worker) StartMatching() (err error) {
 		}
 	}()
 
+	// market orders left in the book by an interrupted run must not rest there
+	err = w.CancelMarketOrders()
+	if err != nil {
+		return
+	}
+
 	_, err = w.TryMatch(NewOrder{})
 	if err != nil {
 		logger.Errorf("first TryMatch in Start failed with err:%s", err)
@@ -149,20 +238,46 @@ func (w *Worker) StartMatching() (err error) {
 	}
 	logger.Info("first TryMatch in Start done")
 
+	// an interrupted run may have left stop orders reached by the last price
+	err = w.TriggerStops()
+	if err != nil {
+		return
+	}
+
 	go w.StartPullTickets(w.BaseAsset)
 	go w.StartPullTickets(w.QuoteAsset)
+	go w.StartTimer()
 
 	for {
-		ticket, ok := <-w.ch
-		if !ok {
-			return
+		select {
+		case ticket, ok := <-w.ch:
+			if !ok {
+				return
+			}
+			err = w.TicketToMatchEngine(ticket)
+			if err != nil {
+				// TODO
+				// if err == "order id is not continuous"
+				// then should reload latest order or just send a new grpc req with current latest order
+				return
+			}
+		case now := <-w.tick:
+			err = w.Expire(now)
+			if err != nil {
+				return
+			}
 		}
-		err = w.TicketToMatchEngine(ticket)
-		if err != nil {
-			// TODO
-			// if err == "order id is not continuous"
-			// then should reload latest order or just send a new grpc req with current latest order
-			return
+		w.MaybeSnapshot()
+	}
+}
+
+// StartTimer send the time to the main task every second, so that it expires orders between tickets
+func (w *Worker) StartTimer() {
+	for t := range time.Tick(time.Second) {
+		select {
+		case w.tick <- t.Unix():
+		default:
+			// the main task is busy, it gets a later time anyway
 		}
 	}
 }
@@ -195,6 +310,25 @@ func (w *Worker) StartBanker(coin string) (err error) {
 		} else {
 			logger.Infof("StartBanker coin(%s), round:%d done", coin, round)
 		}
+		// the bank moved, connect to it at once
+		if !errors.Is(err, xetcd.ErrChanged) {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// StartServeGrpc serve the standbys
+func (w *Worker) StartServeGrpc() (err error) {
+	round := 0
+	for {
+		round++
+		logger.Infof("StartServeGrpc round:%d started", round)
+		err = w.ServeGrpc()
+		if err != nil {
+			logger.Errorf("StartServeGrpc round:%d failed with err:%s", round, err)
+		} else {
+			logger.Infof("StartServeGrpc round:%d done", round)
+		}
 		time.Sleep(time.Second)
 	}
 }
@@ -211,10 +345,28 @@ func (w *Worker) StartPullTickets(coin string) (err error) {
 		} else {
 			logger.Infof("StartPullTickets coin(%s), round:%d done", coin, round)
 		}
-		time.Sleep(time.Second)
+		// the bank moved, connect to it at once
+		if !errors.Is(err, xetcd.ErrChanged) {
+			time.Sleep(time.Second)
+		}
 	}
 }
 
+// LoadListing checks the symbol is listed in the catalog and creates the tables it is missing,
+// a halted symbol still runs, its bank rejects the new orders
+func (w *Worker) LoadListing() (err error) {
+	s, found, err := catalog.Shared.Symbol(w.Symbol)
+	if err != nil {
+		return
+	}
+	if !found {
+		return fmt.Errorf("symbol %s is not listed", w.Symbol)
+	}
+	logger.Infof("LoadListing done with status:%s", s.Status)
+
+	return model.MigrateSymbol(model.GetMySQL(), w.Symbol)
+}
+
 // LoadAllOrders load all pending orders
 //
 //	need to ensure that the previous filedb has been written to mysql before continuing
@@ -231,9 +383,10 @@ func (w *Worker) LoadAllOrders() (err error) {
 	// load from mysql
 	db := model.GetMySQL()
 
+	// filled (deleted) and finished (canceled...) orders are not in the book
 	var orders []model.Order
 	err = db.Scopes(model.OrderTable(w.TablePrefix)).
-		Where("`status`>?", model.OrderStatusDeleted).
+		Where("`status`>? and `status`<?", model.OrderStatusDeleted, model.OrderStatusDone).
 		Order("id asc").Find(&orders).Error
 	if err != nil {
 		return
@@ -246,10 +399,66 @@ func (w *Worker) LoadAllOrders() (err error) {
 			TicketID: order.TicketID,
 			Owner:    order.Owner,
 			FeeRate:  int64(order.FeeLevel * 10000),
+			Type:     order.Type,
 			Price:    DecimalToInt(order.Price),
 			Quantity: DecimalToInt(order.Quantity),
+			Frozen:   DecimalToInt(order.Frozen),
+
+			ClientOrderID:       order.ClientOrderID,
+			SelfTradePrevention: order.SelfTradePrevention,
+
+			Seq:   order.Seq,
+			Entry: order.Seq,
+		}
+		if order.DisplayQty.IsPositive() {
+			// a slice consumed without its replenish being saved yet is shown again
+			o.Display = DecimalToInt(order.DisplayQty)
+			o.Visible = Min(DecimalToInt(order.Visible), o.Quantity)
+			if IsZero(o.Visible) {
+				o.Visible = Min(o.Display, o.Quantity)
+			}
+		}
+
+		// waiting in the trigger book
+		if order.Status == model.OrderStatusPending {
+			no := NewOrder{
+				ID:       o.ID,
+				TicketID: o.TicketID,
+				Owner:    o.Owner,
+				FeeRate:  o.FeeRate,
+				Time:     order.Time,
+				Side:     order.Side,
+				Type:     order.Type,
+				Price:    o.Price,
+				Quantity: o.Quantity,
+				Amount:   DecimalToInt(order.Amount),
+				Frozen:   o.Frozen,
+
+				TimeInForce:   order.TimeInForce,
+				ClientOrderID: order.ClientOrderID,
+
+				SelfTradePrevention: order.SelfTradePrevention,
+
+				StopPrice: DecimalToInt(order.StopPrice),
+				ExpireAt:  order.ExpireAt,
+			}
+			if order.DisplayQty.IsPositive() {
+				no.DisplayQty = DecimalToInt(order.DisplayQty)
+			}
+			w.NewStop(StopOrder{NewOrder: no, StopAbove: order.StopAbove})
+			w.ScheduleExpiry(order.Side, order.ID, order.ExpireAt)
+			continue
 		}
 
+		// a triggered stop order is a limit or market order from then on
+		switch o.Type {
+		case model.OrderTypeStopLimit:
+			o.Type = model.OrderTypeLimit
+		case model.OrderTypeStopMarket:
+			o.Type = model.OrderTypeMarket
+		}
+		w.keys[o.ID] = orderKey{Price: o.Price, Seq: o.Seq}
+
 		// TODO handle delete orders issue
 		if order.Side == model.OrderSideAsk {
 			w.Asks.ReplaceOrInsert(AskOrder(o))
@@ -264,9 +473,20 @@ func (w *Worker) LoadAllOrders() (err error) {
 		} else {
 			return errors.New("invalid order side")
 		}
+		w.ScheduleExpiry(order.Side, order.ID, order.ExpireAt)
 	}
 
-	logger.Infof("loaded asks:%d, bids:%d", w.Asks.Len(), w.Bids.Len())
+	logger.Infof("loaded asks:%d, bids:%d, stops:%d", w.Asks.Len(), w.Bids.Len(), len(w.stops))
+
+	// stop orders are triggered by the price of the last trade
+	var lastTrade model.Trade
+	err = db.Scopes(model.TradeTable(w.TablePrefix)).Order("id desc").Limit(1).Find(&lastTrade).Error
+	if err != nil {
+		return
+	}
+	if lastTrade.ID > 0 {
+		w.LastPrice = DecimalToInt(lastTrade.Price)
+	}
 
 	// cache latest order
 	// NOTE: cannot get it this way because some orders have been deleted
@@ -410,6 +630,22 @@ func (w *Worker) LoadSavedLogID() (id int64, err error) {
 	return
 }
 
+// LoadBankReasonID read from mysql the logID of the last log whose balance change the bank of the coin has saved, 0 if none
+func (w *Worker) LoadBankReasonID(coin string) (id int64, err error) {
+	db := model.GetMySQL()
+
+	var lastkv model.Lastkv
+	err = db.Model(model.Lastkv{}).
+		Where("`app`=? and `key`=?", "bank_"+strings.ToLower(coin), model.LASTKV_K_OME_REASONID+strings.ToLower(w.Symbol)).
+		Limit(1).Find(&lastkv).Error
+	if err != nil {
+		return
+	}
+
+	id = int64(lastkv.Val)
+	return
+}
+
 // WaitForFiledb wait for filedb to complete initialization before the service starts
 //
 //	read the logID of the latest record to ensure that the previous logs have all been written to mysql, i.e., savedLogID >= logID
@@ -424,19 +660,11 @@ func (w *Worker) WaitForFiledb() (err error) {
 		}
 	}()
 
-	s, err := w.fdb.ReadLastLine()
-	if err != nil {
-		return
-	}
-	if s == "" {
-		return nil
-	}
-
-	var ml OmeLog
-	err = json.Unmarshal([]byte(s), &ml)
-	if err != nil {
+	last, ok, err := filedb.Last[OmeLog](w.fdb)
+	if err != nil || !ok {
 		return
 	}
+	ml := last.Log
 
 	w.LogID = ml.LogID
 
@@ -453,23 +681,20 @@ func (w *Worker) WaitForFiledb() (err error) {
 	}
 }
 
-// LoadLatestMatchLog load the latest log
+// LoadLatestMatchLog load the latest match log, a zero one if there is none
 func (w *Worker) LoadLatestMatchLog() (ml MatchLog, err error) {
 	fdb, err := w.Filedb()
 	if err != nil {
 		return
 	}
 
-	s, err := fdb.ReadLastLine()
-	if err != nil {
-		return
-	}
-
-	if s == "" {
-		return
-	}
-
-	err = json.Unmarshal([]byte(s), &ml)
+	err = filedb.Iterate(fdb, filedb.IterOptions{Reverse: true}, func(r filedb.Record[OmeLog]) error {
+		if len(r.Log.MatchLogs) == 0 {
+			return nil
+		}
+		ml = r.Log.MatchLogs[len(r.Log.MatchLogs)-1]
+		return filedb.ErrStop
+	})
 	return
 }
 
@@ -503,6 +728,23 @@ func (w *Worker) TicketToMatchEngine(ticket *xgrpc.Ticket) (err error) {
 		return
 	}
 
+	if int8(ticket.Action) == model.TicketActionCancel || int8(ticket.Action) == model.TicketActionAmend {
+		if int8(ticket.Action) == model.TicketActionCancel {
+			err = w.CancelOrder(ticket)
+		} else {
+			err = w.AmendOrder(ticket)
+		}
+		if err != nil {
+			return
+		}
+		if side == model.OrderSideAsk {
+			w.LatestAskTicketID = ticket.Id
+		} else {
+			w.LatestBidTicketID = ticket.Id
+		}
+		return
+	}
+
 	p, err := decimal.NewFromString(ticket.Price)
 	if err != nil {
 		return
@@ -511,15 +753,45 @@ func (w *Worker) TicketToMatchEngine(ticket *xgrpc.Ticket) (err error) {
 	if err != nil {
 		return
 	}
+	a := decimal.Zero
+	if ticket.Amount != "" {
+		a, err = decimal.NewFromString(ticket.Amount)
+		if err != nil {
+			return
+		}
+	}
+	frozen := decimal.Zero
+	if ticket.Frozen != "" {
+		frozen, err = decimal.NewFromString(ticket.Frozen)
+		if err != nil {
+			return
+		}
+	}
+	stop := int8(ticket.Type) == model.OrderTypeStopLimit || int8(ticket.Type) == model.OrderTypeStopMarket
+	var stopPrice *big.Int
+	if stop {
+		var sp decimal.Decimal
+		sp, err = decimal.NewFromString(ticket.StopPrice)
+		if err != nil {
+			return
+		}
+		stopPrice = DecimalToInt(sp)
+	}
+	// an iceberg order shows a slice of its quantity, a slice as large as the order is not one
+	var displayQty *big.Int
+	if ticket.DisplayQty != "" && (int8(ticket.Type) == model.OrderTypeLimit || int8(ticket.Type) == model.OrderTypeStopLimit) {
+		var dq decimal.Decimal
+		dq, err = decimal.NewFromString(ticket.DisplayQty)
+		if err != nil {
+			return
+		}
+		if dq.IsPositive() && dq.LessThan(q) {
+			displayQty = DecimalToInt(dq)
+		}
+	}
 
 	w.OrderID++
 	w.LogID++
-	defer func() {
-		if err != nil {
-			w.OrderID--
-			w.LogID--
-		}
-	}()
 	now := time.Now().Unix()
 	o := NewOrder{
 		ID:       w.OrderID,
@@ -531,6 +803,18 @@ func (w *Worker) TicketToMatchEngine(ticket *xgrpc.Ticket) (err error) {
 		Type:     int8(ticket.Type),
 		Price:    DecimalToInt(p),
 		Quantity: DecimalToInt(q),
+		Amount:   DecimalToInt(a),
+		Frozen:   DecimalToInt(frozen),
+
+		TimeInForce:   int8(ticket.TimeInForce),
+		ClientOrderID: ticket.ClientOrderID,
+
+		SelfTradePrevention: int8(ticket.SelfTradePrevention),
+
+		StopPrice:  stopPrice,
+		Seq:        w.LogID,
+		DisplayQty: displayQty,
+		ExpireAt:   ticket.ExpireAt,
 	}
 
 	// write new order to filedb
@@ -546,7 +830,22 @@ func (w *Worker) TicketToMatchEngine(ticket *xgrpc.Ticket) (err error) {
 		Type:     o.Type,
 		Price:    o.Price,
 		Quantity: o.Quantity,
+		Frozen:   o.Frozen,
+
+		TimeInForce:   o.TimeInForce,
+		ClientOrderID: o.ClientOrderID,
+
+		SelfTradePrevention: o.SelfTradePrevention,
 	}
+	if (o.Type == model.OrderTypeMarket || o.Type == model.OrderTypeStopMarket) && o.Side == model.OrderSideBid {
+		ol.Amount = o.Amount
+	}
+	if stop {
+		ol.StopPrice = o.StopPrice
+		ol.StopAbove = w.StopAbove(side, o.StopPrice)
+	}
+	ol.DisplayQty = o.DisplayQty
+	ol.ExpireAt = o.ExpireAt
 
 	omeLog := OmeLog{
 		LogID: w.LogID,
@@ -555,78 +854,147 @@ func (w *Worker) TicketToMatchEngine(ticket *xgrpc.Ticket) (err error) {
 		OrderLogs: []OrderLog{ol},
 	}
 
-	mlb, _ := json.Marshal(omeLog)
-
-	// write to filedb
+	// write to filedb, the ids are taken back only if the order is not in it,
+	// the logs that follow take their own ids, which must not be reused
 	f, err := w.Filedb()
+	if err == nil {
+		mlb, _ := f.Marshal(omeLog)
+		err = f.Append(omeLog.LogID, string(mlb)+"\n")
+	}
 	if err != nil {
+		w.OrderID--
+		w.LogID--
 		return
 	}
-	err = f.WriteLine(string(mlb) + "\n")
+
+	if stop {
+		w.NewStop(StopOrder{NewOrder: o, StopAbove: ol.StopAbove})
+	} else if side == model.OrderSideAsk {
+		err = w.NewAsk(o)
+	} else {
+		err = w.NewBid(o)
+	}
 	if err != nil {
 		return
 	}
-
 	if side == model.OrderSideAsk {
-		err = w.NewAsk(o)
-		if err != nil {
-			return
-		}
 		w.LatestAskTicketID = ticket.Id
-	} else if side == model.OrderSideBid {
-		err = w.NewBid(o)
-		if err != nil {
-			return
-		}
-		w.LatestBidTicketID = ticket.Id
 	} else {
-		err = errors.New("invalid order side")
-		return
+		w.LatestBidTicketID = ticket.Id
 	}
+	w.ScheduleExpiry(side, o.ID, o.ExpireAt)
+
+	// the trades may have moved the price across some stop prices
+	err = w.TriggerStops()
 
 	return
 }
 
-// NewAsk put the new ask order into the list
-func (w *Worker) NewAsk(no NewOrder) (err error) {
+// listOrder the order put into the list for a new order,
+// a market order is put at the worst price of its side and a market bid is sized by its quote amount
+func listOrder(no NewOrder) Order {
 	o := Order{
 		ID:       no.ID,
 		TicketID: no.TicketID,
 		Owner:    no.Owner,
 		FeeRate:  no.FeeRate,
+		Type:     no.Type,
 		Price:    no.Price,
 		Quantity: no.Quantity,
+		Frozen:   no.Frozen,
+
+		ClientOrderID:       no.ClientOrderID,
+		SelfTradePrevention: no.SelfTradePrevention,
+
+		Seq:   no.Seq,
+		Entry: no.Seq,
+	}
+	if no.DisplayQty != nil {
+		o.Display = no.DisplayQty
+		o.Visible = Min(no.DisplayQty, no.Quantity)
 	}
+	if o.Type == model.OrderTypeMarket && no.Side == model.OrderSideAsk {
+		o.Price = DecimalToInt(model.OrderPriceMin)
+	} else if o.Type == model.OrderTypeMarket {
+		o.Price = DecimalToInt(model.OrderPriceMax)
+		o.Quantity = big.NewInt(0)
+		o.Amount = no.Amount
+	}
+	return o
+}
+
+// NewAsk put the new ask order into the list
+//
+//	a market ask is put at the lowest price so that it sweeps the bids, and whatever is left is canceled,
+//	the same goes for IOC and FOK orders, FOK and post-only orders may be rejected before touching the book
+func (w *Worker) NewAsk(no NewOrder) (err error) {
+	o := listOrder(no)
 
 	if w.Asks.Has(AskOrder(o)) {
 		return errors.New("order exists")
 	}
 
+	// by the clock of the ome, the bank turns down what has expired by its own clock
+	if w.Expired(no) {
+		return w.RejectOrder(model.OrderSideAsk, o, CancelReasonExpired)
+	}
+
+	if reason := w.CheckTimeInForce(model.OrderSideAsk, o, no.TimeInForce); reason != "" {
+		return w.RejectOrder(model.OrderSideAsk, o, reason)
+	}
+
 	w.Asks.ReplaceOrInsert(AskOrder(o))
+	w.keys[o.ID] = orderKey{Price: o.Price, Seq: o.Seq}
 
 	_, err = w.TryMatch(no)
+	if err != nil {
+		return
+	}
+
+	if o.Type == model.OrderTypeMarket || no.TimeInForce == model.OrderTIFIOC || no.TimeInForce == model.OrderTIFFOK {
+		err = w.CancelRemainder(model.OrderSideAsk, o.ID, CancelReasonUnfilled)
+		return
+	}
+
+	err = w.RestOrder(model.OrderSideAsk, o.ID)
 
 	return
 }
 
 // NewBid put the new bid order into the list
+//
+//	a market bid is put at the highest price and sized by its quote amount instead of quantity,
+//	whatever is left after sweeping the asks is canceled, time in force is honoured as in NewAsk
 func (w *Worker) NewBid(no NewOrder) (err error) {
-	o := Order{
-		ID:       no.ID,
-		TicketID: no.TicketID,
-		Owner:    no.Owner,
-		FeeRate:  no.FeeRate,
-		Price:    no.Price,
-		Quantity: no.Quantity,
-	}
+	o := listOrder(no)
 
 	if w.Bids.Has(BidOrder(o)) {
 		return errors.New("order exists")
 	}
 
+	// by the clock of the ome, the bank turns down what has expired by its own clock
+	if w.Expired(no) {
+		return w.RejectOrder(model.OrderSideBid, o, CancelReasonExpired)
+	}
+
+	if reason := w.CheckTimeInForce(model.OrderSideBid, o, no.TimeInForce); reason != "" {
+		return w.RejectOrder(model.OrderSideBid, o, reason)
+	}
+
 	w.Bids.ReplaceOrInsert(BidOrder(o))
+	w.keys[o.ID] = orderKey{Price: o.Price, Seq: o.Seq}
 
 	_, err = w.TryMatch(no)
+	if err != nil {
+		return
+	}
+
+	if o.Type == model.OrderTypeMarket || no.TimeInForce == model.OrderTIFIOC || no.TimeInForce == model.OrderTIFFOK {
+		err = w.CancelRemainder(model.OrderSideBid, o.ID, CancelReasonUnfilled)
+		return
+	}
+
+	err = w.RestOrder(model.OrderSideBid, o.ID)
 
 	return
 }
@@ -647,40 +1015,101 @@ func (w *Worker) TryMatch(no NewOrder) (bool, error) {
 		return true, nil
 	}
 
+	if oa.Owner == ob.Owner {
+		if mode := w.SelfTradeMode(Order(oa), Order(ob)); mode != model.OrderSTPNone {
+			return w.PreventSelfTrade(Order(oa), Order(ob), mode)
+		}
+	}
+
 	price := ob.Price
-	if oa.ID < ob.ID {
+	if Order(oa).Before(Order(ob)) {
 		price = oa.Price
 	}
-	quantity := ob.Quantity
-	if Less(oa.Quantity, ob.Quantity) {
-		quantity = oa.Quantity
+	// only the current slice of an iceberg order is matched
+	askQuantity := Order(oa).Shown()
+	bidQuantity := Order(ob).Shown()
+	if ob.Amount != nil && price.Sign() > 0 {
+		// market bid, buy as much as the remaining amount allows at this price
+		bidQuantity = big.NewInt(0).Mul(ob.Amount, ExpInt)
+		bidQuantity.Div(bidQuantity, price)
+	} else if ob.Amount != nil {
+		bidQuantity = askQuantity
+	}
+	quantity := bidQuantity
+	if Less(askQuantity, bidQuantity) {
+		quantity = askQuantity
+	}
+	if IsZero(quantity) {
+		// a market bid whose remaining amount cannot buy anything more
+		return true, nil
 	}
 	amount := big.NewInt(0).Mul(price, quantity)
 	amount.Div(amount, ExpInt)
 
+	// the older order is the maker, the newer one takes its liquidity
+	takerSide := model.OrderSideBid
+	askRate, bidRate := w.MakerFeeRate, w.TakerFeeRate
+	if Order(ob).Before(Order(oa)) {
+		takerSide = model.OrderSideAsk
+		askRate, bidRate = w.TakerFeeRate, w.MakerFeeRate
+	}
+	askFee := CalcFee(quantity, askRate, oa.Frozen)
+	bidFee := CalcFee(amount, bidRate, ob.Frozen)
+
 	newAsk := AskOrder(oa)
 	newAsk.Price = oa.Price
 	newAsk.Quantity = big.NewInt(0).Sub(oa.Quantity, quantity)
+	newAsk.Frozen = SubFloor(oa.Frozen, big.NewInt(0).Add(quantity, askFee))
 	newBid := BidOrder(ob)
 	newBid.Price = ob.Price
 	newBid.Quantity = big.NewInt(0).Sub(ob.Quantity, quantity)
+	newBid.Frozen = SubFloor(ob.Frozen, big.NewInt(0).Add(amount, bidFee))
+
+	askDone := IsZero(newAsk.Quantity)
+	bidDone := IsZero(newBid.Quantity)
+	if ob.Amount != nil {
+		newBid.Quantity = big.NewInt(0)
+		newBid.Amount = big.NewInt(0).Sub(ob.Amount, amount)
+		bidDone = IsZero(newBid.Amount)
+	}
 
-	// TODO
-	askFee := big.NewInt(0)
-	bidFee := big.NewInt(0)
+	// an iceberg order whose slice is consumed gets a new one once the trade is written
+	askReplenish, bidReplenish := false, false
+	if oa.Visible != nil {
+		newAsk.Visible = big.NewInt(0).Sub(oa.Visible, quantity)
+		askReplenish = !askDone && IsZero(newAsk.Visible)
+	}
+	if ob.Visible != nil {
+		newBid.Visible = big.NewInt(0).Sub(ob.Visible, quantity)
+		bidReplenish = !bidDone && IsZero(newBid.Visible)
+	}
+
+	// return what was reserved but not spent once an order completes
+	askRefund := big.NewInt(0)
+	if askDone {
+		askRefund, newAsk.Frozen = newAsk.Frozen, big.NewInt(0)
+	}
+	bidRefund := big.NewInt(0)
+	if bidDone {
+		bidRefund, newBid.Frozen = newBid.Frozen, big.NewInt(0)
+	}
 
-	if IsZero(newAsk.Quantity) {
-		w.Asks.Delete(AskOrder{ID: oa.ID, Price: oa.Price})
+	if askDone {
+		w.Asks.Delete(oa)
+		delete(w.keys, oa.ID)
 	} else {
 		w.Asks.ReplaceOrInsert(newAsk)
 	}
 
-	if IsZero(newBid.Quantity) {
-		w.Bids.Delete(BidOrder{ID: ob.ID, Price: ob.Price})
+	if bidDone {
+		w.Bids.Delete(ob)
+		delete(w.keys, ob.ID)
 	} else {
 		w.Bids.ReplaceOrInsert(newBid)
 	}
 
+	w.LastPrice = price
+
 	w.LogID++
 	ml := MatchLog{
 		// LogID:    w.LogID,
@@ -690,11 +1119,13 @@ func (w *Worker) TryMatch(no NewOrder) (bool, error) {
 		AskID:       oa.ID,
 		AskPrice:    newAsk.Price,
 		AskQuantity: newAsk.Quantity,
+		AskFrozen:   newAsk.Frozen,
 
 		Bider:       ob.Owner,
 		BidID:       ob.ID,
 		BidPrice:    newBid.Price,
 		BidQuantity: newBid.Quantity,
+		BidFrozen:   newBid.Frozen,
 
 		Price:    price,
 		Quantity: quantity,
@@ -702,9 +1133,23 @@ func (w *Worker) TryMatch(no NewOrder) (bool, error) {
 		AskFee:   askFee,
 		BidFee:   bidFee,
 
+		TakerSide: takerSide,
+		AskRefund: askRefund,
+		BidRefund: bidRefund,
+
+		AskClientOrderID: oa.ClientOrderID,
+		BidClientOrderID: ob.ClientOrderID,
+
+		AskVisible: newAsk.Visible,
+		BidVisible: newBid.Visible,
+
 		Time: time.Now().Unix(),
 	}
 
+	if ob.Amount != nil {
+		ml.BidAmount = newBid.Amount
+	}
+
 	omeLog := OmeLog{
 		LogID: w.LogID,
 		Ts:    time.Now().UnixNano(),
@@ -712,27 +1157,942 @@ func (w *Worker) TryMatch(no NewOrder) (bool, error) {
 		MatchLogs: []MatchLog{ml},
 	}
 
-	mlb, _ := json.Marshal(omeLog)
-
 	// write to filedb
 	f, err := w.Filedb()
 	if err != nil {
 		return false, err
 	}
-	err = f.WriteLine(string(mlb) + "\n")
+	mlb, _ := f.Marshal(omeLog)
+	err = f.Append(omeLog.LogID, string(mlb)+"\n")
 	// lastFiledbedTime = time.Now()
 	// filedbedLines += 1
 	if err != nil {
 		return false, err
 	}
 
-	if IsZero(newAsk.Quantity) || IsZero(newBid.Quantity) {
+	if askReplenish {
+		err = w.Replenish(model.OrderSideAsk, oa.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+	if bidReplenish {
+		err = w.Replenish(model.OrderSideBid, ob.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if askDone || bidDone || askReplenish || bidReplenish {
 		return w.TryMatch(NewOrder{})
 	}
 
 	return true, nil
 }
 
+// Replenish show a new slice of an iceberg order, it is queued again at the back of its price,
+// while it keeps its Entry, so it is still the maker against the order that consumed the last slice
+func (w *Worker) Replenish(side int8, id int64) (err error) {
+	o := w.FindOrder(side, id)
+	if o == nil {
+		return
+	}
+
+	w.LogID++
+	defer func() {
+		if err != nil {
+			w.LogID--
+		}
+	}()
+
+	omeLog := OmeLog{
+		LogID: w.LogID,
+		Ts:    time.Now().UnixNano(),
+
+		ReplenishLogs: []ReplenishLog{{
+			ID:       o.ID,
+			TicketID: o.TicketID,
+			Owner:    o.Owner,
+			Side:     side,
+			Price:    o.Price,
+			Visible:  Min(o.Display, o.Quantity),
+			Quantity: o.Quantity,
+
+			ClientOrderID: o.ClientOrderID,
+		}},
+	}
+
+	// write to filedb
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	mlb, _ := f.Marshal(omeLog)
+	err = f.Append(omeLog.LogID, string(mlb)+"\n")
+	if err != nil {
+		return
+	}
+
+	n := *o
+	n.Seq = w.LogID
+	n.Visible = omeLog.ReplenishLogs[0].Visible
+	if side == model.OrderSideAsk {
+		w.Asks.Delete(AskOrder(*o))
+		w.Asks.ReplaceOrInsert(AskOrder(n))
+	} else {
+		w.Bids.Delete(BidOrder(*o))
+		w.Bids.ReplaceOrInsert(BidOrder(n))
+	}
+	w.keys[n.ID] = orderKey{Price: n.Price, Seq: n.Seq}
+
+	return
+}
+
+// StopAbove whether a new stop order waits for the price to rise to its stop price, or to fall to it
+//
+//	decided by where the stop price is relative to the last trade price, so one type covers both stop-loss and take-profit,
+//	without any trade yet a bid waits for a rise and an ask for a fall
+func (w *Worker) StopAbove(side int8, stopPrice *big.Int) bool {
+	if w.LastPrice == nil {
+		return side == model.OrderSideBid
+	}
+	return Greater(stopPrice, w.LastPrice)
+}
+
+// NewStop put the stop order into the trigger book, its funds stay frozen in the bank
+func (w *Worker) NewStop(so StopOrder) {
+	if so.StopAbove {
+		w.StopsAbove.ReplaceOrInsert(StopAboveOrder(so))
+	} else {
+		w.StopsBelow.ReplaceOrInsert(StopBelowOrder(so))
+	}
+	w.stops[so.ID] = so
+}
+
+// RemoveStop take the stop order out of the trigger book
+func (w *Worker) RemoveStop(so StopOrder) {
+	if so.StopAbove {
+		w.StopsAbove.Delete(StopAboveOrder(so))
+	} else {
+		w.StopsBelow.Delete(StopBelowOrder(so))
+	}
+	delete(w.stops, so.ID)
+}
+
+// TriggerStops move the stop orders reached by the last trade price into the list one by one,
+// the lowest ID first if both books have one, until the price no longer reaches any,
+// as a triggered order may trade and move the price again
+func (w *Worker) TriggerStops() (err error) {
+	for w.LastPrice != nil {
+		var next *StopOrder
+		if item := w.StopsAbove.Min(); item != nil {
+			so := StopOrder(item.(StopAboveOrder))
+			if !Less(w.LastPrice, so.StopPrice) {
+				next = &so
+			}
+		}
+		if item := w.StopsBelow.Min(); item != nil {
+			so := StopOrder(item.(StopBelowOrder))
+			if !Greater(w.LastPrice, so.StopPrice) && (next == nil || so.ID < next.ID) {
+				next = &so
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		err = w.TriggerStop(*next)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// TriggerStop write a TriggerLog and put the stop order into the list as a limit or market order
+func (w *Worker) TriggerStop(so StopOrder) (err error) {
+	no := so.NewOrder
+	no.Type = model.OrderTypeLimit
+	if so.Type == model.OrderTypeStopMarket {
+		no.Type = model.OrderTypeMarket
+	}
+
+	w.LogID++
+	defer func() {
+		if err != nil {
+			w.LogID--
+		}
+	}()
+	no.Seq = w.LogID
+
+	omeLog := OmeLog{
+		LogID: w.LogID,
+		Ts:    time.Now().UnixNano(),
+
+		TriggerLogs: []TriggerLog{{
+			ID:        no.ID,
+			TicketID:  no.TicketID,
+			Owner:     no.Owner,
+			Side:      no.Side,
+			Type:      no.Type,
+			StopPrice: no.StopPrice,
+			Price:     w.LastPrice,
+			Quantity:  no.Quantity,
+
+			ClientOrderID: no.ClientOrderID,
+		}},
+	}
+
+	// write to filedb
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	mlb, _ := f.Marshal(omeLog)
+	err = f.Append(omeLog.LogID, string(mlb)+"\n")
+	if err != nil {
+		return
+	}
+
+	w.RemoveStop(so)
+
+	if no.Side == model.OrderSideAsk {
+		return w.NewAsk(no)
+	}
+	return w.NewBid(no)
+}
+
+// SelfTradeMode returns the self-trade prevention mode of the newer order, which would take the liquidity of the other,
+// falling back to the mode of the symbol
+func (w *Worker) SelfTradeMode(ask, bid Order) int8 {
+	mode := bid.SelfTradePrevention
+	if bid.Before(ask) {
+		mode = ask.SelfTradePrevention
+	}
+	if mode == model.OrderSTPDefault {
+		mode = w.SelfTradePrevention
+	}
+	if mode == model.OrderSTPDefault {
+		mode = model.OrderSTPNone
+	}
+	return mode
+}
+
+// PreventSelfTrade cancel orders of the same owner instead of matching them according to the mode, then go on matching
+//
+//	every cancel is a CancelLog with reason stp, so the frozen funds are released by the bank
+func (w *Worker) PreventSelfTrade(ask, bid Order, mode int8) (bool, error) {
+	newSide, newest, oldSide, oldest := model.OrderSideBid, bid, model.OrderSideAsk, ask
+	if bid.Before(ask) {
+		newSide, newest, oldSide, oldest = model.OrderSideAsk, ask, model.OrderSideBid, bid
+	}
+
+	var err error
+	switch mode {
+	case model.OrderSTPCancelOldest:
+		err = w.RemoveOrder(oldSide, &oldest, oldest.TicketID, CancelReasonSTP)
+	case model.OrderSTPCancelBoth:
+		err = w.RemoveOrder(oldSide, &oldest, oldest.TicketID, CancelReasonSTP)
+		if err == nil {
+			err = w.RemoveOrder(newSide, &newest, newest.TicketID, CancelReasonSTP)
+		}
+	case model.OrderSTPDecrementAndCancel:
+		err = w.DecrementOrders(ask, bid)
+	default:
+		if mode != model.OrderSTPCancelNewest {
+			logger.Warningf("PreventSelfTrade unknown mode:%d, canceling the newest order:%d", mode, newest.ID)
+		}
+		err = w.RemoveOrder(newSide, &newest, newest.TicketID, CancelReasonSTP)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return w.TryMatch(NewOrder{})
+}
+
+// DecrementOrders take the quantity they would have traded off both orders
+//
+//	a market bid is sized at the price of the ask, as in TryMatch
+func (w *Worker) DecrementOrders(ask, bid Order) (err error) {
+	bidQuantity := bid.Quantity
+	if bid.Amount != nil {
+		bidQuantity = big.NewInt(0)
+		if ask.Price.Sign() > 0 {
+			bidQuantity.Mul(bid.Amount, ExpInt)
+			bidQuantity.Div(bidQuantity, ask.Price)
+		}
+	}
+	quantity := ask.Quantity
+	if Less(bidQuantity, quantity) {
+		quantity = bidQuantity
+	}
+	if IsZero(quantity) {
+		// a market bid whose remaining amount cannot buy anything more
+		return w.RemoveOrder(model.OrderSideBid, &bid, bid.TicketID, CancelReasonSTP)
+	}
+
+	err = w.DecrementOrder(model.OrderSideAsk, &ask, quantity, nil)
+	if err != nil {
+		return
+	}
+	var amount *big.Int
+	if bid.Amount != nil {
+		amount = big.NewInt(0).Mul(quantity, ask.Price)
+		amount.Div(amount, ExpInt)
+	}
+	return w.DecrementOrder(model.OrderSideBid, &bid, quantity, amount)
+}
+
+// DecrementOrder cancel part of an order and release the frozen funds in proportion, the order is removed if nothing is left
+//
+//	amount is the part of the budget of a market bid to cancel, nil for other orders
+func (w *Worker) DecrementOrder(side int8, o *Order, quantity, amount *big.Int) (err error) {
+	remaining := big.NewInt(0).Sub(o.Quantity, quantity)
+	done := IsZero(remaining)
+	if amount != nil {
+		done = !Less(amount, o.Amount)
+	}
+	if done {
+		return w.RemoveOrder(side, o, o.TicketID, CancelReasonSTP)
+	}
+
+	// refund = frozen * part / whole
+	refund := big.NewInt(0).Mul(OrZero(o.Frozen), quantity)
+	refund.Div(refund, o.Quantity)
+	if amount != nil {
+		refund.Mul(OrZero(o.Frozen), amount)
+		refund.Div(refund, o.Amount)
+	}
+	frozen := SubFloor(o.Frozen, refund)
+
+	cl := CancelLog{
+		ID:       o.ID,
+		TicketID: o.TicketID,
+		Owner:    o.Owner,
+		Side:     side,
+		Reason:   CancelReasonSTP,
+		Quantity: quantity,
+		Refund:   refund,
+
+		ClientOrderID: o.ClientOrderID,
+
+		Remaining: remaining,
+		Frozen:    frozen,
+	}
+	if amount != nil {
+		// a market bid keeps no quantity, only its budget
+		cl.Quantity, cl.Remaining = big.NewInt(0), big.NewInt(0)
+	}
+	err = w.WriteCancelLog(cl)
+	if err != nil {
+		return
+	}
+
+	n := *o
+	n.Quantity = cl.Remaining
+	n.Frozen = frozen
+	if o.Visible != nil {
+		n.Visible = Min(o.Visible, n.Quantity)
+	}
+	if amount != nil {
+		n.Amount = big.NewInt(0).Sub(o.Amount, amount)
+	}
+	if side == model.OrderSideAsk {
+		w.Asks.ReplaceOrInsert(AskOrder(n))
+	} else {
+		w.Bids.ReplaceOrInsert(BidOrder(n))
+	}
+
+	return
+}
+
+// CheckTimeInForce returns the reason to reject a new order before it is put into the list, or "" to accept it
+//
+//	post-only: rejected if it would match immediately
+//	FOK: rejected unless the opposite side can fill it completely
+func (w *Worker) CheckTimeInForce(side int8, o Order, tif int8) string {
+	switch tif {
+	case model.OrderTIFPostOnly:
+		if w.Crosses(side, o) {
+			return CancelReasonPostOnly
+		}
+	case model.OrderTIFFOK:
+		if !w.CanFill(side, o) {
+			return CancelReasonFOK
+		}
+	}
+	return ""
+}
+
+// Crosses whether the order would match the best order of the opposite side
+func (w *Worker) Crosses(side int8, o Order) bool {
+	if side == model.OrderSideAsk {
+		bid := w.Bids.Max()
+		return bid != nil && !Greater(o.Price, bid.(BidOrder).Price)
+	}
+
+	ask := w.Asks.Min()
+	return ask != nil && !Greater(ask.(AskOrder).Price, o.Price)
+}
+
+// CanFill whether the opposite side holds enough liquidity at acceptable prices to fill the order completely
+//
+//	a market bid is filled completely when its whole amount can be spent,
+//	the orders of the same owner fill nothing unless self-trade prevention lets them trade, see PreventSelfTrade,
+//	they are skipped if only they are canceled, any other mode cancels or decrements the order once it reaches them
+func (w *Worker) CanFill(side int8, o Order) bool {
+	blocked := false
+	// own whether the resting order r is of the same owner and fills nothing
+	own := func(r Order) bool {
+		if r.Owner != o.Owner {
+			return false
+		}
+		ask, bid := o, r
+		if side == model.OrderSideBid {
+			ask, bid = r, o
+		}
+		switch w.SelfTradeMode(ask, bid) {
+		case model.OrderSTPNone:
+			return false
+		case model.OrderSTPCancelOldest:
+			// canceled, the order goes on with the next one
+		default:
+			blocked = true
+		}
+		return true
+	}
+
+	if side == model.OrderSideAsk {
+		rest := big.NewInt(0).Set(o.Quantity)
+		w.Bids.Descend(func(item btree.Item) bool {
+			ob := item.(BidOrder)
+			if Greater(o.Price, ob.Price) {
+				return false
+			}
+			if own(Order(ob)) {
+				return !blocked
+			}
+			rest.Sub(rest, ob.Quantity)
+			return rest.Sign() > 0
+		})
+		return !blocked && rest.Sign() <= 0
+	}
+
+	if o.Amount != nil {
+		rest := big.NewInt(0).Set(o.Amount)
+		w.Asks.Ascend(func(item btree.Item) bool {
+			oa := item.(AskOrder)
+			if own(Order(oa)) {
+				return !blocked
+			}
+			amount := big.NewInt(0).Mul(oa.Price, oa.Quantity)
+			amount.Div(amount, ExpInt)
+			rest.Sub(rest, amount)
+			return rest.Sign() > 0
+		})
+		return !blocked && rest.Sign() <= 0
+	}
+
+	rest := big.NewInt(0).Set(o.Quantity)
+	w.Asks.Ascend(func(item btree.Item) bool {
+		oa := item.(AskOrder)
+		if Greater(oa.Price, o.Price) {
+			return false
+		}
+		if own(Order(oa)) {
+			return !blocked
+		}
+		rest.Sub(rest, oa.Quantity)
+		return rest.Sign() > 0
+	})
+	return !blocked && rest.Sign() <= 0
+}
+
+// RejectOrder refund a new order that never made it into the list
+func (w *Worker) RejectOrder(side int8, o Order, reason string) (err error) {
+	logger.Infof("RejectOrder order:%d, owner:%d, reason:%s", o.ID, o.Owner, reason)
+
+	return w.WriteCancelLog(CancelLog{
+		ID:       o.ID,
+		TicketID: o.TicketID,
+		Owner:    o.Owner,
+		Side:     side,
+		Reason:   reason,
+		Quantity: o.Quantity,
+		Refund:   SubFloor(o.Frozen, big.NewInt(0)),
+
+		ClientOrderID: o.ClientOrderID,
+	})
+}
+
+// CancelOrder remove the order from the list and return its frozen funds to the owner
+//
+//	the refund is pushed to the bank as a BalanceChange by PushBalanceLogs
+func (w *Worker) CancelOrder(ticket *xgrpc.Ticket) (err error) {
+	side := int8(ticket.Side)
+
+	// locate the order, it must be owned by the requester
+	o := w.FindOrder(side, ticket.OrderID)
+	if so, ok := w.stops[ticket.OrderID]; o == nil && ok && so.Side == side && so.Owner == ticket.Owner {
+		return w.CancelStop(so, ticket.Id, CancelReasonUser)
+	}
+	if o == nil || o.Owner != ticket.Owner {
+		logger.Warningf("CancelOrder ignored with ticket.id:%d, order:%d, owner:%d", ticket.Id, ticket.OrderID, ticket.Owner)
+		return w.WriteCancelLog(CancelLog{
+			ID:       ticket.OrderID,
+			TicketID: ticket.Id,
+			Owner:    ticket.Owner,
+			Side:     side,
+			Reason:   CancelReasonInvalid,
+			Quantity: big.NewInt(0),
+			Refund:   big.NewInt(0),
+
+			ClientOrderID: ticket.ClientOrderID,
+		})
+	}
+
+	return w.RemoveOrder(side, o, ticket.Id, CancelReasonUser)
+}
+
+// AmendOrder change the price or quantity of an order in the list in place, see xnats.AmendReq
+//
+//	reducing the quantity at the same price keeps the time priority and releases the frozen funds in proportion,
+//	anything else needs ticket.Frozen, held by the order and ticket.Reserve the bank froze on top of it, the rest of both is returned,
+//	then it queues again as a new order and may match right away,
+//	orders in the trigger book cannot be amended
+func (w *Worker) AmendOrder(ticket *xgrpc.Ticket) (err error) {
+	side := int8(ticket.Side)
+
+	p, err := decimal.NewFromString(ticket.Price)
+	if err != nil {
+		return
+	}
+	q, err := decimal.NewFromString(ticket.Quantity)
+	if err != nil {
+		return
+	}
+	total := decimal.Zero
+	if ticket.Frozen != "" {
+		total, err = decimal.NewFromString(ticket.Frozen)
+		if err != nil {
+			return
+		}
+	}
+	// the tickets without a reserve froze the whole total
+	reserve := total
+	if ticket.Reserve != "" {
+		reserve, err = decimal.NewFromString(ticket.Reserve)
+		if err != nil {
+			return
+		}
+	}
+	price, quantity := DecimalToInt(p), DecimalToInt(q)
+
+	al := AmendLog{
+		ID:       ticket.OrderID,
+		TicketID: ticket.Id,
+		Owner:    ticket.Owner,
+		Side:     side,
+		Price:    price,
+		Quantity: quantity,
+		Refund:   DecimalToInt(reserve),
+
+		ClientOrderID: ticket.ClientOrderID,
+	}
+
+	o := w.FindOrder(side, ticket.OrderID)
+	switch {
+	case o == nil || o.Owner != ticket.Owner || quantity.Sign() <= 0:
+		al.Reason = CancelReasonInvalid
+	case (IsZero(price) || Equal(price, o.Price)) && !Greater(quantity, o.Quantity):
+		// release = frozen * part / whole
+		release := big.NewInt(0).Sub(o.Quantity, quantity)
+		release.Mul(release, OrZero(o.Frozen))
+		release.Div(release, o.Quantity)
+		al.Price = o.Price
+		al.Frozen = SubFloor(o.Frozen, release)
+		al.Refund.Add(al.Refund, release)
+		al.KeepPriority = true
+		if o.Display != nil {
+			al.Visible = Min(o.Visible, quantity)
+		}
+	case IsZero(price):
+		// more quantity needs more funds, only frozen for a new price
+		al.Reason = CancelReasonInvalid
+	case Less(big.NewInt(0).Add(OrZero(o.Frozen), al.Refund), DecimalToInt(total)):
+		al.Reason = CancelReasonUnderfunded
+	default:
+		al.Frozen = DecimalToInt(total)
+		al.Refund = big.NewInt(0).Add(OrZero(o.Frozen), al.Refund)
+		al.Refund.Sub(al.Refund, al.Frozen)
+		if o.Display != nil {
+			al.Visible = Min(o.Display, quantity)
+		}
+	}
+	if !al.Applied() {
+		logger.Warningf("AmendOrder ignored with ticket.id:%d, order:%d, owner:%d", ticket.Id, ticket.OrderID, ticket.Owner)
+		al.Price, al.Quantity, al.Frozen = big.NewInt(0), big.NewInt(0), big.NewInt(0)
+	}
+
+	err = w.WriteAmendLog(al)
+	if err != nil || !al.Applied() {
+		return
+	}
+
+	n := *o
+	n.Price = al.Price
+	n.Quantity = al.Quantity
+	n.Frozen = al.Frozen
+	n.Visible = al.Visible
+	if !al.KeepPriority {
+		n.Seq, n.Entry = w.LogID, w.LogID
+	}
+	if side == model.OrderSideAsk {
+		w.Asks.Delete(AskOrder(*o))
+		w.Asks.ReplaceOrInsert(AskOrder(n))
+	} else {
+		w.Bids.Delete(BidOrder(*o))
+		w.Bids.ReplaceOrInsert(BidOrder(n))
+	}
+	w.keys[n.ID] = orderKey{Price: n.Price, Seq: n.Seq}
+
+	if al.KeepPriority {
+		return
+	}
+	_, err = w.TryMatch(NewOrder{})
+	if err != nil {
+		return
+	}
+	return w.TriggerStops()
+}
+
+// CancelStop remove a stop order that has not been triggered, all its frozen funds are refunded
+func (w *Worker) CancelStop(so StopOrder, ticketID int64, reason string) (err error) {
+	err = w.WriteCancelLog(CancelLog{
+		ID:       so.ID,
+		TicketID: ticketID,
+		Owner:    so.Owner,
+		Side:     so.Side,
+		Reason:   reason,
+		Quantity: so.Quantity,
+		Refund:   so.Frozen,
+
+		ClientOrderID: so.ClientOrderID,
+	})
+	if err != nil {
+		return
+	}
+	w.RemoveStop(so)
+	return
+}
+
+// ScheduleExpiry let the order expire at expireAt if it is still in the list or the trigger book by then, 0 never expires
+func (w *Worker) ScheduleExpiry(side int8, id, expireAt int64) {
+	if expireAt <= 0 {
+		return
+	}
+	if _, ok := w.stops[id]; !ok && w.FindOrder(side, id) == nil {
+		// completed already
+		return
+	}
+	w.Expiries.ReplaceOrInsert(ExpiryItem{ExpireAt: expireAt, ID: id, Side: side})
+}
+
+// Expired whether the order has expired by the time it is logged with or the clock of the ome, whichever is later,
+// both are in the logs, so the replay admits the same orders
+func (w *Worker) Expired(no NewOrder) bool {
+	return no.ExpireAt > 0 && no.ExpireAt <= max(w.Now, no.Time)
+}
+
+// Expire move the clock of the ome to now and cancel the orders expired by then, if any order is due
+//
+//	a TimerLog is written first, so replaying the logs leads to the same clock and the same cancels,
+//	nothing is written while no order is due, the funds are refunded by the bank from the CancelLogs as for user cancels
+func (w *Worker) Expire(now int64) (err error) {
+	if now <= w.Now {
+		return
+	}
+	first := w.Expiries.Min()
+	if first == nil || first.(ExpiryItem).ExpireAt > now {
+		return
+	}
+	err = w.WriteTimerLog(now)
+	if err != nil {
+		return
+	}
+	w.Now = now
+
+	var due []ExpiryItem
+	w.Expiries.Ascend(func(item btree.Item) bool {
+		e := item.(ExpiryItem)
+		if e.ExpireAt > now {
+			return false
+		}
+		due = append(due, e)
+		return true
+	})
+
+	live := due[:0]
+	for _, e := range due {
+		w.Expiries.Delete(e)
+		if _, ok := w.stops[e.ID]; ok || w.FindOrder(e.Side, e.ID) != nil {
+			live = append(live, e)
+		}
+	}
+
+	for _, e := range live {
+		if so, ok := w.stops[e.ID]; ok {
+			err = w.CancelStop(so, so.TicketID, CancelReasonExpired)
+		} else {
+			o := w.FindOrder(e.Side, e.ID)
+			err = w.RemoveOrder(e.Side, o, o.TicketID, CancelReasonExpired)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// WriteAmendLog write a single AmendLog to filedb
+func (w *Worker) WriteAmendLog(al AmendLog) (err error) {
+	w.LogID++
+	defer func() {
+		if err != nil {
+			w.LogID--
+		}
+	}()
+
+	omeLog := OmeLog{
+		LogID: w.LogID,
+		Ts:    time.Now().UnixNano(),
+
+		AmendLogs: []AmendLog{al},
+	}
+
+	// write to filedb
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	mlb, _ := f.Marshal(omeLog)
+	err = f.Append(omeLog.LogID, string(mlb)+"\n")
+	return
+}
+
+// WriteTimerLog write a single TimerLog to filedb
+func (w *Worker) WriteTimerLog(now int64) (err error) {
+	w.LogID++
+	defer func() {
+		if err != nil {
+			w.LogID--
+		}
+	}()
+
+	omeLog := OmeLog{
+		LogID: w.LogID,
+		Ts:    time.Now().UnixNano(),
+
+		TimerLogs: []TimerLog{{Now: now}},
+	}
+
+	// write to filedb
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	mlb, _ := f.Marshal(omeLog)
+	err = f.Append(omeLog.LogID, string(mlb)+"\n")
+	return
+}
+
+// CancelRemainder remove what is left of an order after matching, if anything
+func (w *Worker) CancelRemainder(side int8, id int64, reason string) (err error) {
+	o := w.FindOrder(side, id)
+	if o == nil {
+		// fully filled
+		return
+	}
+	return w.RemoveOrder(side, o, o.TicketID, reason)
+}
+
+// RestOrder let the owner know the new order is left in the book, if anything is left of it
+func (w *Worker) RestOrder(side int8, id int64) (err error) {
+	o := w.FindOrder(side, id)
+	if o == nil {
+		// fully filled
+		return
+	}
+
+	w.LogID++
+	defer func() {
+		if err != nil {
+			w.LogID--
+		}
+	}()
+
+	omeLog := OmeLog{
+		LogID: w.LogID,
+		Ts:    time.Now().UnixNano(),
+
+		RestLogs: []RestLog{{
+			ID:       o.ID,
+			TicketID: o.TicketID,
+			Owner:    o.Owner,
+			Side:     side,
+			Price:    o.Price,
+			Quantity: o.Quantity,
+
+			ClientOrderID: o.ClientOrderID,
+		}},
+	}
+
+	// write to filedb
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	mlb, _ := f.Marshal(omeLog)
+	err = f.Append(omeLog.LogID, string(mlb)+"\n")
+	return
+}
+
+// CancelMarketOrders remove all market orders from the list, they are never supposed to rest there
+func (w *Worker) CancelMarketOrders() (err error) {
+	var asks, bids []Order
+	w.Asks.Ascend(func(item btree.Item) bool {
+		if o := Order(item.(AskOrder)); o.Type == model.OrderTypeMarket {
+			asks = append(asks, o)
+		}
+		return true
+	})
+	w.Bids.Ascend(func(item btree.Item) bool {
+		if o := Order(item.(BidOrder)); o.Type == model.OrderTypeMarket {
+			bids = append(bids, o)
+		}
+		return true
+	})
+
+	for i := range asks {
+		err = w.RemoveOrder(model.OrderSideAsk, &asks[i], asks[i].TicketID, CancelReasonUnfilled)
+		if err != nil {
+			return
+		}
+	}
+	for i := range bids {
+		err = w.RemoveOrder(model.OrderSideBid, &bids[i], bids[i].TicketID, CancelReasonUnfilled)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Depth returns up to limit price levels of each side, the best first
+//
+//	only the shown quantity is summed up, the hidden part of iceberg orders never leaves the engine
+func (w *Worker) Depth(limit int) (asks, bids []PriceLevel) {
+	add := func(levels []PriceLevel, o Order) ([]PriceLevel, bool) {
+		if n := len(levels); n > 0 && Equal(levels[n-1].Price, o.Price) {
+			levels[n-1].Quantity.Add(levels[n-1].Quantity, o.Shown())
+			return levels, true
+		}
+		if len(levels) == limit {
+			return levels, false
+		}
+		return append(levels, PriceLevel{Price: o.Price, Quantity: big.NewInt(0).Set(o.Shown())}), true
+	}
+
+	// market orders never rest in the book
+	var ok bool
+	w.Asks.Ascend(func(item btree.Item) bool {
+		asks, ok = add(asks, Order(item.(AskOrder)))
+		return ok
+	})
+	w.Bids.Descend(func(item btree.Item) bool {
+		bids, ok = add(bids, Order(item.(BidOrder)))
+		return ok
+	})
+	return
+}
+
+// FindOrder locate an order in Asks/Bids by id, returns nil if it is not in the list
+func (w *Worker) FindOrder(side int8, id int64) *Order {
+	key, ok := w.keys[id]
+	if !ok {
+		return nil
+	}
+
+	if side == model.OrderSideAsk {
+		if item := w.Asks.Get(AskOrder{ID: id, Price: key.Price, Seq: key.Seq}); item != nil {
+			o := Order(item.(AskOrder))
+			return &o
+		}
+	} else if side == model.OrderSideBid {
+		if item := w.Bids.Get(BidOrder{ID: id, Price: key.Price, Seq: key.Seq}); item != nil {
+			o := Order(item.(BidOrder))
+			return &o
+		}
+	}
+
+	return nil
+}
+
+// RemoveOrder write a CancelLog refunding the frozen funds of the order, then remove it from the list
+func (w *Worker) RemoveOrder(side int8, o *Order, ticketID int64, reason string) (err error) {
+	err = w.WriteCancelLog(CancelLog{
+		ID:       o.ID,
+		TicketID: ticketID,
+		Owner:    o.Owner,
+		Side:     side,
+		Reason:   reason,
+		Quantity: o.Quantity,
+		Refund:   SubFloor(o.Frozen, big.NewInt(0)),
+
+		ClientOrderID: o.ClientOrderID,
+	})
+	if err != nil {
+		return
+	}
+
+	if side == model.OrderSideAsk {
+		w.Asks.Delete(AskOrder(*o))
+	} else {
+		w.Bids.Delete(BidOrder(*o))
+	}
+	delete(w.keys, o.ID)
+
+	return
+}
+
+// WriteCancelLog write a single CancelLog to filedb
+func (w *Worker) WriteCancelLog(cl CancelLog) (err error) {
+	w.LogID++
+	defer func() {
+		if err != nil {
+			w.LogID--
+		}
+	}()
+
+	omeLog := OmeLog{
+		LogID: w.LogID,
+		Ts:    time.Now().UnixNano(),
+
+		CancelLogs: []CancelLog{cl},
+	}
+
+	// write to filedb
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	mlb, _ := f.Marshal(omeLog)
+	err = f.Append(omeLog.LogID, string(mlb)+"\n")
+	return
+}
+
 func (w *Worker) CheckoutLastKv(app, key string) (kv model.Lastkv, err error) {
 	if app == "" {
 		app = strings.ToLower(w.Name)
@@ -766,7 +2126,7 @@ func (w *Worker) CheckoutLastKv(app, key string) (kv model.Lastkv, err error) {
 }
 
 // Filedb returns the current working filedb instance
-// TODO: according to the current file splitting method, a new instance should be returned when the time comes
+// the instance splits the logs into segments itself, see config.Filedb
 func (w *Worker) Filedb() (*filedb.Filedb, error) {
 	if w.fdb != nil {
 		return w.fdb, nil
@@ -778,7 +2138,11 @@ func (w *Worker) Filedb() (*filedb.Filedb, error) {
 		return nil, err
 	}
 
-	fdb.ToMySQLHandler = w.ParseAndWriteLogs
+	fdb.SegmentSize = config.Shared.Filedb.SegmentSize
+	fdb.SegmentLogs = config.Shared.Filedb.SegmentLogs
+	fdb.SyncPolicy = config.Shared.Filedb.Sync
+	fdb.SyncInterval = time.Duration(config.Shared.Filedb.SyncInterval) * time.Millisecond
+	fdb.Codec = config.Shared.Filedb.Codec
 
 	w.fdb = fdb
 
@@ -0,0 +1,790 @@
+package ome_test
+
+import (
+	"ccoms/pkg/config"
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/model"
+	"ccoms/pkg/ome"
+	"ccoms/pkg/xgrpc"
+	"ccoms/pkg/xnats"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newWorker(t *testing.T) *ome.Worker {
+	config.Shared = &config.Config{DataDir: t.TempDir()}
+
+	w, err := ome.New("BTC_USDT")
+	require.Nil(t, err)
+	return w
+}
+
+func readLogs(t *testing.T) (logs []ome.OmeLog) {
+	f, err := filedb.New(path.Join(config.Shared.DataDir, "filedb", "ome_btc_usdt.log"))
+	require.Nil(t, err)
+	defer f.Close()
+
+	err = filedb.Iterate(f, filedb.IterOptions{}, func(r filedb.Record[ome.OmeLog]) error {
+		logs = append(logs, *r.Log)
+		return nil
+	})
+	require.Nil(t, err)
+	return
+}
+
+func TestCancelOrder(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 7, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "2", Frozen: "20",
+	}))
+	require.Equal(t, 1, w.Bids.Len())
+
+	// not the owner
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 8, Side: int64(model.OrderSideBid), Action: int64(model.TicketActionCancel), OrderID: 1,
+	}))
+	require.Equal(t, 1, w.Bids.Len())
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 3, Owner: 7, Side: int64(model.OrderSideBid), Action: int64(model.TicketActionCancel), OrderID: 1,
+	}))
+	require.Equal(t, 0, w.Bids.Len())
+	require.Equal(t, int64(3), w.LatestBidTicketID)
+
+	logs := readLogs(t)
+	require.Len(t, logs, 4)
+	require.Equal(t, ome.CancelReasonInvalid, logs[2].CancelLogs[0].Reason)
+	require.Equal(t, "0", logs[2].CancelLogs[0].Refund.String())
+	require.Equal(t, ome.CancelReasonUser, logs[3].CancelLogs[0].Reason)
+	require.Equal(t, "20", ome.IntToDecimal(logs[3].CancelLogs[0].Refund).String())
+}
+
+func TestMarketBid(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "1",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "20", Quantity: "1", Frozen: "1",
+	}))
+
+	// sized by amount, stops in the middle of the second ask
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 2, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeMarket),
+		Price: "0", Quantity: "0", Amount: "20", Frozen: "20",
+	}))
+	require.Equal(t, 0, w.Bids.Len())
+	require.Equal(t, 1, w.Asks.Len())
+
+	logs := readLogs(t)
+	require.Len(t, logs, 7)
+	require.Equal(t, "10", ome.IntToDecimal(logs[5].MatchLogs[0].Price).String())
+	require.Equal(t, "1", ome.IntToDecimal(logs[5].MatchLogs[0].Quantity).String())
+	require.Equal(t, "20", ome.IntToDecimal(logs[6].MatchLogs[0].Price).String())
+	require.Equal(t, "0.5", ome.IntToDecimal(logs[6].MatchLogs[0].Quantity).String())
+
+	// sweeps the book, the remainder is canceled and refunded
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 3, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeMarket),
+		Price: "0", Quantity: "0", Amount: "50", Frozen: "50",
+	}))
+	require.Equal(t, 0, w.Bids.Len())
+	require.Equal(t, 0, w.Asks.Len())
+
+	logs = readLogs(t)
+	require.Len(t, logs, 10)
+	require.Equal(t, "10", ome.IntToDecimal(logs[8].MatchLogs[0].Amount).String())
+	cl := logs[9].CancelLogs[0]
+	require.Equal(t, ome.CancelReasonUnfilled, cl.Reason)
+	require.Equal(t, int64(3), cl.Owner)
+	require.Equal(t, "40", ome.IntToDecimal(cl.Refund).String())
+}
+
+func TestMarketAsk(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "10",
+	}))
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 2, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeMarket),
+		Price: "0", Quantity: "3", Frozen: "3",
+	}))
+	require.Equal(t, 0, w.Bids.Len())
+	require.Equal(t, 0, w.Asks.Len())
+
+	logs := readLogs(t)
+	require.Len(t, logs, 5)
+	require.Equal(t, "10", ome.IntToDecimal(logs[3].MatchLogs[0].Price).String())
+	cl := logs[4].CancelLogs[0]
+	require.Equal(t, ome.CancelReasonUnfilled, cl.Reason)
+	require.Equal(t, "2", ome.IntToDecimal(cl.Quantity).String())
+	require.Equal(t, "2", ome.IntToDecimal(cl.Refund).String())
+}
+
+func TestTimeInForce(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "1",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "11", Quantity: "1", Frozen: "1",
+	}))
+
+	// post-only crossing the book is rejected, otherwise it rests
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 2, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "10", TimeInForce: int64(model.OrderTIFPostOnly),
+	}))
+	require.Equal(t, 0, w.Bids.Len())
+	require.Equal(t, 2, w.Asks.Len())
+	logs := readLogs(t)
+	require.Equal(t, ome.CancelReasonPostOnly, logs[len(logs)-1].CancelLogs[0].Reason)
+	require.True(t, logs[len(logs)-1].CancelLogs[0].Rejected())
+	require.Equal(t, "10", ome.IntToDecimal(logs[len(logs)-1].CancelLogs[0].Refund).String())
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 2, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "9", Quantity: "1", Frozen: "9", TimeInForce: int64(model.OrderTIFPostOnly),
+	}))
+	require.Equal(t, 1, w.Bids.Len())
+
+	// FOK without enough liquidity below its price is rejected without trading
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 3, Owner: 3, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "2", Frozen: "20", TimeInForce: int64(model.OrderTIFFOK),
+	}))
+	require.Equal(t, 2, w.Asks.Len())
+	logs = readLogs(t)
+	require.Equal(t, ome.CancelReasonFOK, logs[len(logs)-1].CancelLogs[0].Reason)
+	require.Equal(t, "20", ome.IntToDecimal(logs[len(logs)-1].CancelLogs[0].Refund).String())
+
+	// IOC takes what it can and cancels the rest
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 4, Owner: 3, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "2", Frozen: "20", TimeInForce: int64(model.OrderTIFIOC),
+	}))
+	require.Equal(t, 1, w.Asks.Len())
+	require.Equal(t, 1, w.Bids.Len())
+	logs = readLogs(t)
+	require.Equal(t, "1", ome.IntToDecimal(logs[len(logs)-2].MatchLogs[0].Quantity).String())
+	cl := logs[len(logs)-1].CancelLogs[0]
+	require.Equal(t, ome.CancelReasonUnfilled, cl.Reason)
+	require.False(t, cl.Rejected())
+	require.Equal(t, "1", ome.IntToDecimal(cl.Quantity).String())
+	require.Equal(t, "10", ome.IntToDecimal(cl.Refund).String())
+
+	// FOK with enough liquidity is filled completely
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 3, Owner: 4, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "9", Quantity: "1", Frozen: "1", TimeInForce: int64(model.OrderTIFFOK),
+	}))
+	require.Equal(t, 1, w.Asks.Len())
+	require.Equal(t, 0, w.Bids.Len())
+	logs = readLogs(t)
+	require.Len(t, logs[len(logs)-1].MatchLogs, 1)
+}
+
+func TestFees(t *testing.T) {
+	config.Shared = &config.Config{
+		DataDir: t.TempDir(),
+		Fee:     config.Fee{Collector: 99, MakerRate: 0.001, TakerRate: 0.002},
+	}
+	w, err := ome.New("BTC_USDT")
+	require.Nil(t, err)
+
+	// frozen at the taker rate, the maker ask gets the difference back when it completes
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "1.002",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 2, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "10.02",
+	}))
+
+	logs := readLogs(t)
+	require.Len(t, logs, 4)
+	ml := logs[3].MatchLogs[0]
+	require.Equal(t, model.OrderSideBid, ml.TakerSide)
+	require.Equal(t, "0.001", ome.IntToDecimal(ml.AskFee).String())
+	require.Equal(t, "0.02", ome.IntToDecimal(ml.BidFee).String())
+	require.Equal(t, "0.001", ome.IntToDecimal(ml.AskRefund).String())
+	require.Equal(t, "0", ome.IntToDecimal(ml.BidRefund).String())
+
+	bc, err := w.BalanceChangeOf("USDT", &logs[3])
+	require.Nil(t, err)
+	require.Equal(t, int64(1), bc.Owner)
+	require.Equal(t, "10", bc.FreeChange)
+	require.Equal(t, int64(2), bc.Owner2)
+	require.Equal(t, "-10.02", bc.FreezeChange2)
+	require.Equal(t, int64(99), bc.Owner3)
+	require.Equal(t, "0.02", bc.FreeChange3)
+
+	bc, err = w.BalanceChangeOf("BTC", &logs[3])
+	require.Nil(t, err)
+	require.Equal(t, "0.001", bc.FreeChange)
+	require.Equal(t, "-1.002", bc.FreezeChange)
+	require.Equal(t, "1", bc.FreeChange2)
+	require.Equal(t, "0.001", bc.FreeChange3)
+
+	// nothing for the order log
+	bc, err = w.BalanceChangeOf("BTC", &logs[0])
+	require.Nil(t, err)
+	require.Nil(t, bc)
+}
+
+func TestOrderEvents(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "2", Frozen: "2", ClientOrderID: "a1",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 2, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "10", ClientOrderID: "b1",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 1, Side: int64(model.OrderSideAsk), Action: int64(model.TicketActionCancel), OrderID: 1,
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 3, Owner: 1, Side: int64(model.OrderSideAsk), Action: int64(model.TicketActionCancel), OrderID: 1,
+		ClientOrderID: "c1",
+	}))
+
+	var events []xnats.OrderEvent
+	for _, l := range readLogs(t) {
+		events = append(events, w.OrderEventsOf(&l)...)
+	}
+	require.Len(t, events, 5)
+
+	require.Equal(t, xnats.OrderEventResting, events[0].Type)
+	require.Equal(t, "a1", events[0].ClientOrderID)
+	require.Equal(t, int64(1), events[0].OrderID)
+	require.Equal(t, "2", events[0].Remaining.String())
+
+	require.Equal(t, xnats.OrderEventPartiallyFilled, events[1].Type)
+	require.Equal(t, "a1", events[1].ClientOrderID)
+	require.Equal(t, "1", events[1].Quantity.String())
+	require.Equal(t, "1", events[1].Remaining.String())
+	require.Equal(t, xnats.OrderEventFilled, events[2].Type)
+	require.Equal(t, "b1", events[2].ClientOrderID)
+	require.Equal(t, model.OrderSideBid, events[2].Side)
+	require.Equal(t, "10", events[2].Price.String())
+
+	require.Equal(t, xnats.OrderEventCancelled, events[3].Type)
+	require.Equal(t, "a1", events[3].ClientOrderID)
+	require.Equal(t, ome.CancelReasonUser, events[3].Reason)
+
+	// the order is gone, the second cancel is turned down
+	require.Equal(t, xnats.OrderEventRejected, events[4].Type)
+	require.Equal(t, "c1", events[4].ClientOrderID)
+	require.Equal(t, ome.CancelReasonInvalid, events[4].Reason)
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	config.Shared = &config.Config{
+		DataDir:             t.TempDir(),
+		SelfTradePrevention: map[string]int8{"BTC_USDT": model.OrderSTPCancelNewest},
+	}
+	w, err := ome.New("BTC_USDT")
+	require.Nil(t, err)
+
+	// resting ask of owner 1, and an ask of owner 2 behind it
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "2", Frozen: "2",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 2, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "11", Quantity: "1", Frozen: "1",
+	}))
+
+	// the symbol default cancels the new bid
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "11", Quantity: "1", Frozen: "11",
+	}))
+	require.Equal(t, 2, w.Asks.Len())
+	require.Equal(t, 0, w.Bids.Len())
+	logs := readLogs(t)
+	cl := logs[len(logs)-1].CancelLogs[0]
+	require.Equal(t, ome.CancelReasonSTP, cl.Reason)
+	require.Equal(t, int64(3), cl.ID)
+	require.Equal(t, "11", ome.IntToDecimal(cl.Refund).String())
+
+	// none trades with itself
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 1, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "0.5", Frozen: "5", SelfTradePrevention: int64(model.OrderSTPNone),
+	}))
+	logs = readLogs(t)
+	require.Len(t, logs[len(logs)-1].MatchLogs, 1)
+	require.Equal(t, int64(1), logs[len(logs)-1].MatchLogs[0].Asker)
+
+	// decrement takes the remaining 1.5 off the ask and the bid, the ask is canceled,
+	// the rest of the bid then trades with owner 2
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 3, Owner: 1, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "11", Quantity: "2", Frozen: "22", SelfTradePrevention: int64(model.OrderSTPDecrementAndCancel),
+	}))
+	require.Equal(t, 1, w.Asks.Len())
+	require.Equal(t, 0, w.Bids.Len())
+	logs = readLogs(t)
+	n := len(logs)
+	askCl, bidCl := logs[n-3].CancelLogs[0], logs[n-2].CancelLogs[0]
+	require.Equal(t, int64(1), askCl.ID)
+	require.False(t, askCl.Partial())
+	require.Equal(t, "1.5", ome.IntToDecimal(askCl.Refund).String())
+	require.Equal(t, int64(5), bidCl.ID)
+	require.True(t, bidCl.Partial())
+	require.Equal(t, "1.5", ome.IntToDecimal(bidCl.Quantity).String())
+	require.Equal(t, "0.5", ome.IntToDecimal(bidCl.Remaining).String())
+	require.Equal(t, "16.5", ome.IntToDecimal(bidCl.Refund).String())
+	require.Equal(t, "5.5", ome.IntToDecimal(bidCl.Frozen).String())
+	require.Equal(t, int64(2), logs[n-1].MatchLogs[0].Asker)
+	require.Equal(t, "0.5", ome.IntToDecimal(logs[n-1].MatchLogs[0].Quantity).String())
+
+	events := w.OrderEventsOf(&logs[n-2])
+	require.Equal(t, xnats.OrderEventDecremented, events[0].Type)
+	require.Equal(t, "0.5", events[0].Remaining.String())
+}
+
+func TestFOKSelfTrade(t *testing.T) {
+	w := newWorker(t)
+
+	ask := func(id, owner int64, price string) *xgrpc.Ticket {
+		return &xgrpc.Ticket{
+			Id: id, Owner: owner, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+			Price: price, Quantity: "1", Frozen: "1",
+		}
+	}
+	fok := func(id int64, quantity string, stp int8) *xgrpc.Ticket {
+		return &xgrpc.Ticket{
+			Id: id, Owner: 1, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+			Price: "11", Quantity: quantity, Frozen: "33", TimeInForce: int64(model.OrderTIFFOK), SelfTradePrevention: int64(stp),
+		}
+	}
+	require.Nil(t, w.TicketToMatchEngine(ask(1, 1, "10")))
+	require.Nil(t, w.TicketToMatchEngine(ask(2, 2, "11")))
+	require.Nil(t, w.TicketToMatchEngine(ask(3, 3, "11")))
+	lastCancel := func() ome.CancelLog {
+		logs := readLogs(t)
+		return logs[len(logs)-1].CancelLogs[0]
+	}
+
+	// the own ask would cancel the bid, it cannot be filled
+	require.Nil(t, w.TicketToMatchEngine(fok(1, "2", model.OrderSTPCancelNewest)))
+	require.Equal(t, ome.CancelReasonFOK, lastCancel().Reason)
+	require.Nil(t, w.TicketToMatchEngine(fok(2, "2", model.OrderSTPDecrementAndCancel)))
+	require.Equal(t, ome.CancelReasonFOK, lastCancel().Reason)
+	// the own ask would be canceled, the others hold 2
+	require.Nil(t, w.TicketToMatchEngine(fok(3, "3", model.OrderSTPCancelOldest)))
+	require.Equal(t, ome.CancelReasonFOK, lastCancel().Reason)
+	require.Equal(t, 3, w.Asks.Len())
+
+	require.Nil(t, w.TicketToMatchEngine(fok(4, "2", model.OrderSTPCancelOldest)))
+	require.Equal(t, 0, w.Asks.Len())
+	require.Equal(t, 0, w.Bids.Len())
+	logs := readLogs(t)
+	n := len(logs)
+	require.Equal(t, ome.CancelReasonSTP, logs[n-3].CancelLogs[0].Reason)
+	require.Equal(t, int64(2), logs[n-2].MatchLogs[0].Asker)
+	require.Equal(t, int64(3), logs[n-1].MatchLogs[0].Asker)
+}
+
+func TestStopOrders(t *testing.T) {
+	w := newWorker(t)
+
+	ticket := func(id, owner int64, side, typ int8, stopPrice, price, quantity, frozen string) *xgrpc.Ticket {
+		return &xgrpc.Ticket{
+			Id: id, Owner: owner, Side: int64(side), Type: int64(typ),
+			StopPrice: stopPrice, Price: price, Quantity: quantity, Frozen: frozen,
+		}
+	}
+	require.Nil(t, w.TicketToMatchEngine(ticket(1, 1, model.OrderSideAsk, model.OrderTypeLimit, "", "10", "1", "1")))
+	require.Nil(t, w.TicketToMatchEngine(ticket(2, 1, model.OrderSideAsk, model.OrderTypeLimit, "", "12", "1", "1")))
+	require.Nil(t, w.TicketToMatchEngine(ticket(1, 3, model.OrderSideBid, model.OrderTypeLimit, "", "8", "1", "8")))
+
+	// without trades a bid waits for a rise and an ask for a fall
+	require.Nil(t, w.TicketToMatchEngine(ticket(2, 2, model.OrderSideBid, model.OrderTypeStopLimit, "10", "12", "1", "12")))
+	logs := readLogs(t)
+	require.True(t, logs[len(logs)-1].OrderLogs[0].StopAbove)
+	require.Nil(t, w.TicketToMatchEngine(ticket(3, 4, model.OrderSideAsk, model.OrderTypeStopLimit, "9", "20", "1", "1")))
+	logs = readLogs(t)
+	require.False(t, logs[len(logs)-1].OrderLogs[0].StopAbove)
+	require.Nil(t, w.TicketToMatchEngine(ticket(4, 4, model.OrderSideAsk, model.OrderTypeStopLimit, "5", "20", "1", "1")))
+	require.Equal(t, 2, w.Asks.Len())
+	require.Equal(t, 1, w.Bids.Len())
+	require.Equal(t, 1, w.StopsAbove.Len())
+	require.Equal(t, 2, w.StopsBelow.Len())
+
+	// a pending stop order can be canceled, all its funds are refunded
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 5, Owner: 4, Side: int64(model.OrderSideAsk), Action: int64(model.TicketActionCancel), OrderID: 6,
+	}))
+	require.Equal(t, 1, w.StopsBelow.Len())
+	logs = readLogs(t)
+	cl := logs[len(logs)-1].CancelLogs[0]
+	require.Equal(t, ome.CancelReasonUser, cl.Reason)
+	require.Equal(t, "1", ome.IntToDecimal(cl.Refund).String())
+
+	require.Nil(t, w.TicketToMatchEngine(ticket(6, 7, model.OrderSideAsk, model.OrderTypeLimit, "", "20", "1", "1")))
+
+	// the trade at 10 triggers the stop bid, which then takes the ask at 12
+	require.Nil(t, w.TicketToMatchEngine(ticket(3, 5, model.OrderSideBid, model.OrderTypeLimit, "", "10", "1", "10")))
+	require.Equal(t, 0, w.StopsAbove.Len())
+	require.Equal(t, "12", ome.IntToDecimal(w.LastPrice).String())
+	logs = readLogs(t)
+	n := len(logs)
+	require.Len(t, logs[n-2].TriggerLogs, 1)
+	tl := logs[n-2].TriggerLogs[0]
+	require.Equal(t, int64(4), tl.ID)
+	require.Equal(t, model.OrderTypeLimit, tl.Type)
+	require.Equal(t, "10", ome.IntToDecimal(tl.Price).String())
+	require.Equal(t, int64(4), logs[n-1].MatchLogs[0].BidID)
+	require.Equal(t, "12", ome.IntToDecimal(logs[n-1].MatchLogs[0].Price).String())
+
+	events := w.OrderEventsOf(&logs[n-2])
+	require.Equal(t, xnats.OrderEventTriggered, events[0].Type)
+	require.Equal(t, int64(2), events[0].Owner)
+
+	// the trade at 8 triggers the stop ask, it queues behind the ask placed after it at the same price
+	require.Nil(t, w.TicketToMatchEngine(ticket(7, 6, model.OrderSideAsk, model.OrderTypeLimit, "", "8", "1", "1")))
+	require.Equal(t, 0, w.StopsBelow.Len())
+	require.Equal(t, 2, w.Asks.Len())
+	require.Equal(t, int64(7), w.Asks.Min().(ome.AskOrder).ID)
+}
+
+func TestIceberg(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "5", Frozen: "5", DisplayQty: "2",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 2, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "1",
+	}))
+	asks, bids := w.Depth(10)
+	require.Len(t, asks, 1)
+	require.Len(t, bids, 0)
+	require.Equal(t, "3", ome.IntToDecimal(asks[0].Quantity).String())
+
+	// the slice is taken, the new one queues behind the ask of owner 2
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 3, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "3", Frozen: "30",
+	}))
+	logs := readLogs(t)
+	n := len(logs)
+	require.Equal(t, int64(1), logs[n-3].MatchLogs[0].AskID)
+	require.Equal(t, "2", ome.IntToDecimal(logs[n-3].MatchLogs[0].Quantity).String())
+	rl := logs[n-2].ReplenishLogs[0]
+	require.Equal(t, int64(1), rl.ID)
+	require.Equal(t, "2", ome.IntToDecimal(rl.Visible).String())
+	require.Equal(t, "3", ome.IntToDecimal(rl.Quantity).String())
+	require.Equal(t, int64(2), logs[n-1].MatchLogs[0].AskID)
+	asks, _ = w.Depth(10)
+	require.Equal(t, "2", ome.IntToDecimal(asks[0].Quantity).String())
+
+	// a replenished slice is still the maker of the order sweeping it
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 4, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "11", Quantity: "3", Frozen: "33",
+	}))
+	require.Equal(t, 0, w.Asks.Len())
+	logs = readLogs(t)
+	n = len(logs)
+	require.Len(t, logs[n-2].ReplenishLogs, 1)
+	ml := logs[n-1].MatchLogs[0]
+	require.Equal(t, int64(1), ml.AskID)
+	require.Equal(t, "1", ome.IntToDecimal(ml.Quantity).String())
+	require.Equal(t, "10", ome.IntToDecimal(ml.Price).String())
+	require.Equal(t, model.OrderSideBid, ml.TakerSide)
+}
+
+func TestExpire(t *testing.T) {
+	w := newWorker(t)
+	t0 := time.Now().Unix() + 3600
+
+	ticket := func(id, owner int64, side, typ int8, price string, expireAt int64) *xgrpc.Ticket {
+		return &xgrpc.Ticket{
+			Id: id, Owner: owner, Side: int64(side), Type: int64(typ),
+			StopPrice: "5", Price: price, Quantity: "1", Frozen: "20", ExpireAt: expireAt,
+		}
+	}
+	require.Nil(t, w.TicketToMatchEngine(ticket(1, 1, model.OrderSideAsk, model.OrderTypeLimit, "12", t0)))
+	require.Nil(t, w.TicketToMatchEngine(ticket(1, 2, model.OrderSideBid, model.OrderTypeLimit, "9", t0+100)))
+	require.Nil(t, w.TicketToMatchEngine(ticket(2, 3, model.OrderSideAsk, model.OrderTypeStopLimit, "5", t0)))
+	// filled before it expires, its expiry is dropped once due
+	require.Nil(t, w.TicketToMatchEngine(ticket(3, 4, model.OrderSideAsk, model.OrderTypeLimit, "11", t0)))
+	require.Nil(t, w.TicketToMatchEngine(ticket(2, 5, model.OrderSideBid, model.OrderTypeLimit, "11", 0)))
+	require.Equal(t, 4, w.Expiries.Len())
+
+	// expired by the time it is logged with, before any tick moves the clock
+	require.Nil(t, w.TicketToMatchEngine(ticket(4, 6, model.OrderSideAsk, model.OrderTypeLimit, "12", time.Now().Unix()-1)))
+	require.Equal(t, 1, w.Asks.Len())
+	logs := readLogs(t)
+	require.Equal(t, ome.CancelReasonExpired, logs[len(logs)-1].CancelLogs[0].Reason)
+
+	// nothing is due yet, the clock stays
+	n := len(logs)
+	require.Nil(t, w.Expire(t0-1))
+	require.Len(t, readLogs(t), n)
+	require.Equal(t, int64(0), w.Now)
+	require.Equal(t, 4, w.Expiries.Len())
+
+	require.Nil(t, w.Expire(t0))
+	require.Equal(t, t0, w.Now)
+	require.Equal(t, 0, w.Asks.Len())
+	require.Equal(t, 1, w.Bids.Len())
+	require.Equal(t, 0, w.StopsBelow.Len())
+	require.Equal(t, 1, w.Expiries.Len())
+	logs = readLogs(t)
+	require.Len(t, logs, n+3)
+	require.Equal(t, t0, logs[n].TimerLogs[0].Now)
+	for _, l := range logs[n+1:] {
+		cl := l.CancelLogs[0]
+		require.Equal(t, ome.CancelReasonExpired, cl.Reason)
+		require.Equal(t, "20", ome.IntToDecimal(cl.Refund).String())
+		require.Equal(t, xnats.OrderEventExpired, w.OrderEventsOf(&l)[0].Type)
+	}
+	require.Equal(t, int64(1), logs[n+1].CancelLogs[0].ID)
+	require.Equal(t, int64(3), logs[n+2].CancelLogs[0].ID)
+	require.Nil(t, w.Expire(t0))
+	require.Len(t, readLogs(t), n+3)
+
+	// expired by the clock of the ome on arrival
+	require.Nil(t, w.TicketToMatchEngine(ticket(5, 6, model.OrderSideAsk, model.OrderTypeLimit, "12", t0)))
+	require.Equal(t, 0, w.Asks.Len())
+	logs = readLogs(t)
+	require.Equal(t, ome.CancelReasonExpired, logs[len(logs)-1].CancelLogs[0].Reason)
+}
+
+func TestExpireIdle(t *testing.T) {
+	w := newWorker(t)
+	now := time.Now().Unix()
+
+	// an idle book writes nothing on the ticks
+	for i := int64(1); i <= 3; i++ {
+		require.Nil(t, w.Expire(now+i))
+	}
+	require.Len(t, readLogs(t), 0)
+	require.Equal(t, int64(0), w.LogID)
+
+	// nor does a book without good-till-time orders
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "1",
+	}))
+	n := len(readLogs(t))
+	for i := int64(4); i <= 6; i++ {
+		require.Nil(t, w.Expire(now+i))
+	}
+	require.Len(t, readLogs(t), n)
+}
+
+func TestFailedWrite(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "1",
+	}))
+	f, err := w.Filedb()
+	require.Nil(t, err)
+	writes := 0
+	fence := 2
+	f.SetFence(func() error {
+		writes++
+		if writes > fence {
+			return errors.New("fenced")
+		}
+		return nil
+	})
+	bid := &xgrpc.Ticket{
+		Id: 1, Owner: 2, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "2", Frozen: "20",
+	}
+
+	// the order and its match are logged, the rest of it is not, the ids logged are not taken back
+	require.NotNil(t, w.TicketToMatchEngine(bid))
+	logs := readLogs(t)
+	require.NotEmpty(t, logs[len(logs)-1].MatchLogs)
+	require.Equal(t, logs[len(logs)-1].LogID, w.LogID)
+	require.Equal(t, int64(2), w.OrderID)
+	logID := w.LogID
+
+	// the order is not logged, its ids are taken back
+	writes, fence = 0, 0
+	bid.Id = 2
+	require.NotNil(t, w.TicketToMatchEngine(bid))
+	require.Len(t, readLogs(t), len(logs))
+	require.Equal(t, logID, w.LogID)
+	require.Equal(t, int64(2), w.OrderID)
+}
+
+func TestAmend(t *testing.T) {
+	w := newWorker(t)
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 1, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "4", Frozen: "4",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 2, Owner: 2, Side: int64(model.OrderSideAsk), Type: int64(model.OrderTypeLimit),
+		Price: "10", Quantity: "1", Frozen: "1",
+	}))
+	amend := func(id, owner int64, side int8, orderID int64, price, quantity, frozen string) *xgrpc.Ticket {
+		return &xgrpc.Ticket{
+			Id: id, Owner: owner, Side: int64(side), Action: int64(model.TicketActionAmend), OrderID: orderID,
+			Price: price, Quantity: quantity, Frozen: frozen,
+		}
+	}
+	lastAmend := func() ome.AmendLog {
+		logs := readLogs(t)
+		return logs[len(logs)-1].AmendLogs[0]
+	}
+
+	// reducing keeps the time priority, half of the funds are returned
+	require.Nil(t, w.TicketToMatchEngine(amend(3, 1, model.OrderSideAsk, 1, "0", "2", "")))
+	al := lastAmend()
+	require.True(t, al.Applied())
+	require.True(t, al.KeepPriority)
+	require.Equal(t, "2", ome.IntToDecimal(al.Refund).String())
+	require.Equal(t, "2", ome.IntToDecimal(al.Frozen).String())
+	require.Equal(t, int64(1), w.Asks.Min().(ome.AskOrder).ID)
+	require.Equal(t, int64(3), w.LatestAskTicketID)
+
+	logs := readLogs(t)
+	bc, err := w.BalanceChangeOf("BTC", &logs[len(logs)-1])
+	require.Nil(t, err)
+	require.Equal(t, "amend", bc.Reason)
+	require.Equal(t, "2", bc.FreeChange)
+	require.Equal(t, "-2", bc.FreezeChange)
+
+	// a new price takes the funds frozen by the ticket and returns the old ones
+	require.Nil(t, w.TicketToMatchEngine(amend(4, 1, model.OrderSideAsk, 1, "11", "2", "2.2")))
+	al = lastAmend()
+	require.False(t, al.KeepPriority)
+	require.Equal(t, "2", ome.IntToDecimal(al.Refund).String())
+	require.Equal(t, "2.2", ome.IntToDecimal(al.Frozen).String())
+	require.Equal(t, int64(2), w.Asks.Min().(ome.AskOrder).ID)
+
+	// more quantity at the same price needs funds, nothing is frozen without a price
+	require.Nil(t, w.TicketToMatchEngine(amend(5, 1, model.OrderSideAsk, 1, "0", "3", "")))
+	require.False(t, lastAmend().Applied())
+	// not the owner, the funds of the ticket are returned
+	require.Nil(t, w.TicketToMatchEngine(amend(6, 3, model.OrderSideAsk, 1, "12", "1", "1.1")))
+	al = lastAmend()
+	require.Equal(t, ome.CancelReasonInvalid, al.Reason)
+	require.Equal(t, "1.1", ome.IntToDecimal(al.Refund).String())
+	events := w.OrderEventsOf(&ome.OmeLog{AmendLogs: []ome.AmendLog{al}})
+	require.Equal(t, xnats.OrderEventRejected, events[0].Type)
+
+	// a lower price is paid from the funds of the order, the difference is returned
+	lower := amend(7, 1, model.OrderSideAsk, 1, "10.5", "1", "1.1")
+	lower.Reserve = "0"
+	require.Nil(t, w.TicketToMatchEngine(lower))
+	al = lastAmend()
+	require.True(t, al.Applied())
+	require.Equal(t, "1.1", ome.IntToDecimal(al.Frozen).String())
+	require.Equal(t, "1.1", ome.IntToDecimal(al.Refund).String())
+	// the order and the ticket together hold less than needed, the reserve is returned
+	more := amend(8, 1, model.OrderSideAsk, 1, "10.5", "3", "3.3")
+	more.Reserve = "1"
+	require.Nil(t, w.TicketToMatchEngine(more))
+	al = lastAmend()
+	require.Equal(t, ome.CancelReasonUnderfunded, al.Reason)
+	require.Equal(t, "1", ome.IntToDecimal(al.Refund).String())
+	require.Equal(t, "1.1", ome.IntToDecimal(w.FindOrder(model.OrderSideAsk, 1).Frozen).String())
+
+	// the amended bid crosses the book and takes the ask
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 3, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeLimit),
+		Price: "9", Quantity: "1", Frozen: "9",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(amend(2, 3, model.OrderSideBid, 3, "10", "1", "10")))
+	logs = readLogs(t)
+	ml := logs[len(logs)-1].MatchLogs[0]
+	require.Equal(t, int64(2), ml.AskID)
+	require.Equal(t, int64(3), ml.BidID)
+	require.Equal(t, model.OrderSideBid, ml.TakerSide)
+	require.Equal(t, 0, w.Bids.Len())
+}
+
+func TestSnapshot(t *testing.T) {
+	w := newWorker(t)
+	config.Shared.Snapshot = config.Snapshot{Enabled: true, Keep: 1}
+
+	limit := func(id, owner int64, side int8, price, quantity, frozen string, expireAt int64) *xgrpc.Ticket {
+		return &xgrpc.Ticket{
+			Id: id, Owner: owner, Side: int64(side), Type: int64(model.OrderTypeLimit),
+			Price: price, Quantity: quantity, Frozen: frozen, ExpireAt: expireAt,
+		}
+	}
+	iceberg := limit(1, 1, model.OrderSideAsk, "10", "5", "5", 0)
+	iceberg.DisplayQty = "1"
+	require.Nil(t, w.TicketToMatchEngine(iceberg))
+	require.Nil(t, w.TicketToMatchEngine(limit(2, 2, model.OrderSideAsk, "11", "2", "2", 0)))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 1, Owner: 3, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeStopLimit),
+		StopPrice: "10.5", Price: "12", Quantity: "1", Frozen: "12",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(limit(2, 4, model.OrderSideBid, "9", "3", "27", 500)))
+	require.Nil(t, w.TicketToMatchEngine(limit(3, 5, model.OrderSideBid, "10", "2", "20", 0)))
+
+	require.Nil(t, w.WriteSnapshot(w.Snapshot()))
+	snapLogID := w.LogID
+
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 4, Owner: 6, Side: int64(model.OrderSideBid), Type: int64(model.OrderTypeMarket),
+		Price: "0", Quantity: "0", Amount: "11", Frozen: "11",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(&xgrpc.Ticket{
+		Id: 3, Owner: 2, Side: int64(model.OrderSideAsk), Action: int64(model.TicketActionAmend), OrderID: 2,
+		Price: "10.5", Quantity: "1", Frozen: "1",
+	}))
+	require.Nil(t, w.TicketToMatchEngine(limit(5, 7, model.OrderSideBid, "11", "4", "44", 0)))
+	require.Equal(t, 0, w.StopsAbove.Len(), "triggered by the trade at 10.5")
+	require.Nil(t, w.Expire(600))
+	require.Equal(t, 2, w.Bids.Len())
+
+	// the latest snapshot and the logs after it
+	w2, err := ome.New("BTC_USDT")
+	require.Nil(t, err)
+	require.Nil(t, w2.LoadSnapshot())
+	require.Equal(t, snapLogID, w2.LogID)
+	require.Nil(t, w2.ReplayLogs())
+	require.Equal(t, fmt.Sprint(w.Snapshot()), fmt.Sprint(w2.Snapshot()))
+
+	// all the logs without a snapshot
+	w3, err := ome.New("BTC_USDT")
+	require.Nil(t, err)
+	require.Nil(t, w3.ReplayLogs())
+	require.Equal(t, fmt.Sprint(w.Snapshot()), fmt.Sprint(w3.Snapshot()))
+
+	// only the latest one is kept
+	require.Nil(t, w.WriteSnapshot(w.Snapshot()))
+	ids, err := w.SnapshotLogIDs()
+	require.Nil(t, err)
+	require.Equal(t, []int64{w.LogID}, ids)
+}
@@ -0,0 +1,495 @@
+package ome
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ccoms/pkg/config"
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/model"
+	"ccoms/pkg/replica"
+
+	"github.com/google/btree"
+)
+
+// Snapshot the state of the matching engine right after the log LogID, encoded with gob
+//
+//	a restart loads the latest one and replays the filedb logs after it, see LoadSnapshot and ReplayLogs
+type Snapshot struct {
+	LogID             int64
+	OrderID           int64
+	LatestAskTicketID int64
+	LatestBidTicketID int64
+
+	LastPrice *big.Int
+	Now       int64
+
+	Asks     []Order // the best first
+	Bids     []Order // the best first
+	Stops    []StopOrder
+	Expiries []ExpiryItem
+}
+
+// Snapshot copies the state of the matching engine, the orders share their numbers as they are never changed in place
+func (w *Worker) Snapshot() Snapshot {
+	s := Snapshot{
+		LogID:             w.LogID,
+		OrderID:           w.OrderID,
+		LatestAskTicketID: w.LatestAskTicketID,
+		LatestBidTicketID: w.LatestBidTicketID,
+
+		LastPrice: w.LastPrice,
+		Now:       w.Now,
+	}
+
+	w.Asks.Ascend(func(item btree.Item) bool {
+		s.Asks = append(s.Asks, Order(item.(AskOrder)))
+		return true
+	})
+	w.Bids.Descend(func(item btree.Item) bool {
+		s.Bids = append(s.Bids, Order(item.(BidOrder)))
+		return true
+	})
+	w.StopsAbove.Ascend(func(item btree.Item) bool {
+		s.Stops = append(s.Stops, StopOrder(item.(StopAboveOrder)))
+		return true
+	})
+	w.StopsBelow.Ascend(func(item btree.Item) bool {
+		s.Stops = append(s.Stops, StopOrder(item.(StopBelowOrder)))
+		return true
+	})
+	// items of completed orders are not worth keeping
+	w.Expiries.Ascend(func(item btree.Item) bool {
+		e := item.(ExpiryItem)
+		if _, ok := w.stops[e.ID]; ok || w.FindOrder(e.Side, e.ID) != nil {
+			s.Expiries = append(s.Expiries, e)
+		}
+		return true
+	})
+
+	return s
+}
+
+// MaybeSnapshot write a snapshot in the background once config.Snapshot.Interval logs are written since the last one,
+// it is skipped while the previous one is still being written
+func (w *Worker) MaybeSnapshot() {
+	cfg := config.Shared.Snapshot
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 10000
+	}
+	if !cfg.Enabled || w.LogID-w.SnapshotLogID < interval {
+		return
+	}
+	if !w.snapshotting.CompareAndSwap(false, true) {
+		return
+	}
+
+	s := w.Snapshot()
+	w.SnapshotLogID = s.LogID
+	go func() {
+		defer w.snapshotting.Store(false)
+		err := w.WriteSnapshot(s)
+		if err != nil {
+			logger.Errorf("WriteSnapshot failed with logID:%d, err:%s", s.LogID, err)
+			return
+		}
+		w.RetainLogs(s.LogID)
+	}()
+}
+
+// RetainLogs remove or archive the filedb segments saved to mysql, covered by the snapshot of snapshotLogID
+// saved by the banks of both coins and replicated by the standby, as config.Filedb.Retention says
+func (w *Worker) RetainLogs(snapshotLogID int64) (err error) {
+	archiveDir := ""
+	switch config.Shared.Filedb.Retention {
+	case config.RetentionDelete:
+	case config.RetentionArchive:
+		archiveDir = path.Join(config.Shared.DataDir, "archive")
+	default:
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			logger.Errorf("RetainLogs failed with snapshotLogID:%d, err:%s", snapshotLogID, err)
+		}
+	}()
+
+	savedLogID, err := w.LoadSavedLogID()
+	if err != nil {
+		return
+	}
+	logID := min(savedLogID, snapshotLogID)
+	for _, coin := range []string{w.BaseAsset, w.QuoteAsset} {
+		var reasonID int64
+		reasonID, err = w.LoadBankReasonID(coin)
+		if err != nil {
+			return
+		}
+		logID = min(logID, reasonID)
+	}
+	// the standby replicates from the segments too
+	standbyLogID, ok, err := replica.StandbyLogID(w.Name)
+	if err != nil {
+		return
+	}
+	if ok {
+		logID = min(logID, standbyLogID)
+	}
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+	segments, err := f.Retain(logID, archiveDir)
+	if err != nil {
+		return
+	}
+	for _, seg := range segments {
+		logger.Infof("RetainLogs %s the segment %s with logs:%d-%d", config.Shared.Filedb.Retention, seg.File, seg.FirstLogID, seg.LastLogID)
+	}
+
+	return
+}
+
+// SnapshotPath returns the file of the snapshot taken after the log logID
+func (w *Worker) SnapshotPath(logID int64) string {
+	return path.Join(config.Shared.DataDir, "snapshot", fmt.Sprintf("%s-%d.snap", strings.ToLower(w.Name), logID))
+}
+
+// SnapshotLogIDs returns the logIDs of the snapshots on disk, the latest first
+func (w *Worker) SnapshotLogIDs() (ids []int64, err error) {
+	entries, err := os.ReadDir(path.Join(config.Shared.DataDir, "snapshot"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	prefix := strings.ToLower(w.Name) + "-"
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".snap") {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".snap"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	return
+}
+
+// WriteSnapshot write the snapshot to a temporary file and move it into place, then remove the old ones beyond config.Snapshot.Keep
+func (w *Worker) WriteSnapshot(s Snapshot) (err error) {
+	p := w.SnapshotPath(s.LogID)
+	err = os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(path.Dir(p), path.Base(p)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	err = gob.NewEncoder(bw).Encode(s)
+	if err != nil {
+		return
+	}
+	err = bw.Flush()
+	if err != nil {
+		return
+	}
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		return
+	}
+	logger.Infof("WriteSnapshot done with logID:%d, asks:%d, bids:%d, stops:%d", s.LogID, len(s.Asks), len(s.Bids), len(s.Stops))
+
+	keep := config.Shared.Snapshot.Keep
+	if keep <= 0 {
+		keep = 3
+	}
+	ids, err := w.SnapshotLogIDs()
+	if err != nil {
+		return
+	}
+	for i := keep; i < len(ids); i++ {
+		err = os.Remove(w.SnapshotPath(ids[i]))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// LoadSnapshot restore the state from the latest snapshot, nothing is changed if there is none
+func (w *Worker) LoadSnapshot() (err error) {
+	defer func() {
+		if err != nil {
+			logger.Errorf("LoadSnapshot failed with err:%s", err)
+		} else {
+			logger.Infof("LoadSnapshot done with logID:%d, asks:%d, bids:%d, stops:%d",
+				w.LogID, w.Asks.Len(), w.Bids.Len(), len(w.stops))
+		}
+	}()
+
+	ids, err := w.SnapshotLogIDs()
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	f, err := os.Open(w.SnapshotPath(ids[0]))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var s Snapshot
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&s)
+	if err != nil {
+		return
+	}
+
+	w.LogID = s.LogID
+	w.SnapshotLogID = s.LogID
+	w.OrderID = s.OrderID
+	w.LatestAskTicketID = s.LatestAskTicketID
+	w.LatestBidTicketID = s.LatestBidTicketID
+	w.LastPrice = s.LastPrice
+	w.Now = s.Now
+
+	for _, o := range s.Asks {
+		w.Asks.ReplaceOrInsert(AskOrder(o))
+		w.keys[o.ID] = orderKey{Price: o.Price, Seq: o.Seq}
+	}
+	for _, o := range s.Bids {
+		w.Bids.ReplaceOrInsert(BidOrder(o))
+		w.keys[o.ID] = orderKey{Price: o.Price, Seq: o.Seq}
+	}
+	for _, so := range s.Stops {
+		w.NewStop(so)
+	}
+	for _, e := range s.Expiries {
+		w.Expiries.ReplaceOrInsert(e)
+	}
+
+	return
+}
+
+// ReplayLogs apply the filedb logs after w.LogID to the state, the logs must follow each other without a gap
+func (w *Worker) ReplayLogs() (err error) {
+	from := w.LogID
+	defer func() {
+		if err != nil {
+			logger.Errorf("ReplayLogs failed with logID:%d, err:%s", w.LogID, err)
+		} else {
+			logger.Infof("ReplayLogs done with logs:%d, logID:%d", w.LogID-from, w.LogID)
+		}
+	}()
+
+	f, err := w.Filedb()
+	if err != nil {
+		return
+	}
+
+	return filedb.Iterate(f, filedb.IterOptions{From: w.LogID + 1}, func(r filedb.Record[OmeLog]) (err error) {
+		if r.LogID != w.LogID+1 {
+			return fmt.Errorf("log id is not continuous, expected:%d, got:%d", w.LogID+1, r.LogID)
+		}
+
+		w.ApplyLog(r.Log)
+		return
+	})
+}
+
+// ApplyLog change the state as the matching engine did when it wrote the log
+func (w *Worker) ApplyLog(ol *OmeLog) {
+	w.LogID = ol.LogID
+
+	for _, l := range ol.OrderLogs {
+		no := NewOrder{
+			ID:       l.ID,
+			TicketID: l.TicketID,
+			Owner:    l.Owner,
+			FeeRate:  l.FeeRate,
+			Time:     l.Time,
+			Side:     l.Side,
+			Type:     l.Type,
+			Price:    l.Price,
+			Quantity: l.Quantity,
+			Amount:   OrZero(l.Amount),
+			Frozen:   l.Frozen,
+
+			TimeInForce:   l.TimeInForce,
+			ClientOrderID: l.ClientOrderID,
+
+			SelfTradePrevention: l.SelfTradePrevention,
+
+			StopPrice:  l.StopPrice,
+			Seq:        ol.LogID,
+			DisplayQty: l.DisplayQty,
+			ExpireAt:   l.ExpireAt,
+		}
+		if l.Type == model.OrderTypeStopLimit || l.Type == model.OrderTypeStopMarket {
+			w.NewStop(StopOrder{NewOrder: no, StopAbove: l.StopAbove})
+		} else {
+			w.putOrder(l.Side, listOrder(no))
+		}
+		w.ScheduleExpiry(l.Side, l.ID, l.ExpireAt)
+		w.OrderID = max(w.OrderID, l.ID)
+		w.applyTicketID(l.Side, l.TicketID)
+	}
+
+	for _, l := range ol.MatchLogs {
+		if o := w.FindOrder(model.OrderSideAsk, l.AskID); o != nil {
+			n := *o
+			n.Quantity, n.Frozen, n.Visible = l.AskQuantity, l.AskFrozen, l.AskVisible
+			if IsZero(n.Quantity) {
+				w.takeOrder(model.OrderSideAsk, *o)
+			} else {
+				w.putOrder(model.OrderSideAsk, n)
+			}
+		}
+		if o := w.FindOrder(model.OrderSideBid, l.BidID); o != nil {
+			n := *o
+			n.Quantity, n.Frozen, n.Visible = l.BidQuantity, l.BidFrozen, l.BidVisible
+			done := IsZero(n.Quantity)
+			if o.Amount != nil {
+				n.Amount = l.BidAmount
+				done = IsZero(n.Amount)
+			}
+			if done {
+				w.takeOrder(model.OrderSideBid, *o)
+			} else {
+				w.putOrder(model.OrderSideBid, n)
+			}
+		}
+		w.LastPrice = l.Price
+	}
+
+	for _, l := range ol.CancelLogs {
+		w.applyTicketID(l.Side, l.TicketID)
+		if l.Reason == CancelReasonInvalid {
+			continue
+		}
+
+		o := w.FindOrder(l.Side, l.ID)
+		if o == nil {
+			if so, ok := w.stops[l.ID]; ok {
+				w.RemoveStop(so)
+			}
+			// otherwise rejected before it was put into the list
+			continue
+		}
+		if !l.Partial() {
+			w.takeOrder(l.Side, *o)
+			continue
+		}
+		n := *o
+		n.Quantity, n.Frozen = l.Remaining, l.Frozen
+		if o.Visible != nil {
+			n.Visible = Min(o.Visible, n.Quantity)
+		}
+		w.putOrder(l.Side, n)
+	}
+
+	for _, l := range ol.TriggerLogs {
+		so, ok := w.stops[l.ID]
+		if !ok {
+			continue
+		}
+		w.RemoveStop(so)
+		no := so.NewOrder
+		no.Type = l.Type
+		no.Seq = ol.LogID
+		w.putOrder(no.Side, listOrder(no))
+	}
+
+	for _, l := range ol.ReplenishLogs {
+		if o := w.FindOrder(l.Side, l.ID); o != nil {
+			n := *o
+			n.Seq, n.Visible = ol.LogID, l.Visible
+			w.putOrder(l.Side, n)
+		}
+	}
+
+	for _, l := range ol.AmendLogs {
+		w.applyTicketID(l.Side, l.TicketID)
+		if !l.Applied() {
+			continue
+		}
+		if o := w.FindOrder(l.Side, l.ID); o != nil {
+			n := *o
+			n.Price, n.Quantity, n.Frozen, n.Visible = l.Price, l.Quantity, l.Frozen, l.Visible
+			if !l.KeepPriority {
+				n.Seq, n.Entry = ol.LogID, ol.LogID
+			}
+			w.putOrder(l.Side, n)
+		}
+	}
+
+	for _, l := range ol.TimerLogs {
+		w.Now = l.Now
+	}
+}
+
+// applyTicketID keep the latest ticket id of the side, the logs of an order carry its own ticket id as well
+func (w *Worker) applyTicketID(side int8, id int64) {
+	if side == model.OrderSideAsk {
+		w.LatestAskTicketID = max(w.LatestAskTicketID, id)
+	} else {
+		w.LatestBidTicketID = max(w.LatestBidTicketID, id)
+	}
+}
+
+// putOrder put the order into the list, replacing the previous version of it which may be sorted differently
+func (w *Worker) putOrder(side int8, o Order) {
+	if old := w.FindOrder(side, o.ID); old != nil {
+		w.takeOrder(side, *old)
+	}
+	if side == model.OrderSideAsk {
+		w.Asks.ReplaceOrInsert(AskOrder(o))
+	} else {
+		w.Bids.ReplaceOrInsert(BidOrder(o))
+	}
+	w.keys[o.ID] = orderKey{Price: o.Price, Seq: o.Seq}
+}
+
+// takeOrder remove the order from the list
+func (w *Worker) takeOrder(side int8, o Order) {
+	if side == model.OrderSideAsk {
+		w.Asks.Delete(AskOrder(o))
+	} else {
+		w.Bids.Delete(BidOrder(o))
+	}
+	delete(w.keys, o.ID)
+}
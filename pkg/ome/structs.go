@@ -16,8 +16,19 @@ type OmeLog struct {
 	LogID int64 `json:"logID"`
 	Ts    int64 `json:"ts"`
 
-	OrderLogs []OrderLog `json:"orders,omitempty"`
-	MatchLogs []MatchLog `json:"matchs,omitempty"`
+	OrderLogs     []OrderLog     `json:"orders,omitempty"`
+	MatchLogs     []MatchLog     `json:"matchs,omitempty"`
+	CancelLogs    []CancelLog    `json:"cancels,omitempty"`
+	RestLogs      []RestLog      `json:"rests,omitempty"`
+	TriggerLogs   []TriggerLog   `json:"triggers,omitempty"`
+	ReplenishLogs []ReplenishLog `json:"replenishes,omitempty"`
+	TimerLogs     []TimerLog     `json:"timers,omitempty"`
+	AmendLogs     []AmendLog     `json:"amends,omitempty"`
+}
+
+// GetLogID makes it a filedb.Log
+func (ol OmeLog) GetLogID() int64 {
+	return ol.LogID
 }
 
 type MatchLog struct {
@@ -28,12 +39,14 @@ type MatchLog struct {
 	AskID       int64    `json:"askID"`
 	AskPrice    *big.Int `json:"askPrice"`
 	AskQuantity *big.Int `json:"askQuantity"` // Remaining quantity
+	AskFrozen   *big.Int `json:"askFrozen"`   // Remaining frozen funds, BTC
 
 	// Latest information of the buy order, USDT
 	Bider       int64    `json:"bider"`
 	BidID       int64    `json:"bidID"`
 	BidPrice    *big.Int `json:"bidPrice"`
 	BidQuantity *big.Int `json:"bidQuantity"` // Remaining quantity
+	BidFrozen   *big.Int `json:"bidFrozen"`   // Remaining frozen funds, USDT
 
 	// Information of this transaction
 	Price    *big.Int `json:"price"`    // BTC/USDT
@@ -42,6 +55,17 @@ type MatchLog struct {
 	AskFee   *big.Int `json:"askFee"`   // Fee, BTC
 	BidFee   *big.Int `json:"bidFee"`   // Fee, USDT
 
+	TakerSide int8     `json:"takerSide"`           // the newer order takes the liquidity and pays the taker rate
+	AskRefund *big.Int `json:"askRefund,omitempty"` // Over-reserved funds returned when the ask completes, BTC
+	BidRefund *big.Int `json:"bidRefund,omitempty"` // Over-reserved funds returned when the bid completes, USDT
+	BidAmount *big.Int `json:"bidAmount,omitempty"` // Remaining budget of a market bid, USDT
+
+	AskClientOrderID string `json:"askClientOrderID,omitempty"`
+	BidClientOrderID string `json:"bidClientOrderID,omitempty"`
+
+	AskVisible *big.Int `json:"askVisible,omitempty"` // Remaining quantity of the current slice of an iceberg ask
+	BidVisible *big.Int `json:"bidVisible,omitempty"` // Remaining quantity of the current slice of an iceberg bid
+
 	Time int64 `json:"time"`
 }
 
@@ -57,8 +81,140 @@ type OrderLog struct {
 	Type     int8     `json:"type"`
 	Price    *big.Int `json:"price"`
 	Quantity *big.Int `json:"quantity"`
+	Amount   *big.Int `json:"amount,omitempty"` // quote budget of a market bid
+	Frozen   *big.Int `json:"frozen"`
+
+	TimeInForce   int8   `json:"timeInForce,omitempty"` // model.OrderTIFXxx
+	ClientOrderID string `json:"clientOrderID,omitempty"`
+
+	SelfTradePrevention int8 `json:"selfTradePrevention,omitempty"` // model.OrderSTPXxx
+
+	StopPrice *big.Int `json:"stopPrice,omitempty"` // stop orders only, see TriggerLog
+	StopAbove bool     `json:"stopAbove,omitempty"` // triggered once the last price rises to StopPrice, otherwise once it falls to it
+
+	DisplayQty *big.Int `json:"displayQty,omitempty"` // iceberg orders only, the size of a slice, see ReplenishLog
+	ExpireAt   int64    `json:"expireAt,omitempty"`   // good-till-time orders only, unix seconds, see TimerLog
+}
+
+// TriggerLog a stop order moved from the trigger book into the list, as a limit or market order
+type TriggerLog struct {
+	LogIndex int64 `json:"logIndex"`
+
+	ID        int64    `json:"id"`
+	TicketID  int64    `json:"ticketID"`
+	Owner     int64    `json:"owner"`
+	Side      int8     `json:"side"`
+	Type      int8     `json:"type"` // model.OrderTypeLimit or model.OrderTypeMarket from now on
+	StopPrice *big.Int `json:"stopPrice"`
+	Price     *big.Int `json:"price"` // the last trade price that triggered it
+	Quantity  *big.Int `json:"quantity"`
+
+	ClientOrderID string `json:"clientOrderID,omitempty"`
+}
+
+// CancelLog an order removed from the book without being filled
+type CancelLog struct {
+	LogIndex int64 `json:"logIndex"`
+
+	ID       int64    `json:"id"`       // order id
+	TicketID int64    `json:"ticketID"` // the cancel ticket
+	Owner    int64    `json:"owner"`
+	Side     int8     `json:"side"`
+	Reason   string   `json:"reason"`   // CancelReasonXxx
+	Quantity *big.Int `json:"quantity"` // Remaining quantity when canceled, or the quantity taken off by a partial cancel
+	Refund   *big.Int `json:"refund"`   // Frozen funds returned to the owner
+
+	ClientOrderID string `json:"clientOrderID,omitempty"`
+
+	// Set by a partial cancel only, the order stays in the book with what is left
+	Remaining *big.Int `json:"remaining,omitempty"` // Remaining quantity
+	Frozen    *big.Int `json:"frozen,omitempty"`    // Remaining frozen funds
+}
+
+// RestLog a new order left in the book after matching, only used to notify the owner
+type RestLog struct {
+	LogIndex int64 `json:"logIndex"`
+
+	ID       int64    `json:"id"`
+	TicketID int64    `json:"ticketID"`
+	Owner    int64    `json:"owner"`
+	Side     int8     `json:"side"`
+	Price    *big.Int `json:"price"`
+	Quantity *big.Int `json:"quantity"` // Remaining quantity
+
+	ClientOrderID string `json:"clientOrderID,omitempty"`
+}
+
+// ReplenishLog a new slice of an iceberg order, it is queued again at the back of its price
+type ReplenishLog struct {
+	LogIndex int64 `json:"logIndex"`
+
+	ID       int64    `json:"id"`
+	TicketID int64    `json:"ticketID"`
+	Owner    int64    `json:"owner"`
+	Side     int8     `json:"side"`
+	Price    *big.Int `json:"price"`
+	Visible  *big.Int `json:"visible"`  // Quantity of the new slice
+	Quantity *big.Int `json:"quantity"` // Remaining quantity, hidden part included
+
+	ClientOrderID string `json:"clientOrderID,omitempty"`
+}
+
+// AmendLog the price or quantity of an order changed in place, the order keeps its ID
+type AmendLog struct {
+	LogIndex int64 `json:"logIndex"`
+
+	ID           int64    `json:"id"`       // order id
+	TicketID     int64    `json:"ticketID"` // the amend ticket
+	Owner        int64    `json:"owner"`
+	Side         int8     `json:"side"`
+	Reason       string   `json:"reason,omitempty"` // CancelReasonInvalid if nothing changed
+	Price        *big.Int `json:"price"`
+	Quantity     *big.Int `json:"quantity"` // Remaining quantity
+	Frozen       *big.Int `json:"frozen"`   // Remaining frozen funds
+	Refund       *big.Int `json:"refund"`   // Frozen funds returned to the owner, of the order before or of the amend ticket
+	KeepPriority bool     `json:"keepPriority,omitempty"`
+	Visible      *big.Int `json:"visible,omitempty"` // Remaining quantity of the current slice of an iceberg order
+
+	ClientOrderID string `json:"clientOrderID,omitempty"` // of the amend request
+}
+
+// Applied whether the order was changed
+func (al AmendLog) Applied() bool {
+	return al.Reason == ""
+}
+
+// TimerLog the clock of the ome moved forward, the orders expired by then are canceled in the logs that follow
+//
+//	written only when an order is due to expire, the ome never reads the clock while matching
+type TimerLog struct {
+	LogIndex int64 `json:"logIndex"`
+
+	Now int64 `json:"now"` // unix seconds
 }
 
+// Partial whether only part of the order was canceled
+func (cl CancelLog) Partial() bool {
+	return cl.Remaining != nil
+}
+
+// Rejected whether the order was turned down as a whole instead of being canceled
+func (cl CancelLog) Rejected() bool {
+	return cl.Reason == CancelReasonFOK || cl.Reason == CancelReasonPostOnly
+}
+
+const (
+	CancelReasonUser     = "cancel"   // canceled by the owner
+	CancelReasonInvalid  = "invalid"  // order not found or not owned by the requester, nothing changed
+	CancelReasonUnfilled = "unfilled" // remainder of a market or IOC order, nothing left to match against
+	CancelReasonFOK      = "fok"      // FOK order rejected as a whole, the book could not fill it completely
+	CancelReasonPostOnly = "postOnly" // post-only order rejected because it would take liquidity
+	CancelReasonSTP      = "stp"      // canceled, fully or partially, by self-trade prevention
+	CancelReasonExpired  = "expired"  // good-till-time order canceled once the clock of the ome passed its expiry
+
+	CancelReasonUnderfunded = "underfunded" // amend turned down, the order and its ticket hold less than the new price and quantity need
+)
+
 type NewOrder struct {
 	ID       int64    `json:"id"`
 	TicketID int64    `json:"ticketID"`
@@ -69,6 +225,75 @@ type NewOrder struct {
 	Type     int8     `json:"type"`
 	Price    *big.Int `json:"price"`
 	Quantity *big.Int `json:"quantity"`
+	Amount   *big.Int `json:"amount"`
+	Frozen   *big.Int `json:"frozen"`
+
+	TimeInForce   int8   `json:"timeInForce"`
+	ClientOrderID string `json:"clientOrderID"`
+
+	SelfTradePrevention int8 `json:"selfTradePrevention"`
+
+	StopPrice  *big.Int `json:"stopPrice"`  // stop orders only
+	Seq        int64    `json:"seq"`        // see Order.Seq
+	DisplayQty *big.Int `json:"displayQty"` // iceberg orders only
+	ExpireAt   int64    `json:"expireAt"`   // good-till-time orders only
+}
+
+// StopOrder a stop order waiting in the trigger book
+type StopOrder struct {
+	NewOrder
+	StopAbove bool // see OrderLog.StopAbove
+}
+
+// ExpiryItem a good-till-time order waiting for its expiry, the earliest first
+//
+//	not removed when the order completes before, such an item is dropped once it is due
+type ExpiryItem struct {
+	ExpireAt int64
+	ID       int64
+	Side     int8
+}
+
+// Less compare the size of two ExpiryItems
+func (a ExpiryItem) Less(item btree.Item) bool {
+	b, _ := item.(ExpiryItem)
+
+	if a.ExpireAt != b.ExpireAt {
+		return a.ExpireAt < b.ExpireAt
+	}
+	return a.ID < b.ID
+}
+
+// StopAboveOrder stop order triggered by a rising price, the lowest stop price first
+type StopAboveOrder StopOrder
+
+// StopBelowOrder stop order triggered by a falling price, the highest stop price first
+type StopBelowOrder StopOrder
+
+// Less compare the size of two StopAboveOrders
+func (a StopAboveOrder) Less(item btree.Item) bool {
+	b, _ := item.(StopAboveOrder)
+
+	f := a.StopPrice.Cmp(b.StopPrice)
+	if f == 0 {
+		return a.ID < b.ID
+	}
+
+	// a.StopPrice < b.StopPrice
+	return f < 0
+}
+
+// Less compare the size of two StopBelowOrders
+func (a StopBelowOrder) Less(item btree.Item) bool {
+	b, _ := item.(StopBelowOrder)
+
+	f := a.StopPrice.Cmp(b.StopPrice)
+	if f == 0 {
+		return a.ID < b.ID
+	}
+
+	// a.StopPrice > b.StopPrice
+	return f > 0
 }
 
 // Order minimal order information
@@ -77,6 +302,59 @@ type Order struct {
 	TicketID int64
 	Owner    int64
 	FeeRate  int64
+	Type     int8
+	Price    *big.Int
+	Quantity *big.Int
+	Amount   *big.Int // remaining quote budget of a market bid, nil for other orders
+	Frozen   *big.Int // funds still frozen in the bank, BTC for asks, USDT for bids
+
+	ClientOrderID       string
+	SelfTradePrevention int8 // model.OrderSTPXxx as requested, see Worker.SelfTradeMode
+
+	// LogID of the log that put the order into the list, orders at the same price are matched in this order,
+	// a triggered stop order queues from the moment it is triggered, not from its ID,
+	// an iceberg order queues again from every replenished slice
+	Seq int64
+	// LogID of the log that put the order into the list, kept when an iceberg order replenishes, see Before
+	Entry int64
+
+	// iceberg orders only, nil for others, see Shown
+	Display *big.Int // size of a slice
+	Visible *big.Int // what is left of the current slice, replenished from Quantity once consumed
+}
+
+// orderKey the fields Asks/Bids are sorted by besides the ID
+type orderKey struct {
+	Price *big.Int
+	Seq   int64
+}
+
+// Before whether a was put into the list before b, the older one is the maker of their trade
+func (a Order) Before(b Order) bool {
+	if a.Entry != b.Entry {
+		return a.Entry < b.Entry
+	}
+	return a.ID < b.ID
+}
+
+// Ahead whether a is matched before b at the same price
+func (a Order) Ahead(b Order) bool {
+	if a.Seq != b.Seq {
+		return a.Seq < b.Seq
+	}
+	return a.ID < b.ID
+}
+
+// Shown the quantity that takes part in matching and depth, the current slice of an iceberg order
+func (a Order) Shown() *big.Int {
+	if a.Visible != nil {
+		return a.Visible
+	}
+	return a.Quantity
+}
+
+// PriceLevel the quantity shown at a price of the book
+type PriceLevel struct {
 	Price    *big.Int
 	Quantity *big.Int
 }
@@ -97,7 +375,7 @@ func (a Order) Less(item btree.Item) bool {
 
 	f := a.Price.Cmp(b.Price)
 	if f == 0 {
-		return a.ID < b.ID
+		return Order(a).Ahead(Order(b))
 	}
 
 	// a.Price > b.Price
@@ -112,9 +390,10 @@ func (a AskOrder) Less(item btree.Item) bool {
 		return false
 	}
 
+	// the older one is matched first as Asks.Min()
 	f := a.Price.Cmp(b.Price)
 	if f == 0 {
-		return a.ID < b.ID
+		return Order(a).Ahead(Order(b))
 	}
 
 	// a.Price < b.Price
@@ -129,9 +408,10 @@ func (a BidOrder) Less(item btree.Item) bool {
 		return false
 	}
 
+	// the older one is matched first as Bids.Max()
 	f := a.Price.Cmp(b.Price)
 	if f == 0 {
-		return a.ID < b.ID
+		return Order(b).Ahead(Order(a))
 	}
 
 	// a.Price < b.Price
@@ -161,6 +441,51 @@ func Greater(a, b *big.Int) bool {
 	return a.Cmp(b) > 0
 }
 
+// Min returns a copy of the smaller one of a and b
+func Min(a, b *big.Int) *big.Int {
+	if Less(b, a) {
+		return big.NewInt(0).Set(b)
+	}
+	return big.NewInt(0).Set(a)
+}
+
 func IsZero(i *big.Int) bool {
 	return len(i.Bits()) == 0
 }
+
+// CalcFee returns value*rate, capped at what is left in frozen after paying value
+//
+//	orders loaded from before frozen funds were tracked have no frozen value and are not capped
+func CalcFee(value, rate, frozen *big.Int) *big.Int {
+	fee := big.NewInt(0).Mul(value, rate)
+	fee.Div(fee, ExpInt)
+	if frozen != nil {
+		rest := SubFloor(frozen, value)
+		if Greater(fee, rest) {
+			fee = rest
+		}
+	}
+	return fee
+}
+
+// OrZero returns i, or 0 if it is nil, for fields missing in older logs
+func OrZero(i *big.Int) *big.Int {
+	if i == nil {
+		return big.NewInt(0)
+	}
+	return i
+}
+
+// SubFloor returns a-b, or 0 if the result is negative
+//
+//	orders loaded from before frozen funds were tracked have no frozen value
+func SubFloor(a, b *big.Int) *big.Int {
+	if a == nil {
+		return big.NewInt(0)
+	}
+	c := big.NewInt(0).Sub(a, b)
+	if c.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return c
+}
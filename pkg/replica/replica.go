@@ -0,0 +1,233 @@
+// Package replica streams the filedb records of a primary bank or ome to its standbys,
+// which append them to their own filedb and apply them to their state, see xgrpc.ReplicaService
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xgrpc"
+	"ccoms/pkg/xlog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var logger = xlog.GetLogger()
+
+// HeartbeatInterval between two heartbeats of a stream, they carry the latest log of the primary, see Lag
+const HeartbeatInterval = time.Second
+
+// ReportInterval between two reports of the lag of a standby, see Lag.Report
+const ReportInterval = 10 * time.Second
+
+// StandbyTimeout a standby that has not reported for this long no longer holds the logs of its primary, see StandbyLogID
+const StandbyTimeout = time.Hour
+
+// ErrRetained returned by Follow if the primary no longer has the logs after logID, removed or archived by its retention,
+// the standby has to start again from a snapshot of the primary taken after logID
+var ErrRetained = errors.New("logs retained by the primary")
+
+// Server the ReplicaService of a primary, T is its log, e.g. bank.BankLog
+type Server[T any, PT interface {
+	*T
+	filedb.Log
+}] struct {
+	xgrpc.UnimplementedReplicaServiceServer
+
+	Fdb *filedb.Filedb
+}
+
+func NewServer[T any, PT interface {
+	*T
+	filedb.Log
+}](fdb *filedb.Filedb) *Server[T, PT] {
+	return &Server[T, PT]{Fdb: fdb}
+}
+
+// Records streams the records after from as they are written, until the standby goes away
+func (s *Server[T, PT]) Records(from *xgrpc.ID, stream xgrpc.ReplicaService_RecordsServer) (err error) {
+	ctx := stream.Context()
+	logger.Infof("Records started from logID:%d", from.Id)
+	defer func() {
+		logger.Infof("Records done with err:%v", err)
+	}()
+
+	// the heartbeats and the records share the stream
+	var mu sync.Mutex
+	var head int64
+	send := func(r *xgrpc.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		head = max(head, r.LogID, s.Fdb.LastLogID())
+		r.HeadLogID = head
+		r.Ts = time.Now().UnixNano()
+		return stream.Send(r)
+	}
+
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if send(&xgrpc.Record{}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// a standby behind the first segment would get the logs after a gap
+	if first := s.Fdb.Segments()[0].FirstLogID; first > from.Id+1 {
+		return status.Errorf(codes.OutOfRange, "the logs %d-%d are retained", from.Id+1, first-1)
+	}
+
+	err = filedb.Iterate[T, PT](s.Fdb, filedb.IterOptions{From: from.Id + 1, Follow: true, Done: ctx.Done()}, func(r filedb.Record[T]) error {
+		return send(&xgrpc.Record{LogID: r.LogID, Data: []byte(r.Data)})
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// Follow streams the records after logID from the primary at addr to fn in order, until ctx is done or fn fails,
+// the heartbeats only update lag
+func Follow(ctx context.Context, addr string, logID int64, lag *Lag, fn func(r *xgrpc.Record) error) (err error) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	stream, err := xgrpc.NewReplicaServiceClient(conn).Records(ctx, &xgrpc.ID{Id: logID})
+	if err != nil {
+		return
+	}
+	for {
+		var r *xgrpc.Record
+		r, err = stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if status.Code(err) == codes.OutOfRange {
+				return fmt.Errorf("%w, %s", ErrRetained, status.Convert(err).Message())
+			}
+			return
+		}
+
+		if len(r.Data) > 0 {
+			err = fn(r)
+			if err != nil {
+				return
+			}
+			logID = r.LogID
+		}
+		lag.Update(r.HeadLogID, logID)
+	}
+}
+
+// Lag how far a standby is behind its primary
+type Lag struct {
+	mu        sync.Mutex
+	logID     int64     // the latest log replicated
+	headLogID int64     // the latest log of the primary
+	at        time.Time // of the latest record or heartbeat
+}
+
+// Update records a record or a heartbeat from the primary
+func (l *Lag) Update(headLogID, logID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.logID = logID
+	l.headLogID = max(l.headLogID, headLogID)
+	l.at = time.Now()
+}
+
+// Get returns the logs the standby has not replicated yet, and the time since it heard from the primary,
+// the logs written since then are not known
+func (l *Lag) Get() (logs int64, silence time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.at.IsZero() {
+		return 0, 0
+	}
+	return max(0, l.headLogID-l.logID), time.Since(l.at)
+}
+
+// MarshalJSON the lag as it is reported
+func (l *Lag) MarshalJSON() ([]byte, error) {
+	logs, silence := l.Get()
+	l.mu.Lock()
+	logID, headLogID := l.logID, l.headLogID
+	l.mu.Unlock()
+
+	return json.Marshal(report{logID, headLogID, logs, silence.Milliseconds(), time.Now().UnixMilli()})
+}
+
+// report the lag in etcd, see Lag.Report
+type report struct {
+	LogID     int64 `json:"logID"`
+	HeadLogID int64 `json:"headLogID"`
+	Logs      int64 `json:"logs"`
+	SilenceMs int64 `json:"silenceMs"`
+	At        int64 `json:"at"` // unix milliseconds
+}
+
+// StandbyLogID returns the latest log the standby of the bank or ome name has replicated, as it reported in etcd,
+// ok is false if it has not reported within StandbyTimeout, e.g. there is no standby
+//
+//	the primary keeps the logs after it, see filedb.Filedb.Retain
+func StandbyLogID(name string) (logID int64, ok bool, err error) {
+	v, err := xetcd.Get(xetcd.KeyReplicaLag(name))
+	if errors.Is(err, xetcd.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return
+	}
+	var r report
+	err = json.Unmarshal([]byte(v), &r)
+	if err != nil {
+		return
+	}
+	if time.Since(time.UnixMilli(r.At)) > StandbyTimeout {
+		return 0, false, nil
+	}
+	return r.LogID, true, nil
+}
+
+// Report logs the lag and puts it in etcd under xetcd.KeyReplicaLag(name) every ReportInterval, until ctx is done
+func (l *Lag) Report(ctx context.Context, name string) {
+	ticker := time.NewTicker(ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b, _ := json.Marshal(l)
+		logger.Infof("replica lag of %s: %s", name, b)
+		err := xetcd.Put(xetcd.KeyReplicaLag(name), string(b))
+		if err != nil {
+			logger.Errorf("Report failed with err:%s", err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package replica_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"ccoms/pkg/filedb"
+	"ccoms/pkg/replica"
+	"ccoms/pkg/xgrpc"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type testLog struct {
+	LogID int64
+	Value string
+}
+
+func (l testLog) GetLogID() int64 { return l.LogID }
+
+func TestFollow(t *testing.T) {
+	fdb, err := filedb.New(path.Join(t.TempDir(), "test.log"))
+	require.Nil(t, err)
+	fdb.Codec = filedb.CodecBinary
+	appendLogs := func(from, to int64) {
+		for i := from; i <= to; i++ {
+			b, err := fdb.Marshal(testLog{LogID: i, Value: "v"})
+			require.Nil(t, err)
+			require.Nil(t, fdb.Append(i, string(b)+"\n"))
+		}
+	}
+	appendLogs(1, 5)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	srv := grpc.NewServer()
+	xgrpc.RegisterReplicaServiceServer(srv, replica.NewServer[testLog](fdb))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lag := &replica.Lag{}
+	got := make(chan int64, 16)
+	done := make(chan error)
+	go func() {
+		done <- replica.Follow(ctx, lis.Addr().String(), 2, lag, func(r *xgrpc.Record) error {
+			l := testLog{}
+			err := filedb.Unmarshal(r.Data, &l)
+			if err != nil {
+				return err
+			}
+			got <- l.LogID
+			return nil
+		})
+	}()
+
+	next := func() int64 {
+		select {
+		case id := <-got:
+			return id
+		case <-time.After(3 * time.Second):
+			t.Fatal("no record from the primary")
+			return 0
+		}
+	}
+	// after the logID the standby has, then the ones appended later
+	for i := int64(3); i <= 5; i++ {
+		require.Equal(t, i, next())
+	}
+	appendLogs(6, 8)
+	for i := int64(6); i <= 8; i++ {
+		require.Equal(t, i, next())
+	}
+
+	logs, silence := lag.Get()
+	require.Equal(t, int64(0), logs)
+	require.Less(t, silence, 2*replica.HeartbeatInterval)
+	b, err := json.Marshal(lag)
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"logID":8`)
+
+	// a standby that goes away ends the stream without an error
+	cancel()
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Follow did not stop")
+	}
+	require.Nil(t, fdb.Close())
+}
+
+func TestLag(t *testing.T) {
+	lag := &replica.Lag{}
+	logs, silence := lag.Get()
+	require.Equal(t, int64(0), logs)
+	require.Equal(t, time.Duration(0), silence)
+
+	lag.Update(10, 4)
+	logs, _ = lag.Get()
+	require.Equal(t, int64(6), logs)
+
+	// a heartbeat never takes the head back
+	lag.Update(7, 5)
+	logs, _ = lag.Get()
+	require.Equal(t, int64(5), logs)
+}
+
+func TestRetained(t *testing.T) {
+	fdb, err := filedb.New(path.Join(t.TempDir(), "test.log"))
+	require.Nil(t, err)
+	fdb.SegmentLogs = 2
+	for i := int64(1); i <= 6; i++ {
+		b, err := fdb.Marshal(testLog{LogID: i, Value: "v"})
+		require.Nil(t, err)
+		require.Nil(t, fdb.Append(i, string(b)+"\n"))
+	}
+	removed, err := fdb.Retain(4, "")
+	require.Nil(t, err)
+	require.Len(t, removed, 2)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	srv := grpc.NewServer()
+	xgrpc.RegisterReplicaServiceServer(srv, replica.NewServer[testLog](fdb))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	// the logs 4 and before are gone, a standby at 3 cannot go on
+	err = replica.Follow(context.Background(), lis.Addr().String(), 3, &replica.Lag{}, func(r *xgrpc.Record) error {
+		return errors.New("no record expected")
+	})
+	require.ErrorIs(t, err, replica.ErrRetained)
+
+	// a standby at 4 gets the rest
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []int64
+	err = replica.Follow(ctx, lis.Addr().String(), 4, &replica.Lag{}, func(r *xgrpc.Record) error {
+		got = append(got, r.LogID)
+		if r.LogID == 6 {
+			cancel()
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []int64{5, 6}, got)
+	require.Nil(t, fdb.Close())
+}
@@ -0,0 +1,187 @@
+// Package rules keeps the trading rules of each symbol in etcd and checks order requests against them.
+package rules
+
+import (
+	"ccoms/pkg/model"
+	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xnats"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Rules trading rules of a symbol, zero values are not checked
+type Rules struct {
+	Symbol       string          `json:"symbol"`
+	TickSize     decimal.Decimal `json:"tickSize"`     // price must be a multiple of it, and within model.OrderPriceMin/Max
+	StepSize     decimal.Decimal `json:"stepSize"`     // quantity must be a multiple of it
+	MinQty       decimal.Decimal `json:"minQty"`       // inclusive
+	MaxQty       decimal.Decimal `json:"maxQty"`       // inclusive
+	MinNotional  decimal.Decimal `json:"minNotional"`  // price * quantity, or the amount of a market bid
+	MaxDeviation float64         `json:"maxDeviation"` // e.g. 0.1, the price must be within ±10% of the last trade price
+}
+
+// Error an order request breaking the rules, Reason is a model.OrderRejectReasonXxx
+type Error struct {
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return "order rejected: " + e.Reason
+}
+
+// Check returns the reason to reject the order request, or "" if it is fine
+//
+//	lastPrice is the last trade price of the symbol, zero if there is none yet
+func (r Rules) Check(o xnats.OrderReq, lastPrice decimal.Decimal) string {
+	market := o.Type == model.OrderTypeMarket || o.Type == model.OrderTypeStopMarket
+	marketBid := market && o.Side == model.OrderSideBid
+
+	if o.Type == model.OrderTypeStopLimit || o.Type == model.OrderTypeStopMarket {
+		if !o.StopPrice.GreaterThan(model.OrderPriceMin) || !o.StopPrice.LessThan(model.OrderPriceMax) || !multipleOf(o.StopPrice, r.TickSize) {
+			return model.OrderRejectReasonInvalidStopPrice
+		}
+	}
+
+	if !market {
+		// market orders are put at the extremes of the book
+		if !o.Price.GreaterThan(model.OrderPriceMin) || !o.Price.LessThan(model.OrderPriceMax) || !multipleOf(o.Price, r.TickSize) {
+			return model.OrderRejectReasonInvalidPrice
+		}
+		// a stop-limit order is priced around its stop price, which may be far from the last price
+		if o.Type == model.OrderTypeLimit && r.MaxDeviation > 0 && lastPrice.IsPositive() {
+			band := lastPrice.Mul(decimal.NewFromFloat(r.MaxDeviation))
+			if o.Price.LessThan(lastPrice.Sub(band)) || o.Price.GreaterThan(lastPrice.Add(band)) {
+				return model.OrderRejectReasonPriceOutOfBand
+			}
+		}
+	}
+
+	// a market bid is sized by its amount
+	if marketBid {
+		if !o.Amount.IsPositive() || o.Amount.LessThan(r.MinNotional) {
+			return model.OrderRejectReasonMinNotional
+		}
+		return ""
+	}
+
+	if !o.Quantity.IsPositive() || !multipleOf(o.Quantity, r.StepSize) {
+		return model.OrderRejectReasonInvalidQuantity
+	}
+	if o.Quantity.LessThan(r.MinQty) || (r.MaxQty.IsPositive() && o.Quantity.GreaterThan(r.MaxQty)) {
+		return model.OrderRejectReasonQuantityOutOfRange
+	}
+
+	// iceberg, each slice must be a valid quantity on its own
+	if !o.DisplayQty.IsZero() {
+		limit := o.Type == model.OrderTypeLimit || o.Type == model.OrderTypeStopLimit
+		if !limit || !o.DisplayQty.IsPositive() || !multipleOf(o.DisplayQty, r.StepSize) || o.DisplayQty.LessThan(r.MinQty) {
+			return model.OrderRejectReasonInvalidDisplayQty
+		}
+	}
+
+	price := o.Price
+	if market {
+		price = lastPrice
+	}
+	if price.IsPositive() && price.Mul(o.Quantity).LessThan(r.MinNotional) {
+		return model.OrderRejectReasonMinNotional
+	}
+
+	return ""
+}
+
+func multipleOf(v, step decimal.Decimal) bool {
+	if !step.IsPositive() {
+		return true
+	}
+	return v.Mod(step).IsZero()
+}
+
+// Registry caches the rules and last trade prices read from etcd, see xetcd.Cache
+type Registry struct {
+	cache *xetcd.Cache
+	peek  bool // see Cached
+}
+
+// Shared the registry backed by xetcd
+var Shared = NewRegistry(5*time.Second, xetcd.Get)
+
+// NewRegistry returns a registry reading the values with get, which returns xetcd.ErrNotFound for missing keys
+func NewRegistry(ttl time.Duration, get func(k string) (string, error)) *Registry {
+	return &Registry{
+		cache: xetcd.NewCache("rules", ttl, get),
+	}
+}
+
+// Cached returns the registry reading only what is cached, it never waits for etcd, see xetcd.Cache.Peek,
+// its reads fail with xetcd.ErrNotCached until the values are read the first time, see Load
+func (r *Registry) Cached() *Registry {
+	return &Registry{cache: r.cache, peek: true}
+}
+
+func (r *Registry) value(k string) (v string, found bool, err error) {
+	if r.peek {
+		return r.cache.Peek(k)
+	}
+	return r.cache.Get(k)
+}
+
+// Load reads the rules and the last trade price of the symbol into the cache
+func (r *Registry) Load(symbol string) (err error) {
+	_, _, err = r.cache.Get(xetcd.KeySymbolRules(symbol))
+	if err != nil {
+		return
+	}
+	_, _, err = r.cache.Get(xetcd.KeyLastPrice(symbol))
+	return
+}
+
+// Rules returns the rules of the symbol, found is false if the symbol has none
+func (r *Registry) Rules(symbol string) (rules Rules, found bool, err error) {
+	v, found, err := r.value(xetcd.KeySymbolRules(symbol))
+	if err != nil || !found {
+		return
+	}
+	err = json.Unmarshal([]byte(v), &rules)
+	return
+}
+
+// LastPrice returns the last trade price of the symbol, zero if there is none yet
+func (r *Registry) LastPrice(symbol string) (price decimal.Decimal, err error) {
+	v, found, err := r.value(xetcd.KeyLastPrice(symbol))
+	if err != nil || !found {
+		return
+	}
+	return decimal.NewFromString(v)
+}
+
+// Check returns the reason to reject the order request by the rules of its symbol, or "" if it is fine or there are no rules
+func (r *Registry) Check(o xnats.OrderReq) (reason string, err error) {
+	rules, found, err := r.Rules(o.Symbol)
+	if err != nil || !found {
+		return
+	}
+	lastPrice, err := r.LastPrice(o.Symbol)
+	if err != nil {
+		return
+	}
+	return rules.Check(o, lastPrice), nil
+}
+
+// PutRules saves the rules of the symbol to etcd
+func PutRules(rules Rules) (err error) {
+	rules.Symbol = strings.ToUpper(rules.Symbol)
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return
+	}
+	return xetcd.Put(xetcd.KeySymbolRules(rules.Symbol), string(b))
+}
+
+// PutLastPrice saves the last trade price of the symbol to etcd, done by ome
+func PutLastPrice(symbol string, price decimal.Decimal) (err error) {
+	return xetcd.Put(xetcd.KeyLastPrice(symbol), price.String())
+}
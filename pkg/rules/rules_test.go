@@ -0,0 +1,112 @@
+package rules_test
+
+import (
+	"ccoms/pkg/model"
+	"ccoms/pkg/rules"
+	"ccoms/pkg/xetcd"
+	"ccoms/pkg/xnats"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func TestCheck(t *testing.T) {
+	r := rules.Rules{
+		Symbol:       "BTC_USDT",
+		TickSize:     d("0.01"),
+		StepSize:     d("0.001"),
+		MinQty:       d("0.001"),
+		MaxQty:       d("100"),
+		MinNotional:  d("10"),
+		MaxDeviation: 0.1,
+	}
+	last := d("100")
+	limit := func(price, qty string) xnats.OrderReq {
+		return xnats.OrderReq{Symbol: "BTC_USDT", Side: model.OrderSideAsk, Type: model.OrderTypeLimit, Price: d(price), Quantity: d(qty)}
+	}
+
+	require.Equal(t, "", r.Check(limit("100.01", "0.1"), last))
+	require.Equal(t, model.OrderRejectReasonInvalidPrice, r.Check(limit("100.001", "0.1"), last))
+	require.Equal(t, model.OrderRejectReasonInvalidPrice, r.Check(limit("0", "0.1"), last))
+	require.Equal(t, model.OrderRejectReasonInvalidQuantity, r.Check(limit("100", "0.1001"), last))
+	require.Equal(t, model.OrderRejectReasonQuantityOutOfRange, r.Check(limit("100", "101"), last))
+	require.Equal(t, model.OrderRejectReasonMinNotional, r.Check(limit("100", "0.01"), last))
+	require.Equal(t, model.OrderRejectReasonPriceOutOfBand, r.Check(limit("111", "1"), last))
+	require.Equal(t, model.OrderRejectReasonPriceOutOfBand, r.Check(limit("89.99", "1"), last))
+	// no trades yet, no band
+	require.Equal(t, "", r.Check(limit("111", "1"), decimal.Zero))
+
+	marketBid := xnats.OrderReq{Symbol: "BTC_USDT", Side: model.OrderSideBid, Type: model.OrderTypeMarket, Amount: d("5")}
+	require.Equal(t, model.OrderRejectReasonMinNotional, r.Check(marketBid, last))
+	marketBid.Amount = d("10")
+	require.Equal(t, "", r.Check(marketBid, last))
+
+	marketAsk := xnats.OrderReq{Symbol: "BTC_USDT", Side: model.OrderSideAsk, Type: model.OrderTypeMarket, Quantity: d("0.05")}
+	require.Equal(t, model.OrderRejectReasonMinNotional, r.Check(marketAsk, last))
+	require.Equal(t, "", r.Check(marketAsk, decimal.Zero))
+
+	stopLimit := limit("120", "1")
+	stopLimit.Type = model.OrderTypeStopLimit
+	require.Equal(t, model.OrderRejectReasonInvalidStopPrice, r.Check(stopLimit, last))
+	stopLimit.StopPrice = d("119.999")
+	require.Equal(t, model.OrderRejectReasonInvalidStopPrice, r.Check(stopLimit, last))
+	// far from the last price, but the band is not applied to stop orders
+	stopLimit.StopPrice = d("119.5")
+	require.Equal(t, "", r.Check(stopLimit, last))
+
+	stopMarketBid := xnats.OrderReq{Symbol: "BTC_USDT", Side: model.OrderSideBid, Type: model.OrderTypeStopMarket, Amount: d("5"), StopPrice: d("110")}
+	require.Equal(t, model.OrderRejectReasonMinNotional, r.Check(stopMarketBid, last))
+	stopMarketBid.Amount = d("10")
+	require.Equal(t, "", r.Check(stopMarketBid, last))
+
+	iceberg := limit("100", "1")
+	iceberg.DisplayQty = d("0.1")
+	require.Equal(t, "", r.Check(iceberg, last))
+	iceberg.DisplayQty = d("0.0001")
+	require.Equal(t, model.OrderRejectReasonInvalidDisplayQty, r.Check(iceberg, last))
+	marketAsk.DisplayQty = d("0.01")
+	require.Equal(t, model.OrderRejectReasonInvalidDisplayQty, r.Check(marketAsk, decimal.Zero))
+}
+
+func TestRegistry(t *testing.T) {
+	kvs := map[string]string{
+		xetcd.KeySymbolRules("BTC_USDT"): `{"symbol":"BTC_USDT","tickSize":"0.01","maxDeviation":0.1}`,
+		xetcd.KeyLastPrice("BTC_USDT"):   "100",
+	}
+	var fail bool
+	reg := rules.NewRegistry(time.Hour, func(k string) (string, error) {
+		if fail {
+			return "", errors.New("etcd is down")
+		}
+		v, ok := kvs[k]
+		if !ok {
+			return "", xetcd.ErrNotFound
+		}
+		return v, nil
+	})
+
+	o := xnats.OrderReq{Symbol: "BTC_USDT", Side: model.OrderSideBid, Type: model.OrderTypeLimit, Price: d("120"), Quantity: d("1")}
+	reason, err := reg.Check(o)
+	require.Nil(t, err)
+	require.Equal(t, model.OrderRejectReasonPriceOutOfBand, reason)
+
+	// cached
+	fail = true
+	reason, err = reg.Check(o)
+	require.Nil(t, err)
+	require.Equal(t, model.OrderRejectReasonPriceOutOfBand, reason)
+
+	// no rules, anything goes
+	fail = false
+	o.Symbol = "ETH_USDT"
+	reason, err = reg.Check(o)
+	require.Nil(t, err)
+	require.Equal(t, "", reason)
+}
@@ -0,0 +1,102 @@
+package xetcd
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotCached returned by Cache.Peek until the key is read the first time
+var ErrNotCached = errors.New("not cached yet")
+
+// Cache caches the values read from etcd, e.g. the trading rules and the catalog
+//
+//	a value is read again once it is older than the ttl, if that fails the cached one is used
+type Cache struct {
+	name    string // of the values, in the logs
+	ttl     time.Duration
+	get     func(k string) (string, error)
+	mu      sync.Mutex
+	items   map[string]cacheItem // etcd key -> value
+	loading map[string]bool      // the keys Peek reads in the background
+}
+
+type cacheItem struct {
+	v     string
+	found bool
+	at    time.Time
+}
+
+// NewCache returns a cache of the values named name, read with get, which returns ErrNotFound for missing keys, e.g. Get
+func NewCache(name string, ttl time.Duration, get func(k string) (string, error)) *Cache {
+	return &Cache{
+		name:    name,
+		ttl:     ttl,
+		get:     get,
+		items:   map[string]cacheItem{},
+		loading: map[string]bool{},
+	}
+}
+
+// Get returns the value of k, found is false if it does not exist
+func (c *Cache) Get(k string) (v string, found bool, err error) {
+	c.mu.Lock()
+	it, ok := c.items[k]
+	c.mu.Unlock()
+	if ok && time.Since(it.at) < c.ttl {
+		return it.v, it.found, nil
+	}
+
+	// without the lock, Peek does not wait for etcd
+	v, err = c.get(k)
+	if errors.Is(err, ErrNotFound) {
+		v, err = "", nil
+	} else if err != nil {
+		if ok {
+			logger.Warningf("%s read k:%s failed, use the cached one, err:%s", c.name, k, err)
+			return it.v, it.found, nil
+		}
+		return
+	}
+
+	found = v != ""
+	c.mu.Lock()
+	c.items[k] = cacheItem{v: v, found: found, at: time.Now()}
+	c.mu.Unlock()
+	return
+}
+
+// Peek returns the cached value of k without waiting for etcd, for the hot paths,
+// it is read in the background if it is older than the ttl or not cached yet, ErrNotCached until it is
+func (c *Cache) Peek(k string) (v string, found bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it, ok := c.items[k]
+	if (!ok || time.Since(it.at) >= c.ttl) && !c.loading[k] {
+		c.loading[k] = true
+		go c.load(k)
+	}
+	if !ok {
+		return "", false, ErrNotCached
+	}
+	return it.v, it.found, nil
+}
+
+// load reads k for Peek, the cached value is kept if that fails
+func (c *Cache) load(k string) {
+	v, err := c.get(k)
+	if errors.Is(err, ErrNotFound) {
+		v, err = "", nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.loading, k)
+	if err != nil {
+		logger.Warningf("%s read k:%s in the background failed, err:%s", c.name, k, err)
+		return
+	}
+	c.items[k] = cacheItem{v: v, found: v != "", at: time.Now()}
+}
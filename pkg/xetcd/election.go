@@ -0,0 +1,189 @@
+package xetcd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DefaultLeaseTTL seconds of the lease of Campaign if its ttl is 0
+const DefaultLeaseTTL = 5
+
+// ErrNotLeader returned by Leadership.Fence once the lease may have expired
+var ErrNotLeader = errors.New("not the leader")
+
+// Leadership the lease of a leader elected by Campaign
+//
+//	the lease is kept alive with one request at a time, each one extends the local deadline to when it was sent plus the TTL,
+//	which is never later than the expiry in etcd, so Fence fails before a standby can be elected
+type Leadership struct {
+	Key      string // the election, see KeyBankLeader and KeyOmeLeader
+	Value    string // the address of the leader
+	Revision int64  // when it was elected, a later leader has a higher one
+
+	lease    clientv3.LeaseID
+	ttl      time.Duration
+	deadline atomic.Int64 // unix nano the lease may expire at
+	done     chan struct{}
+	once     sync.Once
+	cancel   context.CancelFunc
+}
+
+// Campaign blocks until this process leads the election key with value or ctx is done,
+// it holds a lease of ttl seconds until Resign or until it cannot keep the lease alive
+func Campaign(ctx context.Context, key, value string, ttl int64) (l *Leadership, err error) {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	defer func() {
+		if err != nil {
+			logger.Errorf("xetcd Campaign k:%s, v:%s failed with err:%s", key, value, err)
+		} else {
+			logger.Infof("xetcd Campaign k:%s, v:%s elected with revision:%d", key, value, l.Revision)
+		}
+	}()
+
+	cli := SharedCli()
+	sent := time.Now()
+	lease, err := cli.Grant(ctx, ttl)
+	if err != nil {
+		return
+	}
+
+	kctx, cancel := context.WithCancel(context.Background())
+	l = &Leadership{
+		Key:    key,
+		Value:  value,
+		lease:  lease.ID,
+		ttl:    time.Duration(lease.TTL) * time.Second,
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	l.deadline.Store(sent.Add(l.ttl).UnixNano())
+	go l.keepAlive(kctx)
+
+	for {
+		var resp *clientv3.TxnResponse
+		resp, err = cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, value, clientv3.WithLease(lease.ID))).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		if err != nil {
+			break
+		}
+		if resp.Succeeded {
+			l.Revision = resp.Header.Revision
+			return
+		}
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			logger.Infof("xetcd Campaign k:%s led by v:%s, waiting", key, kvs[0].Value)
+		}
+
+		// wait for the leader to go, then try again
+		err = l.waitDelete(ctx, resp.Header.Revision+1)
+		if err != nil {
+			break
+		}
+	}
+
+	l.Resign()
+	return nil, err
+}
+
+// waitDelete waits for the key to be deleted after rev, by the leader or the expiry of its lease
+func (l *Leadership) waitDelete(ctx context.Context, rev int64) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wch := SharedCli().Watch(wctx, l.Key, clientv3.WithRev(rev))
+	for {
+		select {
+		case <-l.done:
+			return ErrNotLeader
+		case wr, ok := <-wch:
+			if !ok {
+				return ctx.Err()
+			}
+			if err := wr.Err(); err != nil {
+				return err
+			}
+			for _, ev := range wr.Events {
+				if ev.Type == clientv3.EventTypeDelete {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// keepAlive renews the lease every third of its TTL, until it is revoked, expired or ctx is done
+func (l *Leadership) keepAlive(ctx context.Context) {
+	defer l.close()
+
+	cli := SharedCli()
+	interval := l.ttl / 3
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		sent := time.Now()
+		rctx, cancel := context.WithTimeout(ctx, interval)
+		resp, err := cli.KeepAliveOnce(rctx, l.lease)
+		cancel()
+		switch {
+		case errors.Is(err, rpctypes.ErrLeaseNotFound):
+			logger.Errorf("xetcd keepAlive k:%s lost the lease", l.Key)
+			return
+		case err != nil:
+			logger.Errorf("xetcd keepAlive k:%s failed with err:%s", l.Key, err)
+		default:
+			l.deadline.Store(sent.Add(time.Duration(resp.TTL) * time.Second).UnixNano())
+		}
+		if l.Fence() != nil {
+			logger.Errorf("xetcd keepAlive k:%s, the lease may have expired", l.Key)
+			return
+		}
+	}
+}
+
+func (l *Leadership) close() {
+	l.once.Do(func() {
+		l.deadline.Store(0)
+		close(l.done)
+	})
+}
+
+// Fence returns ErrNotLeader once the lease may have expired, a leader checks it before every write, see filedb.Filedb.SetFence
+func (l *Leadership) Fence() error {
+	if time.Now().UnixNano() >= l.deadline.Load() {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// Done closed once the leadership is lost or resigned
+func (l *Leadership) Done() <-chan struct{} {
+	return l.done
+}
+
+// Resign gives up the leadership, the lease is revoked so that a standby takes over at once
+func (l *Leadership) Resign() {
+	l.cancel()
+	l.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := SharedCli().Revoke(ctx, l.lease)
+	if err != nil {
+		logger.Errorf("xetcd Resign k:%s failed with err:%s", l.Key, err)
+	}
+}
@@ -0,0 +1,8 @@
+package xetcd
+
+// SetServiceClient replaces the client of the services with cli until the returned func is called
+func SetServiceClient(cli serviceClient) (restore func()) {
+	old := serviceCli
+	serviceCli = func() serviceClient { return cli }
+	return func() { serviceCli = old }
+}
@@ -0,0 +1,220 @@
+package xetcd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ErrChanged returned by the clients whose service moved to another address, see Changed
+var ErrChanged = errors.New("service address changed")
+
+// Registration the address of a service put under a lease by Register, gone once the service is
+type Registration struct {
+	Key   string // e.g. KeyBankService
+	Value string // the address
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// serviceClient the calls of the etcd client the services make, see serviceCli
+type serviceClient interface {
+	Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error)
+	KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error)
+	Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error)
+	Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error)
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+}
+
+// serviceCli returns the client of the services, the shared one unless a test replaces it
+var serviceCli = func() serviceClient {
+	return SharedCli()
+}
+
+var registrations = struct {
+	sync.Mutex
+	m map[*Registration]struct{}
+}{m: map[*Registration]struct{}{}}
+
+// Register puts the address v of a service at k under a lease of DefaultLeaseTTL seconds and keeps it alive,
+// it is put again under a new lease if the lease is lost, e.g. etcd was away for longer than the TTL, until Deregister
+func Register(k, v string) (r *Registration, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r = &Registration{
+		Key:    k,
+		Value:  v,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	lease, err := r.put(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go r.keepAlive(ctx, lease)
+
+	registrations.Lock()
+	registrations.m[r] = struct{}{}
+	registrations.Unlock()
+	return
+}
+
+// put puts the address under a new lease
+func (r *Registration) put(ctx context.Context) (lease clientv3.LeaseID, err error) {
+	defer func() {
+		if err != nil {
+			logger.Errorf("xetcd Register k:%s, v:%s failed with err:%s", r.Key, r.Value, err)
+		} else {
+			logger.Infof("xetcd Register k:%s, v:%s with lease:%x", r.Key, r.Value, lease)
+		}
+	}()
+
+	cli := serviceCli()
+	resp, err := cli.Grant(ctx, DefaultLeaseTTL)
+	if err != nil {
+		return
+	}
+	_, err = cli.Put(ctx, r.Key, r.Value, clientv3.WithLease(resp.ID))
+	if err != nil {
+		return
+	}
+	return resp.ID, nil
+}
+
+// keepAlive keeps the lease alive until ctx is done, then revokes it, which deletes the key unless another service put it since
+func (r *Registration) keepAlive(ctx context.Context, lease clientv3.LeaseID) {
+	defer close(r.done)
+
+	cli := serviceCli()
+	for {
+		if lease != 0 {
+			ch, err := cli.KeepAlive(ctx, lease)
+			if err == nil {
+				for range ch {
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		logger.Errorf("xetcd Register k:%s lost its lease, putting it again", r.Key)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		lease, _ = r.put(ctx)
+	}
+
+	if lease == 0 {
+		return
+	}
+	rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := cli.Revoke(rctx, lease)
+	if err != nil {
+		logger.Errorf("xetcd Deregister k:%s failed with err:%s", r.Key, err)
+	} else {
+		logger.Infof("xetcd Deregister k:%s, v:%s", r.Key, r.Value)
+	}
+}
+
+// Deregister deletes the address, unless another service put it since
+func (r *Registration) Deregister() {
+	registrations.Lock()
+	delete(registrations.m, r)
+	registrations.Unlock()
+
+	r.cancel()
+	<-r.done
+}
+
+// DeregisterAll deregisters the services of this process, before it exits
+func DeregisterAll() {
+	registrations.Lock()
+	rs := make([]*Registration, 0, len(registrations.m))
+	for r := range registrations.m {
+		rs = append(rs, r)
+	}
+	registrations.Unlock()
+
+	for _, r := range rs {
+		r.Deregister()
+	}
+}
+
+// GetWait returns the value of k, it waits for k to be put until ctx is done if it does not exist
+func GetWait(ctx context.Context, k string) (v string, err error) {
+	cli := serviceCli()
+	for {
+		var r *clientv3.GetResponse
+		r, err = cli.Get(ctx, k)
+		if err != nil {
+			return
+		}
+		if r.Count > 0 {
+			return string(r.Kvs[0].Value), nil
+		}
+
+		logger.Infof("xetcd GetWait k:%s not found, waiting", k)
+		err = waitEvent(ctx, k, r.Header.Revision+1, func(ev *clientv3.Event) bool {
+			return ev.Type == clientv3.EventTypePut
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Changed returns a copy of ctx that is done once k no longer holds v, it is deleted or put with another value,
+// the clients of a service use it to drop the connection to its old address at once
+func Changed(ctx context.Context, k, v string) (context.Context, context.CancelFunc) {
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+
+		r, err := serviceCli().Get(cctx, k)
+		if err != nil {
+			return
+		}
+		if r.Count == 0 || string(r.Kvs[0].Value) != v {
+			logger.Infof("xetcd Changed k:%s no longer holds v:%s", k, v)
+			return
+		}
+		err = waitEvent(cctx, k, r.Header.Revision+1, func(ev *clientv3.Event) bool {
+			return ev.Type == clientv3.EventTypeDelete || string(ev.Kv.Value) != v
+		})
+		if err == nil {
+			logger.Infof("xetcd Changed k:%s no longer holds v:%s", k, v)
+		}
+	}()
+	return cctx, cancel
+}
+
+// waitEvent watches k from rev until ok returns true for one of its events or ctx is done
+func waitEvent(ctx context.Context, k string, rev int64, ok func(ev *clientv3.Event) bool) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wch := serviceCli().Watch(wctx, k, clientv3.WithRev(rev))
+	for wr := range wch {
+		if err := wr.Err(); err != nil {
+			return err
+		}
+		for _, ev := range wr.Events {
+			if ok(ev) {
+				return nil
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("watch closed")
+}
@@ -0,0 +1,273 @@
+package xetcd_test
+
+import (
+	"ccoms/pkg/xetcd"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type fakeKV struct {
+	v     string
+	lease clientv3.LeaseID
+}
+
+type fakeWatch struct {
+	k  string
+	ch chan clientv3.WatchResponse
+}
+
+// fakeCli the calls of the services to etcd, in memory
+//
+//	the options of Put are opaque, a key put takes the lease granted last, as Register puts it right after the grant,
+//	the watches start at the current revision
+type fakeCli struct {
+	mu      sync.Mutex
+	rev     int64
+	lease   clientv3.LeaseID // granted last
+	kvs     map[string]fakeKV
+	alive   map[clientv3.LeaseID]chan struct{} // closed once the lease is gone
+	revoked []clientv3.LeaseID
+	watches map[*fakeWatch]struct{}
+}
+
+func newFakeCli(t *testing.T) *fakeCli {
+	f := &fakeCli{
+		kvs:     map[string]fakeKV{},
+		alive:   map[clientv3.LeaseID]chan struct{}{},
+		watches: map[*fakeWatch]struct{}{},
+	}
+	t.Cleanup(xetcd.SetServiceClient(f))
+	return f
+}
+
+func (f *fakeCli) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lease++
+	f.alive[f.lease] = make(chan struct{})
+	return &clientv3.LeaseGrantResponse{ID: f.lease, TTL: ttl}, nil
+}
+
+func (f *fakeCli) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	f.mu.Lock()
+	gone, ok := f.alive[id]
+	f.mu.Unlock()
+	if !ok {
+		return nil, errors.New("lease not found")
+	}
+	ch := make(chan *clientv3.LeaseKeepAliveResponse)
+	go func() {
+		defer close(ch)
+		select {
+		case <-ctx.Done():
+		case <-gone:
+		}
+	}()
+	return ch, nil
+}
+
+func (f *fakeCli) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = append(f.revoked, id)
+	f.dropLease(id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (f *fakeCli) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.put(key, val, f.lease)
+	return &clientv3.PutResponse{}, nil
+}
+
+func (f *fakeCli) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: f.rev}}
+	if kv, ok := f.kvs[key]; ok {
+		r.Count = 1
+		r.Kvs = []*mvccpb.KeyValue{{Key: []byte(key), Value: []byte(kv.v), Lease: int64(kv.lease)}}
+	}
+	return r, nil
+}
+
+func (f *fakeCli) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	w := &fakeWatch{k: key, ch: make(chan clientv3.WatchResponse, 16)}
+	f.mu.Lock()
+	f.watches[w] = struct{}{}
+	f.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.watches, w)
+		close(w.ch)
+	}()
+	return w.ch
+}
+
+// put puts k under lease, with the lock held
+func (f *fakeCli) put(k, v string, lease clientv3.LeaseID) {
+	f.rev++
+	f.kvs[k] = fakeKV{v: v, lease: lease}
+	f.notify(k, &clientv3.Event{Type: clientv3.EventTypePut, Kv: &mvccpb.KeyValue{Key: []byte(k), Value: []byte(v), ModRevision: f.rev}})
+}
+
+// dropLease deletes the keys under lease as etcd does once it is revoked or expires, with the lock held
+func (f *fakeCli) dropLease(lease clientv3.LeaseID) {
+	if gone, ok := f.alive[lease]; ok {
+		close(gone)
+		delete(f.alive, lease)
+	}
+	for k, kv := range f.kvs {
+		if kv.lease == lease {
+			f.rev++
+			delete(f.kvs, k)
+			f.notify(k, &clientv3.Event{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte(k), ModRevision: f.rev}})
+		}
+	}
+}
+
+func (f *fakeCli) notify(k string, ev *clientv3.Event) {
+	for w := range f.watches {
+		if w.k == k {
+			w.ch <- clientv3.WatchResponse{Events: []*clientv3.Event{ev}}
+		}
+	}
+}
+
+// expire expires the lease, as if etcd lost sight of its holder for longer than the TTL
+func (f *fakeCli) expire(lease clientv3.LeaseID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropLease(lease)
+}
+
+// set puts k under lease, as another service does
+func (f *fakeCli) set(k, v string, lease clientv3.LeaseID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.put(k, v, lease)
+}
+
+func (f *fakeCli) delete(k string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.kvs[k]; ok {
+		f.rev++
+		delete(f.kvs, k)
+		f.notify(k, &clientv3.Event{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte(k), ModRevision: f.rev}})
+	}
+}
+
+func (f *fakeCli) get(k string) (kv fakeKV, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	kv, ok = f.kvs[k]
+	return
+}
+
+func (f *fakeCli) watching(k string) (n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for w := range f.watches {
+		if w.k == k {
+			n++
+		}
+	}
+	return
+}
+
+func (f *fakeCli) revokedLeases() []clientv3.LeaseID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]clientv3.LeaseID(nil), f.revoked...)
+}
+
+func TestRegisterLostLease(t *testing.T) {
+	f := newFakeCli(t)
+	k := xetcd.KeyBankService("USDT")
+
+	r, err := xetcd.Register(k, "10.0.0.1:9000")
+	require.Nil(t, err)
+	kv, ok := f.get(k)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.1:9000", kv.v)
+	lost := kv.lease
+
+	// put again under a new lease
+	f.expire(lost)
+	_, ok = f.get(k)
+	require.False(t, ok)
+	require.Eventually(t, func() bool {
+		kv, ok = f.get(k)
+		return ok && kv.v == "10.0.0.1:9000" && kv.lease != lost
+	}, 3*time.Second, 10*time.Millisecond)
+
+	r.Deregister()
+	_, ok = f.get(k)
+	require.False(t, ok)
+	require.Equal(t, []clientv3.LeaseID{kv.lease}, f.revokedLeases())
+}
+
+func TestDeregisterPutSince(t *testing.T) {
+	f := newFakeCli(t)
+	k := xetcd.KeyBankService("USDT")
+
+	r, err := xetcd.Register(k, "10.0.0.1:9000")
+	require.Nil(t, err)
+	kv, ok := f.get(k)
+	require.True(t, ok)
+	own := kv.lease
+
+	// another instance of the service took over meanwhile
+	f.set(k, "10.0.0.2:9000", 100)
+
+	r.Deregister()
+	kv, ok = f.get(k)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.2:9000", kv.v)
+	require.Equal(t, []clientv3.LeaseID{own}, f.revokedLeases())
+}
+
+func TestChanged(t *testing.T) {
+	f := newFakeCli(t)
+	k := xetcd.KeyBankService("USDT")
+	f.set(k, "10.0.0.1:9000", 100)
+
+	// deleted
+	ctx, cancel := xetcd.Changed(context.Background(), k, "10.0.0.1:9000")
+	defer cancel()
+	require.Eventually(t, func() bool { return f.watching(k) == 1 }, time.Second, time.Millisecond)
+	f.set(k, "10.0.0.1:9000", 100)
+	select {
+	case <-ctx.Done():
+		t.Fatal("done while k holds the same value")
+	case <-time.After(100 * time.Millisecond):
+	}
+	f.delete(k)
+	require.Eventually(t, func() bool { return ctx.Err() != nil }, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return f.watching(k) == 0 }, time.Second, time.Millisecond)
+
+	// put with another value
+	f.set(k, "10.0.0.1:9000", 100)
+	ctx, cancel = xetcd.Changed(context.Background(), k, "10.0.0.1:9000")
+	defer cancel()
+	require.Eventually(t, func() bool { return f.watching(k) == 1 }, time.Second, time.Millisecond)
+	f.set(k, "10.0.0.2:9000", 100)
+	require.Eventually(t, func() bool { return ctx.Err() != nil }, time.Second, time.Millisecond)
+
+	// already changed
+	ctx, cancel = xetcd.Changed(context.Background(), k, "10.0.0.1:9000")
+	defer cancel()
+	require.Eventually(t, func() bool { return ctx.Err() != nil }, time.Second, time.Millisecond)
+}
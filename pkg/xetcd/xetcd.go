@@ -17,6 +17,9 @@ type Worker struct {
 var Shared *Worker
 var logger = xlog.GetLogger()
 
+// ErrNotFound returned by Get if the key does not exist
+var ErrNotFound = errors.New("not found")
+
 func New(urls []string) (w *Worker, err error) {
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints:   urls,
@@ -67,7 +70,7 @@ func Get(k string) (v string, err error) {
 		return
 	}
 	if r.Kvs == nil || r.Count == 0 {
-		err = errors.New("not found")
+		err = ErrNotFound
 		return
 	}
 
@@ -75,6 +78,32 @@ func Get(k string) (v string, err error) {
 	return
 }
 
+// GetPrefix returns the keys starting with prefix and their values
+func GetPrefix(prefix string) (kvs map[string]string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+	defer func() {
+		if err != nil {
+			logger.Errorf("xetcd GetPrefix prefix:%s failed with err:%s", prefix, err)
+		} else {
+			logger.Debugf("xetcd GetPrefix prefix:%s, count:%d", prefix, len(kvs))
+		}
+		cancel()
+	}()
+
+	cli := SharedCli()
+	r, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	kvs = make(map[string]string, len(r.Kvs))
+	for _, kv := range r.Kvs {
+		kvs[string(kv.Key)] = string(kv.Value)
+	}
+	return
+}
+
 func Put(k string, v string) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 
@@ -100,6 +129,44 @@ func KeyBankService(coin string) string {
 	return "bank_service_" + strings.ToLower(coin)
 }
 
+// KeyOmeService the grpc address of the ome of the symbol, its standbys replicate from it
+func KeyOmeService(symbol string) string {
+	return "ome_service_" + strings.ToLower(symbol)
+}
+
+// KeyBankLeader the election of the bank of the coin, see Campaign
+func KeyBankLeader(coin string) string {
+	return "bank_leader_" + strings.ToLower(coin)
+}
+
+// KeyOmeLeader the election of the ome of the symbol, see Campaign
+func KeyOmeLeader(symbol string) string {
+	return "ome_leader_" + strings.ToLower(symbol)
+}
+
 func KeyNatsService(coin string) string {
 	return "nats_bank_" + strings.ToLower(coin)
 }
+
+func KeySymbolRules(symbol string) string {
+	return "symbol_rules_" + strings.ToLower(symbol)
+}
+
+// KeyCatalogCoin the listing of the coin, KeyCatalogCoin("") is the prefix of them all, see catalog.Coin
+func KeyCatalogCoin(coin string) string {
+	return "catalog_coin_" + strings.ToLower(coin)
+}
+
+// KeyCatalogSymbol the listing of the symbol, KeyCatalogSymbol("") is the prefix of them all, see catalog.Symbol
+func KeyCatalogSymbol(symbol string) string {
+	return "catalog_symbol_" + strings.ToLower(symbol)
+}
+
+func KeyLastPrice(symbol string) string {
+	return "last_price_" + strings.ToLower(symbol)
+}
+
+// KeyReplicaLag how far the standby of the bank or ome name is behind its primary, see replica.Lag
+func KeyReplicaLag(name string) string {
+	return "replica_lag_" + strings.ToLower(name)
+}
@@ -1,6 +1,9 @@
 package xetcd_test
 
 import (
+	"ccoms/pkg/xetcd"
+	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,3 +19,46 @@ func TestEtcd(t *testing.T) {
 	require.Nil(t, err)
 	defer cli.Close()
 }
+
+func TestCache(t *testing.T) {
+	var down atomic.Bool
+	var reads atomic.Int64
+	c := xetcd.NewCache("test", time.Hour, func(k string) (string, error) {
+		reads.Add(1)
+		if down.Load() {
+			return "", errors.New("etcd is down")
+		}
+		if k == "a" {
+			return "1", nil
+		}
+		return "", xetcd.ErrNotFound
+	})
+
+	// read in the background on the first peek
+	_, _, err := c.Peek("a")
+	require.Equal(t, xetcd.ErrNotCached, err)
+	require.Eventually(t, func() bool {
+		v, found, err := c.Peek("a")
+		return err == nil && found && v == "1"
+	}, time.Second, time.Millisecond)
+
+	// missing keys are cached too
+	v, found, err := c.Get("b")
+	require.Nil(t, err)
+	require.False(t, found)
+	require.Equal(t, "", v)
+	_, found, err = c.Peek("b")
+	require.Nil(t, err)
+	require.False(t, found)
+
+	// fresh, etcd is not read again
+	n := reads.Load()
+	down.Store(true)
+	v, found, err = c.Get("a")
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, "1", v)
+	require.Equal(t, n, reads.Load())
+	_, _, err = c.Get("c")
+	require.NotNil(t, err)
+}
@@ -123,14 +123,25 @@ type Ticket struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id       int64  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
-	Time     int64  `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"`
-	Owner    int64  `protobuf:"varint,3,opt,name=owner,proto3" json:"owner,omitempty"`
-	Side     int64  `protobuf:"varint,4,opt,name=side,proto3" json:"side,omitempty"`
-	Type     int64  `protobuf:"varint,5,opt,name=type,proto3" json:"type,omitempty"`
-	Price    string `protobuf:"bytes,6,opt,name=price,proto3" json:"price,omitempty"`
-	Quantity string `protobuf:"bytes,7,opt,name=quantity,proto3" json:"quantity,omitempty"`
-	FeeRate  int64  `protobuf:"varint,8,opt,name=feeRate,proto3" json:"feeRate,omitempty"`
+	Id                  int64  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Time                int64  `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"`
+	Owner               int64  `protobuf:"varint,3,opt,name=owner,proto3" json:"owner,omitempty"`
+	Side                int64  `protobuf:"varint,4,opt,name=side,proto3" json:"side,omitempty"`
+	Type                int64  `protobuf:"varint,5,opt,name=type,proto3" json:"type,omitempty"`
+	Price               string `protobuf:"bytes,6,opt,name=price,proto3" json:"price,omitempty"`
+	Quantity            string `protobuf:"bytes,7,opt,name=quantity,proto3" json:"quantity,omitempty"`
+	FeeRate             int64  `protobuf:"varint,8,opt,name=feeRate,proto3" json:"feeRate,omitempty"`
+	Action              int64  `protobuf:"varint,9,opt,name=action,proto3" json:"action,omitempty"`
+	OrderID             int64  `protobuf:"varint,10,opt,name=orderID,proto3" json:"orderID,omitempty"`
+	Frozen              string `protobuf:"bytes,11,opt,name=frozen,proto3" json:"frozen,omitempty"`
+	Amount              string `protobuf:"bytes,12,opt,name=amount,proto3" json:"amount,omitempty"`
+	TimeInForce         int64  `protobuf:"varint,13,opt,name=timeInForce,proto3" json:"timeInForce,omitempty"`
+	ClientOrderID       string `protobuf:"bytes,14,opt,name=clientOrderID,proto3" json:"clientOrderID,omitempty"`
+	SelfTradePrevention int64  `protobuf:"varint,15,opt,name=selfTradePrevention,proto3" json:"selfTradePrevention,omitempty"`
+	StopPrice           string `protobuf:"bytes,16,opt,name=stopPrice,proto3" json:"stopPrice,omitempty"`
+	DisplayQty          string `protobuf:"bytes,17,opt,name=displayQty,proto3" json:"displayQty,omitempty"`
+	ExpireAt            int64  `protobuf:"varint,18,opt,name=expireAt,proto3" json:"expireAt,omitempty"`
+	Reserve             string `protobuf:"bytes,19,opt,name=reserve,proto3" json:"reserve,omitempty"`
 }
 
 func (x *Ticket) Reset() {
@@ -221,6 +232,83 @@ func (x *Ticket) GetFeeRate() int64 {
 	return 0
 }
 
+func (x *Ticket) GetAction() int64 {
+	if x != nil {
+		return x.Action
+	}
+	return 0
+}
+
+func (x *Ticket) GetOrderID() int64 {
+	if x != nil {
+		return x.OrderID
+	}
+	return 0
+}
+
+func (x *Ticket) GetFrozen() string {
+	if x != nil {
+		return x.Frozen
+	}
+	return ""
+}
+
+func (x *Ticket) GetAmount() string {
+	if x != nil {
+		return x.Amount
+	}
+	return ""
+}
+
+func (x *Ticket) GetTimeInForce() int64 {
+	if x != nil {
+		return x.TimeInForce
+	}
+	return 0
+}
+
+func (x *Ticket) GetClientOrderID() string {
+	if x != nil {
+		return x.ClientOrderID
+	}
+	return ""
+}
+
+func (x *Ticket) GetSelfTradePrevention() int64 {
+	if x != nil {
+		return x.SelfTradePrevention
+	}
+	return 0
+}
+
+func (x *Ticket) GetStopPrice() string {
+	if x != nil {
+		return x.StopPrice
+	}
+	return ""
+}
+
+func (x *Ticket) GetDisplayQty() string {
+	if x != nil {
+		return x.DisplayQty
+	}
+	return ""
+}
+
+func (x *Ticket) GetExpireAt() int64 {
+	if x != nil {
+		return x.ExpireAt
+	}
+	return 0
+}
+
+func (x *Ticket) GetReserve() string {
+	if x != nil {
+		return x.Reserve
+	}
+	return ""
+}
+
 type BalanceChange struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -236,6 +324,9 @@ type BalanceChange struct {
 	FreeChange2   string `protobuf:"bytes,8,opt,name=freeChange2,proto3" json:"freeChange2,omitempty"`
 	FreezeChange2 string `protobuf:"bytes,9,opt,name=freezeChange2,proto3" json:"freezeChange2,omitempty"`
 	ReasonIDFirst int64  `protobuf:"varint,10,opt,name=reasonIDFirst,proto3" json:"reasonIDFirst,omitempty"`
+	Owner3        int64  `protobuf:"varint,11,opt,name=owner3,proto3" json:"owner3,omitempty"`
+	FreeChange3   string `protobuf:"bytes,12,opt,name=freeChange3,proto3" json:"freeChange3,omitempty"`
+	FreezeChange3 string `protobuf:"bytes,13,opt,name=freezeChange3,proto3" json:"freezeChange3,omitempty"`
 }
 
 func (x *BalanceChange) Reset() {
@@ -340,6 +431,99 @@ func (x *BalanceChange) GetReasonIDFirst() int64 {
 	return 0
 }
 
+func (x *BalanceChange) GetOwner3() int64 {
+	if x != nil {
+		return x.Owner3
+	}
+	return 0
+}
+
+func (x *BalanceChange) GetFreeChange3() string {
+	if x != nil {
+		return x.FreeChange3
+	}
+	return ""
+}
+
+func (x *BalanceChange) GetFreezeChange3() string {
+	if x != nil {
+		return x.FreezeChange3
+	}
+	return ""
+}
+
+// Record a filedb record of a primary, see ReplicaService
+type Record struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	LogID     int64  `protobuf:"varint,1,opt,name=logID,proto3" json:"logID,omitempty"`
+	Data      []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`            // the record as it is in the filedb, empty for a heartbeat
+	HeadLogID int64  `protobuf:"varint,3,opt,name=headLogID,proto3" json:"headLogID,omitempty"` // the latest log of the primary
+	Ts        int64  `protobuf:"varint,4,opt,name=ts,proto3" json:"ts,omitempty"`               // when it was sent, in nanoseconds
+}
+
+func (x *Record) Reset() {
+	*x = Record{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_xgrpc_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Record) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Record) ProtoMessage() {}
+
+func (x *Record) ProtoReflect() protoreflect.Message {
+	mi := &file_xgrpc_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Record.ProtoReflect.Descriptor instead.
+func (*Record) Descriptor() ([]byte, []int) {
+	return file_xgrpc_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Record) GetLogID() int64 {
+	if x != nil {
+		return x.LogID
+	}
+	return 0
+}
+
+func (x *Record) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Record) GetHeadLogID() int64 {
+	if x != nil {
+		return x.HeadLogID
+	}
+	return 0
+}
+
+func (x *Record) GetTs() int64 {
+	if x != nil {
+		return x.Ts
+	}
+	return 0
+}
+
 var File_xgrpc_proto protoreflect.FileDescriptor
 
 var file_xgrpc_proto_rawDesc = []byte{
@@ -347,7 +531,7 @@ var file_xgrpc_proto_rawDesc = []byte{
 	0x67, 0x72, 0x70, 0x63, 0x22, 0x1e, 0x0a, 0x06, 0x53, 0x74, 0x72, 0x69, 0x6e, 0x67, 0x12, 0x14,
 	0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76,
 	0x61, 0x6c, 0x75, 0x65, 0x22, 0x14, 0x0a, 0x02, 0x49, 0x44, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64,
-	0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x69, 0x64, 0x22, 0xb6, 0x01, 0x0a, 0x06, 0x54,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x69, 0x64, 0x22, 0x86, 0x04, 0x0a, 0x06, 0x54,
 	0x69, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
 	0x03, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20,
 	0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6f, 0x77, 0x6e,
@@ -359,7 +543,28 @@ var file_xgrpc_proto_rawDesc = []byte{
 	0x08, 0x71, 0x75, 0x61, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52,
 	0x08, 0x71, 0x75, 0x61, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x12, 0x18, 0x0a, 0x07, 0x66, 0x65, 0x65,
 	0x52, 0x61, 0x74, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x66, 0x65, 0x65, 0x52,
-	0x61, 0x74, 0x65, 0x22, 0xc5, 0x02, 0x0a, 0x0d, 0x42, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x43,
+	0x61, 0x74, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x09, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x6f,
+	0x72, 0x64, 0x65, 0x72, 0x49, 0x44, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x6f, 0x72,
+	0x64, 0x65, 0x72, 0x49, 0x44, 0x12, 0x16, 0x0a, 0x06, 0x66, 0x72, 0x6f, 0x7a, 0x65, 0x6e, 0x18,
+	0x0b, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x66, 0x72, 0x6f, 0x7a, 0x65, 0x6e, 0x12, 0x16, 0x0a,
+	0x06, 0x61, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x61,
+	0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x20, 0x0a, 0x0b, 0x74, 0x69, 0x6d, 0x65, 0x49, 0x6e, 0x46,
+	0x6f, 0x72, 0x63, 0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x74, 0x69, 0x6d, 0x65,
+	0x49, 0x6e, 0x46, 0x6f, 0x72, 0x63, 0x65, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x6c, 0x69, 0x65, 0x6e,
+	0x74, 0x4f, 0x72, 0x64, 0x65, 0x72, 0x49, 0x44, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d,
+	0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x4f, 0x72, 0x64, 0x65, 0x72, 0x49, 0x44, 0x12, 0x30, 0x0a,
+	0x13, 0x73, 0x65, 0x6c, 0x66, 0x54, 0x72, 0x61, 0x64, 0x65, 0x50, 0x72, 0x65, 0x76, 0x65, 0x6e,
+	0x74, 0x69, 0x6f, 0x6e, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x03, 0x52, 0x13, 0x73, 0x65, 0x6c, 0x66,
+	0x54, 0x72, 0x61, 0x64, 0x65, 0x50, 0x72, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x69, 0x6f, 0x6e, 0x12,
+	0x1c, 0x0a, 0x09, 0x73, 0x74, 0x6f, 0x70, 0x50, 0x72, 0x69, 0x63, 0x65, 0x18, 0x10, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x09, 0x73, 0x74, 0x6f, 0x70, 0x50, 0x72, 0x69, 0x63, 0x65, 0x12, 0x1e, 0x0a,
+	0x0a, 0x64, 0x69, 0x73, 0x70, 0x6c, 0x61, 0x79, 0x51, 0x74, 0x79, 0x18, 0x11, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0a, 0x64, 0x69, 0x73, 0x70, 0x6c, 0x61, 0x79, 0x51, 0x74, 0x79, 0x12, 0x1a, 0x0a,
+	0x08, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x41, 0x74, 0x18, 0x12, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x08, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x41, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x72, 0x65, 0x73,
+	0x65, 0x72, 0x76, 0x65, 0x18, 0x13, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x72, 0x65, 0x73, 0x65,
+	0x72, 0x76, 0x65, 0x22, 0xa5, 0x03, 0x0a, 0x0d, 0x42, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x43,
 	0x68, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18,
 	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x20, 0x0a,
 	0x0b, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x54, 0x61, 0x62, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01,
@@ -379,15 +584,31 @@ var file_xgrpc_proto_rawDesc = []byte{
 	0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x66, 0x72, 0x65, 0x65, 0x7a, 0x65, 0x43, 0x68,
 	0x61, 0x6e, 0x67, 0x65, 0x32, 0x12, 0x24, 0x0a, 0x0d, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x49,
 	0x44, 0x46, 0x69, 0x72, 0x73, 0x74, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x72, 0x65,
-	0x61, 0x73, 0x6f, 0x6e, 0x49, 0x44, 0x46, 0x69, 0x72, 0x73, 0x74, 0x32, 0x6b, 0x0a, 0x0b, 0x42,
-	0x61, 0x6e, 0x6b, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x25, 0x0a, 0x07, 0x54, 0x69,
-	0x63, 0x6b, 0x65, 0x74, 0x73, 0x12, 0x09, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e, 0x49, 0x44,
-	0x1a, 0x0d, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e, 0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x30,
-	0x01, 0x12, 0x35, 0x0a, 0x0e, 0x42, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x43, 0x68, 0x61, 0x6e,
-	0x67, 0x65, 0x73, 0x12, 0x14, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e, 0x42, 0x61, 0x6c, 0x61,
-	0x6e, 0x63, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x1a, 0x09, 0x2e, 0x78, 0x67, 0x72, 0x70,
-	0x63, 0x2e, 0x49, 0x44, 0x28, 0x01, 0x30, 0x01, 0x42, 0x0a, 0x5a, 0x08, 0x2e, 0x2e, 0x2f, 0x78,
-	0x67, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x61, 0x73, 0x6f, 0x6e, 0x49, 0x44, 0x46, 0x69, 0x72, 0x73, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6f,
+	0x77, 0x6e, 0x65, 0x72, 0x33, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6f, 0x77, 0x6e,
+	0x65, 0x72, 0x33, 0x12, 0x20, 0x0a, 0x0b, 0x66, 0x72, 0x65, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67,
+	0x65, 0x33, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x66, 0x72, 0x65, 0x65, 0x43, 0x68,
+	0x61, 0x6e, 0x67, 0x65, 0x33, 0x12, 0x24, 0x0a, 0x0d, 0x66, 0x72, 0x65, 0x65, 0x7a, 0x65, 0x43,
+	0x68, 0x61, 0x6e, 0x67, 0x65, 0x33, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x66, 0x72,
+	0x65, 0x65, 0x7a, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x33, 0x22, 0x60, 0x0a, 0x06, 0x52,
+	0x65, 0x63, 0x6f, 0x72, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x6f, 0x67, 0x49, 0x44, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x6c, 0x6f, 0x67, 0x49, 0x44, 0x12, 0x12, 0x0a, 0x04, 0x64,
+	0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12,
+	0x1c, 0x0a, 0x09, 0x68, 0x65, 0x61, 0x64, 0x4c, 0x6f, 0x67, 0x49, 0x44, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x09, 0x68, 0x65, 0x61, 0x64, 0x4c, 0x6f, 0x67, 0x49, 0x44, 0x12, 0x0e, 0x0a,
+	0x02, 0x74, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x74, 0x73, 0x32, 0x6b, 0x0a,
+	0x0b, 0x42, 0x61, 0x6e, 0x6b, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x25, 0x0a, 0x07,
+	0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x12, 0x09, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e,
+	0x49, 0x44, 0x1a, 0x0d, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e, 0x54, 0x69, 0x63, 0x6b, 0x65,
+	0x74, 0x30, 0x01, 0x12, 0x35, 0x0a, 0x0e, 0x42, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x43, 0x68,
+	0x61, 0x6e, 0x67, 0x65, 0x73, 0x12, 0x14, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e, 0x42, 0x61,
+	0x6c, 0x61, 0x6e, 0x63, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x1a, 0x09, 0x2e, 0x78, 0x67,
+	0x72, 0x70, 0x63, 0x2e, 0x49, 0x44, 0x28, 0x01, 0x30, 0x01, 0x32, 0x37, 0x0a, 0x0e, 0x52, 0x65,
+	0x70, 0x6c, 0x69, 0x63, 0x61, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x25, 0x0a, 0x07,
+	0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x73, 0x12, 0x09, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e,
+	0x49, 0x44, 0x1a, 0x0d, 0x2e, 0x78, 0x67, 0x72, 0x70, 0x63, 0x2e, 0x52, 0x65, 0x63, 0x6f, 0x72,
+	0x64, 0x30, 0x01, 0x42, 0x0a, 0x5a, 0x08, 0x2e, 0x2e, 0x2f, 0x78, 0x67, 0x72, 0x70, 0x63, 0x62,
+	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -402,20 +623,23 @@ func file_xgrpc_proto_rawDescGZIP() []byte {
 	return file_xgrpc_proto_rawDescData
 }
 
-var file_xgrpc_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_xgrpc_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_xgrpc_proto_goTypes = []interface{}{
 	(*String)(nil),        // 0: xgrpc.String
 	(*ID)(nil),            // 1: xgrpc.ID
 	(*Ticket)(nil),        // 2: xgrpc.Ticket
 	(*BalanceChange)(nil), // 3: xgrpc.BalanceChange
+	(*Record)(nil),        // 4: xgrpc.Record
 }
 var file_xgrpc_proto_depIdxs = []int32{
 	1, // 0: xgrpc.BankService.Tickets:input_type -> xgrpc.ID
 	3, // 1: xgrpc.BankService.BalanceChanges:input_type -> xgrpc.BalanceChange
-	2, // 2: xgrpc.BankService.Tickets:output_type -> xgrpc.Ticket
-	1, // 3: xgrpc.BankService.BalanceChanges:output_type -> xgrpc.ID
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
+	1, // 2: xgrpc.ReplicaService.Records:input_type -> xgrpc.ID
+	2, // 3: xgrpc.BankService.Tickets:output_type -> xgrpc.Ticket
+	1, // 4: xgrpc.BankService.BalanceChanges:output_type -> xgrpc.ID
+	4, // 5: xgrpc.ReplicaService.Records:output_type -> xgrpc.Record
+	3, // [3:6] is the sub-list for method output_type
+	0, // [0:3] is the sub-list for method input_type
 	0, // [0:0] is the sub-list for extension type_name
 	0, // [0:0] is the sub-list for extension extendee
 	0, // [0:0] is the sub-list for field type_name
@@ -475,6 +699,18 @@ func file_xgrpc_proto_init() {
 				return nil
 			}
 		}
+		file_xgrpc_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Record); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -482,9 +718,9 @@ func file_xgrpc_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_xgrpc_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   5,
 			NumExtensions: 0,
-			NumServices:   1,
+			NumServices:   2,
 		},
 		GoTypes:           file_xgrpc_proto_goTypes,
 		DependencyIndexes: file_xgrpc_proto_depIdxs,
@@ -674,3 +910,104 @@ var _BankService_serviceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "xgrpc.proto",
 }
+
+// ReplicaServiceClient is the client API for ReplicaService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ReplicaServiceClient interface {
+	// a standby asks for the filedb records after id, the primary streams them as they are written, and a heartbeat every second
+	Records(ctx context.Context, in *ID, opts ...grpc.CallOption) (ReplicaService_RecordsClient, error)
+}
+
+type replicaServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReplicaServiceClient(cc grpc.ClientConnInterface) ReplicaServiceClient {
+	return &replicaServiceClient{cc}
+}
+
+func (c *replicaServiceClient) Records(ctx context.Context, in *ID, opts ...grpc.CallOption) (ReplicaService_RecordsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ReplicaService_serviceDesc.Streams[0], "/xgrpc.ReplicaService/Records", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &replicaServiceRecordsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ReplicaService_RecordsClient interface {
+	Recv() (*Record, error)
+	grpc.ClientStream
+}
+
+type replicaServiceRecordsClient struct {
+	grpc.ClientStream
+}
+
+func (x *replicaServiceRecordsClient) Recv() (*Record, error) {
+	m := new(Record)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReplicaServiceServer is the server API for ReplicaService service.
+type ReplicaServiceServer interface {
+	// a standby asks for the filedb records after id, the primary streams them as they are written, and a heartbeat every second
+	Records(*ID, ReplicaService_RecordsServer) error
+}
+
+// UnimplementedReplicaServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedReplicaServiceServer struct {
+}
+
+func (*UnimplementedReplicaServiceServer) Records(*ID, ReplicaService_RecordsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Records not implemented")
+}
+
+func RegisterReplicaServiceServer(s *grpc.Server, srv ReplicaServiceServer) {
+	s.RegisterService(&_ReplicaService_serviceDesc, srv)
+}
+
+func _ReplicaService_Records_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ID)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ReplicaServiceServer).Records(m, &replicaServiceRecordsServer{stream})
+}
+
+type ReplicaService_RecordsServer interface {
+	Send(*Record) error
+	grpc.ServerStream
+}
+
+type replicaServiceRecordsServer struct {
+	grpc.ServerStream
+}
+
+func (x *replicaServiceRecordsServer) Send(m *Record) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _ReplicaService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "xgrpc.ReplicaService",
+	HandlerType: (*ReplicaServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Records",
+			Handler:       _ReplicaService_Records_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "xgrpc.proto",
+}
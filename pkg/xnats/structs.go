@@ -4,18 +4,92 @@ import "github.com/shopspring/decimal"
 
 // OrderReq structure for creating an order request, sent from ingress to bank
 type OrderReq struct {
+	Symbol      string          `json:"symbol"`
+	Owner       int64           `json:"owner"`
+	Side        int8            `json:"side"`        // 0 sell ask, 1 buy bid
+	Type        int8            `json:"type"`        // 1 limit, 2 market (a market bid is sized by Amount), 3 stop-limit, 4 stop-market
+	TimeInForce int8            `json:"timeInForce"` // model.OrderTIFXxx, GTC by default
+	Price       decimal.Decimal `json:"price"`       // price
+	Quantity    decimal.Decimal `json:"quantity"`    // remaining quantity
+	OrigQty     decimal.Decimal `json:"origQty"`     // quantity at the time of order creation
+	Amount      decimal.Decimal `json:"amount"`      // current total transaction amount
+	Time        int64           `json:"time"`        // order creation time, in nanoseconds
+	FeeLevel    float64         `json:"feeLevel"`    // creator's fee rate level
+
+	ClientOrderID string `json:"clientOrderID"` // chosen by the client, unique per owner, carried by all events of the order, at most 64 chars
+
+	SelfTradePrevention int8 `json:"selfTradePrevention"` // model.OrderSTPXxx, the mode of the symbol by default
+
+	StopPrice  decimal.Decimal `json:"stopPrice"`  // stop orders only, the funds are frozen from the start
+	DisplayQty decimal.Decimal `json:"displayQty"` // iceberg limit orders only, the size of the slice shown in the book, zero to show all
+	ExpireAt   int64           `json:"expireAt"`   // good-till-time, unix seconds after which the ome cancels the order, zero to never expire
+}
+
+// CancelReq structure for canceling an order, sent from ingress to the bank holding its frozen funds
+type CancelReq struct {
+	Symbol  string `json:"symbol"`
+	Owner   int64  `json:"owner"`
+	Side    int8   `json:"side"`    // side of the order to cancel
+	OrderID int64  `json:"orderID"` // order id assigned by ome
+	Time    int64  `json:"time"`    // request time, in nanoseconds
+
+	ClientOrderID string `json:"clientOrderID"` // chosen by the client, carried by the rejected event of an invalid cancel
+}
+
+// AmendReq structure for changing the price or quantity of a resting order in place, sent from ingress to the bank holding its frozen funds
+//
+//	a reduce-only amend keeps the price with Price zero, nothing is frozen for it and the order keeps its time priority,
+//	otherwise the bank freezes only what the new price and quantity need more than Frozen, ome checks it against the funds
+//	the order really holds and returns whatever is left over, so a lower price needs no free balance, and the order queues again
+type AmendReq struct {
 	Symbol   string          `json:"symbol"`
 	Owner    int64           `json:"owner"`
-	Side     int8            `json:"side"`     // 0 sell ask, 1 buy bid
-	Type     int8            `json:"type"`     // 0 limit, 1 market
-	Price    decimal.Decimal `json:"price"`    // price
-	Quantity decimal.Decimal `json:"quantity"` // remaining quantity
-	OrigQty  decimal.Decimal `json:"origQty"`  // quantity at the time of order creation
-	Amount   decimal.Decimal `json:"amount"`   // current total transaction amount
-	Time     int64           `json:"time"`     // order creation time, in nanoseconds
-	FeeLevel float64         `json:"feeLevel"` // creator's fee rate level
+	Side     int8            `json:"side"`     // side of the order to amend
+	OrderID  int64           `json:"orderID"`  // order id assigned by ome
+	Price    decimal.Decimal `json:"price"`    // new price, zero to keep it
+	Quantity decimal.Decimal `json:"quantity"` // new remaining quantity
+	Frozen   decimal.Decimal `json:"frozen"`   // funds the order holds now, fee included
+	Time     int64           `json:"time"`     // request time, in nanoseconds
+
+	ClientOrderID string `json:"clientOrderID"` // chosen by the client, carried by the events of the amend
+}
+
+// OrderEvent order lifecycle event, published by the bank and ome on OrderEventSubject(owner)
+//
+//	accepted, rejected: published by the bank holding the funds of the order, MsgSeq is the seq of the request
+//	resting, partiallyFilled, filled, cancelled, rejected: published by ome, OrderID is known from here on
+type OrderEvent struct {
+	Type          string `json:"type"` // OrderEventXxx
+	ClientOrderID string `json:"clientOrderID,omitempty"`
+	Owner         int64  `json:"owner"`
+	Symbol        string `json:"symbol"`
+	Side          int8   `json:"side"`
+	MsgSeq        uint64 `json:"msgSeq,omitempty"`
+	TicketID      int64  `json:"ticketID,omitempty"`
+	OrderID       int64  `json:"orderID,omitempty"`
+	Reason        string `json:"reason,omitempty"` // why it was rejected or cancelled
+
+	Price     decimal.Decimal `json:"price"`     // price of the fill, or of the order
+	Quantity  decimal.Decimal `json:"quantity"`  // quantity of the fill
+	Remaining decimal.Decimal `json:"remaining"` // quantity still open
+	Fee       decimal.Decimal `json:"fee"`       // fee of the fill, in the coin the order pays
+
+	Time int64 `json:"time"` // in nanoseconds
 }
 
+const (
+	OrderEventAccepted        = "accepted"        // funds frozen, ticket created
+	OrderEventRejected        = "rejected"        // turned down, see Reason
+	OrderEventResting         = "resting"         // in the book waiting for a counterparty
+	OrderEventPartiallyFilled = "partiallyFilled" // traded, still open
+	OrderEventFilled          = "filled"          // traded, nothing left
+	OrderEventCancelled       = "cancelled"       // removed from the book, see Reason
+	OrderEventDecremented     = "decremented"     // part of the quantity canceled by self-trade prevention, the rest stays in the book
+	OrderEventTriggered       = "triggered"       // stop order reached its stop price, now a limit or market order
+	OrderEventExpired         = "expired"         // removed from the book once its expiry passed
+	OrderEventAmended         = "amended"         // price or quantity changed in place, see AmendReq
+)
+
 type BalancesReq struct {
 	Items []BalanceReq `json:"items"`
 }
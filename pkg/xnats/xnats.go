@@ -1 +1,30 @@
 package xnats
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+// OrderEventStream the stream holding order lifecycle events, one on the NATS server of each bank
+//
+//	events of asks go to the server of the base coin, events of bids to the server of the quote coin
+const OrderEventStream = "ORDER"
+
+// OrderEventSubject returns the subject of the order events of the owner
+func OrderEventSubject(owner int64) string {
+	return OrderEventStream + "." + strconv.FormatInt(owner, 10)
+}
+
+// PublishOrderEvent publishes the event to the subject of its owner
+//
+//	msgID must be unique per event and stable across retries, e.g. <app>:<logID>:<n>, NATS drops duplicates
+func PublishOrderEvent(js nats.JetStreamContext, msgID string, ev OrderEvent) (err error) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	_, err = js.Publish(OrderEventSubject(ev.Owner), data, nats.MsgId(msgID))
+	return
+}